@@ -1,6 +1,7 @@
 package handlers
 
 import (
+	"fmt"
 	"log"
 	"strings"
 	"time"
@@ -24,12 +25,15 @@ func RestorePreviousMode() {
 		nodes, err := GetExitNodes()
 		if err == nil && len(nodes) > 0 {
 			exitNodes = nodes // Store them globally
+			migrateLegacyFriendlyNames(nodes)
 			break
 		}
 		log.Println("Waiting for exit nodes to become available...")
 		time.Sleep(1 * time.Second)
 	}
 
+	savedMode := CurrentMode
+	ev := Event{Type: EventRestore, Actor: "startup", Before: savedMode}
 	savedExitNode := ""
 	if CurrentMode != "direct" && strings.HasPrefix(CurrentMode, "tailscale:") {
 		savedExitNode = strings.TrimPrefix(CurrentMode, "tailscale:")
@@ -37,12 +41,19 @@ func RestorePreviousMode() {
 
 	if len(exitNodes) == 0 {
 		log.Println("No exit nodes detected within 10s; applying direct mode routing")
-		if err := DisableTailscaleExitNode(); err != nil {
+		err := DisableTailscaleExitNode()
+		if err != nil {
 			log.Printf("Failed to apply direct mode routing: %v", err)
 		}
 		if savedExitNode != "" {
+			ev.Detail = "no exit nodes within 10s; retrying in background"
+			if err == nil {
+				err = fmt.Errorf("exit nodes unavailable")
+			}
 			go retryExitNodeRestore(savedExitNode)
 		}
+		ev.After = CurrentMode
+		RecordEvent(eventResult(ev, err))
 		return
 	}
 
@@ -51,35 +62,47 @@ func RestorePreviousMode() {
 
 	if savedExitNode != "" {
 		log.Printf("Restoring exit node mode: %s", savedExitNode)
-		if err := SetTailscaleExitNode(savedExitNode); err != nil {
+		err := SetTailscaleExitNode(savedExitNode)
+		if err != nil {
 			log.Printf("Failed to restore exit node mode: %v; falling back to direct mode", err)
 			if err := DisableTailscaleExitNode(); err != nil {
 				log.Printf("Failed to apply direct mode routing: %v", err)
 			}
+			ev.Detail = "fell back to direct; retrying in background"
+			Notify(NotifyFailover, "warning", savedExitNode, "Exit node failover",
+				fmt.Sprintf("Could not restore exit node %s at startup (%v); LAN traffic uses the WAN directly.", savedExitNode, err))
 			go retryExitNodeRestore(savedExitNode)
 		} else {
 			log.Printf("Successfully restored exit node mode: %s", savedExitNode)
 		}
+		ev.After = CurrentMode
+		RecordEvent(eventResult(ev, err))
 		return
 	}
 
 	log.Println("Restoring direct mode")
-	if err := DisableTailscaleExitNode(); err != nil {
+	err := DisableTailscaleExitNode()
+	if err != nil {
 		log.Printf("Failed to restore direct mode: %v", err)
 	} else {
 		log.Println("Successfully restored direct mode")
 	}
+	ev.After = CurrentMode
+	RecordEvent(eventResult(ev, err))
 }
 
 // retryExitNodeRestore waits for Tailscale exit nodes after slow boots, then
 // reapplies the saved exit node mode if it is still the desired mode.
 func retryExitNodeRestore(node string) {
+	ev := Event{Type: EventRestoreRetry, Actor: "startup", After: "tailscale:" + node}
 	for i := 0; i < 30; i++ {
 		time.Sleep(2 * time.Second)
 
 		expectedMode := "tailscale:" + node
 		if CurrentMode != expectedMode && CurrentMode != "direct" {
 			log.Printf("Exit node restore skipped: mode changed to %s", CurrentMode)
+			ev.Before, ev.After, ev.Detail = CurrentMode, CurrentMode, "skipped: mode changed"
+			RecordEvent(eventResult(ev, nil))
 			return
 		}
 
@@ -90,14 +113,20 @@ func retryExitNodeRestore(node string) {
 
 		exitNodes = nodes
 		log.Printf("Retrying exit node restore: %s", node)
+		ev.Before = CurrentMode
+		ev.Detail = fmt.Sprintf("attempt %d", i+1)
 		if err := SetTailscaleExitNode(node); err != nil {
 			log.Printf("Exit node restore retry failed: %v", err)
+			RecordEvent(eventResult(ev, err))
 			continue
 		}
 
 		log.Printf("Successfully restored exit node mode on retry: %s", node)
+		RecordEvent(eventResult(ev, nil))
 		return
 	}
 
 	log.Printf("Exit node restore gave up after retries: %s", node)
+	ev.Before, ev.Detail = CurrentMode, "gave up after retries"
+	RecordEvent(eventResult(ev, fmt.Errorf("exit node %s not restored", node)))
 }
@@ -2,11 +2,14 @@ package handlers
 
 import (
 	"crypto/rand"
+	"fmt"
 	"log"
+	"net"
 	"net/http"
 	"os"
 	"strings"
 	"sync"
+	"unicode/utf8"
 
 	"github.com/gorilla/sessions"
 )
@@ -21,6 +24,20 @@ var (
 	credentialsMu   sync.RWMutex
 )
 
+// maxLoggedUsername caps how much of a failed login's username reaches the event log.
+const maxLoggedUsername = 64
+
+// truncateString cuts s to at most n bytes without splitting a UTF-8 sequence.
+func truncateString(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n]
+}
+
 func init() {
 	// Generate a random secret key for session encryption
 	// In production, you should use a fixed secret key stored securely
@@ -120,10 +137,25 @@ func LoginHandler(w http.ResponseWriter, r *http.Request) {
 
 	// Validate credentials
 	expectedUser, expectedPass := getCredentials()
+	loginEvent := Event{Type: EventLogin, Actor: "user:" + username, Detail: "from " + clientIP(r)}
 	if username != expectedUser || password != expectedPass {
+		// The username is unauthenticated input: keep it out of the actor, cap its
+		// length, and log the first failure from a client plus one summary every
+		// loginFailureThreshold attempts, so a flood cannot rotate the log away.
+		attempted := truncateString(username, maxLoggedUsername)
+		count := noteLoginFailure(clientIP(r), attempted)
+		if count == 1 || count%loginFailureThreshold == 0 {
+			detail := fmt.Sprintf("attempted username %q", attempted)
+			if count > 1 {
+				detail = fmt.Sprintf("%d failed attempts in %s, last username %q", count, loginFailureWindow, attempted)
+			}
+			failed := Event{Type: EventLogin, Actor: "login:" + clientIP(r), Detail: detail}
+			RecordEvent(eventResult(failed, fmt.Errorf("invalid credentials")))
+		}
 		http.Redirect(w, r, "/login?error=unauthorized", http.StatusSeeOther)
 		return
 	}
+	RecordEvent(eventResult(loginEvent, nil))
 
 	// Create session
 	session, err := store.Get(r, "auth-session")
@@ -159,6 +191,25 @@ func LogoutHandler(w http.ResponseWriter, r *http.Request) {
 	http.Redirect(w, r, "/login", http.StatusSeeOther)
 }
 
+// clientIP returns the remote address without the port.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// hasAuthenticatedSession reports whether the request carries a logged-in session cookie.
+func hasAuthenticatedSession(r *http.Request) bool {
+	session, err := store.Get(r, "auth-session")
+	if err != nil {
+		return false
+	}
+	auth, ok := session.Values["authenticated"].(bool)
+	return ok && auth
+}
+
 // RequireAuth is a middleware that checks if the user is authenticated
 func RequireAuth(next http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
@@ -174,21 +225,12 @@ func RequireAuth(next http.HandlerFunc) http.HandlerFunc {
 		}
 
 		// Check for static assets (CSS, JS, etc.)
-		if r.URL.Path == "/styles.css" || r.URL.Path == "/script.js" || r.URL.Path == "/setup.js" ||
-			r.URL.Path == "/friendly-names.json" {
+		if r.URL.Path == "/styles.css" || r.URL.Path == "/script.js" || r.URL.Path == "/setup.js" {
 			next(w, r)
 			return
 		}
 
-		session, err := store.Get(r, "auth-session")
-		if err != nil {
-			http.Redirect(w, r, "/login", http.StatusSeeOther)
-			return
-		}
-
-		// Check if user is authenticated
-		auth, ok := session.Values["authenticated"].(bool)
-		if !ok || !auth {
+		if !hasAuthenticatedSession(r) {
 			http.Redirect(w, r, "/login", http.StatusSeeOther)
 			return
 		}
@@ -17,7 +17,17 @@ func ApplyBootstrap(cfg RouterConfig, tailscaleAuthKey string) error {
 }
 
 // ApplyBootstrapWithProgress runs bootstrap and streams step updates when progress is set.
-func ApplyBootstrapWithProgress(cfg RouterConfig, tailscaleAuthKey string, progress setupProgressReporter) error {
+func ApplyBootstrapWithProgress(cfg RouterConfig, tailscaleAuthKey string, progress setupProgressReporter) (err error) {
+	ev := Event{Type: EventBootstrap, Actor: "setup", Before: "unconfigured"}
+	if IsConfigured() {
+		ev.Before = "configured"
+	}
+	defer func() {
+		recordBootstrapOutcome(err)
+		ev.After = fmt.Sprintf("wan=%s lan=%s %s/%d", cfg.WANInterface, cfg.LANInterface, cfg.LANAddress, cfg.LANPrefix)
+		RecordEvent(eventResult(ev, err))
+	}()
+
 	if cfg.LANInterface == "" {
 		return fmt.Errorf("LAN interface is required")
 	}
@@ -59,20 +69,26 @@ func ApplyBootstrapWithProgress(cfg RouterConfig, tailscaleAuthKey string, progr
 	steps := []struct {
 		name string
 		fn   func() error
+		skip bool
 	}{
-		{"install system packages", installSystemPackages},
-		{"install Tailscale", installTailscaleIfMissing},
-		{"enable IP forwarding", func() error { return enableIPForwarding() }},
-		{"install helper scripts", installHelperScripts},
-		{"verify WAN stays on DHCP", func() error { return ensureWANDHCP(cfg) }},
-		{"configure LAN interface", func() error { return configureLANInterface(cfg) }},
-		{"configure dnsmasq", func() error { return configureDnsmasq(cfg) }},
-		{"configure Tailscale", func() error { return configureTailscale(cfg, tailscaleAuthKey) }},
-		{"enable DNS watcher", enableDNSWatcher},
-		{"enable health watch", enableHealthWatch},
+		{"join Wi-Fi network", func() error { return ConnectWifiClient(cfg.WANInterface, cfg.WifiClient) }, cfg.WifiClient.SSID == ""},
+		{"install system packages", installSystemPackages, false},
+		{"install Tailscale", installTailscaleIfMissing, false},
+		{"enable IP forwarding", func() error { return enableIPForwarding() }, false},
+		{"install helper scripts", installHelperScripts, false},
+		{"verify WAN stays on DHCP", func() error { return ensureWANDHCP(cfg) }, false},
+		{"configure LAN interface", func() error { return configureLANInterface(cfg) }, false},
+		{"configure Wi-Fi access point", func() error { return configureWifiAP(cfg) }, !cfg.WifiAP.Enabled},
+		{"configure dnsmasq", func() error { return configureDnsmasq(cfg) }, false},
+		{"configure Tailscale", func() error { return configureTailscale(cfg, tailscaleAuthKey) }, false},
+		{"enable DNS watcher", enableDNSWatcher, false},
+		{"enable health watch", enableHealthWatch, false},
 	}
 
 	for _, step := range steps {
+		if step.skip {
+			continue
+		}
 		log.Printf("Bootstrap: %s", step.name)
 		progress.running(step.name, "started")
 
@@ -200,6 +216,8 @@ func ensureWANDHCP(cfg RouterConfig) error {
 	wanIP, wanPrefix := getInterfaceIPv4CIDR(cfg.WANInterface)
 	if wanIP != "" {
 		log.Printf("Bootstrap: WAN %s uses %s/%d from existing network config (unchanged)", cfg.WANInterface, wanIP, wanPrefix)
+	} else if _, _, associated := wifiLinkInfo(cfg.WANInterface); isWirelessInterface(cfg.WANInterface) && !associated {
+		return fmt.Errorf("WAN %s is wireless but not connected to a network. Pick one under Wi-Fi network", cfg.WANInterface)
 	} else {
 		log.Printf("Bootstrap: WAN %s has no IPv4 yet. DHCP will continue on that interface", cfg.WANInterface)
 	}
@@ -207,34 +225,20 @@ func ensureWANDHCP(cfg RouterConfig) error {
 }
 
 func configureLANInterface(cfg RouterConfig) error {
-	exec.Command("ip", "link", "set", cfg.LANInterface, "up").Run()
-
-	cidr := fmt.Sprintf("%s/%d", cfg.LANAddress, cfg.LANPrefix)
-
-	if usesNetworkManager() {
-		connName := "tailscale-router-lan"
-		_ = exec.Command("nmcli", "con", "delete", connName).Run()
-		cmd := exec.Command("nmcli", "con", "add", "type", "ethernet",
-			"ifname", cfg.LANInterface,
-			"con-name", connName,
-			"ipv4.method", "manual",
-			"ipv4.addresses", cidr,
-			"ipv6.method", "ignore",
-			"connection.autoconnect", "yes",
-		)
-		if out, err := cmd.CombinedOutput(); err != nil {
-			return fmt.Errorf("%v: %s", err, string(out))
+	for i, segment := range LANSegments(cfg) {
+		if i == 0 && cfg.WifiAP.Enabled && usesNetworkManager() {
+			// hostapd owns the interface; its unit assigns the address.
+			exec.Command("ip", "link", "set", cfg.LANInterface, "up").Run()
+			if err := releaseFromNetworkManager(cfg.LANInterface); err != nil {
+				return err
+			}
+			continue
 		}
-		if out, err := exec.Command("nmcli", "con", "up", connName).CombinedOutput(); err != nil {
-			return fmt.Errorf("%v: %s", err, string(out))
+		if err := configureLANSegment(segment); err != nil {
+			return fmt.Errorf("segment %s: %w", segment.Name, err)
 		}
-		return nil
 	}
-
-	block := fmt.Sprintf("\ninterface %s\nstatic ip_address=%s\nnohook wpa_supplicant\n", cfg.LANInterface, cidr)
-	return appendUniqueBlock("/etc/dhcpcd.conf", "interface "+cfg.LANInterface, block, func() error {
-		return exec.Command("systemctl", "restart", "dhcpcd").Run()
-	})
+	return nil
 }
 
 func configureDnsmasq(cfg RouterConfig) error {
@@ -254,22 +258,8 @@ func configureDnsmasq(cfg RouterConfig) error {
 		return fmt.Errorf("migrate dnsmasq config: %w", err)
 	}
 
-	netmask := prefixToNetmask(cfg.LANPrefix)
-	conf := fmt.Sprintf(`# Managed by tailscale-raspberry-router
-interface=%s
-bind-interfaces
-listen-address=%s
-except-interface=%s
-dhcp-range=%s,%s,%s,%dh
-dhcp-option=option:router,%s
-dhcp-option=option:dns-server,%s
-no-resolv
-conf-file=/run/tailscale-router/upstream-servers.conf
-`, cfg.LANInterface, cfg.LANAddress, cfg.WANInterface,
-		cfg.DHCPRangeStart, cfg.DHCPRangeEnd, netmask, cfg.DHCPLeaseHours,
-		cfg.LANAddress, cfg.LANAddress)
-
-	path := "/etc/dnsmasq.d/tailscale-router.conf"
+	conf := renderDnsmasqLANConf(cfg)
+	path := dnsmasqLANConfFile
 	if err := os.WriteFile(path, []byte(conf), 0644); err != nil {
 		return err
 	}
@@ -339,7 +329,7 @@ func migrateDnsmasqForRouter() error {
 	}
 	for _, entry := range entries {
 		name := entry.Name()
-		if name == "tailscale-router.conf" || !strings.HasSuffix(name, ".conf") {
+		if strings.HasPrefix(name, "tailscale-router") || !strings.HasSuffix(name, ".conf") {
 			continue
 		}
 		src := filepath.Join("/etc/dnsmasq.d", name)
@@ -392,7 +382,7 @@ func configureTailscale(cfg RouterConfig, authKey string) error {
 		log.Printf("Bootstrap: Tailscale already connected as %s (%s)", snap.Hostname, snap.IPv4)
 	}
 
-	if err := RunBootstrapTailscale(cfg.TailscaleHost, authKey); err != nil {
+	if err := RunBootstrapTailscale(cfg, authKey); err != nil {
 		return err
 	}
 
@@ -0,0 +1,540 @@
+package handlers
+
+import (
+	"encoding/json"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	stateDir           = "/var/lib/tailscale-router"
+	trafficStoreFile   = stateDir + "/traffic.json"
+	routerAcctChain    = "TS-ROUTER-ACCT"
+	trafficSampleEvery = 30 * time.Second
+	// trafficSaveEvery limits SD card writes; up to this much history is lost on power cut.
+	trafficSaveEvery = 10 * time.Minute
+	// trafficClientIdle drops accounting rules for clients that left the LAN.
+	trafficClientIdle = time.Hour
+
+	trafficKeepHours  = 48
+	trafficKeepDays   = 62
+	trafficKeepMonths = 24
+)
+
+// TrafficCounters are bytes per path, from the client's point of view.
+type TrafficCounters struct {
+	WANDown       uint64 `json:"wan_down"`
+	WANUp         uint64 `json:"wan_up"`
+	TailscaleDown uint64 `json:"tailscale_down"`
+	TailscaleUp   uint64 `json:"tailscale_up"`
+}
+
+// TrafficRates are bytes per second over the last sample interval.
+type TrafficRates struct {
+	WANDown       float64 `json:"wan_down"`
+	WANUp         float64 `json:"wan_up"`
+	TailscaleDown float64 `json:"tailscale_down"`
+	TailscaleUp   float64 `json:"tailscale_up"`
+}
+
+// ClientTraffic is one LAN client in the /clients/traffic response.
+type ClientTraffic struct {
+	IP       string          `json:"ip"`
+	MAC      string          `json:"mac,omitempty"`
+	Hostname string          `json:"hostname,omitempty"`
+	Rate     TrafficRates    `json:"rate"`
+	Today    TrafficCounters `json:"today"`
+	Month    TrafficCounters `json:"month"`
+}
+
+// TrafficPoint is one bucket of a client's history.
+type TrafficPoint struct {
+	Period string          `json:"period"`
+	Bytes  TrafficCounters `json:"bytes"`
+}
+
+// DHCPLease is an entry from the dnsmasq lease file.
+type DHCPLease struct {
+	MAC      string    `json:"mac"`
+	IP       string    `json:"ip"`
+	Hostname string    `json:"hostname"`
+	Expires  time.Time `json:"expires"`
+}
+
+// trafficBuckets maps period key -> client IP -> bytes.
+type trafficBuckets map[string]map[string]TrafficCounters
+
+type trafficStore struct {
+	Hourly  trafficBuckets `json:"hourly"`  // "2006-01-02T15"
+	Daily   trafficBuckets `json:"daily"`   // "2006-01-02"
+	Monthly trafficBuckets `json:"monthly"` // "2006-01"
+}
+
+type trafficClient struct {
+	MAC      string
+	Hostname string
+	LastSeen time.Time
+	Rate     TrafficRates
+}
+
+var (
+	trafficMu      sync.Mutex
+	traffic        = loadTrafficStore()
+	trafficClients = make(map[string]*trafficClient)
+	trafficLast    = make(map[string]TrafficCounters) // last raw counter reading per IP
+	trafficLastAt  time.Time
+	// acctRules tracks which client IPs have rules in TS-ROUTER-ACCT, and acctWANs
+	// the uplinks those rules count.
+	acctRules = make(map[string]bool)
+	acctWANs  []string
+)
+
+func loadTrafficStore() trafficStore {
+	store := trafficStore{}
+	if data, err := os.ReadFile(trafficStoreFile); err == nil {
+		if err := json.Unmarshal(data, &store); err != nil {
+			log.Printf("Ignoring unreadable %s: %v", trafficStoreFile, err)
+		}
+	}
+	if store.Hourly == nil {
+		store.Hourly = make(trafficBuckets)
+	}
+	if store.Daily == nil {
+		store.Daily = make(trafficBuckets)
+	}
+	if store.Monthly == nil {
+		store.Monthly = make(trafficBuckets)
+	}
+	return store
+}
+
+// saveTrafficStore writes atomically so a power cut never leaves a torn file. Caller holds trafficMu.
+func saveTrafficStore() error {
+	if err := os.MkdirAll(stateDir, 0755); err != nil {
+		return err
+	}
+	data, err := json.Marshal(traffic)
+	if err != nil {
+		return err
+	}
+	tmp := trafficStoreFile + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, trafficStoreFile)
+}
+
+func (c *TrafficCounters) add(d TrafficCounters) {
+	c.WANDown += d.WANDown
+	c.WANUp += d.WANUp
+	c.TailscaleDown += d.TailscaleDown
+	c.TailscaleUp += d.TailscaleUp
+}
+
+func (b trafficBuckets) add(period, ip string, d TrafficCounters) {
+	clients := b[period]
+	if clients == nil {
+		clients = make(map[string]TrafficCounters)
+		b[period] = clients
+	}
+	c := clients[ip]
+	c.add(d)
+	clients[ip] = c
+}
+
+// prune keeps the newest keep periods. Keys sort chronologically.
+func (b trafficBuckets) prune(keep int) {
+	if len(b) <= keep {
+		return
+	}
+	keys := make([]string, 0, len(b))
+	for k := range b {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys[:len(keys)-keep] {
+		delete(b, k)
+	}
+}
+
+// parseDnsmasqLeases reads "expiry mac ip hostname clientid" lines.
+func parseDnsmasqLeases() ([]DHCPLease, error) {
+	data, err := os.ReadFile(dnsmasqLeasesFile)
+	if err != nil {
+		return nil, err
+	}
+	var leases []DHCPLease
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 4 {
+			continue
+		}
+		lease := DHCPLease{MAC: fields[1], IP: fields[2]}
+		if fields[3] != "*" {
+			lease.Hostname = fields[3]
+		}
+		if expiry, err := strconv.ParseInt(fields[0], 10, 64); err == nil && expiry > 0 {
+			lease.Expires = time.Unix(expiry, 0)
+		}
+		leases = append(leases, lease)
+	}
+	return leases, nil
+}
+
+// discoverLANClients returns LAN client IPs from DHCP leases and the neighbour table.
+func discoverLANClients(cfg RouterConfig) map[string]trafficClient {
+	clients := make(map[string]trafficClient)
+	var networks []*net.IPNet
+	gateways := make(map[string]bool)
+	for _, segment := range LANSegments(cfg) {
+		if _, network, err := net.ParseCIDR(segment.CIDR()); err == nil {
+			networks = append(networks, network)
+			gateways[segment.Address] = true
+		}
+	}
+	if len(networks) == 0 {
+		return clients
+	}
+	inLAN := func(ip string) bool {
+		parsed := net.ParseIP(ip)
+		if parsed == nil || parsed.To4() == nil || gateways[ip] {
+			return false
+		}
+		for _, network := range networks {
+			if network.Contains(parsed) {
+				return true
+			}
+		}
+		return false
+	}
+
+	if leases, err := parseDnsmasqLeases(); err == nil {
+		for _, lease := range leases {
+			if inLAN(lease.IP) {
+				clients[lease.IP] = trafficClient{MAC: lease.MAC, Hostname: lease.Hostname}
+			}
+		}
+	}
+
+	lanInterfaces, _ := GetLANInterfaces()
+	for _, lanIface := range lanInterfaces {
+		out, err := exec.Command("ip", "-4", "neigh", "show", "dev", lanIface).Output()
+		if err != nil {
+			continue
+		}
+		for _, line := range strings.Split(string(out), "\n") {
+			fields := strings.Fields(line)
+			if len(fields) < 3 || !inLAN(fields[0]) {
+				continue
+			}
+			state := fields[len(fields)-1]
+			if state == "FAILED" || state == "INCOMPLETE" {
+				continue
+			}
+			client := clients[fields[0]]
+			for i := 0; i+1 < len(fields); i++ {
+				if fields[i] == "lladdr" && client.MAC == "" {
+					client.MAC = fields[i+1]
+				}
+			}
+			clients[fields[0]] = client
+		}
+	}
+	return clients
+}
+
+func ensureRouterAcctChain() {
+	exec.Command("iptables", "-N", routerAcctChain).Run()
+	if exec.Command("iptables", "-C", "FORWARD", "-j", routerAcctChain).Run() != nil {
+		exec.Command("iptables", "-I", "FORWARD", "1", "-j", routerAcctChain).Run()
+	}
+}
+
+// acctRuleSpecs are the counting rules for one client, a pair per active WAN (all
+// of them in balance mode) and one for tailscale0. Each forwarded packet matches at
+// most one, so RETURN keeps the chain cheap.
+func acctRuleSpecs(ip string, wans []string) [][]string {
+	var specs [][]string
+	for _, wan := range wans {
+		specs = append(specs,
+			[]string{"-d", ip, "-i", wan, "-j", "RETURN"},
+			[]string{"-s", ip, "-o", wan, "-j", "RETURN"})
+	}
+	return append(specs,
+		[]string{"-d", ip, "-i", "tailscale0", "-j", "RETURN"},
+		[]string{"-s", ip, "-o", "tailscale0", "-j", "RETURN"})
+}
+
+func setAcctRules(action, ip string, wans []string) {
+	for _, spec := range acctRuleSpecs(ip, wans) {
+		args := append([]string{action, routerAcctChain}, spec...)
+		if err := exec.Command("iptables", args...).Run(); err != nil && action == "-A" {
+			log.Printf("iptables accounting rule for %s failed: %v", ip, err)
+		}
+	}
+}
+
+// readAcctCounters parses TS-ROUTER-ACCT byte counters per client IP, summing the WANs.
+func readAcctCounters(wans []string) map[string]TrafficCounters {
+	counters := make(map[string]TrafficCounters)
+	out, err := exec.Command("iptables", "-L", routerAcctChain, "-n", "-v", "-x").Output()
+	if err != nil {
+		return counters
+	}
+	for _, line := range strings.Split(string(out), "\n") {
+		// pkts bytes target prot opt in out source destination
+		fields := strings.Fields(line)
+		if len(fields) < 9 || fields[2] != "RETURN" {
+			continue
+		}
+		bytes, err := strconv.ParseUint(fields[1], 10, 64)
+		if err != nil {
+			continue
+		}
+		in, outIface := fields[5], fields[6]
+		src := strings.TrimSuffix(fields[7], "/32")
+		dst := strings.TrimSuffix(fields[8], "/32")
+
+		switch {
+		case containsString(wans, in):
+			c := counters[dst]
+			c.WANDown += bytes
+			counters[dst] = c
+		case containsString(wans, outIface):
+			c := counters[src]
+			c.WANUp += bytes
+			counters[src] = c
+		case in == "tailscale0":
+			c := counters[dst]
+			c.TailscaleDown = bytes
+			counters[dst] = c
+		case outIface == "tailscale0":
+			c := counters[src]
+			c.TailscaleUp = bytes
+			counters[src] = c
+		}
+	}
+	return counters
+}
+
+// counterDelta handles counters that went backwards (rules re-created or iptables flushed).
+func counterDelta(now, prev uint64) uint64 {
+	if now < prev {
+		return now
+	}
+	return now - prev
+}
+
+// sampleClientTraffic reads the counters once and folds the deltas into the store.
+// When the active WANs changed since the rules were built, the rules are rebuilt
+// for the new uplinks after the old counters were folded in.
+func sampleClientTraffic() {
+	cfg := GetRouterConfig()
+	wans := ActiveWANInterfaces()
+	seen := discoverLANClients(cfg)
+
+	trafficMu.Lock()
+	defer trafficMu.Unlock()
+
+	now := time.Now()
+	ensureRouterAcctChain()
+	if acctWANs == nil {
+		acctWANs = wans
+	}
+	counters := readAcctCounters(acctWANs)
+
+	elapsed := now.Sub(trafficLastAt).Seconds()
+	for ip, current := range counters {
+		prev := trafficLast[ip] // rules start at zero; RunTrafficAccounting flushes old ones
+		delta := TrafficCounters{
+			WANDown:       counterDelta(current.WANDown, prev.WANDown),
+			WANUp:         counterDelta(current.WANUp, prev.WANUp),
+			TailscaleDown: counterDelta(current.TailscaleDown, prev.TailscaleDown),
+			TailscaleUp:   counterDelta(current.TailscaleUp, prev.TailscaleUp),
+		}
+		trafficLast[ip] = current
+
+		traffic.Hourly.add(now.Format("2006-01-02T15"), ip, delta)
+		traffic.Daily.add(now.Format("2006-01-02"), ip, delta)
+		traffic.Monthly.add(now.Format("2006-01"), ip, delta)
+
+		if client := trafficClients[ip]; client != nil && elapsed > 0 {
+			client.Rate = TrafficRates{
+				WANDown:       float64(delta.WANDown) / elapsed,
+				WANUp:         float64(delta.WANUp) / elapsed,
+				TailscaleDown: float64(delta.TailscaleDown) / elapsed,
+				TailscaleUp:   float64(delta.TailscaleUp) / elapsed,
+			}
+		}
+	}
+	trafficLastAt = now
+
+	if !sameInterfaces(acctWANs, wans) {
+		log.Printf("Traffic accounting: counting via %s (was %s)", strings.Join(wans, ","), strings.Join(acctWANs, ","))
+		exec.Command("iptables", "-F", routerAcctChain).Run()
+		trafficLast = make(map[string]TrafficCounters)
+		for ip := range acctRules {
+			setAcctRules("-A", ip, wans)
+		}
+		acctWANs = wans
+	}
+
+	for ip, found := range seen {
+		client := trafficClients[ip]
+		if client == nil {
+			client = &trafficClient{}
+			trafficClients[ip] = client
+		}
+		if found.MAC != "" {
+			client.MAC = found.MAC
+		}
+		if found.Hostname != "" {
+			client.Hostname = found.Hostname
+		}
+		client.LastSeen = now
+		if !acctRules[ip] {
+			setAcctRules("-A", ip, acctWANs)
+			acctRules[ip] = true
+		}
+	}
+
+	for ip, client := range trafficClients {
+		if now.Sub(client.LastSeen) < trafficClientIdle {
+			continue
+		}
+		setAcctRules("-D", ip, acctWANs)
+		delete(acctRules, ip)
+		delete(trafficClients, ip)
+		delete(trafficLast, ip)
+	}
+
+	traffic.Hourly.prune(trafficKeepHours)
+	traffic.Daily.prune(trafficKeepDays)
+	traffic.Monthly.prune(trafficKeepMonths)
+}
+
+// RebuildTrafficAccounting folds in the counters of the old uplinks and moves the
+// accounting rules to the new ones straight away instead of at the next sample.
+// Called when the active WANs change; a no-op until accounting has started.
+func RebuildTrafficAccounting() {
+	trafficMu.Lock()
+	started := acctWANs != nil
+	trafficMu.Unlock()
+	if started {
+		sampleClientTraffic()
+	}
+}
+
+// RunTrafficAccounting samples per-client counters and periodically persists totals.
+func RunTrafficAccounting() {
+	// Rules from a previous run hold counts already stored; start from zero.
+	ensureRouterAcctChain()
+	exec.Command("iptables", "-F", routerAcctChain).Run()
+
+	lastSave := time.Now()
+	for {
+		sampleClientTraffic()
+		if time.Since(lastSave) >= trafficSaveEvery {
+			trafficMu.Lock()
+			if err := saveTrafficStore(); err != nil {
+				log.Printf("Saving traffic totals failed: %v", err)
+			}
+			trafficMu.Unlock()
+			lastSave = time.Now()
+		}
+		time.Sleep(trafficSampleEvery)
+	}
+}
+
+// GetClientTraffic lists known clients, busiest first.
+func GetClientTraffic() []ClientTraffic {
+	now := time.Now()
+	day, month := now.Format("2006-01-02"), now.Format("2006-01")
+
+	trafficMu.Lock()
+	defer trafficMu.Unlock()
+
+	ips := make(map[string]bool)
+	for ip := range trafficClients {
+		ips[ip] = true
+	}
+	for ip := range traffic.Daily[day] {
+		ips[ip] = true
+	}
+
+	list := make([]ClientTraffic, 0, len(ips))
+	for ip := range ips {
+		entry := ClientTraffic{
+			IP:    ip,
+			Today: traffic.Daily[day][ip],
+			Month: traffic.Monthly[month][ip],
+		}
+		if client := trafficClients[ip]; client != nil {
+			entry.MAC = client.MAC
+			entry.Hostname = client.Hostname
+			entry.Rate = client.Rate
+		}
+		list = append(list, entry)
+	}
+
+	total := func(r TrafficRates) float64 { return r.WANDown + r.WANUp + r.TailscaleDown + r.TailscaleUp }
+	sort.Slice(list, func(i, j int) bool {
+		if ri, rj := total(list[i].Rate), total(list[j].Rate); ri != rj {
+			return ri > rj
+		}
+		return list[i].IP < list[j].IP
+	})
+	return list
+}
+
+// GetClientTrafficHistory returns a client's buckets in chronological order.
+func GetClientTrafficHistory(ip, granularity string) []TrafficPoint {
+	trafficMu.Lock()
+	defer trafficMu.Unlock()
+
+	buckets := traffic.Daily
+	switch granularity {
+	case "hourly":
+		buckets = traffic.Hourly
+	case "monthly":
+		buckets = traffic.Monthly
+	}
+
+	keys := make([]string, 0, len(buckets))
+	for k := range buckets {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	points := make([]TrafficPoint, 0, len(keys))
+	for _, k := range keys {
+		if c, ok := buckets[k][ip]; ok {
+			points = append(points, TrafficPoint{Period: k, Bytes: c})
+		}
+	}
+	return points
+}
+
+// ClientTrafficHandler returns per-client rates and today/month totals.
+// GET /clients/traffic, or GET /clients/traffic?ip=192.168.50.20&granularity=hourly|daily|monthly for history.
+func ClientTrafficHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if ip := strings.TrimSpace(r.URL.Query().Get("ip")); ip != "" {
+		json.NewEncoder(w).Encode(GetClientTrafficHistory(ip, r.URL.Query().Get("granularity")))
+		return
+	}
+	json.NewEncoder(w).Encode(GetClientTraffic())
+}
@@ -14,21 +14,44 @@ const (
 
 // RouterConfig is persisted after first-time web setup.
 type RouterConfig struct {
-	Configured       bool   `json:"configured"`
-	WANInterface     string `json:"wan_interface"`
-	LANInterface     string `json:"lan_interface"`
-	LANAddress       string `json:"lan_address"`
-	LANPrefix        int    `json:"lan_prefix"`
-	DHCPRangeStart   string `json:"dhcp_range_start"`
-	DHCPRangeEnd     string `json:"dhcp_range_end"`
-	DHCPLeaseHours   int    `json:"dhcp_lease_hours"`
-	TailscaleHost    string `json:"tailscale_hostname"`
-	AdminUsername    string `json:"admin_username"`
-	AdminPassword    string `json:"admin_password"`
+	Configured         bool               `json:"configured"`
+	WANInterface       string             `json:"wan_interface"`
+	WANLinks           []WANLink          `json:"wan_links,omitempty"`
+	WANMode            string             `json:"wan_mode,omitempty"`
+	WifiClient         WifiClientConfig   `json:"wifi_client"`
+	LANInterface       string             `json:"lan_interface"`
+	LANAddress         string             `json:"lan_address"`
+	LANPrefix          int                `json:"lan_prefix"`
+	DHCPRangeStart     string             `json:"dhcp_range_start"`
+	DHCPRangeEnd       string             `json:"dhcp_range_end"`
+	DHCPLeaseHours     int                `json:"dhcp_lease_hours"`
+	LANSegments        []LANSegment       `json:"lan_segments,omitempty"`
+	WifiAP             WifiAPConfig       `json:"wifi_ap"`
+	GuestPortal        GuestPortalConfig  `json:"guest_portal"`
+	TailscaleHost      string             `json:"tailscale_hostname"`
+	SubnetRouter       bool               `json:"subnet_router"`
+	AdvertiseExitNode  bool               `json:"advertise_exit_node"`
+	ExitNodeNames      map[string]string  `json:"exit_node_names,omitempty"`
+	FavoriteExitNodes  []string           `json:"favorite_exit_nodes,omitempty"`
+	ScheduleTimezone   string             `json:"schedule_timezone,omitempty"`
+	ScheduleRules      []ScheduleRule     `json:"schedule_rules,omitempty"`
+	SplitTunnelCIDRs   []string           `json:"split_tunnel_cidrs,omitempty"`
+	SplitTunnelDomains []string           `json:"split_tunnel_domains,omitempty"`
+	PortForwards       []PortForward      `json:"port_forwards,omitempty"`
+	PortMapping        PortMappingConfig  `json:"port_mapping"`
+	FirewallRules      []FirewallRule     `json:"firewall_rules,omitempty"`
+	SQM                SQMConfig          `json:"sqm"`
+	MSSClamp           MSSClampSettings   `json:"mss_clamp,omitempty"`
+	SpeedTest          SpeedTestConfig    `json:"speed_test"`
+	Notifications      NotificationConfig `json:"notifications"`
+	Watchdog           WatchdogConfig     `json:"watchdog"`
+	MetricsToken       string             `json:"metrics_token,omitempty"`
+	AdminUsername      string             `json:"admin_username"`
+	AdminPassword      string             `json:"admin_password"`
 }
 
 var (
-	configMu sync.RWMutex
+	configMu     sync.RWMutex
 	routerConfig RouterConfig
 )
 
@@ -88,7 +111,12 @@ func IsConfigured() bool {
 	return cfg.Configured && cfg.WANInterface != "" && cfg.LANInterface != ""
 }
 
+// ConfiguredWAN is the WAN currently carrying traffic: the failover choice when
+// several are configured, otherwise wan_interface.
 func ConfiguredWAN() string {
+	if iface := activeWANInterface(); iface != "" {
+		return iface
+	}
 	cfg := GetRouterConfig()
 	if cfg.WANInterface != "" {
 		return cfg.WANInterface
@@ -101,9 +129,13 @@ func ConfiguredWAN() string {
 }
 
 func ConfiguredLANInterfaces() ([]string, error) {
-	cfg := GetRouterConfig()
-	if cfg.LANInterface != "" {
-		return []string{cfg.LANInterface}, nil
+	segments := LANSegments(GetRouterConfig())
+	if len(segments) > 0 {
+		devices := make([]string, 0, len(segments))
+		for _, s := range segments {
+			devices = append(devices, s.Device())
+		}
+		return devices, nil
 	}
 	return detectLANInterfaces("")
 }
@@ -0,0 +1,658 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Diagnostic check results. A failing check is reported with its severity.
+const (
+	DiagnosticPass = "pass"
+	DiagnosticFail = "fail"
+	DiagnosticSkip = "skip"
+	DiagnosticInfo = "info" // evidence only, nothing to judge
+)
+
+const (
+	SeverityInfo     = "info"
+	SeverityWarning  = "warning"
+	SeverityCritical = "critical"
+)
+
+// DiagnosticEvidence is the raw output a check based its result on.
+type DiagnosticEvidence struct {
+	Source string `json:"source"` // command line or file path
+	Output string `json:"output"`
+}
+
+// DiagnosticCheck is one typed diagnostic. IDs are stable so fleet tooling can
+// aggregate failures across routers.
+type DiagnosticCheck struct {
+	ID          string               `json:"id"`
+	Category    string               `json:"category"`
+	Severity    string               `json:"severity"`
+	Result      string               `json:"result"`
+	Summary     string               `json:"summary"`
+	Evidence    []DiagnosticEvidence `json:"evidence,omitempty"`
+	Remediation string               `json:"remediation,omitempty"`
+}
+
+// DiagnosticReport is returned by GET /diagnostics.
+type DiagnosticReport struct {
+	Time     time.Time         `json:"time"`
+	Hostname string            `json:"hostname"`
+	Mode     string            `json:"mode"`
+	Healthy  bool              `json:"healthy"` // no critical check failed
+	Counts   map[string]int    `json:"counts"`  // pass, fail, skip, info
+	Checks   []DiagnosticCheck `json:"checks"`
+}
+
+// diagnosticChecks run in order; categories are contiguous so the text report
+// can print one section per category.
+var diagnosticChecks = []func() DiagnosticCheck{
+	checkRouterConfig,
+	checkInterfaces,
+	checkIPForwarding,
+	checkRouting,
+	checkTailscaleConnected,
+	checkRouterChains,
+	checkNATMasquerade,
+	checkNATEgress,
+	checkMSSClamp,
+	checkTailscaleChains,
+	checkDnsmasqActive,
+	checkDNSResolve,
+	checkConntrackUsage,
+	checkInternet,
+	checkWANPing,
+	checkLANPing,
+	checkWANPathMTU,
+	checkTunnelPathMTU,
+	checkSpeedTests,
+	checkRouterLogs,
+}
+
+// RunDiagnosticChecks runs every check in order, calling onCheck (may be nil) as
+// each one finishes so callers can stream progress.
+func RunDiagnosticChecks(onCheck func(DiagnosticCheck)) DiagnosticReport {
+	hostname, _ := os.Hostname()
+	report := DiagnosticReport{
+		Time:     time.Now().UTC(),
+		Hostname: hostname,
+		Mode:     diagnosticMode(),
+		Healthy:  true,
+		Counts:   map[string]int{DiagnosticPass: 0, DiagnosticFail: 0, DiagnosticSkip: 0, DiagnosticInfo: 0},
+		Checks:   []DiagnosticCheck{},
+	}
+	for _, run := range diagnosticChecks {
+		c := run()
+		report.Checks = append(report.Checks, c)
+		report.Counts[c.Result]++
+		if c.Result == DiagnosticFail && c.Severity == SeverityCritical {
+			report.Healthy = false
+		}
+		if onCheck != nil {
+			onCheck(c)
+		}
+	}
+	return report
+}
+
+// diagCommand runs a command without a shell and records its output as evidence.
+func diagCommand(name string, args ...string) DiagnosticEvidence {
+	ev, _ := diagCommandOK(name, args...)
+	return ev
+}
+
+// diagCommandOK is diagCommand that also reports whether the command succeeded.
+func diagCommandOK(name string, args ...string) (DiagnosticEvidence, bool) {
+	out, err := exec.Command(name, args...).CombinedOutput()
+	text := strings.TrimRight(string(out), "\n")
+	if err != nil && text == "" {
+		text = err.Error()
+	}
+	return DiagnosticEvidence{Source: strings.Join(append([]string{name}, args...), " "), Output: text}, err == nil
+}
+
+func diagFile(path string) DiagnosticEvidence {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return DiagnosticEvidence{Source: path, Output: err.Error()}
+	}
+	return DiagnosticEvidence{Source: path, Output: strings.TrimRight(string(data), "\n")}
+}
+
+// firstLines keeps at most n lines of output.
+func firstLines(text string, n int) string {
+	lines := strings.Split(text, "\n")
+	if len(lines) <= n {
+		return text
+	}
+	return strings.Join(lines[:n], "\n")
+}
+
+// iptablesRules returns the -S listing of a chain, one rule per line.
+func iptablesRules(table, chain string) (DiagnosticEvidence, []string) {
+	ev, ok := diagCommandOK("iptables", "-t", table, "-S", chain)
+	if !ok {
+		return ev, nil
+	}
+	var rules []string
+	for _, line := range strings.Split(ev.Output, "\n") {
+		if strings.HasPrefix(line, "-A ") {
+			rules = append(rules, line)
+		}
+	}
+	return ev, rules
+}
+
+// ruleHasArg reports whether an iptables -S rule contains flag followed by value.
+func ruleHasArg(rule, flag, value string) bool {
+	fields := strings.Fields(rule)
+	for i := 0; i+1 < len(fields); i++ {
+		if fields[i] == flag && fields[i+1] == value {
+			return true
+		}
+	}
+	return false
+}
+
+func diagnosticMode() string {
+	mu.Lock()
+	defer mu.Unlock()
+	return CurrentMode
+}
+
+func checkRouterConfig() DiagnosticCheck {
+	c := DiagnosticCheck{
+		ID:       "config.router",
+		Category: "config",
+		Severity: SeverityWarning,
+		Result:   DiagnosticPass,
+		Summary:  "router configured, mode " + diagnosticMode(),
+		Evidence: []DiagnosticEvidence{{Source: "router config (redacted)", Output: redactedConfigJSON()}},
+	}
+	mode := diagFile(modeFile)
+	c.Evidence = append(c.Evidence, mode)
+	if !IsConfigured() {
+		c.Result, c.Summary = DiagnosticFail, "router is not configured"
+		c.Remediation = "Finish the setup wizard."
+	} else if _, err := os.Stat(modeFile); err != nil {
+		c.Result, c.Summary = DiagnosticFail, "no saved mode file"
+		c.Remediation = "Switch mode once from the dashboard so it is saved and restored after reboot."
+	}
+	return c
+}
+
+func checkInterfaces() DiagnosticCheck {
+	cfg := GetRouterConfig()
+	c := DiagnosticCheck{
+		ID:       "interfaces.present",
+		Category: "interfaces",
+		Severity: SeverityCritical,
+		Result:   DiagnosticPass,
+		Summary:  fmt.Sprintf("WAN=%s LAN=%s LAN_IP=%s", cfg.WANInterface, cfg.LANInterface, cfg.LANAddress),
+		Evidence: []DiagnosticEvidence{diagCommand("ip", "-br", "link"), diagCommand("ip", "-4", "addr", "show")},
+	}
+	var missing []string
+	for _, name := range []string{cfg.WANInterface, cfg.LANInterface} {
+		if name == "" {
+			continue
+		}
+		if _, err := net.InterfaceByName(name); err != nil {
+			missing = append(missing, name)
+		}
+	}
+	if len(missing) > 0 {
+		c.Result = DiagnosticFail
+		c.Summary = "configured interfaces missing: " + strings.Join(missing, ", ")
+		c.Remediation = "Check cabling and USB adapters, or rerun setup with the current interface names."
+	}
+	return c
+}
+
+func checkIPForwarding() DiagnosticCheck {
+	c := DiagnosticCheck{
+		ID:       "forwarding.ipv4",
+		Category: "forwarding",
+		Severity: SeverityCritical,
+		Result:   DiagnosticPass,
+		Summary:  "IPv4 forwarding enabled",
+		Evidence: []DiagnosticEvidence{diagCommand("sysctl", "net.ipv4.ip_forward", "net.ipv4.conf.all.forwarding", "net.ipv4.conf.all.rp_filter")},
+	}
+	if !IsIPForwardingEnabled() {
+		c.Result, c.Summary = DiagnosticFail, "IPv4 forwarding disabled"
+		c.Remediation = "Use Repair routing, which re-enables net.ipv4.ip_forward."
+	}
+	return c
+}
+
+func checkRouting() DiagnosticCheck {
+	return DiagnosticCheck{
+		ID:       "routing.tables",
+		Category: "routing",
+		Severity: SeverityInfo,
+		Result:   DiagnosticInfo,
+		Summary:  "main routing table and policy rules",
+		Evidence: []DiagnosticEvidence{diagCommand("ip", "route", "show"), diagCommand("ip", "rule", "show")},
+	}
+}
+
+func checkTailscaleConnected() DiagnosticCheck {
+	status := diagCommand("tailscale", "status")
+	status.Output = firstLines(status.Output, 20)
+	c := DiagnosticCheck{
+		ID:       "tailscale.connected",
+		Category: "tailscale",
+		Severity: SeverityCritical,
+		Result:   DiagnosticPass,
+		Summary:  "tailscale connected",
+		Evidence: []DiagnosticEvidence{status},
+	}
+	if out, err := exec.Command("tailscale", "status", "--json").Output(); err == nil {
+		var st struct {
+			ExitNodeStatus *struct {
+				ID     string
+				Online bool
+			}
+		}
+		if json.Unmarshal(out, &st) == nil && st.ExitNodeStatus != nil {
+			c.Evidence = append(c.Evidence, DiagnosticEvidence{
+				Source: "tailscale status --json (ExitNodeStatus)",
+				Output: fmt.Sprintf("id=%s online=%t", st.ExitNodeStatus.ID, st.ExitNodeStatus.Online),
+			})
+		}
+	}
+	if !IsTailscaleRunning() {
+		c.Result, c.Summary = DiagnosticFail, "tailscale not connected"
+		c.Remediation = "Check `systemctl status tailscaled` and run `tailscale up` if the node was logged out."
+	}
+	return c
+}
+
+func checkRouterChains() DiagnosticCheck {
+	return DiagnosticCheck{
+		ID:       "firewall.router_chains",
+		Category: "firewall",
+		Severity: SeverityInfo,
+		Result:   DiagnosticInfo,
+		Summary:  "router iptables chains",
+		Evidence: []DiagnosticEvidence{
+			diagCommand("iptables", "-L", "FORWARD", "-n", "-v", "--line-numbers"),
+			diagCommand("iptables", "-L", "TS-ROUTER-GUARD", "-n", "-v"),
+			diagCommand("iptables", "-L", "TS-ROUTER-FWD", "-n", "-v"),
+			diagCommand("iptables", "-t", "mangle", "-L", "TS-ROUTER-MSS", "-n", "-v"),
+			diagCommand("iptables", "-t", "nat", "-L", "POSTROUTING", "-n", "-v", "--line-numbers"),
+			diagCommand("iptables", "-t", "nat", "-L", "TS-ROUTER-NAT", "-n", "-v"),
+		},
+	}
+}
+
+func checkNATMasquerade() DiagnosticCheck {
+	ev, rules := iptablesRules("nat", "TS-ROUTER-NAT")
+	c := DiagnosticCheck{
+		ID:       "firewall.nat_masquerade",
+		Category: "firewall",
+		Severity: SeverityCritical,
+		Result:   DiagnosticFail,
+		Summary:  "TS-ROUTER-NAT has no MASQUERADE rule",
+		Evidence: []DiagnosticEvidence{ev},
+	}
+	for _, rule := range rules {
+		if ruleHasArg(rule, "-j", "MASQUERADE") {
+			c.Result, c.Summary = DiagnosticPass, "NAT masquerade present"
+			return c
+		}
+	}
+	c.Remediation = "Use Repair routing to rebuild the NAT rules for the current mode."
+	return c
+}
+
+func checkNATEgress() DiagnosticCheck {
+	mode := diagnosticMode()
+	egress := ""
+	switch {
+	case strings.HasPrefix(mode, "tailscale:"):
+		egress = "tailscale0"
+	case mode == "direct" && IsConfigured():
+		egress = ConfiguredWAN()
+	}
+	c := DiagnosticCheck{
+		ID:       "firewall.nat_egress",
+		Category: "firewall",
+		Severity: SeverityWarning,
+	}
+	if egress == "" {
+		c.Result, c.Summary = DiagnosticSkip, "no egress expected in mode "+mode
+		return c
+	}
+
+	ev, rules := iptablesRules("nat", "TS-ROUTER-NAT")
+	c.Evidence = []DiagnosticEvidence{ev}
+	for _, rule := range rules {
+		if ruleHasArg(rule, "-j", "MASQUERADE") && ruleHasArg(rule, "-o", egress) {
+			c.Result, c.Summary = DiagnosticPass, "NAT targets "+egress
+			return c
+		}
+	}
+	c.Result, c.Summary = DiagnosticFail, fmt.Sprintf("%s mode but NAT does not target %s", mode, egress)
+	c.Remediation = "Use Repair routing; if it persists, check that the WAN interface name in the config is current."
+	return c
+}
+
+func checkMSSClamp() DiagnosticCheck {
+	c := DiagnosticCheck{
+		ID:       "firewall.mss_clamp",
+		Category: "firewall",
+		Severity: SeverityWarning,
+	}
+	mu.Lock()
+	egress := currentEgressInterfaces()
+	mu.Unlock()
+
+	ev, rules := iptablesRules("mangle", "TS-ROUTER-MSS")
+	c.Evidence = []DiagnosticEvidence{ev}
+	var clamped, missing []string
+	for _, iface := range egress {
+		if mssClampArgs(iface) == nil {
+			continue
+		}
+		found := false
+		for _, rule := range rules {
+			if ruleHasArg(rule, "-j", "TCPMSS") && ruleHasArg(rule, "-o", iface) {
+				found = true
+				break
+			}
+		}
+		if found {
+			clamped = append(clamped, iface)
+		} else {
+			missing = append(missing, iface)
+		}
+	}
+	switch {
+	case len(missing) > 0:
+		c.Result, c.Summary = DiagnosticFail, "TCP MSS clamp missing for "+strings.Join(missing, ", ")
+		c.Remediation = "Use Repair routing to restore the clamp; without it large TCP transfers can stall on smaller-MTU paths."
+	case len(clamped) == 0:
+		c.Result, c.Summary = DiagnosticSkip, "MSS clamp is off for the current egress"
+	default:
+		c.Result, c.Summary = DiagnosticPass, "TCP MSS clamp for "+strings.Join(clamped, ", ")
+	}
+	return c
+}
+
+// mtuPathCheck judges whether the clamp fits the last stored probe of one path:
+// the MSS that leaves the router must not exceed what the path carries. It does
+// not probe; RunMTUProbes and POST /mtu/probe keep the results current.
+func mtuPathCheck(iface string) (DiagnosticEvidence, string, string) {
+	r, ok := lastMTUProbe(iface)
+	if !ok {
+		ev := DiagnosticEvidence{Source: mtuProbesFile, Output: "no probe stored for " + iface}
+		return ev, iface + ": not probed yet; run POST /mtu/probe", DiagnosticSkip
+	}
+	ev := DiagnosticEvidence{
+		Source: fmt.Sprintf("%s: ping -M do via %s to %s at %s", mtuProbesFile, iface, r.Target, r.Time.Format(time.RFC3339)),
+		Output: strings.Join(r.Steps, ", "),
+	}
+	if r.Error != "" {
+		return ev, iface + ": " + r.Error, DiagnosticFail
+	}
+
+	mode, mss := effectiveMSS(iface)
+	sent := mss
+	switch {
+	case mode == MSSClampOff:
+		sent = 1500 - tcpIPv4Overhead // what LAN clients offer on Ethernet
+	case mss == 0:
+		sent = r.InterfaceMTU - tcpIPv4Overhead
+	}
+	summary := fmt.Sprintf("%s: path MTU %d (interface %d, probed %s ago), clamp %s → MSS %d",
+		iface, r.PathMTU, r.InterfaceMTU, time.Since(r.Time).Round(time.Minute), mode, sent)
+	if sent > r.MSS {
+		return ev, summary, DiagnosticFail
+	}
+	return ev, summary, DiagnosticPass
+}
+
+func checkWANPathMTU() DiagnosticCheck {
+	c := DiagnosticCheck{
+		ID:       "mtu.wan",
+		Category: "mtu",
+		Severity: SeverityWarning,
+		Result:   DiagnosticSkip,
+	}
+	var summaries, bad []string
+	for _, iface := range ActiveWANInterfaces() {
+		ev, summary, result := mtuPathCheck(iface)
+		c.Evidence = append(c.Evidence, ev)
+		summaries = append(summaries, summary)
+		switch result {
+		case DiagnosticFail:
+			bad = append(bad, iface)
+		case DiagnosticPass:
+			c.Result = DiagnosticPass
+		}
+	}
+	c.Summary = strings.Join(summaries, "; ")
+	if c.Summary == "" {
+		c.Summary = "no active WAN link"
+	}
+	if len(bad) > 0 {
+		c.Result = DiagnosticFail
+		c.Remediation = fmt.Sprintf("Set the MSS clamp for %s to auto (or fixed at the path MTU minus 40) so TCP sessions fit the WAN path.", strings.Join(bad, ", "))
+	}
+	return c
+}
+
+func checkTunnelPathMTU() DiagnosticCheck {
+	c := DiagnosticCheck{
+		ID:       "mtu.tailscale0",
+		Category: "mtu",
+		Severity: SeverityWarning,
+	}
+	if !strings.HasPrefix(diagnosticMode(), "tailscale:") {
+		c.Result, c.Summary = DiagnosticSkip, "no exit node in use; the tailscale0 path is probed through the exit node"
+		return c
+	}
+	ev, summary, result := mtuPathCheck("tailscale0")
+	c.Evidence = []DiagnosticEvidence{ev}
+	c.Result, c.Summary = result, summary
+	if result == DiagnosticFail {
+		c.Remediation = "Set the MSS clamp for tailscale0 to auto; the exit node's own uplink is smaller than the tunnel MTU."
+	}
+	return c
+}
+
+func checkTailscaleChains() DiagnosticCheck {
+	return DiagnosticCheck{
+		ID:       "firewall.tailscale_chains",
+		Category: "firewall",
+		Severity: SeverityInfo,
+		Result:   DiagnosticInfo,
+		Summary:  "tailscaled iptables chains",
+		Evidence: []DiagnosticEvidence{
+			diagCommand("iptables", "-L", "ts-forward", "-n", "-v"),
+			diagCommand("iptables", "-t", "nat", "-L", "ts-postrouting", "-n", "-v"),
+		},
+	}
+}
+
+func checkDnsmasqActive() DiagnosticCheck {
+	services := diagCommand("systemctl", "is-active", "dnsmasq", "tailscaled", "tailscale-router")
+	conf := diagFile(dnsmasqLANConfFile)
+	var kept []string
+	for _, line := range strings.Split(conf.Output, "\n") {
+		for _, key := range []string{"dhcp-range", "interface", "listen-address"} {
+			if strings.HasPrefix(line, key) {
+				kept = append(kept, line)
+				break
+			}
+		}
+	}
+	if kept != nil {
+		conf.Output = strings.Join(kept, "\n")
+	}
+
+	c := DiagnosticCheck{
+		ID:       "dns.dnsmasq_active",
+		Category: "dns",
+		Severity: SeverityCritical,
+		Result:   DiagnosticPass,
+		Summary:  "dnsmasq active",
+		Evidence: []DiagnosticEvidence{services, diagFile("/run/tailscale-router/upstream-servers.conf"), conf},
+	}
+	if exec.Command("systemctl", "is-active", "--quiet", "dnsmasq").Run() != nil {
+		c.Result, c.Summary = DiagnosticFail, "dnsmasq not active"
+		c.Remediation = "Use Repair routing & DNS, then check `journalctl -u dnsmasq` for config errors."
+	}
+	return c
+}
+
+func checkDNSResolve() DiagnosticCheck {
+	cfg := GetRouterConfig()
+	c := DiagnosticCheck{
+		ID:       "dns.resolve",
+		Category: "dns",
+		Severity: SeverityWarning,
+	}
+	if cfg.LANAddress == "" {
+		c.Result, c.Summary = DiagnosticSkip, "no LAN address configured"
+		return c
+	}
+	ev, ok := diagCommandOK("dig", "@"+cfg.LANAddress, "google.com", "+short", "+time=2")
+	ev.Output = firstLines(ev.Output, 5)
+	c.Evidence = []DiagnosticEvidence{ev}
+	if ok && net.ParseIP(strings.TrimSpace(firstLines(ev.Output, 1))) != nil {
+		c.Result, c.Summary = DiagnosticPass, "router resolver answers on "+cfg.LANAddress
+		return c
+	}
+	c.Result, c.Summary = DiagnosticFail, "router resolver did not answer on "+cfg.LANAddress
+	c.Remediation = "Check the upstream DNS servers and that dnsmasq listens on the LAN address."
+	return c
+}
+
+func checkConntrackUsage() DiagnosticCheck {
+	countEv := diagFile("/proc/sys/net/netfilter/nf_conntrack_count")
+	maxEv := diagFile("/proc/sys/net/netfilter/nf_conntrack_max")
+	c := DiagnosticCheck{
+		ID:       "conntrack.usage",
+		Category: "conntrack",
+		Severity: SeverityWarning,
+		Evidence: []DiagnosticEvidence{countEv, maxEv},
+	}
+	count, err1 := strconv.Atoi(strings.TrimSpace(countEv.Output))
+	max, err2 := strconv.Atoi(strings.TrimSpace(maxEv.Output))
+	if err1 != nil || err2 != nil || max == 0 {
+		c.Result, c.Summary = DiagnosticSkip, "conntrack counters not available"
+		return c
+	}
+	c.Result = DiagnosticPass
+	c.Summary = fmt.Sprintf("%d of %d conntrack entries in use", count, max)
+	if count*10 >= max*9 {
+		c.Result = DiagnosticFail
+		c.Remediation = "The table is nearly full and new connections will be dropped; raise net.netfilter.nf_conntrack_max or find the client opening many connections."
+	}
+	return c
+}
+
+func pingCheck(id, severity, target, iface, what string) DiagnosticCheck {
+	args := []string{"-c", "2", "-W", "2"}
+	if iface != "" {
+		args = append(args, "-I", iface)
+	}
+	ev, ok := diagCommandOK("ping", append(args, target)...)
+	c := DiagnosticCheck{
+		ID:       id,
+		Category: "connectivity",
+		Severity: severity,
+		Result:   DiagnosticPass,
+		Summary:  what + " reachable",
+		Evidence: []DiagnosticEvidence{ev},
+	}
+	if !ok {
+		c.Result, c.Summary = DiagnosticFail, what+" unreachable"
+	}
+	return c
+}
+
+func checkInternet() DiagnosticCheck {
+	c := pingCheck("connectivity.internet", SeverityCritical, "1.1.1.1", "", "1.1.1.1 from the router")
+	if c.Result == DiagnosticFail {
+		c.Remediation = "Check the WAN link and, in exit node mode, that the exit node is online."
+	}
+	return c
+}
+
+func checkWANPing() DiagnosticCheck {
+	wan := GetRouterConfig().WANInterface
+	if wan == "" {
+		return DiagnosticCheck{ID: "connectivity.wan", Category: "connectivity", Severity: SeverityWarning, Result: DiagnosticSkip, Summary: "no WAN interface configured"}
+	}
+	c := pingCheck("connectivity.wan", SeverityWarning, "1.1.1.1", wan, "1.1.1.1 via "+wan)
+	if c.Result == DiagnosticFail {
+		c.Remediation = "The WAN uplink has no internet access; check the modem or upstream router."
+	}
+	return c
+}
+
+func checkLANPing() DiagnosticCheck {
+	cfg := GetRouterConfig()
+	if cfg.LANInterface == "" || cfg.LANAddress == "" {
+		return DiagnosticCheck{ID: "connectivity.lan", Category: "connectivity", Severity: SeverityWarning, Result: DiagnosticSkip, Summary: "no LAN interface configured"}
+	}
+	c := pingCheck("connectivity.lan", SeverityWarning, cfg.LANAddress, cfg.LANInterface, "LAN address "+cfg.LANAddress)
+	if c.Result == DiagnosticFail {
+		c.Remediation = "The LAN address is not assigned; rerun setup or use Repair routing."
+	}
+	return c
+}
+
+// checkSpeedTests reports the last stored measurements rather than running new
+// ones, which would saturate the uplink for the length of the report.
+func checkSpeedTests() DiagnosticCheck {
+	c := DiagnosticCheck{
+		ID:       "throughput.last",
+		Category: "throughput",
+		Severity: SeverityInfo,
+		Result:   DiagnosticInfo,
+	}
+	var summaries []string
+	for _, path := range []string{SpeedTestPathWAN, SpeedTestPathExitNode} {
+		r, ok := latestSpeedResult(path)
+		if !ok {
+			continue
+		}
+		via := r.Interface
+		if r.ExitNode != "" {
+			via = r.ExitNode + " via " + r.Interface
+		}
+		line := fmt.Sprintf("%s (%s): %.1f down / %.1f up Mbit/s, %.0f ms, %s ago",
+			path, via, r.DownloadMbps, r.UploadMbps, r.LatencyMs, time.Since(r.Time).Round(time.Minute))
+		summaries = append(summaries, line)
+		c.Evidence = append(c.Evidence, DiagnosticEvidence{Source: "speed test " + r.Time.UTC().Format(time.RFC3339) + " against " + r.Endpoint, Output: line})
+	}
+	if len(summaries) == 0 {
+		c.Result, c.Summary = DiagnosticSkip, "no speed test results yet"
+		return c
+	}
+	c.Summary = strings.Join(summaries, "; ")
+	return c
+}
+
+func checkRouterLogs() DiagnosticCheck {
+	return DiagnosticCheck{
+		ID:       "logs.router",
+		Category: "logs",
+		Severity: SeverityInfo,
+		Result:   DiagnosticInfo,
+		Summary:  "recent router service log",
+		Evidence: []DiagnosticEvidence{diagCommand("journalctl", "-u", "tailscale-router", "-n", "40", "--no-pager")},
+	}
+}
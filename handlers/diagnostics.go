@@ -4,8 +4,6 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
-	"os"
-	"os/exec"
 	"strings"
 )
 
@@ -73,10 +71,11 @@ func DiagnosticsRepairHandler(w http.ResponseWriter, r *http.Request) {
 		strings.Contains(r.Header.Get("Accept"), "text/event-stream")
 
 	if stream {
-		repairRoutingStream(w)
+		repairRoutingStream(w, requestActor(r))
 		return
 	}
 
+	ev := Event{Type: EventRepair, Actor: requestActor(r), Before: CurrentMode}
 	var err error
 	if CurrentMode != "direct" && strings.HasPrefix(CurrentMode, "tailscale:") {
 		node := strings.TrimPrefix(CurrentMode, "tailscale:")
@@ -84,6 +83,9 @@ func DiagnosticsRepairHandler(w http.ResponseWriter, r *http.Request) {
 	} else {
 		err = DisableTailscaleExitNode()
 	}
+	recordRepairOutcome(err)
+	ev.After = CurrentMode
+	RecordEvent(eventResult(ev, err))
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -93,7 +95,7 @@ func DiagnosticsRepairHandler(w http.ResponseWriter, r *http.Request) {
 	fmt.Fprintf(w, "Repair complete. Mode: %s\n", CurrentMode)
 }
 
-func repairRoutingStream(w http.ResponseWriter) {
+func repairRoutingStream(w http.ResponseWriter, actor string) {
 	w.Header().Set("Content-Type", "text/event-stream")
 	w.Header().Set("Cache-Control", "no-cache")
 	w.Header().Set("Connection", "keep-alive")
@@ -116,6 +118,7 @@ func repairRoutingStream(w http.ResponseWriter) {
 	emit("=== Repair routing & DNS ===")
 	emit(fmt.Sprintf("Current mode: %s", CurrentMode))
 
+	ev := Event{Type: EventRepair, Actor: actor, Before: CurrentMode, Detail: "streamed"}
 	var err error
 	if CurrentMode != "direct" && strings.HasPrefix(CurrentMode, "tailscale:") {
 		node := strings.TrimPrefix(CurrentMode, "tailscale:")
@@ -125,6 +128,9 @@ func repairRoutingStream(w http.ResponseWriter) {
 		emit("Re-applying direct mode")
 		err = DisableTailscaleExitNode()
 	}
+	recordRepairOutcome(err)
+	ev.After = CurrentMode
+	RecordEvent(eventResult(ev, err))
 
 	if err != nil {
 		emit("FAIL: " + err.Error())
@@ -143,152 +149,107 @@ func repairRoutingStream(w http.ResponseWriter) {
 	f.Flush()
 }
 
-// RunDiagnostics writes a copy-paste friendly health report.
-func RunDiagnostics(emit diagnosticReporter) {
-	emitSection := func(title string) {
-		emit("")
-		emit("========== " + title + " ==========")
-	}
-
-	emitSection("CONFIG")
-	emit(redactedConfigJSON())
-	if data, err := os.ReadFile(modeFile); err == nil {
-		emit(string(data))
-	} else {
-		emit("NO MODE FILE")
+// DiagnosticsHandler returns the structured diagnostic report as JSON.
+func DiagnosticsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
 	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(RunDiagnosticChecks(nil))
+}
 
-	emitSection("INTERFACES")
-	emit(shellOutput("ip -br link"))
-	emit(shellOutput("ip -4 addr show"))
-
-	emitSection("IP FORWARDING")
-	emit(shellOutput("sysctl net.ipv4.ip_forward net.ipv4.conf.all.forwarding net.ipv4.conf.all.rp_filter"))
-
-	emitSection("ROUTING")
-	emit(shellOutput("ip route show"))
-	emit(shellOutput("ip rule show"))
+// RunDiagnostics writes a copy-paste friendly health report, rendered from the
+// typed checks as each one finishes.
+func RunDiagnostics(emit diagnosticReporter) DiagnosticReport {
+	category := ""
+	report := RunDiagnosticChecks(func(c DiagnosticCheck) {
+		if c.Category != category {
+			category = c.Category
+			emit("")
+			emit("========== " + strings.ToUpper(category) + " ==========")
+		}
+		for _, line := range renderDiagnosticCheck(c) {
+			emit(line)
+		}
+	})
 
-	emitSection("TAILSCALE")
-	emit(shellOutput("tailscale status 2>&1 | head -20"))
-	if out := shellOutput("tailscale status --json 2>/dev/null"); out != "" {
-		for _, line := range strings.Split(out, "\n") {
-			if strings.Contains(line, "ExitNode") {
-				emit(line)
-			}
+	emit("")
+	emit("========== SUMMARY ==========")
+	for _, c := range report.Checks {
+		if c.Result == DiagnosticPass || c.Result == DiagnosticFail {
+			emit(diagnosticLabel(c) + ": " + c.Summary)
 		}
 	}
+	return report
+}
 
-	emitSection("ROUTER IPTABLES")
-	emit(shellOutput("iptables -L FORWARD -n -v --line-numbers"))
-	emit(shellOutput("iptables -L TS-ROUTER-FWD -n -v"))
-	emit(shellOutput("iptables -t mangle -L TS-ROUTER-MSS -n -v 2>/dev/null"))
-	emit(shellOutput("iptables -t nat -L POSTROUTING -n -v --line-numbers"))
-	emit(shellOutput("iptables -t nat -L TS-ROUTER-NAT -n -v"))
-
-	emitSection("TAILSCALE IPTABLES")
-	emit(shellOutput("iptables -L ts-forward -n -v 2>/dev/null || echo no ts-forward"))
-	emit(shellOutput("iptables -t nat -L ts-postrouting -n -v 2>/dev/null || echo no ts-postrouting"))
-
-	emitSection("DNS / DHCP")
-	emit(shellOutput("systemctl is-active dnsmasq tailscaled tailscale-router 2>&1"))
-	if data, err := os.ReadFile("/run/tailscale-router/upstream-servers.conf"); err == nil {
-		emit(string(data))
-	} else {
-		emit("NO UPSTREAM FILE")
+// diagnosticLabel is the text-report prefix: a failure reads WARN or FAIL by severity.
+func diagnosticLabel(c DiagnosticCheck) string {
+	switch c.Result {
+	case DiagnosticPass:
+		return "OK"
+	case DiagnosticSkip:
+		return "SKIP"
+	case DiagnosticFail:
+		if c.Severity == SeverityCritical {
+			return "FAIL"
+		}
+		return "WARN"
 	}
-	emit(shellOutput("grep -E 'dhcp-range|interface|listen-address' /etc/dnsmasq.d/tailscale-router.conf 2>/dev/null"))
-
-	emitSection("CONNTRACK")
-	emit(shellOutput("cat /proc/sys/net/netfilter/nf_conntrack_count 2>/dev/null || echo n/a"))
-	emit(shellOutput("cat /proc/sys/net/netfilter/nf_conntrack_max 2>/dev/null || echo n/a"))
+	return "INFO"
+}
 
-	emitSection("CONNECTIVITY FROM PI")
-	cfg := GetRouterConfig()
-	emit(fmt.Sprintf("WAN=%s LAN=%s LAN_IP=%s", cfg.WANInterface, cfg.LANInterface, cfg.LANAddress))
-	emit(shellOutput("ping -c 2 -W 2 1.1.1.1"))
-	if cfg.WANInterface != "" {
-		emit(shellOutput("ping -c 2 -W 2 -I " + cfg.WANInterface + " 1.1.1.1 2>&1"))
-	}
-	if cfg.LANInterface != "" && cfg.LANAddress != "" {
-		emit(shellOutput("ping -c 2 -W 2 -I " + cfg.LANInterface + " " + cfg.LANAddress + " 2>&1"))
+func renderDiagnosticCheck(c DiagnosticCheck) []string {
+	lines := []string{fmt.Sprintf("%s: %s [%s]", diagnosticLabel(c), c.Summary, c.ID)}
+	for _, ev := range c.Evidence {
+		lines = append(lines, "$ "+ev.Source)
+		if ev.Output != "" {
+			lines = append(lines, ev.Output)
+		}
 	}
-	if cfg.LANAddress != "" {
-		emit(shellOutput("dig @" + cfg.LANAddress + " google.com +short +time=2 2>&1 | head -5"))
+	if c.Result == DiagnosticFail && c.Remediation != "" {
+		lines = append(lines, "→ "+c.Remediation)
 	}
-
-	emitSection("RECENT LOGS")
-	emit(shellOutput("journalctl -u tailscale-router -n 40 --no-pager 2>/dev/null"))
-
-	emitSection("SUMMARY")
-	emit(diagnosticSummary())
+	return lines
 }
 
-func redactedConfigJSON() string {
-	cfg := GetRouterConfig()
+// redactedRouterConfig masks the known secrets in cfg. /setup/status serves the
+// result without a login, so every stored credential has to be covered here.
+func redactedRouterConfig(cfg RouterConfig) RouterConfig {
 	cfg.AdminPassword = "***"
-	data, err := json.MarshalIndent(cfg, "", "  ")
-	if err != nil {
-		return "CONFIG READ ERROR"
+	if cfg.MetricsToken != "" {
+		cfg.MetricsToken = "***"
 	}
-	return string(data)
-}
-
-func shellOutput(cmdline string) string {
-	out, err := exec.Command("sh", "-c", cmdline).CombinedOutput()
-	text := strings.TrimRight(string(out), "\n")
-	if err != nil && text == "" {
-		return err.Error()
-	}
-	return text
-}
-
-func diagnosticSummary() string {
-	var issues []string
-
-	if !IsIPForwardingEnabled() {
-		issues = append(issues, "FAIL: IPv4 forwarding disabled")
-	} else {
-		issues = append(issues, "OK: IPv4 forwarding enabled")
+	cfg.Notifications = redactedNotificationConfig(cfg.Notifications)
+	for i := range cfg.Notifications.Sinks {
+		if cfg.Notifications.Sinks[i].URL != "" {
+			cfg.Notifications.Sinks[i].URL = redactSecretURL(cfg.Notifications.Sinks[i].URL)
+		}
 	}
-
-	if exec.Command("systemctl", "is-active", "--quiet", "dnsmasq").Run() != nil {
-		issues = append(issues, "FAIL: dnsmasq not active")
-	} else {
-		issues = append(issues, "OK: dnsmasq active")
+	cfg.WifiClient = redactWifiClientConfig(cfg.WifiClient)
+	if cfg.WifiAP.Passphrase != "" {
+		cfg.WifiAP.Passphrase = "***"
 	}
+	return cfg
+}
 
-	natOut := shellOutput("iptables -t nat -L TS-ROUTER-NAT -n -v")
-	if !strings.Contains(natOut, "MASQUERADE") {
-		issues = append(issues, "FAIL: TS-ROUTER-NAT has no MASQUERADE rule")
-	} else if strings.Contains(CurrentMode, "tailscale:") && !strings.Contains(natOut, "tailscale0") {
-		issues = append(issues, "WARN: exit node mode but NAT may not target tailscale0")
-	} else if CurrentMode == "direct" && IsConfigured() {
-		wan := ConfiguredWAN()
-		if wan != "" && !strings.Contains(natOut, wan) {
-			issues = append(issues, "WARN: direct mode but NAT may not target WAN "+wan)
-		}
-	} else {
-		issues = append(issues, "OK: NAT masquerade present")
-	}
+// redactedConfigJSON is the config for diagnostics and support bundles: known
+// secrets are masked, then any field that looks like a key, token or password.
+func redactedConfigJSON() string {
+	cfg := redactedRouterConfig(GetRouterConfig())
 
-	if strings.Contains(CurrentMode, "tailscale:") {
-		mss := shellOutput("iptables -t mangle -L TS-ROUTER-MSS -n -v 2>/dev/null")
-		if strings.Contains(mss, "TCPMSS") {
-			issues = append(issues, "OK: TCP MSS clamp for tailscale0")
-		} else {
-			issues = append(issues, "WARN: TCP MSS clamp missing (use Repair routing)")
-		}
+	raw, err := json.Marshal(cfg)
+	if err != nil {
+		return "CONFIG READ ERROR"
 	}
-
-	if !IsTailscaleRunning() {
-		issues = append(issues, "FAIL: tailscale not connected")
-	} else {
-		issues = append(issues, "OK: tailscale connected")
+	var generic interface{}
+	if err := json.Unmarshal(raw, &generic); err != nil {
+		return "CONFIG READ ERROR"
 	}
-
-	if len(issues) == 0 {
-		return "No issues detected"
+	data, err := json.MarshalIndent(redactJSONSecrets(generic), "", "  ")
+	if err != nil {
+		return "CONFIG READ ERROR"
 	}
-	return strings.Join(issues, "\n")
+	return string(data)
 }
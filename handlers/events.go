@@ -0,0 +1,276 @@
+package handlers
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	eventLogFile = stateDir + "/events.jsonl"
+	// Rotated files are events.jsonl.1 (newest) .. events.jsonl.<eventLogKeep>.
+	eventLogMaxBytes = 1 << 20
+	eventLogKeep     = 3
+	eventPageDefault = 50
+	eventPageMax     = 500
+)
+
+// Event types recorded in the event log.
+const (
+	EventModeSwitch   = "mode_switch"
+	EventLogin        = "login"
+	EventRepair       = "repair"
+	EventRestore      = "restore"
+	EventRestoreRetry = "restore_retry"
+	EventBootstrap    = "bootstrap"
+)
+
+// Event is one audit record. Before/After hold the state the action changed (usually the mode).
+type Event struct {
+	ID     int64     `json:"id"`
+	Time   time.Time `json:"time"`
+	Type   string    `json:"type"`
+	Actor  string    `json:"actor"`
+	Before string    `json:"before,omitempty"`
+	After  string    `json:"after,omitempty"`
+	Result string    `json:"result"`
+	Error  string    `json:"error,omitempty"`
+	Detail string    `json:"detail,omitempty"`
+}
+
+// EventQuery filters and pages the log. Empty fields match everything.
+type EventQuery struct {
+	Type   string
+	Actor  string
+	Result string
+	Since  time.Time
+	Until  time.Time
+	Before int64 // only events with a smaller ID (paging cursor)
+	Limit  int
+}
+
+// EventPage is newest-first; pass NextBefore as before= to get the next page.
+type EventPage struct {
+	Events     []Event `json:"events"`
+	NextBefore int64   `json:"next_before,omitempty"`
+}
+
+var (
+	eventMu     sync.Mutex
+	lastEventID int64 = -1 // loaded from disk on first write
+)
+
+func eventLogFiles() []string {
+	files := []string{eventLogFile}
+	for i := 1; i <= eventLogKeep; i++ {
+		files = append(files, fmt.Sprintf("%s.%d", eventLogFile, i))
+	}
+	return files
+}
+
+// readEventFile parses one JSONL file, skipping torn or unreadable lines.
+func readEventFile(path string) []Event {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+
+	var events []Event
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var ev Event
+		if json.Unmarshal(scanner.Bytes(), &ev) == nil {
+			events = append(events, ev)
+		}
+	}
+	return events
+}
+
+// loadLastEventID finds the highest ID on disk. Caller holds eventMu.
+func loadLastEventID() int64 {
+	for _, path := range eventLogFiles() {
+		if events := readEventFile(path); len(events) > 0 {
+			return events[len(events)-1].ID
+		}
+	}
+	return 0
+}
+
+// rotateEventLog shifts events.jsonl -> .1 -> .2 ... Caller holds eventMu.
+func rotateEventLog() {
+	files := eventLogFiles()
+	os.Remove(files[len(files)-1])
+	for i := len(files) - 1; i > 0; i-- {
+		os.Rename(files[i-1], files[i])
+	}
+}
+
+// RecordEvent appends an event to the log; failures are logged, never returned.
+func RecordEvent(ev Event) {
+	eventMu.Lock()
+	defer eventMu.Unlock()
+
+	if lastEventID < 0 {
+		lastEventID = loadLastEventID()
+	}
+	lastEventID++
+	ev.ID = lastEventID
+	if ev.Time.IsZero() {
+		ev.Time = time.Now()
+	}
+	if ev.Actor == "" {
+		ev.Actor = "system"
+	}
+
+	data, err := json.Marshal(ev)
+	if err != nil {
+		log.Printf("Event log: %v", err)
+		return
+	}
+
+	if err := os.MkdirAll(stateDir, 0755); err != nil {
+		log.Printf("Event log: %v", err)
+		return
+	}
+	if info, err := os.Stat(eventLogFile); err == nil && info.Size()+int64(len(data)) > eventLogMaxBytes {
+		rotateEventLog()
+	}
+
+	f, err := os.OpenFile(eventLogFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		log.Printf("Event log: %v", err)
+		return
+	}
+	defer f.Close()
+	if _, err := f.Write(append(data, '\n')); err != nil {
+		log.Printf("Event log: %v", err)
+	}
+}
+
+// eventResult fills Result and Error from err.
+func eventResult(ev Event, err error) Event {
+	ev.Result = "success"
+	if err != nil {
+		ev.Result = "failure"
+		ev.Error = err.Error()
+	}
+	return ev
+}
+
+// requestActor names who made a request: the session user, or "token" for bearer access.
+func requestActor(r *http.Request) string {
+	if session, err := store.Get(r, "auth-session"); err == nil {
+		if username, ok := session.Values["username"].(string); ok && username != "" {
+			return "user:" + username
+		}
+	}
+	if strings.HasPrefix(r.Header.Get("Authorization"), "Bearer ") || r.URL.Query().Get("token") != "" {
+		return "token"
+	}
+	return "anonymous"
+}
+
+func (q EventQuery) matches(ev Event) bool {
+	if q.Type != "" && ev.Type != q.Type {
+		return false
+	}
+	if q.Actor != "" && ev.Actor != q.Actor {
+		return false
+	}
+	if q.Result != "" && ev.Result != q.Result {
+		return false
+	}
+	if !q.Since.IsZero() && ev.Time.Before(q.Since) {
+		return false
+	}
+	if !q.Until.IsZero() && ev.Time.After(q.Until) {
+		return false
+	}
+	if q.Before > 0 && ev.ID >= q.Before {
+		return false
+	}
+	return true
+}
+
+// QueryEvents returns matching events newest first.
+func QueryEvents(q EventQuery) EventPage {
+	if q.Limit <= 0 {
+		q.Limit = eventPageDefault
+	}
+	if q.Limit > eventPageMax {
+		q.Limit = eventPageMax
+	}
+
+	eventMu.Lock()
+	defer eventMu.Unlock()
+
+	page := EventPage{Events: []Event{}}
+	for _, path := range eventLogFiles() {
+		events := readEventFile(path)
+		for i := len(events) - 1; i >= 0; i-- {
+			if !q.matches(events[i]) {
+				continue
+			}
+			if len(page.Events) == q.Limit {
+				page.NextBefore = page.Events[len(page.Events)-1].ID
+				return page
+			}
+			page.Events = append(page.Events, events[i])
+		}
+	}
+	return page
+}
+
+// EventsHandler pages and filters the event log.
+// GET /events?type=mode_switch&actor=user:admin&result=failure&since=RFC3339&until=RFC3339&before=<id>&limit=50
+func EventsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	params := r.URL.Query()
+	q := EventQuery{
+		Type:   strings.TrimSpace(params.Get("type")),
+		Actor:  strings.TrimSpace(params.Get("actor")),
+		Result: strings.TrimSpace(params.Get("result")),
+	}
+	for name, dst := range map[string]*time.Time{"since": &q.Since, "until": &q.Until} {
+		if value := params.Get(name); value != "" {
+			t, err := time.Parse(time.RFC3339, value)
+			if err != nil {
+				http.Error(w, "Invalid "+name+" parameter (RFC 3339 expected)", http.StatusBadRequest)
+				return
+			}
+			*dst = t
+		}
+	}
+	if value := params.Get("before"); value != "" {
+		before, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			http.Error(w, "Invalid before parameter", http.StatusBadRequest)
+			return
+		}
+		q.Before = before
+	}
+	if value := params.Get("limit"); value != "" {
+		limit, err := strconv.Atoi(value)
+		if err != nil {
+			http.Error(w, "Invalid limit parameter", http.StatusBadRequest)
+			return
+		}
+		q.Limit = limit
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(QueryEvents(q))
+}
@@ -0,0 +1,276 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"os/exec"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	exitNodeLatencyTTL       = 5 * time.Minute
+	exitNodeProbeConcurrency = 8
+	autoExitNodeInterval     = 10 * time.Minute
+	// autoExitNodeMinGain is the latency improvement required before auto mode
+	// moves off a working node, so similar nodes do not flap.
+	autoExitNodeMinGain = 0.2
+)
+
+type exitNodeLatency struct {
+	Latency time.Duration
+	Err     string
+	Checked time.Time
+}
+
+var (
+	latencyMu    sync.Mutex
+	latencyCache = make(map[string]exitNodeLatency) // keyed by exit node IP
+
+	// autoExitNode is the exitNodes key picked by tailscale:auto modes (guarded by mu).
+	autoExitNode string
+
+	pingLatencyPattern = regexp.MustCompile(` in ([0-9.]+(?:ms|s|us|µs))`)
+)
+
+// probeExitNodeLatency measures round-trip time to an exit node over the tailnet.
+func probeExitNodeLatency(ip string) (time.Duration, error) {
+	out, _ := exec.Command("tailscale", "ping", "--c", "1", "--timeout", "3s", ip).CombinedOutput()
+	if latency, err := parseTailscalePingLatency(string(out)); err == nil {
+		return latency, nil
+	}
+
+	// WireGuard-only peers (Mullvad) do not answer disco pings; try ICMP through the tunnel.
+	out, _ = exec.Command("tailscale", "ping", "--icmp", "--c", "1", "--timeout", "3s", ip).CombinedOutput()
+	return parseTailscalePingLatency(string(out))
+}
+
+// parseTailscalePingLatency reads "pong from host (100.x) via DERP(fra) in 45ms".
+// tailscale ping exits non-zero on DERP-only pongs, so output is parsed regardless.
+func parseTailscalePingLatency(output string) (time.Duration, error) {
+	match := pingLatencyPattern.FindStringSubmatch(output)
+	if match == nil {
+		return 0, fmt.Errorf("no pong: %s", strings.TrimSpace(output))
+	}
+	return time.ParseDuration(strings.Replace(match[1], "µs", "us", 1))
+}
+
+func cachedExitNodeLatency(ip string) (exitNodeLatency, bool) {
+	latencyMu.Lock()
+	defer latencyMu.Unlock()
+	result, ok := latencyCache[ip]
+	return result, ok
+}
+
+// ProbeExitNodeLatencies pings online nodes concurrently and caches the results.
+// Nodes probed within maxAge are skipped.
+func ProbeExitNodeLatencies(nodes map[string]ExitNode, maxAge time.Duration) {
+	sem := make(chan struct{}, exitNodeProbeConcurrency)
+	var wg sync.WaitGroup
+
+	for _, node := range nodes {
+		if !node.Online {
+			continue
+		}
+		if cached, ok := cachedExitNodeLatency(node.IP); ok && time.Since(cached.Checked) < maxAge {
+			continue
+		}
+
+		wg.Add(1)
+		go func(ip string) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+
+			latency, err := probeExitNodeLatency(ip)
+			result := exitNodeLatency{Latency: latency, Checked: time.Now()}
+			if err != nil {
+				result.Err = err.Error()
+			}
+
+			latencyMu.Lock()
+			latencyCache[ip] = result
+			latencyMu.Unlock()
+		}(node.IP)
+	}
+
+	wg.Wait()
+}
+
+// annotateExitNodeLatency copies fresh cached latencies onto nodes.
+func annotateExitNodeLatency(nodes map[string]ExitNode) {
+	latencyMu.Lock()
+	defer latencyMu.Unlock()
+
+	for key, node := range nodes {
+		cached, ok := latencyCache[node.IP]
+		if !ok || cached.Err != "" || time.Since(cached.Checked) > exitNodeLatencyTTL {
+			continue
+		}
+		node.LatencyMs = math.Round(float64(cached.Latency.Microseconds())/100) / 10
+		nodes[key] = node
+	}
+}
+
+// parseAutoExitNodeSpec recognises "auto" and "auto:<country or city>" node names.
+func parseAutoExitNodeSpec(node string) (string, bool) {
+	if node == "auto" {
+		return "", true
+	}
+	if strings.HasPrefix(node, "auto:") {
+		return strings.TrimSpace(strings.TrimPrefix(node, "auto:")), true
+	}
+	return "", false
+}
+
+func autoExitNodeMode(filter string) string {
+	if filter == "" {
+		return "tailscale:auto"
+	}
+	return "tailscale:auto:" + filter
+}
+
+// exitNodeMatchesFilter matches a country or city name or code (de, Germany, ber, Berlin).
+func exitNodeMatchesFilter(node ExitNode, filter string) bool {
+	if filter == "" {
+		return true
+	}
+	for _, value := range []string{node.CountryCode, node.Country, node.CityCode, node.City} {
+		if value != "" && strings.EqualFold(value, filter) {
+			return true
+		}
+	}
+	return false
+}
+
+// selectAutoExitNode probes online nodes matching filter and returns them with
+// the key of the lowest-latency one.
+func selectAutoExitNode(filter string, maxAge time.Duration) (map[string]ExitNode, string, error) {
+	nodes, err := GetExitNodes()
+	if err != nil {
+		return nil, "", err
+	}
+
+	candidates := make(map[string]ExitNode)
+	for key, node := range nodes {
+		if node.Online && exitNodeMatchesFilter(node, filter) {
+			candidates[key] = node
+		}
+	}
+	if len(candidates) == 0 {
+		return nil, "", fmt.Errorf("no online exit node matches %q", filter)
+	}
+
+	ProbeExitNodeLatencies(candidates, maxAge)
+	annotateExitNodeLatency(candidates)
+
+	best := ""
+	for key, node := range candidates {
+		if node.LatencyMs == 0 {
+			continue
+		}
+		if best == "" || node.LatencyMs < candidates[best].LatencyMs {
+			best = key
+		}
+	}
+	if best == "" {
+		return candidates, "", fmt.Errorf("no exit node matching %q answered latency probes", filter)
+	}
+	return candidates, best, nil
+}
+
+// SetAutoExitNode switches to the lowest-latency online node matching filter.
+func SetAutoExitNode(filter string) error {
+	candidates, best, err := selectAutoExitNode(filter, exitNodeLatencyTTL)
+	if err != nil {
+		recordModeSwitch(autoExitNodeMode(filter), err)
+		return err
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	if GetRouterConfig().AdvertiseExitNode {
+		return fmt.Errorf("this router is advertised as an exit node; disable that before using another exit node")
+	}
+	if err := applyExitNodeRouting(candidates[best], autoExitNodeMode(filter)); err != nil {
+		return err
+	}
+	autoExitNode = best
+	log.Printf("Auto exit node: selected %s (%.1f ms)", best, candidates[best].LatencyMs)
+	return nil
+}
+
+// reevaluateAutoExitNode moves to a clearly faster node, or off a node that went offline.
+func reevaluateAutoExitNode(filter string) {
+	mode := autoExitNodeMode(filter)
+	candidates, best, err := selectAutoExitNode(filter, autoExitNodeInterval/2)
+	if err != nil {
+		log.Printf("Auto exit node re-evaluation: %v", err)
+		return
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	if CurrentMode != mode || best == autoExitNode {
+		return
+	}
+	current, ok := candidates[autoExitNode]
+	if ok && current.LatencyMs > 0 &&
+		candidates[best].LatencyMs > current.LatencyMs*(1-autoExitNodeMinGain) {
+		return
+	}
+	failover := !ok || current.LatencyMs == 0
+
+	log.Printf("Auto exit node: switching %s -> %s (%.1f ms)", autoExitNode, best, candidates[best].LatencyMs)
+	if err := applyExitNodeRouting(candidates[best], mode); err != nil {
+		log.Printf("Auto exit node switch failed: %v", err)
+		return
+	}
+	if failover {
+		Notify(NotifyFailover, "warning", best, "Exit node failover",
+			fmt.Sprintf("Auto mode moved from unreachable node %s to %s.", autoExitNode, candidates[best].Name))
+	}
+	autoExitNode = best
+}
+
+// RunAutoExitNodeLoop periodically re-selects the best node while an auto mode is active.
+func RunAutoExitNodeLoop() {
+	for {
+		time.Sleep(autoExitNodeInterval)
+		mu.Lock()
+		mode := CurrentMode
+		mu.Unlock()
+		if !strings.HasPrefix(mode, "tailscale:") {
+			continue
+		}
+		if filter, ok := parseAutoExitNodeSpec(strings.TrimPrefix(mode, "tailscale:")); ok {
+			reevaluateAutoExitNode(filter)
+		}
+	}
+}
+
+// ExitNodeLatencyHandler probes every online exit node and returns the results.
+func ExitNodeLatencyHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	nodes, err := GetExitNodes()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	ProbeExitNodeLatencies(nodes, 0)
+	annotateExitNodeLatency(nodes)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(nodes)
+}
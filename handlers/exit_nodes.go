@@ -0,0 +1,259 @@
+package handlers
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// legacyFriendlyNamesFile held DNS name -> label pairs before names moved to config.json.
+const legacyFriendlyNamesFile = "./templates/friendly-names.json"
+
+// ExitNodeQuery filters the exit node list. Empty fields match everything.
+type ExitNodeQuery struct {
+	Provider     string
+	Country      string
+	City         string
+	Search       string
+	OnlineOnly   bool
+	FavoriteOnly bool
+}
+
+// ExitNodeGroup is a labelled set of exit nodes (by provider, country, or city).
+type ExitNodeGroup struct {
+	Key   string     `json:"key"`
+	Label string     `json:"label"`
+	Nodes []ExitNode `json:"nodes"`
+}
+
+func (q ExitNodeQuery) matches(node ExitNode) bool {
+	if q.OnlineOnly && !node.Online {
+		return false
+	}
+	if q.FavoriteOnly && !node.Favorite {
+		return false
+	}
+	if q.Provider != "" && !strings.EqualFold(node.Provider, q.Provider) {
+		return false
+	}
+	if q.Country != "" && !strings.EqualFold(node.CountryCode, q.Country) && !strings.EqualFold(node.Country, q.Country) {
+		return false
+	}
+	if q.City != "" && !strings.EqualFold(node.CityCode, q.City) && !strings.EqualFold(node.City, q.City) {
+		return false
+	}
+	if q.Search != "" {
+		haystack := strings.ToLower(strings.Join([]string{node.Name, node.Hostname, node.DNSName, node.Country, node.City}, " "))
+		if !strings.Contains(haystack, strings.ToLower(q.Search)) {
+			return false
+		}
+	}
+	return true
+}
+
+// FilterExitNodes returns matching nodes ordered favorites first, then private
+// nodes, then by Tailscale priority and name.
+func FilterExitNodes(nodes map[string]ExitNode, query ExitNodeQuery) []ExitNode {
+	result := make([]ExitNode, 0, len(nodes))
+	for _, node := range nodes {
+		if query.matches(node) {
+			result = append(result, node)
+		}
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		a, b := result[i], result[j]
+		if a.Favorite != b.Favorite {
+			return a.Favorite
+		}
+		if a.Provider != b.Provider {
+			return a.Provider == exitNodeProviderPrivate
+		}
+		if a.Priority != b.Priority {
+			return a.Priority > b.Priority
+		}
+		return strings.ToLower(a.Name) < strings.ToLower(b.Name)
+	})
+	return result
+}
+
+// GroupExitNodes splits an ordered node list by "provider", "country" or "city",
+// keeping the order in which groups first appear.
+func GroupExitNodes(nodes []ExitNode, by string) []ExitNodeGroup {
+	var groups []ExitNodeGroup
+	index := make(map[string]int)
+
+	for _, node := range nodes {
+		key, label := node.Provider, node.Provider
+		switch by {
+		case "country":
+			key, label = node.CountryCode, node.Country
+		case "city":
+			key, label = node.CountryCode+"-"+node.CityCode, node.City
+		}
+		if key == "" || key == "-" {
+			key, label = node.Provider, node.Provider
+		}
+
+		i, ok := index[key]
+		if !ok {
+			i = len(groups)
+			index[key] = i
+			groups = append(groups, ExitNodeGroup{Key: key, Label: label})
+		}
+		groups[i].Nodes = append(groups[i].Nodes, node)
+	}
+	return groups
+}
+
+func exitNodeQueryFromRequest(r *http.Request) ExitNodeQuery {
+	q := r.URL.Query()
+	online, _ := strconv.ParseBool(q.Get("online"))
+	favorite, _ := strconv.ParseBool(q.Get("favorite"))
+	return ExitNodeQuery{
+		Provider:     strings.TrimSpace(q.Get("provider")),
+		Country:      strings.TrimSpace(q.Get("country")),
+		City:         strings.TrimSpace(q.Get("city")),
+		Search:       strings.TrimSpace(q.Get("q")),
+		OnlineOnly:   online,
+		FavoriteOnly: favorite,
+	}
+}
+
+// ExitNodesHandler lists exit nodes with optional filtering and grouping.
+// GET /exit-nodes?provider=mullvad&country=de&city=ber&online=1&favorite=1&q=text&group=country
+func ExitNodesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	nodes, err := GetExitNodes()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	list := FilterExitNodes(nodes, exitNodeQueryFromRequest(r))
+
+	w.Header().Set("Content-Type", "application/json")
+	if by := r.URL.Query().Get("group"); by != "" {
+		json.NewEncoder(w).Encode(GroupExitNodes(list, by))
+		return
+	}
+	json.NewEncoder(w).Encode(list)
+}
+
+// ExitNodeNameHandler sets (or clears, with an empty name) a node's friendly name.
+func ExitNodeNameHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	id := strings.TrimSpace(r.URL.Query().Get("id"))
+	if id == "" {
+		http.Error(w, "Missing id parameter", http.StatusBadRequest)
+		return
+	}
+	name := strings.TrimSpace(r.URL.Query().Get("name"))
+
+	cfg := GetRouterConfig()
+	names := make(map[string]string, len(cfg.ExitNodeNames)+1)
+	for k, v := range cfg.ExitNodeNames {
+		names[k] = v
+	}
+	if name == "" {
+		delete(names, id)
+	} else {
+		names[id] = name
+	}
+	cfg.ExitNodeNames = names
+
+	if err := SaveRouterConfig(cfg); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// ExitNodeFavoriteHandler adds or removes a node from the favorites list.
+func ExitNodeFavoriteHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	id := strings.TrimSpace(r.URL.Query().Get("id"))
+	if id == "" {
+		http.Error(w, "Missing id parameter", http.StatusBadRequest)
+		return
+	}
+	favorite, err := strconv.ParseBool(r.URL.Query().Get("favorite"))
+	if err != nil {
+		http.Error(w, "Invalid favorite parameter", http.StatusBadRequest)
+		return
+	}
+
+	cfg := GetRouterConfig()
+	var favorites []string
+	for _, existing := range cfg.FavoriteExitNodes {
+		if existing != id {
+			favorites = append(favorites, existing)
+		}
+	}
+	if favorite {
+		favorites = append(favorites, id)
+	}
+	cfg.FavoriteExitNodes = favorites
+
+	if err := SaveRouterConfig(cfg); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// migrateLegacyFriendlyNames imports friendly-names.json into config.json, keyed by
+// stable node ID. The old file is renamed so the import runs once.
+func migrateLegacyFriendlyNames(nodes map[string]ExitNode) {
+	data, err := os.ReadFile(legacyFriendlyNamesFile)
+	if err != nil {
+		return
+	}
+	var legacy map[string]string
+	if err := json.Unmarshal(data, &legacy); err != nil {
+		log.Printf("Ignoring unreadable %s: %v", legacyFriendlyNamesFile, err)
+		return
+	}
+
+	cfg := GetRouterConfig()
+	names := make(map[string]string, len(cfg.ExitNodeNames)+len(legacy))
+	for k, v := range cfg.ExitNodeNames {
+		names[k] = v
+	}
+
+	imported := 0
+	for ref, label := range legacy {
+		node, ok := findExitNode(nodes, ref)
+		if !ok || names[node.ID] != "" {
+			continue
+		}
+		names[node.ID] = label
+		imported++
+	}
+
+	if imported > 0 {
+		cfg.ExitNodeNames = names
+		if err := SaveRouterConfig(cfg); err != nil {
+			log.Printf("Friendly name import failed: %v", err)
+			return
+		}
+	}
+	log.Printf("Imported %d friendly names from %s", imported, legacyFriendlyNamesFile)
+	_ = os.Rename(legacyFriendlyNamesFile, legacyFriendlyNamesFile+".migrated")
+}
@@ -0,0 +1,479 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// routerPolicyChain holds the user's ordered rules. TS-ROUTER-GUARD jumps to it
+	// first, so a drop here wins over tailscaled's rules and every mode, forward
+	// and segment rule.
+	routerPolicyChain = "TS-ROUTER-POLICY"
+
+	FirewallActionAllow  = "allow"
+	FirewallActionDrop   = "drop"
+	FirewallActionReject = "reject"
+
+	firewallCommentPrefix = "tsr-fw:"
+	maxFirewallRules      = 100
+	firewallCheckInterval = 30 * time.Second
+)
+
+var (
+	firewallNamePattern    = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9 ._-]{0,39}$`)
+	firewallTimePattern    = regexp.MustCompile(`^([01][0-9]|2[0-3]):[0-5][0-9]$`)
+	firewallCommentPattern = regexp.MustCompile(`/\* ` + firewallCommentPrefix + `(.*?) \*/`)
+	firewallWeekdays       = map[string]time.Weekday{
+		"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+		"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+	}
+)
+
+// FirewallSchedule limits a rule to a daily window, evaluated in the schedule timezone.
+// An End before Start runs past midnight; no Days means every day.
+type FirewallSchedule struct {
+	Days  []string `json:"days,omitempty"` // mon, tue, ...
+	Start string   `json:"start"`          // HH:MM
+	End   string   `json:"end"`            // HH:MM
+}
+
+// FirewallRule matches new forwarded connections. Rules are evaluated in order and
+// the first match decides: allow hands the connection on to the mode's rules,
+// drop and reject stop it.
+type FirewallRule struct {
+	Name        string            `json:"name"`
+	Source      string            `json:"source,omitempty"`      // client IP, CIDR or MAC; empty = any
+	Destination string            `json:"destination,omitempty"` // IP or CIDR; empty = any
+	Protocol    string            `json:"protocol,omitempty"`    // any, tcp, udp or icmp
+	Ports       string            `json:"ports,omitempty"`       // "25", "80,443", "8000-8100"
+	Action      string            `json:"action"`
+	Schedule    *FirewallSchedule `json:"schedule,omitempty"`
+	Disabled    bool              `json:"disabled,omitempty"`
+}
+
+// FirewallRuleStatus adds live state to a rule for GET /firewall.
+type FirewallRuleStatus struct {
+	FirewallRule
+	Active  bool   `json:"active"` // enabled and inside its schedule
+	Packets uint64 `json:"packets"`
+	Bytes   uint64 `json:"bytes"`
+}
+
+type firewallCounter struct {
+	packets, bytes uint64
+}
+
+var (
+	firewallMu sync.Mutex
+	// firewallBase carries counters across chain rebuilds, keyed by rule name.
+	firewallBase   = make(map[string]firewallCounter)
+	firewallActive string // names of the active rules when the chain was last built
+)
+
+func normalizeFirewallRule(rule FirewallRule) FirewallRule {
+	rule.Name = strings.TrimSpace(rule.Name)
+	rule.Source = strings.ToLower(strings.TrimSpace(rule.Source))
+	rule.Destination = strings.TrimSpace(rule.Destination)
+	rule.Protocol = strings.ToLower(strings.TrimSpace(rule.Protocol))
+	if rule.Protocol == "" {
+		rule.Protocol = "any"
+	}
+	rule.Ports = strings.ReplaceAll(strings.TrimSpace(rule.Ports), " ", "")
+	rule.Action = strings.ToLower(strings.TrimSpace(rule.Action))
+	if rule.Schedule != nil {
+		for i, day := range rule.Schedule.Days {
+			rule.Schedule.Days[i] = strings.ToLower(strings.TrimSpace(day))
+		}
+	}
+	return rule
+}
+
+// firewallPorts turns "80,443,8000-8100" into the multiport form "80,443,8000:8100".
+func firewallPorts(spec string) (string, error) {
+	var parts []string
+	for _, item := range strings.Split(spec, ",") {
+		r, err := parsePortRange(item)
+		if err != nil {
+			return "", err
+		}
+		if r.lo == r.hi {
+			parts = append(parts, strconv.Itoa(r.lo))
+		} else {
+			parts = append(parts, fmt.Sprintf("%d:%d", r.lo, r.hi))
+		}
+	}
+	// multiport takes at most 15 ports, a range counting as two.
+	count := 0
+	for _, p := range parts {
+		count++
+		if strings.Contains(p, ":") {
+			count++
+		}
+	}
+	if count > 15 {
+		return "", fmt.Errorf("too many ports in %q (max 15, a range counts as 2)", spec)
+	}
+	return strings.Join(parts, ","), nil
+}
+
+func firewallSourceArgs(source string) ([]string, error) {
+	if source == "" {
+		return nil, nil
+	}
+	if _, err := net.ParseMAC(source); err == nil {
+		return []string{"-m", "mac", "--mac-source", source}, nil
+	}
+	cidr, err := normalizeSplitTunnelCIDR(source)
+	if err != nil {
+		return nil, fmt.Errorf("source must be an IP, CIDR or MAC address")
+	}
+	return []string{"-s", cidr}, nil
+}
+
+func validateFirewallRules(cfg RouterConfig, rules []FirewallRule) error {
+	if len(rules) > maxFirewallRules {
+		return fmt.Errorf("at most %d rules are supported", maxFirewallRules)
+	}
+	names := make(map[string]bool)
+	for _, rule := range rules {
+		if !firewallNamePattern.MatchString(rule.Name) {
+			return fmt.Errorf("rule name %q must be 1-40 letters, digits, spaces, dots, dashes or underscores", rule.Name)
+		}
+		if names[strings.ToLower(rule.Name)] {
+			return fmt.Errorf("rule %s listed twice", rule.Name)
+		}
+		names[strings.ToLower(rule.Name)] = true
+
+		if _, err := firewallSourceArgs(rule.Source); err != nil {
+			return fmt.Errorf("rule %s: %v", rule.Name, err)
+		}
+		if rule.Destination != "" {
+			if _, err := normalizeSplitTunnelCIDR(rule.Destination); err != nil {
+				return fmt.Errorf("rule %s: destination: %v", rule.Name, err)
+			}
+		}
+		switch rule.Protocol {
+		case "any", "tcp", "udp":
+		case "icmp":
+			if rule.Ports != "" {
+				return fmt.Errorf("rule %s: ports need protocol tcp, udp or any", rule.Name)
+			}
+		default:
+			return fmt.Errorf("rule %s: protocol must be any, tcp, udp or icmp", rule.Name)
+		}
+		if rule.Ports != "" {
+			if _, err := firewallPorts(rule.Ports); err != nil {
+				return fmt.Errorf("rule %s: %v", rule.Name, err)
+			}
+		}
+		if rule.Action != FirewallActionAllow && rule.Action != FirewallActionDrop && rule.Action != FirewallActionReject {
+			return fmt.Errorf("rule %s: action must be allow, drop or reject", rule.Name)
+		}
+
+		if s := rule.Schedule; s != nil {
+			if !firewallTimePattern.MatchString(s.Start) || !firewallTimePattern.MatchString(s.End) {
+				return fmt.Errorf("rule %s: schedule start and end must be HH:MM", rule.Name)
+			}
+			if s.Start == s.End {
+				return fmt.Errorf("rule %s: schedule start and end must differ", rule.Name)
+			}
+			for _, day := range s.Days {
+				if _, ok := firewallWeekdays[day]; !ok {
+					return fmt.Errorf("rule %s: unknown day %q (use mon, tue, ...)", rule.Name, day)
+				}
+			}
+		}
+	}
+	if _, err := scheduleLocation(cfg, ScheduleRule{}); err != nil {
+		return fmt.Errorf("schedule timezone: %v", err)
+	}
+	return nil
+}
+
+func minutesOfDay(hhmm string) int {
+	h, _ := strconv.Atoi(hhmm[:2])
+	m, _ := strconv.Atoi(hhmm[3:])
+	return h*60 + m
+}
+
+// firewallRuleActive reports whether rule applies at t (already in the schedule timezone).
+func firewallRuleActive(rule FirewallRule, t time.Time) bool {
+	if rule.Disabled {
+		return false
+	}
+	s := rule.Schedule
+	if s == nil {
+		return true
+	}
+	start, end := minutesOfDay(s.Start), minutesOfDay(s.End)
+	now := t.Hour()*60 + t.Minute()
+	day := t.Weekday()
+	inWindow := now >= start && now < end
+	if end < start {
+		// Past midnight: the early part belongs to the window that began yesterday.
+		if now >= start {
+			inWindow = true
+		} else if now < end {
+			inWindow = true
+			day = (day + 6) % 7
+		}
+	}
+	if !inWindow {
+		return false
+	}
+	if len(s.Days) == 0 {
+		return true
+	}
+	for _, name := range s.Days {
+		if firewallWeekdays[name] == day {
+			return true
+		}
+	}
+	return false
+}
+
+func activeFirewallRules(cfg RouterConfig, now time.Time) []FirewallRule {
+	loc, err := scheduleLocation(cfg, ScheduleRule{})
+	if err != nil {
+		loc = time.Local
+	}
+	local := now.In(loc)
+	var active []FirewallRule
+	for _, rule := range cfg.FirewallRules {
+		if firewallRuleActive(rule, local) {
+			active = append(active, rule)
+		}
+	}
+	return active
+}
+
+// firewallRuleArgs renders one rule into iptables match+target arguments; "any"
+// with ports becomes a tcp and a udp line.
+func firewallRuleArgs(rule FirewallRule) [][]string {
+	base := []string{"-m", "comment", "--comment", firewallCommentPrefix + rule.Name}
+	source, _ := firewallSourceArgs(rule.Source)
+	base = append(base, source...)
+	if rule.Destination != "" {
+		dst, _ := normalizeSplitTunnelCIDR(rule.Destination)
+		base = append(base, "-d", dst)
+	}
+
+	var target []string
+	switch rule.Action {
+	case FirewallActionAllow:
+		target = []string{"-j", "RETURN"}
+	case FirewallActionReject:
+		target = []string{"-j", "REJECT"}
+	default:
+		target = []string{"-j", "DROP"}
+	}
+
+	protocols := []string{rule.Protocol}
+	if rule.Protocol == "any" {
+		protocols = []string{""}
+		if rule.Ports != "" {
+			protocols = []string{"tcp", "udp"}
+		}
+	}
+
+	var lines [][]string
+	for _, proto := range protocols {
+		args := append([]string(nil), base...)
+		if proto != "" {
+			args = append(args, "-p", proto)
+		}
+		if rule.Ports != "" {
+			ports, _ := firewallPorts(rule.Ports)
+			args = append(args, "-m", "multiport", "--dports", ports)
+		}
+		if proto == "tcp" && rule.Action == FirewallActionReject {
+			lines = append(lines, append(args, "-j", "REJECT", "--reject-with", "tcp-reset"))
+			continue
+		}
+		lines = append(lines, append(args, target...))
+	}
+	return lines
+}
+
+// readFirewallCounters sums the chain's packet and byte counters per rule name.
+func readFirewallCounters() map[string]firewallCounter {
+	counters := make(map[string]firewallCounter)
+	out, err := exec.Command("iptables", "-L", routerPolicyChain, "-v", "-x", "-n").Output()
+	if err != nil {
+		return counters
+	}
+	for _, line := range strings.Split(string(out), "\n") {
+		m := firewallCommentPattern.FindStringSubmatch(line)
+		fields := strings.Fields(line)
+		if m == nil || len(fields) < 2 {
+			continue
+		}
+		packets, err1 := strconv.ParseUint(fields[0], 10, 64)
+		bytes, err2 := strconv.ParseUint(fields[1], 10, 64)
+		if err1 != nil || err2 != nil {
+			continue
+		}
+		c := counters[m[1]]
+		c.packets += packets
+		c.bytes += bytes
+		counters[m[1]] = c
+	}
+	return counters
+}
+
+func ensureFirewallPolicyChain() {
+	exec.Command("iptables", "-N", routerPolicyChain).Run()
+}
+
+// rebuildFirewallPolicy renders the active rules into TS-ROUTER-POLICY, keeping
+// counters of rules that survive the rebuild.
+func rebuildFirewallPolicy(cfg RouterConfig, now time.Time) {
+	active := activeFirewallRules(cfg, now)
+	var names []string
+	for _, rule := range active {
+		names = append(names, rule.Name)
+	}
+
+	firewallMu.Lock()
+	defer firewallMu.Unlock()
+
+	ensureFirewallPolicyChain()
+	// Rules that are only paused by their schedule keep their history; deleted ones drop it.
+	current := readFirewallCounters()
+	kept := make(map[string]firewallCounter)
+	for _, rule := range cfg.FirewallRules {
+		base, c := firewallBase[rule.Name], current[rule.Name]
+		kept[rule.Name] = firewallCounter{base.packets + c.packets, base.bytes + c.bytes}
+	}
+	firewallBase = kept
+
+	exec.Command("iptables", "-F", routerPolicyChain).Run()
+	// Only new connections are judged; replies of allowed ones always pass.
+	appendPortForwardChainRule("filter", routerPolicyChain, "-m", "conntrack", "--ctstate", "RELATED,ESTABLISHED", "-j", "RETURN")
+	for _, rule := range active {
+		for _, args := range firewallRuleArgs(rule) {
+			appendPortForwardChainRule("filter", routerPolicyChain, args...)
+		}
+	}
+	firewallActive = strings.Join(names, "\x00")
+
+	cutBlockedHostConnections(active)
+}
+
+// cutBlockedHostConnections drops the conntrack entries of single hosts that the
+// rules block outright. The policy only judges new connections, so this ends the
+// ones opened before the block, or while ts-forward sat above TS-ROUTER-GUARD.
+func cutBlockedHostConnections(rules []FirewallRule) {
+	for _, rule := range rules {
+		if rule.Action == FirewallActionAllow || rule.Source == "" || rule.Destination != "" || rule.Ports != "" || rule.Protocol != "any" {
+			continue
+		}
+		if ip := net.ParseIP(rule.Source); ip != nil {
+			exec.Command("conntrack", "-D", "-s", ip.String()).Run()
+		}
+	}
+}
+
+// appendFirewallPolicyJump is called by flushRouterIPTablesRules before anything else
+// lands in TS-ROUTER-GUARD, so the policy also sees traffic leaving through an exit node.
+func appendFirewallPolicyJump() {
+	ensureFirewallPolicyChain()
+	appendRouterGuardRule("-j", routerPolicyChain)
+}
+
+// EnsureFirewallPolicy renders the policy at startup.
+func EnsureFirewallPolicy() {
+	rebuildFirewallPolicy(GetRouterConfig(), time.Now())
+}
+
+// RunFirewallSchedule rebuilds the chain whenever a scheduled rule starts or stops.
+func RunFirewallSchedule() {
+	ticker := time.NewTicker(firewallCheckInterval)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		cfg := GetRouterConfig()
+		var names []string
+		for _, rule := range activeFirewallRules(cfg, now) {
+			names = append(names, rule.Name)
+		}
+		firewallMu.Lock()
+		changed := strings.Join(names, "\x00") != firewallActive
+		firewallMu.Unlock()
+		if changed {
+			log.Printf("Firewall schedule changed the active rules: %s", strings.Join(names, ", "))
+			rebuildFirewallPolicy(cfg, now)
+		}
+	}
+}
+
+func GetFirewallStatus() []FirewallRuleStatus {
+	cfg := GetRouterConfig()
+	activeNames := make(map[string]bool)
+	for _, rule := range activeFirewallRules(cfg, time.Now()) {
+		activeNames[rule.Name] = true
+	}
+
+	firewallMu.Lock()
+	current := readFirewallCounters()
+	base := firewallBase
+	firewallMu.Unlock()
+
+	result := []FirewallRuleStatus{}
+	for _, rule := range cfg.FirewallRules {
+		status := FirewallRuleStatus{FirewallRule: rule, Active: activeNames[rule.Name]}
+		status.Packets = base[rule.Name].packets + current[rule.Name].packets
+		status.Bytes = base[rule.Name].bytes + current[rule.Name].bytes
+		result = append(result, status)
+	}
+	return result
+}
+
+// FirewallHandler reads or replaces the ordered forward policy.
+// POST /firewall {"rules": [{"name": "no smtp", "protocol": "tcp", "ports": "25", "action": "reject"}, {"name": "bedtime", "source": "aa:bb:cc:dd:ee:ff", "action": "drop", "schedule": {"start": "22:00", "end": "07:00"}}]}
+func FirewallHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		var req struct {
+			Rules []FirewallRule `json:"rules"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "invalid JSON body", http.StatusBadRequest)
+			return
+		}
+		for i := range req.Rules {
+			req.Rules[i] = normalizeFirewallRule(req.Rules[i])
+			if req.Rules[i].Name == "" {
+				req.Rules[i].Name = fmt.Sprintf("rule-%d", i+1)
+			}
+		}
+
+		cfg := GetRouterConfig()
+		if err := validateFirewallRules(cfg, req.Rules); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		cfg.FirewallRules = req.Rules
+		if err := SaveRouterConfig(cfg); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		rebuildFirewallPolicy(cfg, time.Now())
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"rules": GetFirewallStatus()})
+}
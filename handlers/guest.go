@@ -0,0 +1,562 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// routerCaptiveChain (filter) lets accepted guest MACs through and drops the rest.
+	routerCaptiveChain = "TS-ROUTER-CAPTIVE"
+	// routerPortalChain (nat PREROUTING) sends web requests of unaccepted guests to the portal.
+	routerPortalChain = "TS-ROUTER-PORTAL"
+	// routerInputChain (filter INPUT) limits what guests may reach on the router itself.
+	routerInputChain = "TS-ROUTER-IN"
+
+	guestPortalPort          = 5001
+	guestSessionsFile        = stateDir + "/guest_sessions.json"
+	defaultGuestSessionHours = 24
+	defaultGuestPortalTitle  = "Guest Wi-Fi"
+	defaultGuestTerms        = "By continuing you agree to use this network lawfully and accept that access may be logged, limited or revoked at any time."
+
+	// EventGuestAccept is recorded when a guest device accepts the terms page.
+	EventGuestAccept = "guest_accept"
+)
+
+// GuestPortalConfig is the splash page shown to guest segments.
+type GuestPortalConfig struct {
+	Title        string `json:"title"`
+	Terms        string `json:"terms"`
+	SessionHours int    `json:"session_hours"`
+}
+
+// GuestSession records one device that accepted the terms.
+type GuestSession struct {
+	MAC        string    `json:"mac"`
+	IP         string    `json:"ip"`
+	Segment    string    `json:"segment"`
+	AcceptedAt time.Time `json:"accepted_at"`
+	ExpiresAt  time.Time `json:"expires_at"`
+}
+
+// GuestStatus is returned by GET /guest.
+type GuestStatus struct {
+	Portal     GuestPortalConfig `json:"portal"`
+	PortalPort int               `json:"portal_port"`
+	Segments   []string          `json:"segments"`
+	Sessions   []GuestSession    `json:"sessions"`
+}
+
+var (
+	guestMu       sync.Mutex
+	guestSessions map[string]GuestSession // by lower-case MAC; nil until loaded
+	guestShaped   = make(map[string]bool)
+	guestPortals  = make(map[string]*http.Server) // by segment address, under guestMu
+)
+
+func normalizeGuestPortal(p GuestPortalConfig) GuestPortalConfig {
+	p.Title = strings.TrimSpace(p.Title)
+	if p.Title == "" {
+		p.Title = defaultGuestPortalTitle
+	}
+	p.Terms = strings.TrimSpace(p.Terms)
+	if p.Terms == "" {
+		p.Terms = defaultGuestTerms
+	}
+	if p.SessionHours <= 0 {
+		p.SessionHours = defaultGuestSessionHours
+	}
+	return p
+}
+
+func guestSegments(cfg RouterConfig) []LANSegment {
+	var result []LANSegment
+	for _, s := range LANSegments(cfg) {
+		if s.Guest {
+			result = append(result, s)
+		}
+	}
+	return result
+}
+
+func guestSegmentForIP(cfg RouterConfig, ip string) (LANSegment, bool) {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return LANSegment{}, false
+	}
+	for _, s := range guestSegments(cfg) {
+		if _, network, err := net.ParseCIDR(s.CIDR()); err == nil && network.Contains(parsed) {
+			return s, true
+		}
+	}
+	return LANSegment{}, false
+}
+
+// neighborMAC looks up a LAN client's MAC in the kernel neighbour table.
+func neighborMAC(ip string) string {
+	out, err := exec.Command("ip", "neigh", "show", ip).Output()
+	if err != nil {
+		return ""
+	}
+	fields := strings.Fields(string(out))
+	for i := 0; i+1 < len(fields); i++ {
+		if fields[i] == "lladdr" {
+			return strings.ToLower(fields[i+1])
+		}
+	}
+	return ""
+}
+
+// loadGuestSessionsLocked reads the accepted MACs once. Caller holds guestMu.
+func loadGuestSessionsLocked() {
+	if guestSessions != nil {
+		return
+	}
+	guestSessions = make(map[string]GuestSession)
+	data, err := os.ReadFile(guestSessionsFile)
+	if err != nil {
+		return
+	}
+	var list []GuestSession
+	if err := json.Unmarshal(data, &list); err != nil {
+		log.Printf("Ignoring unreadable %s: %v", guestSessionsFile, err)
+		return
+	}
+	for _, s := range list {
+		guestSessions[s.MAC] = s
+	}
+}
+
+// saveGuestSessionsLocked writes atomically. Caller holds guestMu.
+func saveGuestSessionsLocked() error {
+	if err := os.MkdirAll(stateDir, 0755); err != nil {
+		return err
+	}
+	data, err := json.Marshal(sortedGuestSessionsLocked())
+	if err != nil {
+		return err
+	}
+	tmp := guestSessionsFile + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, guestSessionsFile)
+}
+
+func sortedGuestSessionsLocked() []GuestSession {
+	list := make([]GuestSession, 0, len(guestSessions))
+	for _, s := range guestSessions {
+		list = append(list, s)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].AcceptedAt.After(list[j].AcceptedAt) })
+	return list
+}
+
+// pruneGuestSessionsLocked drops expired sessions and reports whether any were removed.
+func pruneGuestSessionsLocked(now time.Time) bool {
+	changed := false
+	for mac, s := range guestSessions {
+		if !now.Before(s.ExpiresAt) {
+			delete(guestSessions, mac)
+			changed = true
+		}
+	}
+	return changed
+}
+
+func ensureGuestChains() {
+	exec.Command("iptables", "-N", routerCaptiveChain).Run()
+	exec.Command("iptables", "-N", routerInputChain).Run()
+	exec.Command("iptables", "-t", "nat", "-N", routerPortalChain).Run()
+
+	if exec.Command("iptables", "-C", "INPUT", "-j", routerInputChain).Run() != nil {
+		exec.Command("iptables", "-I", "INPUT", "1", "-j", routerInputChain).Run()
+	}
+	if exec.Command("iptables", "-t", "nat", "-C", "PREROUTING", "-j", routerPortalChain).Run() != nil {
+		exec.Command("iptables", "-t", "nat", "-I", "PREROUTING", "1", "-j", routerPortalChain).Run()
+	}
+}
+
+func appendGuestChainRule(table, chain string, args ...string) {
+	cmdArgs := append([]string{"-t", table, "-A", chain}, args...)
+	if out, err := exec.Command("iptables", cmdArgs...).CombinedOutput(); err != nil {
+		log.Printf("iptables %s rule failed: %v: %s", chain, err, strings.TrimSpace(string(out)))
+	}
+}
+
+// rebuildGuestChains renders the captive, portal and input chains from the
+// guest segments and the accepted MACs. These chains are not touched by mode switches.
+func rebuildGuestChains(cfg RouterConfig) {
+	guestMu.Lock()
+	loadGuestSessionsLocked()
+	sessions := sortedGuestSessionsLocked()
+	guestMu.Unlock()
+
+	ensureGuestChains()
+	exec.Command("iptables", "-F", routerCaptiveChain).Run()
+	exec.Command("iptables", "-F", routerInputChain).Run()
+	exec.Command("iptables", "-t", "nat", "-F", routerPortalChain).Run()
+
+	segments := guestSegments(cfg)
+	if len(segments) == 0 {
+		return
+	}
+
+	for _, s := range sessions {
+		appendGuestChainRule("filter", routerCaptiveChain, "-m", "mac", "--mac-source", s.MAC, "-j", "RETURN")
+		appendGuestChainRule("nat", routerPortalChain, "-m", "mac", "--mac-source", s.MAC, "-j", "RETURN")
+	}
+	appendGuestChainRule("filter", routerCaptiveChain, "-j", "DROP")
+
+	port := strconv.Itoa(guestPortalPort)
+	for _, s := range segments {
+		device := s.Device()
+		appendGuestChainRule("nat", routerPortalChain, "-i", device, "-p", "tcp", "--dport", "80",
+			"-j", "DNAT", "--to-destination", s.Address+":"+port)
+
+		// DHCP, DNS, ping and the portal only; the dashboard on :5000 stays out of reach.
+		appendGuestChainRule("filter", routerInputChain, "-i", device, "-m", "state", "--state", "RELATED,ESTABLISHED", "-j", "ACCEPT")
+		appendGuestChainRule("filter", routerInputChain, "-i", device, "-p", "udp", "--dport", "67", "-j", "ACCEPT")
+		appendGuestChainRule("filter", routerInputChain, "-i", device, "-p", "udp", "--dport", "53", "-j", "ACCEPT")
+		appendGuestChainRule("filter", routerInputChain, "-i", device, "-p", "tcp", "--dport", "53", "-j", "ACCEPT")
+		appendGuestChainRule("filter", routerInputChain, "-i", device, "-p", "tcp", "--dport", port, "-j", "ACCEPT")
+		appendGuestChainRule("filter", routerInputChain, "-i", device, "-p", "icmp", "-j", "ACCEPT")
+		appendGuestChainRule("filter", routerInputChain, "-i", device, "-j", "DROP")
+	}
+}
+
+// appendGuestForwardRules runs first in appendLANSegmentRules: unaccepted devices
+// go nowhere, and guests never reach tailnet addresses or each other through the router.
+// The rules live in TS-ROUTER-GUARD so they also hold while an exit node is active.
+func appendGuestForwardRules(s LANSegment) {
+	ensureGuestChains()
+	device := s.Device()
+	appendRouterGuardRule("-i", device, "-j", routerCaptiveChain)
+	appendRouterGuardRule("-i", device, "-d", tailnetCIDR, "-j", "DROP")
+	appendRouterGuardRule("-i", device, "-o", device, "-j", "DROP")
+}
+
+// applyGuestShaping caps a guest segment: HTB + fq_codel on egress (download) and
+// an ingress policer (upload).
+func applyGuestShaping(s LANSegment) {
+	device := s.Device()
+	clearGuestShaping(device)
+	if s.DownloadKbps <= 0 && s.UploadKbps <= 0 {
+		return
+	}
+
+	run := func(args ...string) {
+		if out, err := exec.Command("tc", args...).CombinedOutput(); err != nil {
+			log.Printf("tc %s: %v: %s", strings.Join(args, " "), err, strings.TrimSpace(string(out)))
+		}
+	}
+	if s.DownloadKbps > 0 {
+		rate := fmt.Sprintf("%dkbit", s.DownloadKbps)
+		run("qdisc", "add", "dev", device, "root", "handle", "1:", "htb", "default", "10")
+		run("class", "add", "dev", device, "parent", "1:", "classid", "1:10", "htb", "rate", rate, "ceil", rate)
+		run("qdisc", "add", "dev", device, "parent", "1:10", "fq_codel")
+	}
+	if s.UploadKbps > 0 {
+		// 20 ms worth of traffic, at least 16 KB, so single bursts are not cut short.
+		burst := s.UploadKbps * 1000 / 8 / 50
+		if burst < 16000 {
+			burst = 16000
+		}
+		run("qdisc", "add", "dev", device, "handle", "ffff:", "ingress")
+		run("filter", "add", "dev", device, "parent", "ffff:", "protocol", "ip", "u32", "match", "u32", "0", "0",
+			"police", "rate", fmt.Sprintf("%dkbit", s.UploadKbps), "burst", strconv.Itoa(burst), "drop", "flowid", ":1")
+	}
+	guestMu.Lock()
+	guestShaped[device] = true
+	guestMu.Unlock()
+}
+
+func clearGuestShaping(device string) {
+	exec.Command("tc", "qdisc", "del", "dev", device, "root").Run()
+	exec.Command("tc", "qdisc", "del", "dev", device, "ingress").Run()
+	guestMu.Lock()
+	delete(guestShaped, device)
+	guestMu.Unlock()
+}
+
+// ApplyGuestNetwork brings the captive chains, portal listeners and bandwidth caps
+// in line with the config.
+func ApplyGuestNetwork() {
+	cfg := GetRouterConfig()
+	rebuildGuestChains(cfg)
+	refreshGuestPortals(cfg)
+
+	wanted := make(map[string]bool)
+	for _, s := range guestSegments(cfg) {
+		wanted[s.Device()] = true
+		applyGuestShaping(s)
+	}
+
+	guestMu.Lock()
+	var stale []string
+	for device := range guestShaped {
+		if !wanted[device] {
+			stale = append(stale, device)
+		}
+	}
+	guestMu.Unlock()
+	for _, device := range stale {
+		clearGuestShaping(device)
+	}
+}
+
+// acceptGuest opens the network for the device behind ip.
+func acceptGuest(ip string) (GuestSession, error) {
+	cfg := GetRouterConfig()
+	segment, ok := guestSegmentForIP(cfg, ip)
+	if !ok {
+		return GuestSession{}, fmt.Errorf("%s is not on a guest network", ip)
+	}
+	mac := neighborMAC(ip)
+	if mac == "" {
+		return GuestSession{}, fmt.Errorf("could not find the hardware address of %s", ip)
+	}
+
+	portal := normalizeGuestPortal(cfg.GuestPortal)
+	now := time.Now()
+	session := GuestSession{
+		MAC:        mac,
+		IP:         ip,
+		Segment:    segment.Name,
+		AcceptedAt: now,
+		ExpiresAt:  now.Add(time.Duration(portal.SessionHours) * time.Hour),
+	}
+
+	guestMu.Lock()
+	loadGuestSessionsLocked()
+	guestSessions[mac] = session
+	err := saveGuestSessionsLocked()
+	guestMu.Unlock()
+	if err != nil {
+		log.Printf("Warning: save guest sessions: %v", err)
+	}
+
+	rebuildGuestChains(cfg)
+	// Drop the conntrack entries that were redirected to the portal.
+	exec.Command("conntrack", "-D", "-s", ip).Run()
+	RecordEvent(Event{Type: EventGuestAccept, Actor: "guest:" + mac, After: segment.Name, Result: "success", Detail: "from " + ip})
+	log.Printf("Guest %s (%s) accepted the terms on %s", mac, ip, segment.Name)
+	return session, nil
+}
+
+func guestAccepted(ip string) bool {
+	mac := neighborMAC(ip)
+	if mac == "" {
+		return false
+	}
+	guestMu.Lock()
+	defer guestMu.Unlock()
+	loadGuestSessionsLocked()
+	s, ok := guestSessions[mac]
+	return ok && time.Now().Before(s.ExpiresAt)
+}
+
+type guestPageData struct {
+	Title    string
+	Terms    string
+	Accepted bool
+	Error    string
+	Hours    int
+}
+
+func renderGuestPage(w http.ResponseWriter, status int, data guestPageData) {
+	tmpl, err := template.ParseFiles("./templates/guest.html")
+	if err != nil {
+		http.Error(w, "guest portal template missing", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	tmpl.Execute(w, data)
+}
+
+// guestPortalHandler answers every URL a captive client is redirected to.
+func guestPortalHandler(w http.ResponseWriter, r *http.Request) {
+	ip := clientIP(r)
+	portal := normalizeGuestPortal(GetRouterConfig().GuestPortal)
+	data := guestPageData{Title: portal.Title, Terms: portal.Terms, Hours: portal.SessionHours}
+
+	if r.Method == http.MethodPost && r.URL.Path == "/accept" {
+		if r.FormValue("accept") == "" {
+			data.Error = "Please tick the box to accept the terms."
+			renderGuestPage(w, http.StatusBadRequest, data)
+			return
+		}
+		if _, err := acceptGuest(ip); err != nil {
+			data.Error = err.Error()
+			renderGuestPage(w, http.StatusForbidden, data)
+			return
+		}
+		data.Accepted = true
+		renderGuestPage(w, http.StatusOK, data)
+		return
+	}
+
+	data.Accepted = guestAccepted(ip)
+	// A non-2xx answer makes phones and laptops open their captive portal sheet.
+	status := http.StatusOK
+	if !data.Accepted && r.URL.Path != "/" {
+		status = http.StatusNetworkAuthenticationRequired
+	}
+	renderGuestPage(w, status, data)
+}
+
+// refreshGuestPortals serves the splash page on each guest segment address only,
+// never on the WAN or the other segments, and stops it on segments that are no
+// longer guest segments.
+func refreshGuestPortals(cfg RouterConfig) {
+	wanted := make(map[string]bool)
+	for _, s := range guestSegments(cfg) {
+		wanted[s.Address] = true
+	}
+
+	guestMu.Lock()
+	defer guestMu.Unlock()
+	for address, srv := range guestPortals {
+		if !wanted[address] {
+			srv.Close()
+			delete(guestPortals, address)
+		}
+	}
+	for address := range wanted {
+		if guestPortals[address] != nil {
+			continue
+		}
+		addr := net.JoinHostPort(address, strconv.Itoa(guestPortalPort))
+		ln, err := net.Listen("tcp4", addr)
+		if err != nil {
+			log.Printf("Guest portal on %s: %v", addr, err)
+			continue
+		}
+		mux := http.NewServeMux()
+		mux.HandleFunc("/", guestPortalHandler)
+		srv := &http.Server{Handler: mux}
+		guestPortals[address] = srv
+		go func() {
+			if err := srv.Serve(ln); err != nil && err != http.ErrServerClosed {
+				log.Printf("Guest portal on %s stopped: %v", addr, err)
+			}
+		}()
+	}
+}
+
+// RunGuestPortal serves the splash page, applies guest rules and expires sessions.
+func RunGuestPortal() {
+	ApplyGuestNetwork()
+
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for range ticker.C {
+		// Retries listeners whose segment address was not up yet.
+		refreshGuestPortals(GetRouterConfig())
+		guestMu.Lock()
+		loadGuestSessionsLocked()
+		changed := pruneGuestSessionsLocked(time.Now())
+		if changed {
+			saveGuestSessionsLocked()
+		}
+		guestMu.Unlock()
+		if changed {
+			rebuildGuestChains(GetRouterConfig())
+		}
+	}
+}
+
+func GetGuestStatus() GuestStatus {
+	cfg := GetRouterConfig()
+	status := GuestStatus{
+		Portal:     normalizeGuestPortal(cfg.GuestPortal),
+		PortalPort: guestPortalPort,
+		Segments:   []string{},
+	}
+	for _, s := range guestSegments(cfg) {
+		status.Segments = append(status.Segments, s.Name)
+	}
+	guestMu.Lock()
+	loadGuestSessionsLocked()
+	status.Sessions = sortedGuestSessionsLocked()
+	guestMu.Unlock()
+	return status
+}
+
+// GuestHandler reads or updates the splash page settings.
+// POST /guest {"title": "Cafe Wi-Fi", "terms": "...", "session_hours": 12}
+func GuestHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		var req GuestPortalConfig
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "invalid JSON body", http.StatusBadRequest)
+			return
+		}
+		if req.SessionHours < 0 || req.SessionHours > 24*30 {
+			http.Error(w, "session_hours must be 0-720", http.StatusBadRequest)
+			return
+		}
+		cfg := GetRouterConfig()
+		cfg.GuestPortal = req
+		if err := SaveRouterConfig(cfg); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(GetGuestStatus())
+}
+
+// GuestRevokeHandler ends a guest session. POST /guest/revoke?mac=aa:bb:cc:dd:ee:ff
+func GuestRevokeHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	mac := strings.ToLower(strings.TrimSpace(r.URL.Query().Get("mac")))
+	if _, err := net.ParseMAC(mac); err != nil {
+		http.Error(w, "Invalid mac parameter", http.StatusBadRequest)
+		return
+	}
+
+	guestMu.Lock()
+	loadGuestSessionsLocked()
+	session, ok := guestSessions[mac]
+	delete(guestSessions, mac)
+	err := saveGuestSessionsLocked()
+	guestMu.Unlock()
+	if !ok {
+		http.Error(w, "No session for "+mac, http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	rebuildGuestChains(GetRouterConfig())
+	exec.Command("conntrack", "-D", "-s", session.IP).Run()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(GetGuestStatus())
+}
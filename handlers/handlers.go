@@ -24,11 +24,16 @@ func StatusHandler(w http.ResponseWriter, r *http.Request) {
 	// Check if Tailscale is running before responding
 	if !IsTailscaleRunning() {
 		response := map[string]interface{}{
-			"mode":       CurrentMode,
-			"exitNodes":  map[string]ExitNode{},
-			"configured": IsConfigured(),
-			"network":    GetNetworkSnapshot(),
-			"warning":    "Tailscale is not connected",
+			"mode":           CurrentMode,
+			"exitNodes":      map[string]ExitNode{},
+			"configured":     IsConfigured(),
+			"network":        GetNetworkSnapshot(),
+			"subnetRouter":   GetSubnetRouterStatus(),
+			"exitNodeServer": GetExitNodeServerStatus(),
+			"schedule":       GetScheduleStatus(),
+			"splitTunnel":    GetSplitTunnelStatus(CurrentMode),
+			"wan":            GetWANStatus(),
+			"warning":        "Tailscale is not connected",
 		}
 		w.Header().Set("Content-Type", "application/json")
 		json.NewEncoder(w).Encode(response)
@@ -42,10 +47,16 @@ func StatusHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	response := map[string]interface{}{
-		"mode":       CurrentMode,
-		"exitNodes":  exitNodes,
-		"configured": IsConfigured(),
-		"network":    GetNetworkSnapshot(),
+		"mode":           CurrentMode,
+		"exitNodes":      exitNodes,
+		"configured":     IsConfigured(),
+		"network":        GetNetworkSnapshot(),
+		"subnetRouter":   GetSubnetRouterStatus(),
+		"exitNodeServer": GetExitNodeServerStatus(),
+		"autoExitNode":   autoExitNode,
+		"schedule":       GetScheduleStatus(),
+		"splitTunnel":    GetSplitTunnelStatus(CurrentMode),
+		"wan":            GetWANStatus(),
 	}
 
 	w.Header().Set("Content-Type", "application/json")
@@ -55,9 +66,12 @@ func StatusHandler(w http.ResponseWriter, r *http.Request) {
 // Set Mode API Handler
 func SetModeHandler(w http.ResponseWriter, r *http.Request) {
 	modeType := r.URL.Query().Get("mode")
+	ev := Event{Type: EventModeSwitch, Actor: requestActor(r), Before: CurrentMode}
 
 	if modeType == "direct" {
 		err := DisableTailscaleExitNode()
+		ev.After = CurrentMode
+		RecordEvent(eventResult(ev, err))
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
@@ -69,6 +83,11 @@ func SetModeHandler(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 		err := SetTailscaleExitNode(node)
+		ev.After = CurrentMode
+		if err != nil {
+			ev.After = "tailscale:" + node
+		}
+		RecordEvent(eventResult(ev, err))
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
@@ -78,6 +97,8 @@ func SetModeHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	NoteManualModeChange(CurrentMode)
+
 	w.WriteHeader(http.StatusOK)
 	fmt.Fprintf(w, "Switched to mode: %s\n", CurrentMode)
 }
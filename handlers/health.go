@@ -0,0 +1,479 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	healthHistorySize = 50
+	healthMaxBackoff  = 10 * time.Minute
+	healthServiceWait = 2 * time.Second
+)
+
+// EventHealthRemediation is recorded whenever a probe's remediation runs.
+const EventHealthRemediation = "health_remediation"
+
+// HealthProbe is one pluggable check. Remediate may be nil (report only);
+// Applies may be nil (always runs). Critical probes decide overall health.
+type HealthProbe struct {
+	Name        string
+	Description string
+	Interval    time.Duration
+	Critical    bool
+	Applies     func() bool
+	Check       func() (string, error)
+	Remediate   func() error
+}
+
+// HealthResult is one entry in a probe's history.
+type HealthResult struct {
+	Time        time.Time `json:"time"`
+	OK          bool      `json:"ok"`
+	Detail      string    `json:"detail,omitempty"`
+	Error       string    `json:"error,omitempty"`
+	Remediation string    `json:"remediation,omitempty"` // "ok" or the remediation error
+}
+
+// HealthProbeStatus is the API view of a probe.
+type HealthProbeStatus struct {
+	Name                string         `json:"name"`
+	Description         string         `json:"description"`
+	Critical            bool           `json:"critical"`
+	Status              string         `json:"status"` // pending, ok, failing, skipped
+	IntervalSeconds     int            `json:"interval_seconds"`
+	ConsecutiveFailures int            `json:"consecutive_failures"`
+	FailingSince        time.Time      `json:"failing_since"`
+	LastCheck           time.Time      `json:"last_check"`
+	LastSuccess         time.Time      `json:"last_success"`
+	Detail              string         `json:"detail,omitempty"`
+	Error               string         `json:"error,omitempty"`
+	CanRemediate        bool           `json:"can_remediate"`
+	Remediations        int            `json:"remediations"`
+	NextRemediation     time.Time      `json:"next_remediation"`
+	History             []HealthResult `json:"history,omitempty"`
+}
+
+// HealthReport is returned by GET /health.
+type HealthReport struct {
+	Healthy bool                `json:"healthy"`
+	Probes  []HealthProbeStatus `json:"probes"`
+}
+
+type healthProbeState struct {
+	probe HealthProbe
+	// runMu serializes runOnce, so a manual run never overlaps the probe loop
+	// and remediation cannot run twice at once.
+	runMu sync.Mutex
+
+	// guarded by healthMu
+	status          HealthProbeStatus
+	backoff         time.Duration
+	nextRemediation time.Time
+	history         []HealthResult
+}
+
+var (
+	healthMu      sync.Mutex
+	healthProbes  []*healthProbeState
+	healthStarted bool
+)
+
+// RegisterHealthProbe adds a probe. Probes registered after RunHealthChecks start immediately.
+func RegisterHealthProbe(p HealthProbe) {
+	if p.Interval <= 0 {
+		p.Interval = time.Minute
+	}
+	state := &healthProbeState{
+		probe: p,
+		status: HealthProbeStatus{
+			Name:            p.Name,
+			Description:     p.Description,
+			Critical:        p.Critical,
+			Status:          "pending",
+			IntervalSeconds: int(p.Interval / time.Second),
+			CanRemediate:    p.Remediate != nil,
+		},
+		backoff: p.Interval,
+	}
+
+	healthMu.Lock()
+	healthProbes = append(healthProbes, state)
+	started := healthStarted
+	healthMu.Unlock()
+
+	if started {
+		go state.run()
+	}
+}
+
+func findHealthProbe(name string) *healthProbeState {
+	healthMu.Lock()
+	defer healthMu.Unlock()
+	for _, state := range healthProbes {
+		if state.probe.Name == name {
+			return state
+		}
+	}
+	return nil
+}
+
+// getHealthProbeStatus returns the current status of one probe without history.
+func getHealthProbeStatus(name string) (HealthProbeStatus, bool) {
+	state := findHealthProbe(name)
+	if state == nil {
+		return HealthProbeStatus{}, false
+	}
+	healthMu.Lock()
+	defer healthMu.Unlock()
+	return state.snapshot(false), true
+}
+
+// RunHealthChecks registers the built-in probes and runs each on its own schedule.
+func RunHealthChecks() {
+	for _, p := range defaultHealthProbes() {
+		RegisterHealthProbe(p)
+	}
+
+	healthMu.Lock()
+	healthStarted = true
+	probes := append([]*healthProbeState(nil), healthProbes...)
+	healthMu.Unlock()
+
+	for _, state := range probes {
+		go state.run()
+	}
+}
+
+func (s *healthProbeState) run() {
+	for {
+		s.runOnce()
+		time.Sleep(s.probe.Interval)
+	}
+}
+
+// runOnce checks the probe and remediates on failure, backing off between attempts.
+func (s *healthProbeState) runOnce() {
+	s.runMu.Lock()
+	defer s.runMu.Unlock()
+
+	now := time.Now()
+	if s.probe.Applies != nil && !s.probe.Applies() {
+		healthMu.Lock()
+		s.status.Status = "skipped"
+		s.status.LastCheck = now
+		s.status.ConsecutiveFailures = 0
+		s.status.FailingSince = time.Time{}
+		s.status.Detail, s.status.Error = "", ""
+		s.backoff, s.nextRemediation = s.probe.Interval, time.Time{}
+		healthMu.Unlock()
+		return
+	}
+
+	detail, err := s.probe.Check()
+	result := HealthResult{Time: now, OK: err == nil, Detail: detail}
+	if err != nil {
+		result.Error = err.Error()
+	}
+
+	healthMu.Lock()
+	s.status.LastCheck = now
+	s.status.Detail, s.status.Error = result.Detail, result.Error
+	if err == nil {
+		s.status.Status = "ok"
+		s.status.LastSuccess = now
+		s.status.ConsecutiveFailures = 0
+		s.status.FailingSince = time.Time{}
+		s.backoff, s.nextRemediation = s.probe.Interval, time.Time{}
+		s.appendHistory(result)
+		healthMu.Unlock()
+		return
+	}
+	s.status.Status = "failing"
+	if s.status.ConsecutiveFailures == 0 {
+		s.status.FailingSince = now
+	}
+	s.status.ConsecutiveFailures++
+	remediate := s.probe.Remediate != nil && !now.Before(s.nextRemediation)
+	if remediate {
+		s.nextRemediation = now.Add(s.backoff)
+		s.backoff *= 2
+		if s.backoff > healthMaxBackoff {
+			s.backoff = healthMaxBackoff
+		}
+		s.status.Remediations++
+	}
+	healthMu.Unlock()
+
+	if remediate {
+		log.Printf("Health: %s failing (%v), remediating", s.probe.Name, err)
+		remErr := s.probe.Remediate()
+		result.Remediation = "ok"
+		if remErr != nil {
+			result.Remediation = remErr.Error()
+			log.Printf("Health: %s remediation failed: %v", s.probe.Name, remErr)
+		}
+		RecordEvent(eventResult(Event{
+			Type:   EventHealthRemediation,
+			Actor:  "health",
+			Detail: fmt.Sprintf("%s: %s", s.probe.Name, err),
+		}, remErr))
+	}
+
+	healthMu.Lock()
+	s.appendHistory(result)
+	healthMu.Unlock()
+}
+
+// appendHistory keeps the newest healthHistorySize results. Caller holds healthMu.
+func (s *healthProbeState) appendHistory(result HealthResult) {
+	s.history = append(s.history, result)
+	if len(s.history) > healthHistorySize {
+		s.history = s.history[len(s.history)-healthHistorySize:]
+	}
+}
+
+// snapshot copies the probe status. Caller holds healthMu.
+func (s *healthProbeState) snapshot(withHistory bool) HealthProbeStatus {
+	status := s.status
+	status.NextRemediation = s.nextRemediation
+	if withHistory {
+		status.History = append([]HealthResult(nil), s.history...)
+	}
+	return status
+}
+
+// GetHealthReport returns every probe; Healthy is false if any critical probe is failing.
+func GetHealthReport(withHistory bool) HealthReport {
+	healthMu.Lock()
+	defer healthMu.Unlock()
+
+	report := HealthReport{Healthy: true, Probes: []HealthProbeStatus{}}
+	for _, state := range healthProbes {
+		status := state.snapshot(withHistory)
+		if status.Critical && status.Status == "failing" {
+			report.Healthy = false
+		}
+		report.Probes = append(report.Probes, status)
+	}
+	return report
+}
+
+func healthServiceProbe(service string) HealthProbe {
+	return HealthProbe{
+		Name:        "service:" + service,
+		Description: service + " is active",
+		Interval:    30 * time.Second,
+		Critical:    true,
+		Applies:     IsConfigured,
+		Check: func() (string, error) {
+			if exec.Command("systemctl", "is-active", "--quiet", service).Run() != nil {
+				return "", fmt.Errorf("%s is not active", service)
+			}
+			return "active", nil
+		},
+		Remediate: func() error { return restartHealthService(service) },
+	}
+}
+
+func restartHealthService(service string) error {
+	if out, err := exec.Command("systemctl", "restart", service).CombinedOutput(); err != nil {
+		return fmt.Errorf("%v: %s", err, strings.TrimSpace(string(out)))
+	}
+	if service == "tailscaled" {
+		reassertRouterGuard()
+	}
+	time.Sleep(healthServiceWait)
+	if exec.Command("systemctl", "is-active", "--quiet", service).Run() != nil {
+		return fmt.Errorf("%s did not stay active after restart", service)
+	}
+	return nil
+}
+
+// healthEgressInterface is where LAN traffic should be masqueraded in the current mode.
+func healthEgressInterface() string {
+	mu.Lock()
+	mode := CurrentMode
+	mu.Unlock()
+	if strings.HasPrefix(mode, "tailscale:") {
+		return "tailscale0"
+	}
+	iface, err := GetActiveInternetInterface()
+	if err != nil {
+		return ConfiguredWAN()
+	}
+	return iface
+}
+
+func defaultHealthProbes() []HealthProbe {
+	hostapd := healthServiceProbe(hostapdService)
+	hostapd.Applies = func() bool { return IsConfigured() && GetRouterConfig().WifiAP.Enabled }
+
+	return []HealthProbe{
+		healthServiceProbe("tailscaled"),
+		healthServiceProbe("dnsmasq"),
+		hostapd,
+		wifiClientHealthProbe(),
+		{
+			Name:        "default_route",
+			Description: "Router has a default route",
+			Interval:    30 * time.Second,
+			Critical:    true,
+			Applies:     IsConfigured,
+			Check: func() (string, error) {
+				iface, gateway := getDefaultRoute()
+				if iface == "" {
+					return "", fmt.Errorf("no default route")
+				}
+				return fmt.Sprintf("via %s dev %s", gateway, iface), nil
+			},
+		},
+		{
+			Name:        "wan_link",
+			Description: "WAN interface has link",
+			Interval:    15 * time.Second,
+			Critical:    true,
+			Applies:     IsConfigured,
+			Check: func() (string, error) {
+				wan := ConfiguredWAN()
+				if !wanLinkUp(wan) {
+					return "", fmt.Errorf("%s has no link", wan)
+				}
+				return wan + " up", nil
+			},
+			Remediate: func() error {
+				wan := ConfiguredWAN()
+				if out, err := exec.Command("ip", "link", "set", wan, "up").CombinedOutput(); err != nil {
+					return fmt.Errorf("%v: %s", err, strings.TrimSpace(string(out)))
+				}
+				return nil
+			},
+		},
+		{
+			Name:        "ip_forwarding",
+			Description: "IPv4 forwarding is enabled",
+			Interval:    time.Minute,
+			Critical:    true,
+			Check: func() (string, error) {
+				if !IsIPForwardingEnabled() {
+					return "", fmt.Errorf("net.ipv4.ip_forward is 0")
+				}
+				return "enabled", nil
+			},
+			Remediate: EnsureIPForwarding,
+		},
+		{
+			Name:        "nat_rule",
+			Description: "LAN masquerade rule exists for the active egress",
+			Interval:    time.Minute,
+			Critical:    true,
+			Applies:     IsConfigured,
+			Check: func() (string, error) {
+				egress := healthEgressInterface()
+				if exec.Command("iptables", "-t", "nat", "-C", routerNatChain, "-o", egress, "-j", "MASQUERADE").Run() != nil {
+					return "", fmt.Errorf("no MASQUERADE rule for %s in %s", egress, routerNatChain)
+				}
+				return "masquerade on " + egress, nil
+			},
+			Remediate: ReapplyCurrentMode,
+		},
+		{
+			Name:        "exit_node",
+			Description: "Active exit node answers pings",
+			Interval:    time.Minute,
+			Applies:     func() bool { return IsConfigured() && activeExitNodeRef() != "" },
+			Check: func() (string, error) {
+				ref := activeExitNodeRef()
+				nodes, err := GetExitNodes()
+				if err != nil {
+					return "", err
+				}
+				node, ok := findExitNode(nodes, ref)
+				if !ok {
+					return "", fmt.Errorf("exit node %s not found", ref)
+				}
+				latency, err := probeExitNodeLatency(node.IP)
+				if err != nil {
+					return "", fmt.Errorf("%s unreachable: %v", node.Name, err)
+				}
+				return fmt.Sprintf("%s in %s", node.Name, latency.Round(time.Millisecond)), nil
+			},
+			// Only auto mode may pick another node; a pinned node is the user's choice.
+			Remediate: func() error {
+				mu.Lock()
+				mode := CurrentMode
+				mu.Unlock()
+				filter, ok := parseAutoExitNodeSpec(strings.TrimPrefix(mode, "tailscale:"))
+				if !ok {
+					return fmt.Errorf("exit node is pinned; not switching")
+				}
+				return SetAutoExitNode(filter)
+			},
+		},
+		{
+			Name:        "dns_lan",
+			Description: "dnsmasq answers on the LAN address",
+			Interval:    time.Minute,
+			Critical:    true,
+			Applies:     func() bool { return IsConfigured() && GetRouterConfig().LANAddress != "" },
+			Check: func() (string, error) {
+				addr := GetRouterConfig().LANAddress
+				if _, err := queryDnsmasqStat(addr, "cachesize.bind"); err != nil {
+					return "", fmt.Errorf("no answer from %s: %v", addr, err)
+				}
+				return "answering on " + addr, nil
+			},
+			Remediate: func() error { return restartHealthService("dnsmasq") },
+		},
+	}
+}
+
+// HealthHandler reports all probes. GET /health?history=false omits history.
+func HealthHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	withHistory := true
+	if value := r.URL.Query().Get("history"); value != "" {
+		parsed, err := strconv.ParseBool(value)
+		if err != nil {
+			http.Error(w, "Invalid history parameter", http.StatusBadRequest)
+			return
+		}
+		withHistory = parsed
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(GetHealthReport(withHistory))
+}
+
+// HealthRunHandler runs one probe now. POST /health/run?probe=<name>
+func HealthRunHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	state := findHealthProbe(strings.TrimSpace(r.URL.Query().Get("probe")))
+	if state == nil {
+		http.Error(w, "Unknown health probe", http.StatusNotFound)
+		return
+	}
+	state.runOnce()
+
+	healthMu.Lock()
+	status := state.snapshot(false)
+	healthMu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(status)
+}
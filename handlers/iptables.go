@@ -3,17 +3,32 @@ package handlers
 import (
 	"log"
 	"os/exec"
+	"strings"
+	"sync"
+	"time"
 )
 
 const (
 	routerForwardChain = "TS-ROUTER-FWD"
 	routerNatChain     = "TS-ROUTER-NAT"
 	routerMSSChain     = "TS-ROUTER-MSS"
+	routerSplitChain   = "TS-ROUTER-SPLIT"
+
+	// routerGuardChain holds every forward DROP (firewall policy, guests, segments).
+	// It must sit above tailscaled's ts-forward jump, which ends in
+	// "-o tailscale0 -j ACCEPT" and would otherwise let exit-node traffic past them.
+	routerGuardChain      = "TS-ROUTER-GUARD"
+	forwardGuardInterval  = 15 * time.Second
+	forwardGuardFollowUps = 5 // one-second re-checks after the router changes tailscale
 )
 
+// guardMu keeps concurrent checks from inserting the guard jump twice.
+var guardMu sync.Mutex
+
 func ensureRouterIPTablesChains() {
 	exec.Command("iptables", "-N", routerForwardChain).Run()
 	exec.Command("iptables", "-t", "nat", "-N", routerNatChain).Run()
+	ensureRouterGuardFirst()
 
 	if exec.Command("iptables", "-C", "FORWARD", "-j", routerForwardChain).Run() != nil {
 		exec.Command("iptables", "-A", "FORWARD", "-j", routerForwardChain).Run()
@@ -23,11 +38,77 @@ func ensureRouterIPTablesChains() {
 	}
 }
 
+// ensureRouterGuardFirst keeps the TS-ROUTER-GUARD jump as the first rule of FORWARD.
+// tailscaled inserts its own jump at position 1 every time it starts, so this runs
+// again from RunForwardGuard. It reports whether the jump had to be moved.
+func ensureRouterGuardFirst() bool {
+	guardMu.Lock()
+	defer guardMu.Unlock()
+	exec.Command("iptables", "-N", routerGuardChain).Run()
+	out, err := exec.Command("iptables", "-S", "FORWARD").Output()
+	if err != nil {
+		return false
+	}
+	for _, line := range strings.Split(string(out), "\n") {
+		if strings.HasPrefix(line, "-A FORWARD ") {
+			if strings.TrimSpace(line) == "-A FORWARD -j "+routerGuardChain {
+				return false
+			}
+			break
+		}
+	}
+	for exec.Command("iptables", "-D", "FORWARD", "-j", routerGuardChain).Run() == nil {
+	}
+	if err := exec.Command("iptables", "-I", "FORWARD", "1", "-j", routerGuardChain).Run(); err != nil {
+		log.Printf("iptables: insert %s at the top of FORWARD: %v", routerGuardChain, err)
+		return false
+	}
+	return true
+}
+
+func checkRouterGuard() {
+	if ensureRouterGuardFirst() {
+		log.Printf("iptables: moved %s back above tailscaled's FORWARD rules", routerGuardChain)
+		// Connections that slipped past the policy meanwhile are established now.
+		cutBlockedHostConnections(activeFirewallRules(GetRouterConfig(), time.Now()))
+	}
+}
+
+// reassertRouterGuard runs after every tailscale set and tailscaled restart the
+// router performs itself, so guests and policy drops are not left below ts-forward
+// until the next RunForwardGuard tick. tailscaled may install its rules a moment
+// later, so the check repeats in the background for a few seconds.
+func reassertRouterGuard() {
+	checkRouterGuard()
+	go func() {
+		for i := 0; i < forwardGuardFollowUps; i++ {
+			time.Sleep(time.Second)
+			checkRouterGuard()
+		}
+	}()
+}
+
+// RunForwardGuard puts the guard chain back on top after tailscaled restarts
+// that the router did not cause.
+func RunForwardGuard() {
+	ticker := time.NewTicker(forwardGuardInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		checkRouterGuard()
+	}
+}
+
+// flushRouterIPTablesRules resets the mode-owned chains. The firewall policy jump
+// and port forwards are re-added straight away; their own chains are not touched.
 func flushRouterIPTablesRules() {
 	ensureRouterIPTablesChains()
+	exec.Command("iptables", "-F", routerGuardChain).Run()
 	exec.Command("iptables", "-F", routerForwardChain).Run()
 	exec.Command("iptables", "-t", "nat", "-F", routerNatChain).Run()
 	clearRouterMSSClamp()
+	clearSplitTunnelMarks()
+	appendFirewallPolicyJump()
+	appendPortForwardRules()
 }
 
 func ensureRouterMSSChain() {
@@ -37,26 +118,23 @@ func ensureRouterMSSChain() {
 	}
 }
 
-// ensureRouterMSSClamp prevents LAN TCP sessions from exceeding tailscale0 MTU (1280).
+// ensureRouterMSSClamp clamps the MSS of TCP SYNs leaving outIface so sessions fit
+// its path MTU (tailscale0 is 1280; PPPoE and LTE WANs are below 1500). The clamp
+// mode per interface comes from mssClampArgs.
 func ensureRouterMSSClamp(outIface string) {
-	ensureRouterMSSChain()
-	args := []string{
-		"-t", "mangle", "-C", routerMSSChain,
-		"-o", outIface, "-p", "tcp", "--tcp-flags", "SYN,RST", "SYN",
-		"-j", "TCPMSS", "--clamp-mss-to-pmtu",
-	}
-	if exec.Command("iptables", args...).Run() == nil {
+	target := mssClampArgs(outIface)
+	if target == nil {
 		return
 	}
-	appendArgs := []string{
-		"-t", "mangle", "-A", routerMSSChain,
-		"-o", outIface, "-p", "tcp", "--tcp-flags", "SYN,RST", "SYN",
-		"-j", "TCPMSS", "--clamp-mss-to-pmtu",
+	ensureRouterMSSChain()
+	rule := append([]string{"-o", outIface, "-p", "tcp", "--tcp-flags", "SYN,RST", "SYN"}, target...)
+	if exec.Command("iptables", append([]string{"-t", "mangle", "-C", routerMSSChain}, rule...)...).Run() == nil {
+		return
 	}
-	if err := exec.Command("iptables", appendArgs...).Run(); err != nil {
+	if err := exec.Command("iptables", append([]string{"-t", "mangle", "-A", routerMSSChain}, rule...)...).Run(); err != nil {
 		log.Printf("iptables MSS clamp for %s: %v", outIface, err)
 	} else {
-		log.Printf("iptables MSS clamp enabled on %s", outIface)
+		log.Printf("iptables MSS clamp enabled on %s (%s)", outIface, strings.Join(target[len(target)-2:], " "))
 	}
 }
 
@@ -72,9 +150,51 @@ func appendRouterForwardRule(args ...string) {
 	}
 }
 
+// appendRouterGuardRule adds a rule to TS-ROUTER-GUARD, ahead of tailscaled's
+// forward rules and of every ACCEPT in TS-ROUTER-FWD.
+func appendRouterGuardRule(args ...string) {
+	ensureRouterIPTablesChains()
+	cmdArgs := append([]string{"-A", routerGuardChain}, args...)
+	if err := exec.Command("iptables", cmdArgs...).Run(); err != nil {
+		log.Printf("iptables guard rule failed: %v", err)
+	}
+}
+
+func appendRouterNatRule(args ...string) {
+	ensureRouterIPTablesChains()
+	cmdArgs := append([]string{"-t", "nat", "-A", routerNatChain}, args...)
+	if err := exec.Command("iptables", cmdArgs...).Run(); err != nil {
+		log.Printf("iptables NAT rule failed: %v", err)
+	}
+}
+
 func appendRouterNatMasquerade(outIface string) {
 	ensureRouterIPTablesChains()
 	if err := exec.Command("iptables", "-t", "nat", "-A", routerNatChain, "-o", outIface, "-j", "MASQUERADE").Run(); err != nil {
 		log.Printf("iptables NAT rule failed for %s: %v", outIface, err)
 	}
 }
+
+// appendRouterNatMasqueradeFrom masquerades only traffic sourced from srcCIDR.
+func appendRouterNatMasqueradeFrom(srcCIDR, outIface string) {
+	ensureRouterIPTablesChains()
+	if err := exec.Command("iptables", "-t", "nat", "-A", routerNatChain, "-s", srcCIDR, "-o", outIface, "-j", "MASQUERADE").Run(); err != nil {
+		log.Printf("iptables NAT rule failed for %s from %s: %v", outIface, srcCIDR, err)
+	}
+}
+
+func ensureRouterSplitChain() {
+	exec.Command("iptables", "-t", "mangle", "-N", routerSplitChain).Run()
+	if exec.Command("iptables", "-t", "mangle", "-C", "PREROUTING", "-j", routerSplitChain).Run() != nil {
+		exec.Command("iptables", "-t", "mangle", "-A", "PREROUTING", "-j", routerSplitChain).Run()
+	}
+}
+
+// appendRouterSplitRule adds a packet-marking rule for split tunneling (mangle PREROUTING).
+func appendRouterSplitRule(args ...string) {
+	ensureRouterSplitChain()
+	cmdArgs := append([]string{"-t", "mangle", "-A", routerSplitChain}, args...)
+	if err := exec.Command("iptables", cmdArgs...).Run(); err != nil {
+		log.Printf("iptables split tunnel rule failed: %v", err)
+	}
+}
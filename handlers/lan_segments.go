@@ -0,0 +1,672 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+const (
+	SegmentModeFollow = "follow"
+	SegmentModeDirect = "direct"
+	SegmentModeNone   = "none"
+
+	SegmentIsolationNone     = "none"
+	SegmentIsolationIsolated = "isolated"
+
+	// primarySegmentName is used when the config only has the legacy single-LAN fields.
+	primarySegmentName = "lan"
+
+	// segmentDirectFwmark sends a "direct" segment through the main table while an
+	// exit node is active. Separate from splitTunnelFwmark so each feature owns its rule.
+	segmentDirectFwmark       = "0x2000/0x2000"
+	segmentDirectRulePriority = 93
+
+	dnsmasqLANConfFile = "/etc/dnsmasq.d/tailscale-router.conf"
+	dhcpcdConfFile     = "/etc/dhcpcd.conf"
+)
+
+var segmentNamePattern = regexp.MustCompile(`^[a-z][a-z0-9-]{0,14}$`)
+
+// LANSegment is one routed LAN: a physical interface or an 802.1Q VLAN on a trunk port.
+type LANSegment struct {
+	Name           string `json:"name"`
+	Interface      string `json:"interface"`
+	VLAN           int    `json:"vlan,omitempty"` // 1-4094 creates <interface>.<vlan>
+	Address        string `json:"address"`
+	Prefix         int    `json:"prefix"`
+	DHCPRangeStart string `json:"dhcp_range_start"`
+	DHCPRangeEnd   string `json:"dhcp_range_end"`
+	DHCPLeaseHours int    `json:"dhcp_lease_hours,omitempty"`
+	// Mode is follow (the router's mode), direct, tailscale:<node> or none (no internet).
+	Mode string `json:"mode,omitempty"`
+	// Isolation "isolated" blocks new connections to other segments except AllowSegments.
+	Isolation     string   `json:"isolation,omitempty"`
+	AllowSegments []string `json:"allow_segments,omitempty"`
+	// Guest puts the segment behind the captive portal and away from the router,
+	// the tailnet and the other segments. The caps apply per segment, 0 is unlimited.
+	Guest        bool `json:"guest,omitempty"`
+	DownloadKbps int  `json:"download_kbps,omitempty"`
+	UploadKbps   int  `json:"upload_kbps,omitempty"`
+}
+
+// LANSegmentStatus is one entry of GET /lan/segments.
+type LANSegmentStatus struct {
+	LANSegment
+	Device   string   `json:"device"`
+	CIDR     string   `json:"cidr"`
+	LinkUp   bool     `json:"link_up"`
+	IPv4     []string `json:"ipv4"`
+	Internet string   `json:"internet"` // where new connections to the internet go right now
+}
+
+// Device is the kernel interface name carrying the segment.
+func (s LANSegment) Device() string {
+	if s.VLAN > 0 {
+		return fmt.Sprintf("%s.%d", s.Interface, s.VLAN)
+	}
+	return s.Interface
+}
+
+func (s LANSegment) CIDR() string {
+	return networkCIDR(s.Address, s.Prefix)
+}
+
+func (s LANSegment) canReach(other string) bool {
+	if s.Isolation != SegmentIsolationIsolated {
+		return true
+	}
+	return containsString(s.AllowSegments, other)
+}
+
+// LANSegments returns every LAN segment. Configs from before segments existed
+// describe a single LAN in the top-level fields.
+func LANSegments(cfg RouterConfig) []LANSegment {
+	if len(cfg.LANSegments) > 0 {
+		return cfg.LANSegments
+	}
+	if cfg.LANInterface == "" {
+		return nil
+	}
+	return []LANSegment{{
+		Name:           primarySegmentName,
+		Interface:      cfg.LANInterface,
+		Address:        cfg.LANAddress,
+		Prefix:         cfg.LANPrefix,
+		DHCPRangeStart: cfg.DHCPRangeStart,
+		DHCPRangeEnd:   cfg.DHCPRangeEnd,
+		DHCPLeaseHours: cfg.DHCPLeaseHours,
+	}}
+}
+
+func normalizeLANSegment(s LANSegment) LANSegment {
+	s.Name = strings.ToLower(strings.TrimSpace(s.Name))
+	s.Interface = strings.TrimSpace(s.Interface)
+	s.Address = strings.TrimSpace(s.Address)
+	s.DHCPRangeStart = strings.TrimSpace(s.DHCPRangeStart)
+	s.DHCPRangeEnd = strings.TrimSpace(s.DHCPRangeEnd)
+	s.Mode = strings.TrimSpace(s.Mode)
+	if s.Mode == "" {
+		s.Mode = SegmentModeFollow
+	}
+	s.Isolation = strings.ToLower(strings.TrimSpace(s.Isolation))
+	if s.Isolation == "" {
+		s.Isolation = SegmentIsolationNone
+	}
+	if s.Prefix == 0 {
+		s.Prefix = 24
+	}
+	if s.Guest {
+		s.Isolation = SegmentIsolationIsolated
+		s.AllowSegments = nil
+	}
+	return s
+}
+
+func validateSegmentMode(mode string) error {
+	switch {
+	case mode == SegmentModeFollow, mode == SegmentModeDirect, mode == SegmentModeNone:
+		return nil
+	case strings.HasPrefix(mode, "tailscale:") && len(mode) > len("tailscale:"):
+		return nil
+	}
+	return fmt.Errorf("mode must be follow, direct, none or tailscale:<node>")
+}
+
+// validateLANSegments checks each segment and that no two subnets, nor any
+// segment and WAN, overlap.
+func validateLANSegments(cfg RouterConfig, segments []LANSegment) error {
+	if len(segments) == 0 {
+		return fmt.Errorf("at least one LAN segment is required")
+	}
+
+	wans := []string{cfg.WANInterface}
+	for _, link := range cfg.WANLinks {
+		wans = append(wans, link.Interface)
+	}
+
+	names := make(map[string]bool)
+	devices := make(map[string]bool)
+	for _, s := range segments {
+		if !segmentNamePattern.MatchString(s.Name) {
+			return fmt.Errorf("segment name %q must be lowercase letters, digits or dashes (max 15)", s.Name)
+		}
+		if names[s.Name] {
+			return fmt.Errorf("segment %s listed twice", s.Name)
+		}
+		names[s.Name] = true
+
+		if s.Interface == "" {
+			return fmt.Errorf("segment %s: interface is required", s.Name)
+		}
+		if s.VLAN < 0 || s.VLAN > 4094 {
+			return fmt.Errorf("segment %s: VLAN ID must be 1-4094", s.Name)
+		}
+		device := s.Device()
+		if len(device) > 15 {
+			return fmt.Errorf("segment %s: interface name %s is longer than 15 characters", s.Name, device)
+		}
+		if devices[device] {
+			return fmt.Errorf("segment %s: %s is already used by another segment", s.Name, device)
+		}
+		devices[device] = true
+		if containsString(wans, s.Interface) || s.Interface == "tailscale0" {
+			return fmt.Errorf("segment %s: %s is a WAN interface", s.Name, s.Interface)
+		}
+		if _, err := net.InterfaceByName(s.Interface); err != nil {
+			return fmt.Errorf("segment %s: interface %s not found", s.Name, s.Interface)
+		}
+
+		if s.Prefix < 8 || s.Prefix > 30 {
+			return fmt.Errorf("segment %s: prefix must be 8-30", s.Name)
+		}
+		network := networkAddr(s.Address, s.Prefix)
+		if network == nil {
+			return fmt.Errorf("segment %s: invalid address %q", s.Name, s.Address)
+		}
+		subnet := &net.IPNet{IP: network, Mask: net.CIDRMask(s.Prefix, 32)}
+		for _, ip := range []string{s.DHCPRangeStart, s.DHCPRangeEnd} {
+			parsed := net.ParseIP(ip)
+			if parsed == nil || !subnet.Contains(parsed) {
+				return fmt.Errorf("segment %s: DHCP range address %q is not in %s", s.Name, ip, subnet)
+			}
+		}
+
+		if err := validateSegmentMode(s.Mode); err != nil {
+			return fmt.Errorf("segment %s: %v", s.Name, err)
+		}
+		if s.Isolation != SegmentIsolationNone && s.Isolation != SegmentIsolationIsolated {
+			return fmt.Errorf("segment %s: isolation must be none or isolated", s.Name)
+		}
+		if s.DownloadKbps < 0 || s.UploadKbps < 0 {
+			return fmt.Errorf("segment %s: bandwidth caps cannot be negative", s.Name)
+		}
+		if !s.Guest && (s.DownloadKbps > 0 || s.UploadKbps > 0) {
+			return fmt.Errorf("segment %s: bandwidth caps are only available on guest segments", s.Name)
+		}
+
+		for _, wan := range wans {
+			if err := validateLANDoesNotOverlapWAN(wan, s.Address, s.Prefix); err != nil {
+				return fmt.Errorf("segment %s: %v", s.Name, err)
+			}
+		}
+	}
+
+	for i, a := range segments {
+		for _, other := range a.AllowSegments {
+			if !names[other] || other == a.Name {
+				return fmt.Errorf("segment %s: allow_segments entry %q is not another segment", a.Name, other)
+			}
+		}
+		for _, b := range segments[i+1:] {
+			if subnetsOverlap(a.Address, a.Prefix, b.Address, b.Prefix) {
+				return fmt.Errorf("segment %s (%s) overlaps segment %s (%s)", a.Name, a.CIDR(), b.Name, b.CIDR())
+			}
+		}
+	}
+	return nil
+}
+
+// setLANSegments stores segments and mirrors the first into the single-LAN fields
+// that the rest of the router (health checks, setup status, metrics) still reads.
+func setLANSegments(cfg *RouterConfig, segments []LANSegment) {
+	primary := segments[0]
+	cfg.LANInterface = primary.Device()
+	cfg.LANAddress = primary.Address
+	cfg.LANPrefix = primary.Prefix
+	cfg.DHCPRangeStart = primary.DHCPRangeStart
+	cfg.DHCPRangeEnd = primary.DHCPRangeEnd
+	if primary.DHCPLeaseHours > 0 {
+		cfg.DHCPLeaseHours = primary.DHCPLeaseHours
+	}
+	cfg.LANSegments = segments
+}
+
+func lanSegmentConnName(s LANSegment) string {
+	if s.Name == primarySegmentName {
+		return "tailscale-router-lan"
+	}
+	return "tailscale-router-lan-" + s.Name
+}
+
+// configureLANSegment creates the VLAN link if needed and assigns the gateway address.
+func configureLANSegment(s LANSegment) error {
+	exec.Command("ip", "link", "set", s.Interface, "up").Run()
+	device := s.Device()
+	cidr := fmt.Sprintf("%s/%d", s.Address, s.Prefix)
+
+	if usesNetworkManager() {
+		connName := lanSegmentConnName(s)
+		_ = exec.Command("nmcli", "con", "delete", connName).Run()
+		args := []string{"con", "add"}
+		if s.VLAN > 0 {
+			args = append(args, "type", "vlan", "dev", s.Interface, "id", strconv.Itoa(s.VLAN))
+		} else {
+			args = append(args, "type", "ethernet")
+		}
+		args = append(args,
+			"ifname", device,
+			"con-name", connName,
+			"ipv4.method", "manual",
+			"ipv4.addresses", cidr,
+			"ipv6.method", "ignore",
+			"connection.autoconnect", "yes",
+		)
+		if out, err := exec.Command("nmcli", args...).CombinedOutput(); err != nil {
+			return fmt.Errorf("%v: %s", err, string(out))
+		}
+		if out, err := exec.Command("nmcli", "con", "up", connName).CombinedOutput(); err != nil {
+			return fmt.Errorf("%v: %s", err, string(out))
+		}
+		return nil
+	}
+
+	if err := ensureVLANLink(s); err != nil {
+		return err
+	}
+	block := fmt.Sprintf("\ninterface %s\nstatic ip_address=%s\nnohook wpa_supplicant\n", device, cidr)
+	return writeDhcpcdStanza(device, block)
+}
+
+// withoutDhcpcdStanza drops the "interface <device>" stanza from a dhcpcd.conf,
+// up to the next interface, ssid or profile line, with the blank line before it.
+func withoutDhcpcdStanza(content, device string) string {
+	lines := strings.Split(content, "\n")
+	var kept []string
+	inside := false
+	for _, line := range lines {
+		fields := strings.Fields(line)
+		if len(fields) > 0 {
+			switch fields[0] {
+			case "interface", "ssid", "profile":
+				leaving := inside
+				inside = len(fields) == 2 && fields[0] == "interface" && fields[1] == device
+				blankBefore := len(kept) > 0 && strings.TrimSpace(kept[len(kept)-1]) == ""
+				if inside && blankBefore {
+					kept = kept[:len(kept)-1]
+				} else if leaving && !inside && len(kept) > 0 && !blankBefore {
+					kept = append(kept, "")
+				}
+			}
+		}
+		if !inside {
+			kept = append(kept, line)
+		}
+	}
+	result := strings.Join(kept, "\n")
+	if result != "" && strings.HasSuffix(content, "\n") && !strings.HasSuffix(result, "\n") {
+		result += "\n"
+	}
+	return result
+}
+
+// writeDhcpcdStanza replaces the stanza for device with block (or removes it when
+// block is empty) and restarts dhcpcd if the file changed.
+func writeDhcpcdStanza(device, block string) error {
+	data, err := os.ReadFile(dhcpcdConfFile)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	content := withoutDhcpcdStanza(string(data), device)
+	if block != "" {
+		if content != "" && !strings.HasSuffix(content, "\n") {
+			content += "\n"
+		}
+		content += block
+	}
+	if content == string(data) {
+		return nil
+	}
+	if err := os.WriteFile(dhcpcdConfFile, []byte(content), 0644); err != nil {
+		return err
+	}
+	return exec.Command("systemctl", "restart", "dhcpcd").Run()
+}
+
+// ensureVLANLink creates <interface>.<vlan>. Without NetworkManager nothing else
+// persists it, so EnsureLANSegments calls this again at every start.
+func ensureVLANLink(s LANSegment) error {
+	if s.VLAN == 0 {
+		return nil
+	}
+	device := s.Device()
+	if _, err := net.InterfaceByName(device); err != nil {
+		exec.Command("modprobe", "8021q").Run()
+		out, err := exec.Command("ip", "link", "add", "link", s.Interface, "name", device,
+			"type", "vlan", "id", strconv.Itoa(s.VLAN)).CombinedOutput()
+		if err != nil {
+			return fmt.Errorf("create VLAN %s: %v: %s", device, err, strings.TrimSpace(string(out)))
+		}
+	}
+	exec.Command("ip", "link", "set", device, "up").Run()
+	if ip, _ := getInterfaceIPv4CIDR(device); ip == "" {
+		exec.Command("ip", "addr", "replace", fmt.Sprintf("%s/%d", s.Address, s.Prefix), "dev", device).Run()
+	}
+	return nil
+}
+
+// removeLANSegment undoes configureLANSegment for a segment that was deleted.
+func removeLANSegment(s LANSegment) {
+	if usesNetworkManager() {
+		exec.Command("nmcli", "con", "delete", lanSegmentConnName(s)).Run()
+	} else if err := writeDhcpcdStanza(s.Device(), ""); err != nil {
+		log.Printf("LAN segment %s: remove %s from %s: %v", s.Name, s.Device(), dhcpcdConfFile, err)
+	}
+	if s.VLAN > 0 {
+		exec.Command("ip", "link", "del", s.Device()).Run()
+	} else {
+		exec.Command("ip", "addr", "del", fmt.Sprintf("%s/%d", s.Address, s.Prefix), "dev", s.Device()).Run()
+	}
+}
+
+// EnsureLANSegments recreates VLAN links on startup when NetworkManager does not manage them.
+func EnsureLANSegments() {
+	if usesNetworkManager() {
+		return
+	}
+	for _, s := range LANSegments(GetRouterConfig()) {
+		if err := ensureVLANLink(s); err != nil {
+			log.Printf("LAN segment %s: %v", s.Name, err)
+		}
+	}
+}
+
+// renderDnsmasqLANConf serves DHCP and DNS on every segment, one tagged range each.
+func renderDnsmasqLANConf(cfg RouterConfig) string {
+	segments := LANSegments(cfg)
+	var b strings.Builder
+	b.WriteString("# Managed by tailscale-raspberry-router\n")
+	var addresses []string
+	for _, s := range segments {
+		fmt.Fprintf(&b, "interface=%s\n", s.Device())
+		addresses = append(addresses, s.Address)
+	}
+	b.WriteString("bind-interfaces\n")
+	fmt.Fprintf(&b, "listen-address=%s\n", strings.Join(addresses, ","))
+	fmt.Fprintf(&b, "except-interface=%s\n", cfg.WANInterface)
+	for _, s := range segments {
+		hours := s.DHCPLeaseHours
+		if hours == 0 {
+			hours = cfg.DHCPLeaseHours
+		}
+		fmt.Fprintf(&b, "dhcp-range=set:%s,%s,%s,%s,%dh\n", s.Name, s.DHCPRangeStart, s.DHCPRangeEnd, prefixToNetmask(s.Prefix), hours)
+		fmt.Fprintf(&b, "dhcp-option=tag:%s,option:router,%s\n", s.Name, s.Address)
+		fmt.Fprintf(&b, "dhcp-option=tag:%s,option:dns-server,%s\n", s.Name, s.Address)
+		if s.Guest {
+			// RFC 8910 captive-portal URI, for clients that look for it.
+			fmt.Fprintf(&b, "dhcp-option=tag:%s,114,\"http://%s:%d/\"\n", s.Name, s.Address, guestPortalPort)
+		}
+	}
+	b.WriteString("no-resolv\nconf-file=/run/tailscale-router/upstream-servers.conf\n")
+	return b.String()
+}
+
+// applyDnsmasqLANConf rewrites the LAN part of dnsmasq's config after segments change.
+func applyDnsmasqLANConf(cfg RouterConfig) error {
+	if err := os.WriteFile(dnsmasqLANConfFile, []byte(renderDnsmasqLANConf(cfg)), 0644); err != nil {
+		return err
+	}
+	if out, err := exec.Command("dnsmasq", "--test").CombinedOutput(); err != nil {
+		return fmt.Errorf("dnsmasq config test failed: %v: %s", err, strings.TrimSpace(string(out)))
+	}
+	if out, err := exec.Command("systemctl", "restart", "dnsmasq").CombinedOutput(); err != nil {
+		return fmt.Errorf("systemctl restart dnsmasq: %v: %s%s", err, strings.TrimSpace(string(out)), dnsmasqJournalTail())
+	}
+	return nil
+}
+
+// segmentUsesExitNode reports whether a segment pinned to ref may use active.
+func segmentUsesExitNode(ref string, active *ExitNode, nodes map[string]ExitNode) bool {
+	if active == nil {
+		return false
+	}
+	if filter, ok := parseAutoExitNodeSpec(ref); ok {
+		return exitNodeMatchesFilter(*active, filter)
+	}
+	node, ok := findExitNode(nodes, ref)
+	return ok && node.ID == active.ID
+}
+
+// appendLANSegmentRules enforces isolation and per-segment modes. It runs right
+// after flushRouterIPTablesRules; its DROPs go into TS-ROUTER-GUARD, ahead of
+// tailscaled's ts-forward and the mode's ACCEPTs, its ACCEPTs into TS-ROUTER-FWD.
+// active is the exit node being applied, or nil in direct mode. Caller holds mu.
+func appendLANSegmentRules(active *ExitNode) {
+	segments := LANSegments(GetRouterConfig())
+	if len(segments) == 0 {
+		return
+	}
+
+	// Guest rules come first so nothing below can open a path for an unaccepted device.
+	for _, s := range segments {
+		if s.Guest {
+			appendGuestForwardRules(s)
+		}
+	}
+
+	// Inter-segment policy: replies always pass, new connections only where allowed.
+	for _, a := range segments {
+		for _, b := range segments {
+			if a.Name == b.Name {
+				continue
+			}
+			if a.canReach(b.Name) {
+				appendRouterForwardRule("-i", a.Device(), "-o", b.Device(), "-j", "ACCEPT")
+				continue
+			}
+			appendRouterGuardRule("-i", a.Device(), "-o", b.Device(), "-m", "state", "!", "--state", "RELATED,ESTABLISHED", "-j", "DROP")
+			appendRouterForwardRule("-i", a.Device(), "-o", b.Device(), "-m", "state", "--state", "RELATED,ESTABLISHED", "-j", "ACCEPT")
+		}
+	}
+
+	var nodes map[string]ExitNode
+	wans := ActiveWANInterfaces()
+	bypass := false
+	for _, s := range segments {
+		device := s.Device()
+		switch {
+		case s.Mode == SegmentModeNone:
+			log.Printf("LAN segment %s: no internet access", s.Name)
+			for _, wan := range wans {
+				appendRouterGuardRule("-i", device, "-o", wan, "-j", "DROP")
+			}
+			appendRouterGuardRule("-i", device, "-o", "tailscale0", "!", "-d", tailnetCIDR, "-j", "DROP")
+
+		case s.Mode == SegmentModeDirect && active != nil:
+			log.Printf("LAN segment %s: direct via WAN while the exit node is active", s.Name)
+			bypass = true
+			appendRouterSplitRule("-i", device, "-j", "MARK", "--set-mark", segmentDirectFwmark)
+			for _, wan := range wans {
+				appendRouterForwardRule("-i", device, "-o", wan, "-m", "state", "--state", "NEW,RELATED,ESTABLISHED", "-j", "ACCEPT")
+				appendRouterForwardRule("-i", wan, "-o", device, "-m", "state", "--state", "RELATED,ESTABLISHED", "-j", "ACCEPT")
+				appendRouterNatMasqueradeFrom(s.CIDR(), wan)
+			}
+
+		case strings.HasPrefix(s.Mode, "tailscale:"):
+			// Fail closed: never the WAN, and only the pinned node.
+			for _, wan := range wans {
+				appendRouterGuardRule("-i", device, "-o", wan, "-j", "DROP")
+			}
+			if nodes == nil && active != nil {
+				nodes, _ = GetExitNodes()
+			}
+			if !segmentUsesExitNode(strings.TrimPrefix(s.Mode, "tailscale:"), active, nodes) {
+				log.Printf("LAN segment %s: pinned exit node is not active, internet blocked", s.Name)
+				appendRouterGuardRule("-i", device, "-o", "tailscale0", "!", "-d", tailnetCIDR, "-j", "DROP")
+			}
+		}
+	}
+
+	if bypass {
+		ensureFwmarkRule(segmentDirectRulePriority, segmentDirectFwmark, "main")
+	} else {
+		deleteIPRulePriority(segmentDirectRulePriority)
+	}
+}
+
+// segmentInternetPath describes where a segment's internet traffic goes in mode.
+func segmentInternetPath(s LANSegment, mode string) string {
+	exitActive := strings.HasPrefix(mode, "tailscale:")
+	switch {
+	case s.Mode == SegmentModeNone:
+		return "blocked"
+	case s.Mode == SegmentModeDirect:
+		return "wan"
+	case strings.HasPrefix(s.Mode, "tailscale:"):
+		if !exitActive {
+			return "blocked"
+		}
+		if s.Mode == mode {
+			return "exit node"
+		}
+		return "exit node if it matches " + strings.TrimPrefix(s.Mode, "tailscale:")
+	case exitActive:
+		return "exit node"
+	default:
+		return "wan"
+	}
+}
+
+func GetLANSegmentStatus() []LANSegmentStatus {
+	mu.Lock()
+	mode := CurrentMode
+	mu.Unlock()
+
+	ipv4 := getIPv4ByInterface()
+	var result []LANSegmentStatus
+	for _, s := range LANSegments(GetRouterConfig()) {
+		s = normalizeLANSegment(s)
+		result = append(result, LANSegmentStatus{
+			LANSegment: s,
+			Device:     s.Device(),
+			CIDR:       s.CIDR(),
+			LinkUp:     wanLinkUp(s.Device()),
+			IPv4:       ipv4[s.Device()],
+			Internet:   segmentInternetPath(s, mode),
+		})
+	}
+	return result
+}
+
+// LANSegmentsHandler reads or replaces the LAN segments. The first segment is the
+// primary LAN (dashboard, health checks).
+// POST /lan/segments {"segments": [{"name": "trusted", "interface": "eth1", ...}, {"name": "guest", "interface": "eth1", "vlan": 20, ...}]}
+func LANSegmentsHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		var req struct {
+			Segments []LANSegment `json:"segments"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "invalid JSON body", http.StatusBadRequest)
+			return
+		}
+		for i := range req.Segments {
+			req.Segments[i] = normalizeLANSegment(req.Segments[i])
+		}
+
+		cfg := GetRouterConfig()
+		if err := validateLANSegments(cfg, req.Segments); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if cfg.WifiAP.Enabled && req.Segments[0].Device() != cfg.LANInterface {
+			http.Error(w, "the first segment must stay on the Wi-Fi access point interface "+cfg.LANInterface, http.StatusBadRequest)
+			return
+		}
+
+		previous := LANSegments(cfg)
+		guestAPChanged := cfg.WifiAP.Enabled && len(previous) > 0 && previous[0].Guest != req.Segments[0].Guest
+		setLANSegments(&cfg, req.Segments)
+
+		// Save first, then bring the interfaces in line with the saved config. A
+		// segment that fails does not stop the others, so the router ends up as
+		// close to the config as it can and the error names what was not applied.
+		if err := SaveRouterConfig(cfg); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		for _, old := range previous {
+			kept := false
+			for _, s := range req.Segments {
+				if s.Name == old.Name && s.Device() == old.Device() {
+					kept = true
+				}
+			}
+			if !kept {
+				removeLANSegment(old)
+			}
+		}
+		var applied, failed []string
+		for i, s := range req.Segments {
+			if i == 0 && cfg.WifiAP.Enabled {
+				applied = append(applied, s.Name)
+				continue // hostapd's unit owns the address
+			}
+			if err := configureLANSegment(s); err != nil {
+				log.Printf("LAN segment %s: %v", s.Name, err)
+				failed = append(failed, fmt.Sprintf("%s: %v", s.Name, err))
+				continue
+			}
+			applied = append(applied, s.Name)
+		}
+
+		if err := applyDnsmasqLANConf(cfg); err != nil {
+			failed = append(failed, "dnsmasq: "+err.Error())
+		}
+		ApplyLocalPolicyRouting(cfg)
+		ApplyGuestNetwork()
+		if guestAPChanged {
+			if err := configureWifiAP(cfg); err != nil {
+				log.Printf("Warning: update Wi-Fi client isolation: %v", err)
+			}
+		}
+		if cfg.SubnetRouter {
+			if err := applyTailscaleAdvertisedRoutes(cfg); err != nil {
+				log.Printf("Warning: advertise LAN segments: %v", err)
+			}
+		}
+		if err := ReapplyCurrentMode(); err != nil {
+			failed = append(failed, "routing: "+err.Error())
+		}
+		if len(failed) > 0 {
+			http.Error(w, fmt.Sprintf("segments saved; applied: %s; failed: %s",
+				strings.Join(applied, ", "), strings.Join(failed, "; ")), http.StatusInternalServerError)
+			return
+		}
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(GetLANSegmentStatus())
+}
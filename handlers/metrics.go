@@ -0,0 +1,377 @@
+package handlers
+
+import (
+	"crypto/subtle"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const dnsmasqLeasesFile = "/var/lib/misc/dnsmasq.leases"
+
+// metricsServices are reported by tsrouter_service_up.
+var metricsServices = []string{"dnsmasq", "tailscaled", "watchdog"}
+
+type modeSwitchKey struct {
+	Mode   string
+	Result string
+}
+
+var (
+	metricsMu        sync.Mutex
+	modeSwitchCounts = make(map[modeSwitchKey]uint64)
+	bootstrapCounts  = make(map[string]uint64) // keyed by result
+	repairCounts     = make(map[string]uint64) // keyed by result
+	lastBootstrapAt  time.Time
+	lastRepairAt     time.Time
+	// metricsProbing is set while a background latency probe for /metrics runs.
+	metricsProbing bool
+)
+
+func metricsResult(err error) string {
+	if err != nil {
+		return "failure"
+	}
+	return "success"
+}
+
+// modeKind collapses a saved mode into a low-cardinality label.
+func modeKind(mode string) string {
+	switch {
+	case mode == "direct":
+		return "direct"
+	case strings.HasPrefix(mode, "tailscale:auto"):
+		return "auto"
+	case strings.HasPrefix(mode, "tailscale:"):
+		return "exit_node"
+	}
+	return "unknown"
+}
+
+func recordModeSwitch(mode string, err error) {
+	metricsMu.Lock()
+	defer metricsMu.Unlock()
+	modeSwitchCounts[modeSwitchKey{Mode: modeKind(mode), Result: metricsResult(err)}]++
+}
+
+func recordBootstrapOutcome(err error) {
+	metricsMu.Lock()
+	defer metricsMu.Unlock()
+	bootstrapCounts[metricsResult(err)]++
+	lastBootstrapAt = time.Now()
+}
+
+func recordRepairOutcome(err error) {
+	metricsMu.Lock()
+	defer metricsMu.Unlock()
+	repairCounts[metricsResult(err)]++
+	lastRepairAt = time.Now()
+}
+
+// metricsToken returns the bearer token that grants /metrics access without a session.
+func metricsToken() string {
+	if token := GetRouterConfig().MetricsToken; token != "" {
+		return token
+	}
+	return os.Getenv("METRICS_TOKEN")
+}
+
+// metricsAuthorized accepts the token only in the Authorization header; a query
+// parameter would end up in access and proxy logs.
+func metricsAuthorized(r *http.Request) bool {
+	if token := metricsToken(); token != "" {
+		if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+			presented := strings.TrimPrefix(auth, "Bearer ")
+			if presented != "" && subtle.ConstantTimeCompare([]byte(presented), []byte(token)) == 1 {
+				return true
+			}
+		}
+	}
+	return hasAuthenticatedSession(r)
+}
+
+// refreshExitNodeLatency re-probes node in the background once its cached latency
+// is stale, so a scrape only ever exports cached values and never waits on ping.
+func refreshExitNodeLatency(node ExitNode) {
+	if cached, ok := cachedExitNodeLatency(node.IP); ok && time.Since(cached.Checked) < exitNodeLatencyTTL {
+		return
+	}
+	metricsMu.Lock()
+	if metricsProbing {
+		metricsMu.Unlock()
+		return
+	}
+	metricsProbing = true
+	metricsMu.Unlock()
+
+	go func() {
+		ProbeExitNodeLatencies(map[string]ExitNode{node.ID: node}, exitNodeLatencyTTL)
+		metricsMu.Lock()
+		metricsProbing = false
+		metricsMu.Unlock()
+	}()
+}
+
+// metricsWriter emits the Prometheus text exposition format.
+type metricsWriter struct {
+	w io.Writer
+}
+
+func (m metricsWriter) header(name, typ, help string) {
+	fmt.Fprintf(m.w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+// sample writes one value; labels are name/value pairs.
+func (m metricsWriter) sample(name string, value float64, labels ...string) {
+	var b strings.Builder
+	b.WriteString(name)
+	if len(labels) > 0 {
+		b.WriteByte('{')
+		for i := 0; i+1 < len(labels); i += 2 {
+			if i > 0 {
+				b.WriteByte(',')
+			}
+			fmt.Fprintf(&b, "%s=\"%s\"", labels[i], escapeMetricLabel(labels[i+1]))
+		}
+		b.WriteByte('}')
+	}
+	fmt.Fprintf(m.w, "%s %s\n", b.String(), strconv.FormatFloat(value, 'g', -1, 64))
+}
+
+func escapeMetricLabel(value string) string {
+	value = strings.ReplaceAll(value, `\`, `\\`)
+	value = strings.ReplaceAll(value, `"`, `\"`)
+	return strings.ReplaceAll(value, "\n", `\n`)
+}
+
+func boolMetric(v bool) float64 {
+	if v {
+		return 1
+	}
+	return 0
+}
+
+func readProcUint(path string) (float64, bool) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0, false
+	}
+	v, err := strconv.ParseFloat(strings.TrimSpace(string(data)), 64)
+	return v, err == nil
+}
+
+func countDnsmasqLeases() (int, bool) {
+	leases, err := parseDnsmasqLeases()
+	if err != nil {
+		return 0, false
+	}
+	return len(leases), true
+}
+
+// queryDnsmasqStat reads a dnsmasq counter such as "hits.bind" via a CHAOS TXT query.
+func queryDnsmasqStat(server, name string) (float64, error) {
+	conn, err := net.DialTimeout("udp", net.JoinHostPort(server, "53"), time.Second)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(time.Second))
+
+	query := []byte{0x13, 0x37, 0x01, 0x00, 0, 1, 0, 0, 0, 0, 0, 0}
+	for _, label := range strings.Split(name, ".") {
+		query = append(query, byte(len(label)))
+		query = append(query, label...)
+	}
+	query = append(query, 0, 0, 16, 0, 3) // TXT, CHAOS
+	if _, err := conn.Write(query); err != nil {
+		return 0, err
+	}
+
+	buf := make([]byte, 512)
+	n, err := conn.Read(buf)
+	if err != nil {
+		return 0, err
+	}
+	resp := buf[:n]
+	if n < 12 || binary.BigEndian.Uint16(resp[6:8]) == 0 {
+		return 0, fmt.Errorf("no answer for %s", name)
+	}
+
+	// Skip the echoed question, then the answer name, type, class and TTL.
+	pos := len(query)
+	if pos+2 > n {
+		return 0, fmt.Errorf("short answer for %s", name)
+	}
+	if resp[pos]&0xc0 == 0xc0 {
+		pos += 2
+	} else {
+		for pos < n && resp[pos] != 0 {
+			pos += int(resp[pos]) + 1
+		}
+		pos++
+	}
+	pos += 8
+	if pos+3 > n {
+		return 0, fmt.Errorf("short answer for %s", name)
+	}
+	rdlen := int(binary.BigEndian.Uint16(resp[pos : pos+2]))
+	txtLen := int(resp[pos+2])
+	if pos+2+rdlen > n || txtLen+1 > rdlen {
+		return 0, fmt.Errorf("malformed answer for %s", name)
+	}
+	return strconv.ParseFloat(string(resp[pos+3:pos+3+txtLen]), 64)
+}
+
+// writeRouterMetrics gathers everything exported on /metrics.
+func writeRouterMetrics(w io.Writer) {
+	m := metricsWriter{w: w}
+	cfg := GetRouterConfig()
+	mode := diagnosticMode()
+
+	m.header("tsrouter_mode", "gauge", "Active routing mode (1 for the current kind).")
+	for _, kind := range []string{"direct", "exit_node", "auto"} {
+		m.sample("tsrouter_mode", boolMetric(modeKind(mode) == kind), "mode", kind)
+	}
+	m.header("tsrouter_mode_info", "gauge", "Saved mode string.")
+	m.sample("tsrouter_mode_info", 1, "mode", mode)
+
+	if strings.HasPrefix(mode, "tailscale:") {
+		if nodes, err := GetExitNodes(); err == nil {
+			online := 0
+			for _, node := range nodes {
+				if node.Online {
+					online++
+				}
+			}
+			m.header("tsrouter_exit_nodes_online", "gauge", "Exit nodes currently online in the tailnet.")
+			m.sample("tsrouter_exit_nodes_online", float64(online))
+
+			ref := strings.TrimPrefix(mode, "tailscale:")
+			if _, ok := parseAutoExitNodeSpec(ref); ok {
+				mu.Lock()
+				ref = autoExitNode
+				mu.Unlock()
+			}
+			if node, ok := findExitNode(nodes, ref); ok {
+				refreshExitNodeLatency(node)
+				m.header("tsrouter_exit_node_online", "gauge", "Whether the active exit node is online.")
+				m.sample("tsrouter_exit_node_online", boolMetric(node.Online), "node", node.ID, "name", node.Name)
+				if cached, ok := cachedExitNodeLatency(node.IP); ok && cached.Err == "" {
+					m.header("tsrouter_exit_node_latency_seconds", "gauge", "Last measured round-trip time to the active exit node.")
+					m.sample("tsrouter_exit_node_latency_seconds", cached.Latency.Seconds(), "node", node.ID, "name", node.Name)
+				}
+			}
+		}
+	}
+
+	ifaces, _ := filepath.Glob("/sys/class/net/*/statistics")
+	m.header("tsrouter_network_receive_bytes_total", "counter", "Bytes received per interface.")
+	for _, dir := range ifaces {
+		iface := filepath.Base(filepath.Dir(dir))
+		if iface == "lo" {
+			continue
+		}
+		if v, ok := readProcUint(filepath.Join(dir, "rx_bytes")); ok {
+			m.sample("tsrouter_network_receive_bytes_total", v, "interface", iface)
+		}
+	}
+	m.header("tsrouter_network_transmit_bytes_total", "counter", "Bytes transmitted per interface.")
+	for _, dir := range ifaces {
+		iface := filepath.Base(filepath.Dir(dir))
+		if iface == "lo" {
+			continue
+		}
+		if v, ok := readProcUint(filepath.Join(dir, "tx_bytes")); ok {
+			m.sample("tsrouter_network_transmit_bytes_total", v, "interface", iface)
+		}
+	}
+
+	if v, ok := readProcUint("/proc/sys/net/netfilter/nf_conntrack_count"); ok {
+		m.header("tsrouter_conntrack_entries", "gauge", "Tracked connections.")
+		m.sample("tsrouter_conntrack_entries", v)
+	}
+	if v, ok := readProcUint("/proc/sys/net/netfilter/nf_conntrack_max"); ok {
+		m.header("tsrouter_conntrack_entries_limit", "gauge", "Maximum tracked connections.")
+		m.sample("tsrouter_conntrack_entries_limit", v)
+	}
+
+	if leases, ok := countDnsmasqLeases(); ok {
+		m.header("tsrouter_dhcp_leases", "gauge", "Active dnsmasq DHCP leases.")
+		m.sample("tsrouter_dhcp_leases", float64(leases))
+	}
+
+	if cfg.LANAddress != "" {
+		stats := []struct {
+			query, name, typ, help string
+		}{
+			{"cachesize.bind", "tsrouter_dns_cache_size", "gauge", "dnsmasq cache size."},
+			{"insertions.bind", "tsrouter_dns_cache_insertions_total", "counter", "dnsmasq cache insertions."},
+			{"evictions.bind", "tsrouter_dns_cache_evictions_total", "counter", "dnsmasq cache evictions of unexpired entries."},
+			{"hits.bind", "tsrouter_dns_cache_hits_total", "counter", "Queries answered from the dnsmasq cache."},
+			{"misses.bind", "tsrouter_dns_cache_misses_total", "counter", "Queries forwarded upstream by dnsmasq."},
+		}
+		for _, stat := range stats {
+			v, err := queryDnsmasqStat(cfg.LANAddress, stat.query)
+			if err != nil {
+				continue
+			}
+			m.header(stat.name, stat.typ, stat.help)
+			m.sample(stat.name, v)
+		}
+	}
+
+	m.header("tsrouter_service_up", "gauge", "Whether a systemd service is active.")
+	for _, service := range metricsServices {
+		active := exec.Command("systemctl", "is-active", "--quiet", service).Run() == nil
+		m.sample("tsrouter_service_up", boolMetric(active), "service", service)
+	}
+
+	metricsMu.Lock()
+	defer metricsMu.Unlock()
+
+	m.header("tsrouter_mode_switches_total", "counter", "Routing mode applications by target kind and result.")
+	for key, count := range modeSwitchCounts {
+		m.sample("tsrouter_mode_switches_total", float64(count), "mode", key.Mode, "result", key.Result)
+	}
+	m.header("tsrouter_bootstrap_runs_total", "counter", "Bootstrap runs by result.")
+	for result, count := range bootstrapCounts {
+		m.sample("tsrouter_bootstrap_runs_total", float64(count), "result", result)
+	}
+	if !lastBootstrapAt.IsZero() {
+		m.header("tsrouter_bootstrap_last_run_timestamp_seconds", "gauge", "Unix time of the last bootstrap run.")
+		m.sample("tsrouter_bootstrap_last_run_timestamp_seconds", float64(lastBootstrapAt.Unix()))
+	}
+	m.header("tsrouter_repair_runs_total", "counter", "Routing and DNS repairs by result.")
+	for result, count := range repairCounts {
+		m.sample("tsrouter_repair_runs_total", float64(count), "result", result)
+	}
+	if !lastRepairAt.IsZero() {
+		m.header("tsrouter_repair_last_run_timestamp_seconds", "gauge", "Unix time of the last repair.")
+		m.sample("tsrouter_repair_last_run_timestamp_seconds", float64(lastRepairAt.Unix()))
+	}
+}
+
+// MetricsHandler serves Prometheus metrics to a logged-in session or a bearer token.
+func MetricsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !metricsAuthorized(r) {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="tailscale-router"`)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	writeRouterMetrics(w)
+}
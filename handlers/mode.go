@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"io/ioutil"
 	"log"
+	"strings"
 )
 
 const modeFile = "/etc/tailscale-mode.json" // Persistent storage for mode
@@ -36,3 +37,20 @@ func SaveMode(mode string) {
 	data, _ := json.Marshal(state)
 	ioutil.WriteFile(modeFile, data, 0644)
 }
+
+// ReapplyCurrentMode rebuilds routing for the saved mode after a settings change.
+func ReapplyCurrentMode() error {
+	if strings.HasPrefix(CurrentMode, "tailscale:") {
+		return SetTailscaleExitNode(strings.TrimPrefix(CurrentMode, "tailscale:"))
+	}
+	return DisableTailscaleExitNode()
+}
+
+// currentEgressInterfaces is where LAN traffic leaves the router in the current
+// mode: tailscale0 with an exit node, the active WAN links otherwise. Caller holds mu.
+func currentEgressInterfaces() []string {
+	if strings.HasPrefix(CurrentMode, "tailscale:") {
+		return []string{"tailscale0"}
+	}
+	return ActiveWANInterfaces()
+}
@@ -0,0 +1,375 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MSS clamp modes for an egress interface.
+const (
+	MSSClampPMTU  = "pmtu"  // --clamp-mss-to-pmtu: follows the interface/route MTU
+	MSSClampFixed = "fixed" // a configured MSS
+	MSSClampAuto  = "auto"  // from the last DF-ping probe of the path
+	MSSClampOff   = "off"
+)
+
+const (
+	mtuProbesFile    = stateDir + "/mtu_probes.json"
+	mtuProbeMin      = 576
+	mtuProbeMaxAge   = 6 * time.Hour
+	mtuProbeInterval = 10 * time.Minute
+	tcpIPv4Overhead  = 40 // IPv4 + TCP headers without options
+	icmpIPv4Overhead = 28 // IPv4 + ICMP echo headers
+)
+
+// MSSClampConfig is the clamp for one egress interface; interfaces without an
+// entry use pmtu.
+type MSSClampConfig struct {
+	Mode string `json:"mode"`
+	MSS  int    `json:"mss,omitempty"` // fixed mode only
+}
+
+// MSSClampSettings maps egress interface names to their clamp.
+type MSSClampSettings map[string]MSSClampConfig
+
+// MTUProbeResult is the outcome of a DF-ping binary search over one path.
+type MTUProbeResult struct {
+	Interface    string    `json:"interface"`
+	Target       string    `json:"target"`
+	InterfaceMTU int       `json:"interface_mtu"`
+	PathMTU      int       `json:"path_mtu,omitempty"`
+	MSS          int       `json:"mss,omitempty"` // PathMTU minus IPv4/TCP headers
+	Steps        []string  `json:"steps,omitempty"`
+	Error        string    `json:"error,omitempty"`
+	Time         time.Time `json:"time"`
+}
+
+// MTUEgressStatus is the API view of one active egress.
+type MTUEgressStatus struct {
+	Interface    string          `json:"interface"`
+	Mode         string          `json:"mode"`
+	MSS          int             `json:"mss,omitempty"` // set MSS; 0 with pmtu means it follows the route
+	InterfaceMTU int             `json:"interface_mtu"`
+	Probe        *MTUProbeResult `json:"probe,omitempty"`
+}
+
+// MTUStatus is returned by /mtu.
+type MTUStatus struct {
+	Clamp  MSSClampSettings  `json:"mss_clamp"`
+	Egress []MTUEgressStatus `json:"egress"`
+	Probes []MTUProbeResult  `json:"probes"` // last probe of every WAN link and tailscale0
+}
+
+var (
+	mtuMu     sync.Mutex
+	mtuProbes map[string]MTUProbeResult // by interface, loaded lazily
+)
+
+func loadMTUProbesLocked() {
+	if mtuProbes != nil {
+		return
+	}
+	mtuProbes = make(map[string]MTUProbeResult)
+	data, err := os.ReadFile(mtuProbesFile)
+	if err != nil {
+		return
+	}
+	if err := json.Unmarshal(data, &mtuProbes); err != nil {
+		log.Printf("Ignoring unreadable %s: %v", mtuProbesFile, err)
+		mtuProbes = make(map[string]MTUProbeResult)
+	}
+}
+
+func saveMTUProbesLocked() error {
+	if err := os.MkdirAll(stateDir, 0755); err != nil {
+		return err
+	}
+	data, err := json.Marshal(mtuProbes)
+	if err != nil {
+		return err
+	}
+	tmp := mtuProbesFile + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, mtuProbesFile)
+}
+
+func lastMTUProbe(iface string) (MTUProbeResult, bool) {
+	mtuMu.Lock()
+	defer mtuMu.Unlock()
+	loadMTUProbesLocked()
+	r, ok := mtuProbes[iface]
+	return r, ok
+}
+
+func interfaceMTU(iface string) int {
+	if ifi, err := net.InterfaceByName(iface); err == nil {
+		return ifi.MTU
+	}
+	return 0
+}
+
+// mtuProbeTarget is the address pinged through iface: the WAN link's health probe
+// target when one is configured.
+func mtuProbeTarget(iface string) string {
+	for _, link := range GetRouterConfig().WANLinks {
+		if link.Interface == iface && link.ProbeTarget != "" {
+			return link.ProbeTarget
+		}
+	}
+	return wanDefaultProbeTarget
+}
+
+// pingDF sends don't-fragment pings sized to exactly mtu bytes on the wire.
+func pingDF(iface, target string, mtu int) bool {
+	return exec.Command("ping", "-M", "do", "-s", fmt.Sprint(mtu-icmpIPv4Overhead),
+		"-c", "2", "-i", "0.2", "-W", "1", "-I", iface, target).Run() == nil
+}
+
+// probePathMTU finds the largest packet that reaches target through iface without
+// fragmentation, by binary search between mtuProbeMin and the interface MTU.
+func probePathMTU(iface string) MTUProbeResult {
+	r := MTUProbeResult{Interface: iface, Target: mtuProbeTarget(iface), InterfaceMTU: interfaceMTU(iface), Time: time.Now()}
+	if r.InterfaceMTU == 0 {
+		r.Error = iface + " not found"
+		return r
+	}
+	try := func(mtu int) bool {
+		ok := pingDF(iface, r.Target, mtu)
+		mark := "✗"
+		if ok {
+			mark = "✓"
+		}
+		r.Steps = append(r.Steps, fmt.Sprintf("%d %s", mtu, mark))
+		return ok
+	}
+
+	if try(r.InterfaceMTU) {
+		r.PathMTU = r.InterfaceMTU
+	} else if !try(mtuProbeMin) {
+		r.Error = fmt.Sprintf("no reply from %s via %s, even at %d bytes", r.Target, iface, mtuProbeMin)
+		return r
+	} else {
+		lo, hi := mtuProbeMin, r.InterfaceMTU // lo passes, hi fails
+		for hi-lo > 1 {
+			mid := (lo + hi) / 2
+			if try(mid) {
+				lo = mid
+			} else {
+				hi = mid
+			}
+		}
+		r.PathMTU = lo
+	}
+	r.MSS = r.PathMTU - tcpIPv4Overhead
+	return r
+}
+
+// runMTUProbe probes iface, stores the result and re-applies the clamp when an
+// auto-mode interface got a different MSS. Callers must not hold mu.
+func runMTUProbe(iface string) MTUProbeResult {
+	r := probePathMTU(iface)
+	if r.Error != "" {
+		log.Printf("MTU probe %s: %s", iface, r.Error)
+	} else {
+		log.Printf("MTU probe %s: path MTU %d to %s (interface %d)", iface, r.PathMTU, r.Target, r.InterfaceMTU)
+	}
+
+	mtuMu.Lock()
+	loadMTUProbesLocked()
+	prev, had := mtuProbes[iface]
+	if r.Error == "" || !had {
+		mtuProbes[iface] = r
+	}
+	if err := saveMTUProbesLocked(); err != nil {
+		log.Printf("Saving %s: %v", mtuProbesFile, err)
+	}
+	mtuMu.Unlock()
+
+	if r.Error == "" && mssClampSetting(iface).Mode == MSSClampAuto && (!had || prev.MSS != r.MSS) {
+		mu.Lock()
+		reapplyMSSClamp(currentEgressInterfaces())
+		mu.Unlock()
+	}
+	return r
+}
+
+func mssClampSetting(iface string) MSSClampConfig {
+	c, ok := GetRouterConfig().MSSClamp[iface]
+	if !ok || c.Mode == "" {
+		return MSSClampConfig{Mode: MSSClampPMTU}
+	}
+	return c
+}
+
+// effectiveMSS is the MSS the clamp sets on iface, 0 when it follows the route MTU
+// (pmtu, or auto without a usable probe) or the clamp is off.
+func effectiveMSS(iface string) (mode string, mss int) {
+	c := mssClampSetting(iface)
+	switch c.Mode {
+	case MSSClampFixed:
+		return c.Mode, c.MSS
+	case MSSClampAuto:
+		if r, ok := lastMTUProbe(iface); ok && r.MSS > 0 && r.PathMTU < r.InterfaceMTU {
+			return c.Mode, r.MSS
+		}
+	}
+	return c.Mode, 0
+}
+
+// mssClampArgs is the TCPMSS match and target for SYNs leaving iface, or nil when
+// the clamp is off. A set MSS only ever lowers what the endpoints offered.
+func mssClampArgs(iface string) []string {
+	mode, mss := effectiveMSS(iface)
+	if mode == MSSClampOff {
+		return nil
+	}
+	if mss == 0 {
+		return []string{"-j", "TCPMSS", "--clamp-mss-to-pmtu"}
+	}
+	return []string{"-m", "tcpmss", "--mss", fmt.Sprintf("%d:65535", mss+1), "-j", "TCPMSS", "--set-mss", fmt.Sprint(mss)}
+}
+
+// reapplyMSSClamp rebuilds TS-ROUTER-MSS for the given egress. Caller holds mu.
+func reapplyMSSClamp(egress []string) {
+	clearRouterMSSClamp()
+	for _, iface := range egress {
+		ensureRouterMSSClamp(iface)
+	}
+}
+
+// mtuProbeInterfaces lists every WAN link and tailscale0 whatever the mode, so
+// both paths have a probe on record. ping -I binds to the interface, so a path
+// is probed even while traffic leaves through the other one.
+func mtuProbeInterfaces() []string {
+	ifaces := ActiveWANInterfaces()
+	for _, link := range GetRouterConfig().WANLinks {
+		if !containsString(ifaces, link.Interface) {
+			ifaces = append(ifaces, link.Interface)
+		}
+	}
+	return append(ifaces, "tailscale0")
+}
+
+// RunMTUProbes keeps the probes of every WAN link and tailscale0 fresh.
+func RunMTUProbes() {
+	time.Sleep(2 * time.Minute)
+	for {
+		for _, iface := range mtuProbeInterfaces() {
+			if r, ok := lastMTUProbe(iface); ok && r.Error == "" && time.Since(r.Time) < mtuProbeMaxAge {
+				continue
+			}
+			runMTUProbe(iface)
+		}
+		time.Sleep(mtuProbeInterval)
+	}
+}
+
+func GetMTUStatus() MTUStatus {
+	mu.Lock()
+	egress := currentEgressInterfaces()
+	mu.Unlock()
+
+	status := MTUStatus{Clamp: GetRouterConfig().MSSClamp, Egress: []MTUEgressStatus{}}
+	if status.Clamp == nil {
+		status.Clamp = MSSClampSettings{}
+	}
+	for _, iface := range egress {
+		e := MTUEgressStatus{Interface: iface, InterfaceMTU: interfaceMTU(iface)}
+		e.Mode, e.MSS = effectiveMSS(iface)
+		if r, ok := lastMTUProbe(iface); ok {
+			e.Probe = &r
+		}
+		status.Egress = append(status.Egress, e)
+	}
+	status.Probes = []MTUProbeResult{}
+	for _, iface := range mtuProbeInterfaces() {
+		if r, ok := lastMTUProbe(iface); ok {
+			status.Probes = append(status.Probes, r)
+		}
+	}
+	return status
+}
+
+func validateMSSClamp(clamp MSSClampSettings) error {
+	for iface, c := range clamp {
+		if iface == "" || len(iface) > 15 || strings.ContainsAny(iface, " /") {
+			return fmt.Errorf("invalid interface name %q", iface)
+		}
+		switch c.Mode {
+		case MSSClampPMTU, MSSClampAuto, MSSClampOff:
+			if c.MSS != 0 {
+				return fmt.Errorf("%s: mss is only used with mode fixed", iface)
+			}
+		case MSSClampFixed:
+			if c.MSS < mtuProbeMin-tcpIPv4Overhead || c.MSS > 9000-tcpIPv4Overhead {
+				return fmt.Errorf("%s: mss must be %d-%d", iface, mtuProbeMin-tcpIPv4Overhead, 9000-tcpIPv4Overhead)
+			}
+		default:
+			return fmt.Errorf("%s: mode must be pmtu, fixed, auto or off", iface)
+		}
+	}
+	return nil
+}
+
+// MTUHandler reads or updates the per-egress MSS clamp.
+// POST /mtu {"mss_clamp": {"ppp0": {"mode": "fixed", "mss": 1452}, "wwan0": {"mode": "auto"}}}
+func MTUHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		var req struct {
+			MSSClamp MSSClampSettings `json:"mss_clamp"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "invalid JSON body", http.StatusBadRequest)
+			return
+		}
+		for iface, c := range req.MSSClamp {
+			c.Mode = strings.ToLower(strings.TrimSpace(c.Mode))
+			req.MSSClamp[iface] = c
+		}
+		if err := validateMSSClamp(req.MSSClamp); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		cfg := GetRouterConfig()
+		cfg.MSSClamp = req.MSSClamp
+		if err := SaveRouterConfig(cfg); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		mu.Lock()
+		reapplyMSSClamp(currentEgressInterfaces())
+		mu.Unlock()
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(GetMTUStatus())
+}
+
+// MTUProbeHandler probes the path MTU of every WAN link and tailscale0 now (POST /mtu/probe).
+func MTUProbeHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	for _, iface := range mtuProbeInterfaces() {
+		runMTUProbe(iface)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(GetMTUStatus())
+}
@@ -0,0 +1,478 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	WANModeFailover = "failover"
+	WANModeBalance  = "balance"
+
+	// EventWANChange is recorded when the set of WANs carrying traffic changes.
+	EventWANChange = "wan_change"
+
+	// wanRouteMetric sits below the DHCP client's per-interface defaults (200+),
+	// so the managed default route wins while theirs stay usable for probes.
+	wanRouteMetric        = 50
+	wanProbeInterval      = 10 * time.Second
+	wanFailAfter          = 3 // consecutive failed probes before a link is taken out
+	wanDefaultProbeTarget = "1.1.1.1"
+)
+
+// WANLink is one uplink. Order in RouterConfig.WANLinks is failover priority.
+type WANLink struct {
+	Interface   string `json:"interface"`
+	Weight      int    `json:"weight,omitempty"`       // share of new flows in balance mode (default 1)
+	ProbeTarget string `json:"probe_target,omitempty"` // pinged through the link (default 1.1.1.1)
+}
+
+// WANLinkStatus is the API view of one uplink.
+type WANLinkStatus struct {
+	WANLink
+	Gateway string `json:"gateway,omitempty"`
+	LinkUp  bool   `json:"link_up"`
+	Healthy bool   `json:"healthy"`
+	Active  bool   `json:"active"`
+	Error   string `json:"error,omitempty"`
+}
+
+// WANStatus is returned by GET /wan.
+type WANStatus struct {
+	Mode   string          `json:"mode"`
+	Active []string        `json:"active"`
+	Links  []WANLinkStatus `json:"links"`
+}
+
+var (
+	wanMu sync.Mutex
+	// activeWANs are the interfaces carrying traffic, primary first. Nil while
+	// multi-WAN is off or not yet evaluated.
+	activeWANs    []string
+	wanHealthy    = make(map[string]bool)
+	wanRegistered = make(map[string]bool)
+
+	// wanEvalMu serializes evaluateWANs, so WANHandler and RunWANFailover never
+	// apply the same change twice.
+	wanEvalMu sync.Mutex
+)
+
+func multiWANEnabled(cfg RouterConfig) bool {
+	return len(cfg.WANLinks) > 1
+}
+
+func wanMode(cfg RouterConfig) string {
+	if cfg.WANMode == WANModeBalance {
+		return WANModeBalance
+	}
+	return WANModeFailover
+}
+
+func wanProbeName(iface string) string {
+	return "wan:" + iface
+}
+
+func findWANLink(cfg RouterConfig, iface string) (WANLink, bool) {
+	for _, link := range cfg.WANLinks {
+		if link.Interface == iface {
+			return link, true
+		}
+	}
+	return WANLink{}, false
+}
+
+// activeWANInterface is the primary WAN chosen by failover, or "" when multi-WAN is off.
+func activeWANInterface() string {
+	wanMu.Lock()
+	defer wanMu.Unlock()
+	if len(activeWANs) == 0 {
+		return ""
+	}
+	return activeWANs[0]
+}
+
+// ActiveWANInterfaces lists every WAN that direct mode should NAT out of.
+func ActiveWANInterfaces() []string {
+	wanMu.Lock()
+	active := append([]string(nil), activeWANs...)
+	wanMu.Unlock()
+	if len(active) > 0 {
+		return active
+	}
+
+	iface, err := GetActiveInternetInterface()
+	if err != nil {
+		log.Println("Error detecting active interface, defaulting to eth0")
+		iface = "eth0"
+	}
+	return []string{iface}
+}
+
+// wanGateway reads the DHCP-provided gateway for iface ("" for point-to-point links).
+func wanGateway(iface string) string {
+	out, err := exec.Command("ip", "-4", "route", "show", "default", "dev", iface).Output()
+	if err != nil {
+		return ""
+	}
+	for _, line := range strings.Split(string(out), "\n") {
+		fields := strings.Fields(line)
+		for i := 0; i+1 < len(fields); i++ {
+			if fields[i] == "via" {
+				return fields[i+1]
+			}
+		}
+	}
+	return ""
+}
+
+// probeWANLink pings the link's target bound to the interface, bypassing the managed route.
+func probeWANLink(link WANLink) (string, error) {
+	if !wanLinkUp(link.Interface) {
+		return "", fmt.Errorf("%s has no link", link.Interface)
+	}
+	target := link.ProbeTarget
+	if target == "" {
+		target = wanDefaultProbeTarget
+	}
+	if err := exec.Command("ping", "-c", "1", "-W", "2", "-I", link.Interface, target).Run(); err != nil {
+		return "", fmt.Errorf("no reply from %s via %s", target, link.Interface)
+	}
+	return fmt.Sprintf("%s reachable via %s", target, link.Interface), nil
+}
+
+// ensureWANProbes registers a health probe for each configured link. Links that are
+// removed later report "skipped".
+func ensureWANProbes(cfg RouterConfig) {
+	for _, link := range cfg.WANLinks {
+		iface := link.Interface
+		wanMu.Lock()
+		registered := wanRegistered[iface]
+		wanRegistered[iface] = true
+		wanMu.Unlock()
+		if registered {
+			continue
+		}
+
+		RegisterHealthProbe(HealthProbe{
+			Name:        wanProbeName(iface),
+			Description: "Internet reachable via " + iface,
+			Interval:    wanProbeInterval,
+			Applies: func() bool {
+				cfg := GetRouterConfig()
+				_, ok := findWANLink(cfg, iface)
+				return IsConfigured() && multiWANEnabled(cfg) && ok
+			},
+			Check: func() (string, error) {
+				link, _ := findWANLink(GetRouterConfig(), iface)
+				return probeWANLink(link)
+			},
+		})
+	}
+}
+
+// wanLinkHealthy applies hysteresis: a link drops out after wanFailAfter failed
+// probes and comes back on the first success.
+func wanLinkHealthy(link WANLink) bool {
+	status, ok := getHealthProbeStatus(wanProbeName(link.Interface))
+
+	wanMu.Lock()
+	defer wanMu.Unlock()
+	healthy, known := wanHealthy[link.Interface]
+	switch {
+	case ok && status.Status == "ok":
+		healthy = true
+	case ok && status.Status == "failing":
+		healthy = (!known || healthy) && status.ConsecutiveFailures < wanFailAfter
+	default:
+		healthy = wanLinkUp(link.Interface)
+	}
+	wanHealthy[link.Interface] = healthy
+	return healthy
+}
+
+// applyWANRoutes installs the managed default route over the selected links.
+func applyWANRoutes(links []WANLink) error {
+	args := []string{"route", "replace", "default", "metric", fmt.Sprint(wanRouteMetric)}
+	if len(links) == 1 {
+		if gw := wanGateway(links[0].Interface); gw != "" {
+			args = append(args, "via", gw)
+		}
+		args = append(args, "dev", links[0].Interface)
+	} else {
+		// Hash on ports too so one client's flows spread across links.
+		exec.Command("sysctl", "-w", "net.ipv4.fib_multipath_hash_policy=1").Run()
+		for _, link := range links {
+			weight := link.Weight
+			if weight <= 0 {
+				weight = 1
+			}
+			args = append(args, "nexthop")
+			if gw := wanGateway(link.Interface); gw != "" {
+				args = append(args, "via", gw)
+			}
+			args = append(args, "dev", link.Interface, "weight", fmt.Sprint(weight))
+		}
+	}
+
+	if out, err := exec.Command("ip", args...).CombinedOutput(); err != nil {
+		return fmt.Errorf("%v: %s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+func clearWANRoutes() {
+	exec.Command("ip", "route", "del", "default", "metric", fmt.Sprint(wanRouteMetric)).Run()
+}
+
+func sameInterfaces(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// evaluateWANs picks the links that should carry traffic and applies changes.
+// force rewrites the route even when the same links stay active (new weights).
+// The config is read under wanEvalMu, so a run that waited for another never
+// applies settings older than the ones just applied.
+func evaluateWANs(force bool) {
+	wanEvalMu.Lock()
+	defer wanEvalMu.Unlock()
+
+	cfg := GetRouterConfig()
+	if !multiWANEnabled(cfg) {
+		wanMu.Lock()
+		wasManaged := activeWANs != nil
+		activeWANs = nil
+		wanMu.Unlock()
+		if wasManaged {
+			clearWANRoutes()
+			if err := ReapplyCurrentMode(); err != nil {
+				log.Printf("WAN: reapply mode: %v", err)
+			}
+		}
+		return
+	}
+
+	var healthy []WANLink
+	for _, link := range cfg.WANLinks {
+		if wanLinkHealthy(link) {
+			healthy = append(healthy, link)
+		}
+	}
+	if len(healthy) == 0 {
+		// Nothing answers; stay on the primary rather than removing every route.
+		healthy = cfg.WANLinks[:1]
+	}
+	selected := healthy[:1]
+	if wanMode(cfg) == WANModeBalance {
+		selected = healthy
+	}
+
+	var next []string
+	for _, link := range selected {
+		next = append(next, link.Interface)
+	}
+	wanMu.Lock()
+	prev := activeWANs
+	wanMu.Unlock()
+	changed := !sameInterfaces(prev, next)
+	if !changed && !force {
+		return
+	}
+
+	if err := applyWANRoutes(selected); err != nil {
+		log.Printf("WAN: default route via %s: %v", strings.Join(next, ","), err)
+		return
+	}
+	wanMu.Lock()
+	activeWANs = next
+	wanMu.Unlock()
+	if changed {
+		onWANChange(cfg, prev, next)
+	}
+}
+
+// onWANChange rebuilds NAT and traffic accounting for the new uplinks and tells
+// tailscaled to rebind its sockets.
+func onWANChange(cfg RouterConfig, prev, next []string) {
+	before, after := strings.Join(prev, ","), strings.Join(next, ",")
+	if prev == nil {
+		// First evaluation after start: nothing moved if the primary is in use.
+		if after == cfg.WANInterface {
+			return
+		}
+		before = cfg.WANInterface
+	}
+	log.Printf("WAN: traffic now via %s (was %s)", after, before)
+
+	if err := ReapplyCurrentMode(); err != nil {
+		log.Printf("WAN: reapply mode: %v", err)
+	}
+	RebuildTrafficAccounting()
+	if out, err := exec.Command("tailscale", "debug", "rebind").CombinedOutput(); err != nil {
+		log.Printf("WAN: tailscale rebind: %v: %s", err, strings.TrimSpace(string(out)))
+	}
+
+	RecordEvent(Event{Type: EventWANChange, Before: before, After: after, Result: "success"})
+	Notify(NotifyWANFailover, "warning", "wan", "WAN changed",
+		fmt.Sprintf("Internet traffic now leaves via %s (was %s).", after, before))
+}
+
+// RunWANFailover probes every configured WAN and moves traffic when the active one fails.
+func RunWANFailover() {
+	for {
+		cfg := GetRouterConfig()
+		if IsConfigured() {
+			ensureWANProbes(cfg)
+			evaluateWANs(false)
+		}
+		time.Sleep(wanProbeInterval)
+	}
+}
+
+func GetWANStatus() WANStatus {
+	cfg := GetRouterConfig()
+	links := cfg.WANLinks
+	if len(links) == 0 && cfg.WANInterface != "" {
+		links = []WANLink{{Interface: cfg.WANInterface}}
+	}
+
+	active := ActiveWANInterfaces()
+	isActive := make(map[string]bool)
+	for _, iface := range active {
+		isActive[iface] = true
+	}
+
+	status := WANStatus{Mode: wanMode(cfg), Active: active, Links: []WANLinkStatus{}}
+	for _, link := range links {
+		linkStatus := WANLinkStatus{
+			WANLink: link,
+			Gateway: wanGateway(link.Interface),
+			LinkUp:  wanLinkUp(link.Interface),
+			Active:  isActive[link.Interface],
+		}
+		linkStatus.Healthy = linkStatus.LinkUp
+		if probe, ok := getHealthProbeStatus(wanProbeName(link.Interface)); ok && probe.Status != "skipped" {
+			linkStatus.Healthy = probe.Status != "failing"
+			linkStatus.Error = probe.Error
+		}
+		status.Links = append(status.Links, linkStatus)
+	}
+	return status
+}
+
+type wanSettingsRequest struct {
+	Mode  string    `json:"mode"`
+	Links []WANLink `json:"links"`
+}
+
+func validateWANLinks(cfg RouterConfig, links []WANLink) error {
+	if len(links) == 0 {
+		return fmt.Errorf("at least one WAN interface is required")
+	}
+	seen := make(map[string]bool)
+	for _, link := range links {
+		if link.Interface == "" {
+			return fmt.Errorf("WAN interface name is required")
+		}
+		if seen[link.Interface] {
+			return fmt.Errorf("WAN interface %s listed twice", link.Interface)
+		}
+		seen[link.Interface] = true
+		if link.Interface == "tailscale0" {
+			return fmt.Errorf("%s cannot be used as a WAN", link.Interface)
+		}
+		if _, err := net.InterfaceByName(link.Interface); err != nil {
+			return fmt.Errorf("interface %s not found", link.Interface)
+		}
+		if link.Weight < 0 {
+			return fmt.Errorf("weight for %s must not be negative", link.Interface)
+		}
+		if link.ProbeTarget != "" && net.ParseIP(link.ProbeTarget) == nil {
+			return fmt.Errorf("probe target %q for %s must be an IP address", link.ProbeTarget, link.Interface)
+		}
+		for _, segment := range LANSegments(cfg) {
+			if link.Interface == segment.Interface || link.Interface == segment.Device() {
+				return fmt.Errorf("%s is used by LAN segment %s", link.Interface, segment.Name)
+			}
+			if err := validateLANDoesNotOverlapWAN(link.Interface, segment.Address, segment.Prefix); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// WANHandler reads or replaces the WAN list. The first link becomes wan_interface.
+// POST /wan {"mode": "failover"|"balance", "links": [{"interface": "eth0"}, {"interface": "usb0", "weight": 1}]}
+func WANHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		var req wanSettingsRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "invalid JSON body", http.StatusBadRequest)
+			return
+		}
+		if req.Mode == "" {
+			req.Mode = WANModeFailover
+		}
+		if req.Mode != WANModeFailover && req.Mode != WANModeBalance {
+			http.Error(w, "mode must be failover or balance", http.StatusBadRequest)
+			return
+		}
+		for i := range req.Links {
+			req.Links[i].Interface = strings.TrimSpace(req.Links[i].Interface)
+			req.Links[i].ProbeTarget = strings.TrimSpace(req.Links[i].ProbeTarget)
+		}
+
+		cfg := GetRouterConfig()
+		if err := validateWANLinks(cfg, req.Links); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		cfg.WANInterface = req.Links[0].Interface
+		cfg.WANMode = req.Mode
+		cfg.WANLinks = nil
+		if len(req.Links) > 1 {
+			cfg.WANLinks = req.Links
+		}
+		if err := SaveRouterConfig(cfg); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		ensureWANProbes(cfg)
+		if multiWANEnabled(cfg) {
+			evaluateWANs(true)
+		} else {
+			wanMu.Lock()
+			activeWANs = nil
+			wanMu.Unlock()
+			clearWANRoutes()
+			if err := ReapplyCurrentMode(); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(GetWANStatus())
+}
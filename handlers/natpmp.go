@@ -0,0 +1,174 @@
+package handlers
+
+import (
+	"encoding/binary"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+// NAT-PMP (RFC 6886) listens on the gateway address clients already know.
+const natPMPPort = 5351
+
+var (
+	natPMPMu        sync.Mutex
+	natPMPListeners = make(map[string]*net.UDPConn) // by segment address
+)
+
+const (
+	natPMPResultSuccess           = 0
+	natPMPResultUnsupportedVer    = 1
+	natPMPResultNotAuthorized     = 2
+	natPMPResultNetworkFailure    = 3
+	natPMPResultOutOfResources    = 4
+	natPMPResultUnsupportedOpcode = 5
+)
+
+func natPMPResult(err error) uint16 {
+	switch err {
+	case nil:
+		return natPMPResultSuccess
+	case errPortMappingInactive:
+		return natPMPResultNetworkFailure
+	case errPortMappingFull:
+		return natPMPResultOutOfResources
+	default:
+		return natPMPResultNotAuthorized
+	}
+}
+
+// refreshNATPMPListeners keeps one socket per eligible segment address, so
+// NAT-PMP never answers on the WAN or on guest segments, and closes them all
+// when port mapping is disabled.
+func refreshNATPMPListeners() {
+	wanted := make(map[string]bool)
+	for _, s := range portMappingSegments(GetRouterConfig()) {
+		wanted[s.Address] = true
+	}
+
+	natPMPMu.Lock()
+	defer natPMPMu.Unlock()
+	for address, conn := range natPMPListeners {
+		if !wanted[address] {
+			conn.Close()
+			delete(natPMPListeners, address)
+		}
+	}
+	for address := range wanted {
+		if natPMPListeners[address] != nil {
+			continue
+		}
+		conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.ParseIP(address), Port: natPMPPort})
+		if err != nil {
+			log.Printf("NAT-PMP on %s: %v", address, err)
+			continue
+		}
+		natPMPListeners[address] = conn
+		go serveNATPMP(address, conn)
+	}
+}
+
+func serveNATPMP(address string, conn *net.UDPConn) {
+	log.Printf("NAT-PMP listening on %s:%d", address, natPMPPort)
+	buf := make([]byte, 64)
+	for {
+		n, addr, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			return // closed by refreshNATPMPListeners
+		}
+		// Only clients on this segment; the same check keeps WAN senders out.
+		if s, ok := portMappingSegment(GetRouterConfig(), addr.IP); !ok || s.Address != address {
+			continue
+		}
+		if resp := handleNATPMPRequest(buf[:n], addr.IP.String()); resp != nil {
+			conn.WriteToUDP(resp, addr)
+		}
+	}
+}
+
+// handleNATPMPRequest returns the response packet, or nil for packets to ignore.
+func handleNATPMPRequest(req []byte, client string) []byte {
+	if len(req) < 2 || req[1] >= 128 {
+		return nil
+	}
+	version, opcode := req[0], req[1]
+	epoch := uint32(time.Since(pmStarted) / time.Second)
+
+	header := func(size int, result uint16) []byte {
+		resp := make([]byte, size)
+		resp[1] = opcode + 128
+		binary.BigEndian.PutUint16(resp[2:], result)
+		binary.BigEndian.PutUint32(resp[4:], epoch)
+		return resp
+	}
+
+	if version != 0 {
+		return header(8, natPMPResultUnsupportedVer)
+	}
+
+	switch opcode {
+	case 0:
+		resp := header(12, natPMPResultSuccess)
+		ip := net.ParseIP(portMappingExternalIP()).To4()
+		pmMu.Lock()
+		active := pmActive
+		pmMu.Unlock()
+		if ip == nil || !active {
+			binary.BigEndian.PutUint16(resp[2:], natPMPResultNetworkFailure)
+			return resp
+		}
+		copy(resp[8:], ip)
+		return resp
+
+	case 1, 2:
+		if len(req) < 12 {
+			return nil
+		}
+		protocol := "udp"
+		if opcode == 2 {
+			protocol = "tcp"
+		}
+		internalPort := int(binary.BigEndian.Uint16(req[4:]))
+		externalPort := int(binary.BigEndian.Uint16(req[6:]))
+		lifetime := binary.BigEndian.Uint32(req[8:])
+
+		resp := header(16, natPMPResultSuccess)
+		binary.BigEndian.PutUint16(resp[8:], uint16(internalPort))
+
+		if lifetime == 0 {
+			// Deletion: one mapping, or all of the client's when the internal port is 0.
+			if internalPort == 0 {
+				deleteClientPortMappings(protocol, client)
+				return resp
+			}
+			for _, m := range listPortMappings() {
+				if m.Protocol == protocol && m.InternalIP == client && m.InternalPort == internalPort {
+					deletePortMapping(protocol, m.ExternalPort, client)
+				}
+			}
+			return resp
+		}
+
+		if externalPort == 0 {
+			externalPort = internalPort
+		}
+		m, err := addPortMapping(PortMapping{
+			Protocol:     protocol,
+			ExternalPort: externalPort,
+			InternalIP:   client,
+			InternalPort: internalPort,
+			Description:  "NAT-PMP",
+			Via:          "natpmp",
+		}, time.Duration(lifetime)*time.Second, true)
+		if err != nil {
+			binary.BigEndian.PutUint16(resp[2:], natPMPResult(err))
+			return resp
+		}
+		binary.BigEndian.PutUint16(resp[10:], uint16(m.ExternalPort))
+		binary.BigEndian.PutUint32(resp[12:], uint32(time.Until(m.ExpiresAt)/time.Second))
+		return resp
+	}
+
+	return header(8, natPMPResultUnsupportedOpcode)
+}
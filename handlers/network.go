@@ -15,6 +15,8 @@ type NetworkInterface struct {
 	IPv4           []string `json:"ipv4"`
 	IsDefaultRoute bool     `json:"is_default_route"`
 	Kind           string   `json:"kind"` // ethernet, wireless, tunnel, other
+	SSID           string   `json:"ssid,omitempty"`   // wireless only: associated network
+	Signal         int      `json:"signal,omitempty"` // wireless only: 0-100%
 }
 
 // RoutingSummary describes the current default route.
@@ -64,7 +66,7 @@ func GetNetworkSnapshot() NetworkSnapshot {
 		ManagementIPs: getManagementAccessIPs(),
 		Hostname:      getSystemHostname(),
 		Configured:    IsConfigured(),
-		Config:        GetRouterConfig(),
+		Config:        redactedRouterConfig(GetRouterConfig()),
 	}
 }
 
@@ -108,14 +110,14 @@ func parseJSONLinks(output []byte, defaultIface string) []NetworkInterface {
 		}
 
 		kind := classifyInterface(name, link.LinkType)
-		result = append(result, NetworkInterface{
+		result = append(result, withWifiLink(NetworkInterface{
 			Name:           name,
 			MAC:            link.Address,
 			State:          strings.ToLower(link.OperState),
 			IPv4:           ipv4Map[name],
 			IsDefaultRoute: name == defaultIface,
 			Kind:           kind,
-		})
+		}))
 	}
 
 	return result
@@ -153,19 +155,27 @@ func parseTextLinks(defaultIface string) []NetworkInterface {
 			}
 		}
 
-		result = append(result, NetworkInterface{
+		result = append(result, withWifiLink(NetworkInterface{
 			Name:           name,
 			MAC:            mac,
 			State:          state,
 			IPv4:           ipv4Map[name],
 			IsDefaultRoute: name == defaultIface,
 			Kind:           classifyInterface(name, ""),
-		})
+		}))
 	}
 
 	return result
 }
 
+// withWifiLink fills SSID and signal for an associated wireless interface.
+func withWifiLink(iface NetworkInterface) NetworkInterface {
+	if iface.Kind == "wireless" {
+		iface.SSID, iface.Signal, _ = wifiLinkInfo(iface.Name)
+	}
+	return iface
+}
+
 func getIPv4ByInterface() map[string][]string {
 	result := make(map[string][]string)
 	output, err := exec.Command("ip", "-o", "-4", "addr", "show").Output()
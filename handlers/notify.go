@@ -0,0 +1,618 @@
+package handlers
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/smtp"
+	"net/url"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Notification events.
+const (
+	NotifyExitNodeDown     = "exit_node_down"
+	NotifyExitNodeUp       = "exit_node_up"
+	NotifyFailover         = "failover"
+	NotifyWANDown          = "wan_down"
+	NotifyWANUp            = "wan_up"
+	NotifyWANFailover      = "wan_failover"
+	NotifyServiceRestarted = "service_restarted"
+	NotifyLoginFailures    = "login_failures"
+	NotifyTest             = "test"
+)
+
+const (
+	notifyTimeout         = 10 * time.Second
+	notifyMonitorInterval = 30 * time.Second
+	// smtpSessionTimeout bounds a whole SMTP conversation, so a server that stops
+	// answering cannot hang the sender.
+	smtpSessionTimeout = 30 * time.Second
+	// notifyCooldown suppresses repeats of the same alert (event + subject).
+	notifyCooldown             = 10 * time.Minute
+	defaultNotifyRatePerHour   = 30
+	loginFailureWindow         = 10 * time.Minute
+	loginFailureThreshold      = 5
+	notifyDownAfterChecks      = 2 // consecutive failed checks before "down"
+	notifyServiceRestartSource = "ActiveEnterTimestampMonotonic"
+)
+
+// notifyWatchedServices are reported when they restart (health remediation or otherwise).
+var notifyWatchedServices = []string{"dnsmasq", "tailscaled"}
+
+// NotificationSinkConfig configures one destination. Type is webhook, ntfy, gotify or smtp.
+type NotificationSinkConfig struct {
+	Name    string   `json:"name"`
+	Type    string   `json:"type"`
+	Enabled bool     `json:"enabled"`
+	Events  []string `json:"events,omitempty"` // empty = all events
+
+	URL   string `json:"url,omitempty"`   // webhook URL, ntfy topic URL, gotify server URL
+	Token string `json:"token,omitempty"` // bearer token (webhook, ntfy) or gotify app token
+
+	SMTPHost     string   `json:"smtp_host,omitempty"`
+	SMTPPort     int      `json:"smtp_port,omitempty"`
+	SMTPUsername string   `json:"smtp_username,omitempty"`
+	SMTPPassword string   `json:"smtp_password,omitempty"`
+	SMTPFrom     string   `json:"smtp_from,omitempty"`
+	SMTPTo       []string `json:"smtp_to,omitempty"`
+	SMTPTLS      bool     `json:"smtp_tls,omitempty"` // implicit TLS (port 465); STARTTLS is used when offered
+}
+
+// NotificationConfig is stored in config.json.
+type NotificationConfig struct {
+	Sinks       []NotificationSinkConfig `json:"sinks,omitempty"`
+	RatePerHour int                      `json:"rate_per_hour,omitempty"`
+}
+
+// Notification is what sinks deliver; webhooks receive it as JSON.
+type Notification struct {
+	Event    string    `json:"event"`
+	Severity string    `json:"severity"` // info, warning, critical
+	Title    string    `json:"title"`
+	Message  string    `json:"message"`
+	Subject  string    `json:"subject,omitempty"` // node, interface or service the alert is about
+	Host     string    `json:"host"`
+	Time     time.Time `json:"time"`
+}
+
+type notificationSink interface {
+	Send(n Notification) error
+}
+
+type webhookSink struct{ cfg NotificationSinkConfig }
+type ntfySink struct{ cfg NotificationSinkConfig }
+type gotifySink struct{ cfg NotificationSinkConfig }
+type smtpSink struct{ cfg NotificationSinkConfig }
+
+var (
+	notifyMu       sync.Mutex
+	notifyLastSent = make(map[string]time.Time) // event|subject -> last send
+	notifySentLog  []time.Time                  // sends within the last hour
+
+	loginFailuresMu sync.Mutex
+	loginFailures   = make(map[string][]time.Time) // client IP -> failure times
+
+	notifyHTTPClient = &http.Client{Timeout: notifyTimeout}
+)
+
+func newNotificationSink(cfg NotificationSinkConfig) (notificationSink, error) {
+	switch cfg.Type {
+	case "webhook":
+		if cfg.URL == "" {
+			return nil, fmt.Errorf("webhook sink %q needs url", cfg.Name)
+		}
+		return webhookSink{cfg}, nil
+	case "ntfy":
+		if cfg.URL == "" {
+			return nil, fmt.Errorf("ntfy sink %q needs url (topic URL)", cfg.Name)
+		}
+		return ntfySink{cfg}, nil
+	case "gotify":
+		if cfg.URL == "" || cfg.Token == "" {
+			return nil, fmt.Errorf("gotify sink %q needs url and token", cfg.Name)
+		}
+		return gotifySink{cfg}, nil
+	case "smtp":
+		if cfg.SMTPHost == "" || cfg.SMTPFrom == "" || len(cfg.SMTPTo) == 0 {
+			return nil, fmt.Errorf("smtp sink %q needs smtp_host, smtp_from and smtp_to", cfg.Name)
+		}
+		return smtpSink{cfg}, nil
+	}
+	return nil, fmt.Errorf("unknown sink type %q", cfg.Type)
+}
+
+func postNotification(req *http.Request) error {
+	resp, err := notifyHTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("%s returned %s", req.URL.Host, resp.Status)
+	}
+	return nil
+}
+
+func (s webhookSink) Send(n Notification) error {
+	body, err := json.Marshal(n)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, s.cfg.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if s.cfg.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+s.cfg.Token)
+	}
+	return postNotification(req)
+}
+
+func ntfyPriority(severity string) string {
+	switch severity {
+	case "critical":
+		return "5"
+	case "warning":
+		return "4"
+	}
+	return "3"
+}
+
+func (s ntfySink) Send(n Notification) error {
+	req, err := http.NewRequest(http.MethodPost, s.cfg.URL, strings.NewReader(n.Message))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Title", n.Title)
+	req.Header.Set("Priority", ntfyPriority(n.Severity))
+	req.Header.Set("Tags", n.Event)
+	if s.cfg.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+s.cfg.Token)
+	}
+	return postNotification(req)
+}
+
+func (s gotifySink) Send(n Notification) error {
+	priority := 5
+	switch n.Severity {
+	case "critical":
+		priority = 9
+	case "warning":
+		priority = 7
+	}
+	body, err := json.Marshal(map[string]interface{}{
+		"title":    n.Title,
+		"message":  n.Message,
+		"priority": priority,
+	})
+	if err != nil {
+		return err
+	}
+	endpoint := strings.TrimRight(s.cfg.URL, "/") + "/message?token=" + url.QueryEscape(s.cfg.Token)
+	req, err := http.NewRequest(http.MethodPost, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	return postNotification(req)
+}
+
+func (s smtpSink) Send(n Notification) error {
+	port := s.cfg.SMTPPort
+	if port == 0 {
+		port = 587
+		if s.cfg.SMTPTLS {
+			port = 465
+		}
+	}
+	addr := net.JoinHostPort(s.cfg.SMTPHost, strconv.Itoa(port))
+
+	var msg strings.Builder
+	fmt.Fprintf(&msg, "From: %s\r\n", s.cfg.SMTPFrom)
+	fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(s.cfg.SMTPTo, ", "))
+	fmt.Fprintf(&msg, "Subject: %s\r\n", n.Title)
+	fmt.Fprintf(&msg, "Date: %s\r\n", n.Time.Format(time.RFC1123Z))
+	msg.WriteString("Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	fmt.Fprintf(&msg, "%s\r\n\r\nRouter: %s\r\nEvent: %s\r\n", n.Message, n.Host, n.Event)
+
+	var auth smtp.Auth
+	if s.cfg.SMTPUsername != "" {
+		auth = smtp.PlainAuth("", s.cfg.SMTPUsername, s.cfg.SMTPPassword, s.cfg.SMTPHost)
+	}
+
+	tlsConfig := &tls.Config{ServerName: s.cfg.SMTPHost}
+	var conn net.Conn
+	var err error
+	if s.cfg.SMTPTLS {
+		conn, err = tls.DialWithDialer(&net.Dialer{Timeout: notifyTimeout}, "tcp", addr, tlsConfig)
+	} else {
+		conn, err = net.DialTimeout("tcp", addr, notifyTimeout)
+	}
+	if err != nil {
+		return err
+	}
+	if err := conn.SetDeadline(time.Now().Add(smtpSessionTimeout)); err != nil {
+		conn.Close()
+		return err
+	}
+	client, err := smtp.NewClient(conn, s.cfg.SMTPHost)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer client.Close()
+	if !s.cfg.SMTPTLS {
+		// Upgrade with STARTTLS when the server offers it, as smtp.SendMail does.
+		if ok, _ := client.Extension("STARTTLS"); ok {
+			if err := client.StartTLS(tlsConfig); err != nil {
+				return err
+			}
+		}
+	}
+	if auth != nil {
+		if err := client.Auth(auth); err != nil {
+			return err
+		}
+	}
+	if err := client.Mail(s.cfg.SMTPFrom); err != nil {
+		return err
+	}
+	for _, to := range s.cfg.SMTPTo {
+		if err := client.Rcpt(to); err != nil {
+			return err
+		}
+	}
+	w, err := client.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write([]byte(msg.String())); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return client.Quit()
+}
+
+func sinkWantsEvent(cfg NotificationSinkConfig, event string) bool {
+	return event == NotifyTest || len(cfg.Events) == 0 || containsString(cfg.Events, event)
+}
+
+// allowNotification applies the per-alert cooldown and the hourly cap.
+func allowNotification(n Notification) bool {
+	notifyMu.Lock()
+	defer notifyMu.Unlock()
+
+	now := time.Now()
+	key := n.Event + "|" + n.Subject
+	if last, ok := notifyLastSent[key]; ok && now.Sub(last) < notifyCooldown {
+		return false
+	}
+
+	limit := GetRouterConfig().Notifications.RatePerHour
+	if limit <= 0 {
+		limit = defaultNotifyRatePerHour
+	}
+	recent := notifySentLog[:0]
+	for _, t := range notifySentLog {
+		if now.Sub(t) < time.Hour {
+			recent = append(recent, t)
+		}
+	}
+	notifySentLog = recent
+	if len(notifySentLog) >= limit {
+		log.Printf("Notification %s suppressed: %d sent in the last hour", n.Event, len(notifySentLog))
+		return false
+	}
+
+	notifyLastSent[key] = now
+	notifySentLog = append(notifySentLog, now)
+	return true
+}
+
+func newNotification(event, severity, subject, title, message string) Notification {
+	host, _ := os.Hostname()
+	if cfg := GetRouterConfig(); cfg.TailscaleHost != "" {
+		host = cfg.TailscaleHost
+	}
+	return Notification{
+		Event:    event,
+		Severity: severity,
+		Subject:  subject,
+		Title:    fmt.Sprintf("[%s] %s", host, title),
+		Message:  message,
+		Host:     host,
+		Time:     time.Now(),
+	}
+}
+
+// Notify sends to every enabled sink that wants the event. Sends run in the
+// background so callers holding mu are never blocked on the network.
+func Notify(event, severity, subject, title, message string) {
+	n := newNotification(event, severity, subject, title, message)
+	cfg := GetRouterConfig().Notifications
+	if len(cfg.Sinks) == 0 || !allowNotification(n) {
+		return
+	}
+
+	for _, sinkCfg := range cfg.Sinks {
+		if !sinkCfg.Enabled || !sinkWantsEvent(sinkCfg, event) {
+			continue
+		}
+		sink, err := newNotificationSink(sinkCfg)
+		if err != nil {
+			log.Printf("Notification sink: %v", err)
+			continue
+		}
+		go func(name string, sink notificationSink) {
+			if err := sink.Send(n); err != nil {
+				log.Printf("Notification %s via %s failed: %v", n.Event, name, err)
+			}
+		}(sinkCfg.Name, sink)
+	}
+}
+
+// noteLoginFailure alerts once a client IP fails loginFailureThreshold times within
+// the window and returns that client's failures in the window. IPs without
+// failures inside the window are forgotten.
+func noteLoginFailure(ip, username string) int {
+	loginFailuresMu.Lock()
+	now := time.Now()
+	for client, times := range loginFailures {
+		var recent []time.Time
+		for _, t := range times {
+			if now.Sub(t) < loginFailureWindow {
+				recent = append(recent, t)
+			}
+		}
+		if len(recent) == 0 {
+			delete(loginFailures, client)
+		} else {
+			loginFailures[client] = recent
+		}
+	}
+	loginFailures[ip] = append(loginFailures[ip], now)
+	count := len(loginFailures[ip])
+	loginFailuresMu.Unlock()
+
+	if count >= loginFailureThreshold {
+		Notify(NotifyLoginFailures, "warning", ip, "Repeated failed logins",
+			fmt.Sprintf("%d failed dashboard logins from %s in %s (last username %q).", count, ip, loginFailureWindow, username))
+	}
+	return count
+}
+
+// activeExitNodeRef returns the exitNodes reference for the current mode, if any.
+func activeExitNodeRef() string {
+	mu.Lock()
+	defer mu.Unlock()
+	if !strings.HasPrefix(CurrentMode, "tailscale:") {
+		return ""
+	}
+	ref := strings.TrimPrefix(CurrentMode, "tailscale:")
+	if _, ok := parseAutoExitNodeSpec(ref); ok {
+		return autoExitNode
+	}
+	return ref
+}
+
+// wanLinkUp reads carrier/operstate so a pulled cable is seen without waiting for DHCP.
+func wanLinkUp(iface string) bool {
+	data, err := os.ReadFile("/sys/class/net/" + iface + "/operstate")
+	if err != nil {
+		return false
+	}
+	state := strings.TrimSpace(string(data))
+	return state == "up" || state == "unknown"
+}
+
+func serviceActiveSince(service string) string {
+	out, err := exec.Command("systemctl", "show", "-p", notifyServiceRestartSource, "--value", service).Output()
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(out))
+}
+
+// notifyState tracks what the monitor last reported so only transitions alert.
+type notifyState struct {
+	exitNodeRef   string
+	exitNodeDown  bool
+	exitNodeFails int
+	wanDown       bool
+	wanFails      int
+	serviceSince  map[string]string
+}
+
+func (s *notifyState) checkExitNode() {
+	ref := activeExitNodeRef()
+	if ref != s.exitNodeRef {
+		s.exitNodeRef, s.exitNodeDown, s.exitNodeFails = ref, false, 0
+	}
+	if ref == "" {
+		return
+	}
+
+	online := false
+	name := ref
+	if nodes, err := GetExitNodes(); err == nil {
+		if node, ok := findExitNode(nodes, ref); ok {
+			online, name = node.Online, node.Name
+		}
+	}
+
+	if online {
+		if s.exitNodeDown {
+			Notify(NotifyExitNodeUp, "info", ref, "Exit node back online", fmt.Sprintf("Exit node %s is online again.", name))
+		}
+		s.exitNodeDown, s.exitNodeFails = false, 0
+		return
+	}
+	s.exitNodeFails++
+	if !s.exitNodeDown && s.exitNodeFails >= notifyDownAfterChecks {
+		s.exitNodeDown = true
+		Notify(NotifyExitNodeDown, "critical", ref, "Exit node offline",
+			fmt.Sprintf("Exit node %s is offline; LAN clients in mode %s may have no internet.", name, diagnosticMode()))
+	}
+}
+
+func (s *notifyState) checkWAN() {
+	wan := ConfiguredWAN()
+	if wanLinkUp(wan) {
+		if s.wanDown {
+			Notify(NotifyWANUp, "info", wan, "WAN link up", fmt.Sprintf("WAN interface %s is up again.", wan))
+		}
+		s.wanDown, s.wanFails = false, 0
+		return
+	}
+	s.wanFails++
+	if !s.wanDown && s.wanFails >= notifyDownAfterChecks {
+		s.wanDown = true
+		Notify(NotifyWANDown, "critical", wan, "WAN link down", fmt.Sprintf("WAN interface %s has no link.", wan))
+	}
+}
+
+func (s *notifyState) checkServices() {
+	for _, service := range notifyWatchedServices {
+		since := serviceActiveSince(service)
+		prev, seen := s.serviceSince[service]
+		s.serviceSince[service] = since
+		if !seen || since == "" || since == "0" || since == prev {
+			continue
+		}
+		Notify(NotifyServiceRestarted, "warning", service, "Service restarted",
+			fmt.Sprintf("%s was restarted (by health remediation or manually).", service))
+	}
+}
+
+// RunNotificationMonitor watches the exit node, WAN link and services and alerts on transitions.
+func RunNotificationMonitor() {
+	state := &notifyState{serviceSince: make(map[string]string)}
+	for {
+		if len(GetRouterConfig().Notifications.Sinks) > 0 {
+			state.checkExitNode()
+			state.checkWAN()
+			state.checkServices()
+		}
+		time.Sleep(notifyMonitorInterval)
+	}
+}
+
+// redactedNotificationConfig hides secrets for API responses.
+func redactedNotificationConfig(cfg NotificationConfig) NotificationConfig {
+	out := NotificationConfig{RatePerHour: cfg.RatePerHour}
+	for _, sink := range cfg.Sinks {
+		if sink.Token != "" {
+			sink.Token = "***"
+		}
+		if sink.SMTPPassword != "" {
+			sink.SMTPPassword = "***"
+		}
+		out.Sinks = append(out.Sinks, sink)
+	}
+	return out
+}
+
+// NotificationsHandler reads or replaces notification sinks. Secrets sent back
+// as "***" keep the stored value.
+func NotificationsHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		var req NotificationConfig
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "invalid JSON body", http.StatusBadRequest)
+			return
+		}
+
+		cfg := GetRouterConfig()
+		existing := make(map[string]NotificationSinkConfig)
+		for _, sink := range cfg.Notifications.Sinks {
+			existing[sink.Name] = sink
+		}
+		names := make(map[string]bool)
+		for i := range req.Sinks {
+			sink := &req.Sinks[i]
+			sink.Name = strings.TrimSpace(sink.Name)
+			if sink.Name == "" {
+				sink.Name = fmt.Sprintf("%s-%d", sink.Type, i+1)
+			}
+			if names[sink.Name] {
+				http.Error(w, fmt.Sprintf("duplicate sink name %q", sink.Name), http.StatusBadRequest)
+				return
+			}
+			names[sink.Name] = true
+			if sink.Token == "***" {
+				sink.Token = existing[sink.Name].Token
+			}
+			if sink.SMTPPassword == "***" {
+				sink.SMTPPassword = existing[sink.Name].SMTPPassword
+			}
+			if _, err := newNotificationSink(*sink); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+
+		cfg.Notifications = req
+		if err := SaveRouterConfig(cfg); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(redactedNotificationConfig(GetRouterConfig().Notifications))
+}
+
+// NotificationTestHandler sends a test message synchronously and reports per-sink results.
+// POST /notifications/test?sink=<name> (all enabled sinks when omitted)
+func NotificationTestHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	only := strings.TrimSpace(r.URL.Query().Get("sink"))
+	n := newNotification(NotifyTest, "info", "", "Test notification", "Notifications from this router are working.")
+
+	results := make(map[string]string)
+	for _, sinkCfg := range GetRouterConfig().Notifications.Sinks {
+		if only != "" && sinkCfg.Name != only {
+			continue
+		}
+		if only == "" && !sinkCfg.Enabled {
+			continue
+		}
+		sink, err := newNotificationSink(sinkCfg)
+		if err == nil {
+			err = sink.Send(n)
+		}
+		results[sinkCfg.Name] = "ok"
+		if err != nil {
+			results[sinkCfg.Name] = err.Error()
+		}
+	}
+	if len(results) == 0 {
+		http.Error(w, "No matching notification sinks", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(results)
+}
@@ -0,0 +1,261 @@
+package handlers
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"strings"
+	"testing"
+	"time"
+)
+
+// capturedRequest is what a stand-in notification server received.
+type capturedRequest struct {
+	method string
+	path   string
+	query  string
+	header http.Header
+	body   []byte
+}
+
+func newCaptureServer(t *testing.T, status int) (*httptest.Server, <-chan capturedRequest) {
+	t.Helper()
+	got := make(chan capturedRequest, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		got <- capturedRequest{r.Method, r.URL.Path, r.URL.RawQuery, r.Header.Clone(), body}
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(srv.Close)
+	return srv, got
+}
+
+func testNotification() Notification {
+	return Notification{
+		Event:    NotifyExitNodeDown,
+		Severity: "critical",
+		Title:    "[router] Exit node offline",
+		Message:  "Exit node nyc is offline.",
+		Subject:  "nyc",
+		Host:     "router",
+		Time:     time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC),
+	}
+}
+
+func TestWebhookSinkPayload(t *testing.T) {
+	srv, got := newCaptureServer(t, http.StatusNoContent)
+	sink := webhookSink{NotificationSinkConfig{Name: "hook", Type: "webhook", URL: srv.URL + "/hook", Token: "s3cret"}}
+	n := testNotification()
+	if err := sink.Send(n); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+
+	req := <-got
+	if req.method != http.MethodPost || req.path != "/hook" {
+		t.Errorf("request = %s %s, want POST /hook", req.method, req.path)
+	}
+	if ct := req.header.Get("Content-Type"); ct != "application/json" {
+		t.Errorf("Content-Type = %q", ct)
+	}
+	if auth := req.header.Get("Authorization"); auth != "Bearer s3cret" {
+		t.Errorf("Authorization = %q", auth)
+	}
+	var decoded Notification
+	if err := json.Unmarshal(req.body, &decoded); err != nil {
+		t.Fatalf("body is not JSON: %v: %s", err, req.body)
+	}
+	if decoded != n {
+		t.Errorf("body = %+v, want %+v", decoded, n)
+	}
+}
+
+func TestNtfySinkPayload(t *testing.T) {
+	srv, got := newCaptureServer(t, http.StatusOK)
+	sink := ntfySink{NotificationSinkConfig{Name: "phone", Type: "ntfy", URL: srv.URL + "/router-alerts"}}
+	n := testNotification()
+	if err := sink.Send(n); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+
+	req := <-got
+	if req.method != http.MethodPost || req.path != "/router-alerts" {
+		t.Errorf("request = %s %s, want POST /router-alerts", req.method, req.path)
+	}
+	if string(req.body) != n.Message {
+		t.Errorf("body = %q, want the message", req.body)
+	}
+	for header, want := range map[string]string{"Title": n.Title, "Priority": "5", "Tags": n.Event, "Authorization": ""} {
+		if v := req.header.Get(header); v != want {
+			t.Errorf("%s = %q, want %q", header, v, want)
+		}
+	}
+}
+
+func TestGotifySinkPayload(t *testing.T) {
+	srv, got := newCaptureServer(t, http.StatusOK)
+	sink := gotifySink{NotificationSinkConfig{Name: "gotify", Type: "gotify", URL: srv.URL + "/", Token: "app token"}}
+	n := testNotification()
+	n.Severity = "warning"
+	if err := sink.Send(n); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+
+	req := <-got
+	if req.method != http.MethodPost || req.path != "/message" || req.query != "token=app+token" {
+		t.Errorf("request = %s %s?%s, want POST /message?token=app+token", req.method, req.path, req.query)
+	}
+	var body struct {
+		Title    string `json:"title"`
+		Message  string `json:"message"`
+		Priority int    `json:"priority"`
+	}
+	if err := json.Unmarshal(req.body, &body); err != nil {
+		t.Fatalf("body is not JSON: %v: %s", err, req.body)
+	}
+	if body.Title != n.Title || body.Message != n.Message || body.Priority != 7 {
+		t.Errorf("body = %+v", body)
+	}
+}
+
+func TestSinkReportsHTTPErrors(t *testing.T) {
+	srv, got := newCaptureServer(t, http.StatusUnauthorized)
+	sink := webhookSink{NotificationSinkConfig{Name: "hook", Type: "webhook", URL: srv.URL}}
+	if err := sink.Send(testNotification()); err == nil {
+		t.Error("Send succeeded against a 401")
+	}
+	<-got
+}
+
+// smtpSession is what a stand-in SMTP server received.
+type smtpSession struct {
+	auth  string // decoded AUTH PLAIN response
+	from  string
+	rcpts []string
+	data  string
+}
+
+// newSMTPServer accepts one session on 127.0.0.1, offering AUTH PLAIN and
+// accepting credentials only when acceptAuth is set.
+func newSMTPServer(t *testing.T, acceptAuth bool) (string, int, <-chan smtpSession) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	got := make(chan smtpSession, 1)
+
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(10 * time.Second))
+		tp := textproto.NewConn(conn)
+		var s smtpSession
+		defer func() { got <- s }()
+
+		tp.PrintfLine("220 test ESMTP")
+		for {
+			line, err := tp.ReadLine()
+			if err != nil {
+				return
+			}
+			verb := strings.ToUpper(strings.Fields(line + " ")[0])
+			switch verb {
+			case "EHLO":
+				tp.PrintfLine("250-test")
+				tp.PrintfLine("250 AUTH PLAIN")
+			case "AUTH":
+				fields := strings.Fields(line)
+				decoded, _ := base64.StdEncoding.DecodeString(fields[len(fields)-1])
+				s.auth = string(decoded)
+				if !acceptAuth {
+					tp.PrintfLine("535 5.7.8 authentication failed")
+					continue
+				}
+				tp.PrintfLine("235 2.7.0 accepted")
+			case "MAIL":
+				s.from = line
+				tp.PrintfLine("250 ok")
+			case "RCPT":
+				s.rcpts = append(s.rcpts, line)
+				tp.PrintfLine("250 ok")
+			case "DATA":
+				tp.PrintfLine("354 go ahead")
+				data, err := tp.ReadDotBytes()
+				if err != nil {
+					return
+				}
+				s.data = string(data)
+				tp.PrintfLine("250 queued")
+			case "QUIT":
+				tp.PrintfLine("221 bye")
+				return
+			default:
+				tp.PrintfLine("502 not implemented")
+			}
+		}
+	}()
+
+	addr := ln.Addr().(*net.TCPAddr)
+	return addr.IP.String(), addr.Port, got
+}
+
+func TestSMTPSinkMessage(t *testing.T) {
+	host, port, got := newSMTPServer(t, true)
+	sink := smtpSink{NotificationSinkConfig{
+		Name: "mail", Type: "smtp", SMTPHost: host, SMTPPort: port,
+		SMTPUsername: "router", SMTPPassword: "pw",
+		SMTPFrom: "router@example.com", SMTPTo: []string{"a@example.com", "b@example.com"},
+	}}
+	n := testNotification()
+	if err := sink.Send(n); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+
+	s := <-got
+	if s.auth != "\x00router\x00pw" {
+		t.Errorf("AUTH PLAIN = %q", s.auth)
+	}
+	if s.from != "MAIL FROM:<router@example.com>" {
+		t.Errorf("envelope from = %q", s.from)
+	}
+	if len(s.rcpts) != 2 || s.rcpts[0] != "RCPT TO:<a@example.com>" || s.rcpts[1] != "RCPT TO:<b@example.com>" {
+		t.Errorf("envelope recipients = %q", s.rcpts)
+	}
+	for _, want := range []string{
+		"From: router@example.com\n",
+		"To: a@example.com, b@example.com\n",
+		"Subject: " + n.Title + "\n",
+		"Date: " + n.Time.Format(time.RFC1123Z) + "\n",
+		"Content-Type: text/plain; charset=utf-8\n",
+		n.Message + "\n",
+		"Event: " + n.Event + "\n",
+	} {
+		if !strings.Contains(s.data, want) {
+			t.Errorf("message lacks %q:\n%s", want, s.data)
+		}
+	}
+}
+
+func TestSMTPSinkReportsAuthFailure(t *testing.T) {
+	host, port, got := newSMTPServer(t, false)
+	sink := smtpSink{NotificationSinkConfig{
+		Name: "mail", Type: "smtp", SMTPHost: host, SMTPPort: port,
+		SMTPUsername: "router", SMTPPassword: "wrong",
+		SMTPFrom: "router@example.com", SMTPTo: []string{"a@example.com"},
+	}}
+	err := sink.Send(testNotification())
+	if err == nil || !strings.Contains(err.Error(), "authentication failed") {
+		t.Errorf("Send = %v, want the server's 535", err)
+	}
+	if s := <-got; s.from != "" || s.data != "" {
+		t.Errorf("mail sent after a failed login: %+v", s)
+	}
+}
@@ -0,0 +1,284 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+const (
+	// routerDNATChain (nat PREROUTING) holds the port forwards. Unlike TS-ROUTER-NAT
+	// it is not flushed on mode switches; rebuildPortForwardChains owns it.
+	routerDNATChain = "TS-ROUTER-DNAT"
+	// routerPortForwardMarkChain (mangle PREROUTING) marks forwarded WAN connections
+	// so both directions stay on the main table while an exit node is active.
+	routerPortForwardMarkChain = "TS-ROUTER-PFWD"
+
+	portForwardFwmark       = "0x4000/0x4000"
+	portForwardRulePriority = 94
+
+	PortForwardSourceWAN       = "wan"
+	PortForwardSourceTailscale = "tailscale0"
+)
+
+// PortForward exposes one LAN service on the router's WAN or tailnet address.
+type PortForward struct {
+	Name         string   `json:"name,omitempty"`
+	Protocol     string   `json:"protocol"` // tcp, udp or both
+	ExternalPort int      `json:"external_port"`
+	Source       string   `json:"source"` // wan or tailscale0
+	TargetIP     string   `json:"target_ip"`
+	TargetPort   int      `json:"target_port"`
+	SourceCIDRs  []string `json:"source_cidrs,omitempty"` // empty allows everyone
+	Disabled     bool     `json:"disabled,omitempty"`
+}
+
+func (f PortForward) protocols() []string {
+	if f.Protocol == "both" {
+		return []string{"tcp", "udp"}
+	}
+	return []string{f.Protocol}
+}
+
+func (f PortForward) sourceCIDRs() []string {
+	if len(f.SourceCIDRs) == 0 {
+		return []string{"0.0.0.0/0"}
+	}
+	return f.SourceCIDRs
+}
+
+// inputInterfaces is where the forward listens: every WAN link, or tailscale0.
+func (f PortForward) inputInterfaces(cfg RouterConfig) []string {
+	if f.Source == PortForwardSourceTailscale {
+		return []string{"tailscale0"}
+	}
+	var wans []string
+	if cfg.WANInterface != "" {
+		wans = append(wans, cfg.WANInterface)
+	}
+	for _, link := range cfg.WANLinks {
+		if !containsString(wans, link.Interface) {
+			wans = append(wans, link.Interface)
+		}
+	}
+	return wans
+}
+
+func normalizePortForward(f PortForward) (PortForward, error) {
+	f.Name = strings.TrimSpace(f.Name)
+	f.Protocol = strings.ToLower(strings.TrimSpace(f.Protocol))
+	if f.Protocol == "" {
+		f.Protocol = "tcp"
+	}
+	f.Source = strings.TrimSpace(f.Source)
+	if f.Source == "" {
+		f.Source = PortForwardSourceWAN
+	}
+	f.TargetIP = strings.TrimSpace(f.TargetIP)
+	if f.TargetPort == 0 {
+		f.TargetPort = f.ExternalPort
+	}
+
+	var cidrs []string
+	for _, value := range f.SourceCIDRs {
+		if strings.TrimSpace(value) == "" {
+			continue
+		}
+		cidr, err := normalizeSplitTunnelCIDR(value)
+		if err != nil {
+			return f, err
+		}
+		if !containsString(cidrs, cidr) {
+			cidrs = append(cidrs, cidr)
+		}
+	}
+	f.SourceCIDRs = cidrs
+	return f, nil
+}
+
+// validatePortForwards checks each forward and that no two claim the same port.
+func validatePortForwards(cfg RouterConfig, forwards []PortForward) error {
+	for i, f := range forwards {
+		label := f.Name
+		if label == "" {
+			label = fmt.Sprintf("%s/%d", f.Protocol, f.ExternalPort)
+		}
+		if f.Protocol != "tcp" && f.Protocol != "udp" && f.Protocol != "both" {
+			return fmt.Errorf("forward %s: protocol must be tcp, udp or both", label)
+		}
+		if f.Source != PortForwardSourceWAN && f.Source != PortForwardSourceTailscale {
+			return fmt.Errorf("forward %s: source must be wan or tailscale0", label)
+		}
+		if f.ExternalPort < 1 || f.ExternalPort > 65535 || f.TargetPort < 1 || f.TargetPort > 65535 {
+			return fmt.Errorf("forward %s: ports must be 1-65535", label)
+		}
+		if f.ExternalPort == 5000 || f.ExternalPort == guestPortalPort {
+			return fmt.Errorf("forward %s: port %d is used by the router itself", label, f.ExternalPort)
+		}
+
+		target := net.ParseIP(f.TargetIP)
+		if target == nil || target.To4() == nil {
+			return fmt.Errorf("forward %s: invalid target IP %q", label, f.TargetIP)
+		}
+		onLAN := false
+		for _, s := range LANSegments(cfg) {
+			if s.Address == f.TargetIP {
+				return fmt.Errorf("forward %s: %s is the router's own address", label, f.TargetIP)
+			}
+			if _, network, err := net.ParseCIDR(s.CIDR()); err == nil && network.Contains(target) {
+				onLAN = true
+			}
+		}
+		if !onLAN {
+			return fmt.Errorf("forward %s: target %s is not on a LAN segment", label, f.TargetIP)
+		}
+
+		for _, other := range forwards[i+1:] {
+			if other.Source != f.Source || other.ExternalPort != f.ExternalPort {
+				continue
+			}
+			for _, p := range f.protocols() {
+				if containsString(other.protocols(), p) {
+					return fmt.Errorf("%s port %d on %s is forwarded twice", p, f.ExternalPort, f.Source)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func ensurePortForwardChains() {
+	exec.Command("iptables", "-t", "nat", "-N", routerDNATChain).Run()
+	exec.Command("iptables", "-t", "mangle", "-N", routerPortForwardMarkChain).Run()
+
+	if exec.Command("iptables", "-t", "nat", "-C", "PREROUTING", "-j", routerDNATChain).Run() != nil {
+		exec.Command("iptables", "-t", "nat", "-A", "PREROUTING", "-j", routerDNATChain).Run()
+	}
+	if exec.Command("iptables", "-t", "mangle", "-C", "PREROUTING", "-j", routerPortForwardMarkChain).Run() != nil {
+		exec.Command("iptables", "-t", "mangle", "-A", "PREROUTING", "-j", routerPortForwardMarkChain).Run()
+	}
+}
+
+func appendPortForwardChainRule(table, chain string, args ...string) {
+	cmdArgs := append([]string{"-t", table, "-A", chain}, args...)
+	if out, err := exec.Command("iptables", cmdArgs...).CombinedOutput(); err != nil {
+		log.Printf("iptables %s rule failed: %v: %s", chain, err, strings.TrimSpace(string(out)))
+	}
+}
+
+// rebuildPortForwardChains renders the DNAT and marking chains from the config.
+func rebuildPortForwardChains(cfg RouterConfig) {
+	ensurePortForwardChains()
+	exec.Command("iptables", "-t", "nat", "-F", routerDNATChain).Run()
+	exec.Command("iptables", "-t", "mangle", "-F", routerPortForwardMarkChain).Run()
+
+	marked := false
+	for _, f := range cfg.PortForwards {
+		if f.Disabled {
+			continue
+		}
+		to := net.JoinHostPort(f.TargetIP, strconv.Itoa(f.TargetPort))
+		for _, iface := range f.inputInterfaces(cfg) {
+			for _, proto := range f.protocols() {
+				for _, cidr := range f.sourceCIDRs() {
+					match := []string{"-i", iface, "-s", cidr, "-p", proto, "--dport", strconv.Itoa(f.ExternalPort),
+						"-m", "addrtype", "--dst-type", "LOCAL"}
+					appendPortForwardChainRule("nat", routerDNATChain, append(match, "-j", "DNAT", "--to-destination", to)...)
+					if f.Source == PortForwardSourceWAN {
+						appendPortForwardChainRule("mangle", routerPortForwardMarkChain, append(match, "-j", "CONNMARK", "--set-mark", portForwardFwmark)...)
+						marked = true
+					}
+				}
+			}
+		}
+	}
+
+	if marked {
+		// Copy the connection mark onto every packet, replies included, so they route via the WAN.
+		appendPortForwardChainRule("mangle", routerPortForwardMarkChain, "-m", "connmark", "--mark", portForwardFwmark, "-j", "MARK", "--set-mark", portForwardFwmark)
+		ensureFwmarkRule(portForwardRulePriority, portForwardFwmark, "main")
+	} else {
+		deleteIPRulePriority(portForwardRulePriority)
+	}
+}
+
+// appendPortForwardRules adds the TS-ROUTER-FWD accepts for DNATed connections.
+// flushRouterIPTablesRules calls it so forwards survive every mode switch. The
+// matching RETURNs in TS-ROUTER-GUARD follow the firewall policy jump but precede
+// the segment and guest DROPs, so a forward to a host on a "none" or pinned
+// segment still gets its replies out.
+func appendPortForwardRules() {
+	for _, f := range GetRouterConfig().PortForwards {
+		if f.Disabled {
+			continue
+		}
+		port := strconv.Itoa(f.TargetPort)
+		for _, proto := range f.protocols() {
+			appendRouterGuardRule("-d", f.TargetIP, "-p", proto, "--dport", port, "-m", "conntrack", "--ctstate", "DNAT", "-j", "RETURN")
+			appendRouterGuardRule("-s", f.TargetIP, "-p", proto, "--sport", port, "-m", "conntrack", "--ctstate", "DNAT", "-j", "RETURN")
+			appendRouterForwardRule("-d", f.TargetIP, "-p", proto, "--dport", port, "-m", "conntrack", "--ctstate", "DNAT", "-j", "ACCEPT")
+			appendRouterForwardRule("-s", f.TargetIP, "-p", proto, "--sport", port, "-m", "conntrack", "--ctstate", "DNAT", "-j", "ACCEPT")
+		}
+	}
+}
+
+// EnsurePortForwards restores the DNAT chain at startup.
+func EnsurePortForwards() {
+	rebuildPortForwardChains(GetRouterConfig())
+}
+
+// PortForwardsHandler reads or replaces the port forwards.
+// POST /port-forwards {"forwards": [{"name": "nvr", "protocol": "tcp", "external_port": 8443, "source": "wan", "target_ip": "192.168.50.20", "target_port": 443, "source_cidrs": ["203.0.113.0/24"]}]}
+func PortForwardsHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		var req struct {
+			Forwards []PortForward `json:"forwards"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "invalid JSON body", http.StatusBadRequest)
+			return
+		}
+		for i := range req.Forwards {
+			f, err := normalizePortForward(req.Forwards[i])
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			req.Forwards[i] = f
+		}
+
+		cfg := GetRouterConfig()
+		if err := validatePortForwards(cfg, req.Forwards); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		cfg.PortForwards = req.Forwards
+		if err := SaveRouterConfig(cfg); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		rebuildPortForwardChains(cfg)
+		if err := ReapplyCurrentMode(); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	forwards := GetRouterConfig().PortForwards
+	if forwards == nil {
+		forwards = []PortForward{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"forwards": forwards})
+}
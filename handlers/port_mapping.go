@@ -0,0 +1,556 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// routerPortMappingChain exists in both nat (PREROUTING, DNAT) and filter (jumped
+	// from TS-ROUTER-FWD). Client requests edit it; mode switches never flush it.
+	routerPortMappingChain = "TS-ROUTER-UPNP"
+
+	defaultPortMappingLease = 2 * time.Hour
+	defaultMaxPortMappings  = 128
+	defaultPortMappingPorts = "1024-65535"
+)
+
+var (
+	errPortMappingInactive   = errors.New("port mapping is only available in direct mode")
+	errPortMappingNotAllowed = errors.New("client or port is not allowed")
+	errPortMappingConflict   = errors.New("external port is mapped to another client")
+	errPortMappingFull       = errors.New("no more port mappings available")
+	errPortMappingNotFound   = errors.New("no such port mapping")
+)
+
+// PortMappingConfig controls the UPnP IGD and NAT-PMP responders.
+type PortMappingConfig struct {
+	Enabled bool `json:"enabled"`
+	// AllowedClients are LAN CIDRs that may request mappings; empty allows every
+	// client on a segment with internet access (guest segments never).
+	AllowedClients []string `json:"allowed_clients,omitempty"`
+	// AllowedPorts are ranges such as "1024-65535" or "3074"; both the external and
+	// the internal port must fall inside one.
+	AllowedPorts    []string `json:"allowed_ports,omitempty"`
+	MaxLeaseSeconds int      `json:"max_lease_seconds,omitempty"`
+	MaxMappings     int      `json:"max_mappings,omitempty"`
+}
+
+// PortMapping is one client-requested forward from the WAN.
+type PortMapping struct {
+	Protocol     string    `json:"protocol"`
+	ExternalPort int       `json:"external_port"`
+	InternalIP   string    `json:"internal_ip"`
+	InternalPort int       `json:"internal_port"`
+	RemoteHost   string    `json:"remote_host,omitempty"`
+	Description  string    `json:"description,omitempty"`
+	Via          string    `json:"via"` // upnp or natpmp
+	CreatedAt    time.Time `json:"created_at"`
+	ExpiresAt    time.Time `json:"expires_at"`
+}
+
+// PortMappingStatus is returned by GET /port-mapping.
+type PortMappingStatus struct {
+	Config     PortMappingConfig `json:"config"`
+	Active     bool              `json:"active"`
+	ExternalIP string            `json:"external_ip,omitempty"`
+	Mappings   []PortMapping     `json:"mappings"`
+}
+
+type portRange struct {
+	lo, hi int
+}
+
+func (r portRange) contains(port int) bool {
+	return port >= r.lo && port <= r.hi
+}
+
+var (
+	pmMu sync.Mutex
+	// pmActive is set by applyDirectModeRouting and cleared when an exit node takes over.
+	pmActive   bool
+	pmMappings = make(map[string]PortMapping) // by protocol/external port
+	pmStarted  = time.Now()
+)
+
+func portMappingKey(protocol string, externalPort int) string {
+	return protocol + "/" + strconv.Itoa(externalPort)
+}
+
+func parsePortRange(value string) (portRange, error) {
+	value = strings.TrimSpace(value)
+	lo, hi := value, value
+	if i := strings.Index(value, "-"); i >= 0 {
+		lo, hi = value[:i], value[i+1:]
+	}
+	a, errA := strconv.Atoi(strings.TrimSpace(lo))
+	b, errB := strconv.Atoi(strings.TrimSpace(hi))
+	if errA != nil || errB != nil || a < 1 || b > 65535 || a > b {
+		return portRange{}, fmt.Errorf("invalid port range %q", value)
+	}
+	return portRange{a, b}, nil
+}
+
+func normalizePortMappingConfig(c PortMappingConfig) (PortMappingConfig, error) {
+	var clients []string
+	for _, value := range c.AllowedClients {
+		if strings.TrimSpace(value) == "" {
+			continue
+		}
+		cidr, err := normalizeSplitTunnelCIDR(value)
+		if err != nil {
+			return c, err
+		}
+		if !containsString(clients, cidr) {
+			clients = append(clients, cidr)
+		}
+	}
+	c.AllowedClients = clients
+
+	var ports []string
+	for _, value := range c.AllowedPorts {
+		if strings.TrimSpace(value) == "" {
+			continue
+		}
+		r, err := parsePortRange(value)
+		if err != nil {
+			return c, err
+		}
+		text := strconv.Itoa(r.lo)
+		if r.hi != r.lo {
+			text += "-" + strconv.Itoa(r.hi)
+		}
+		ports = append(ports, text)
+	}
+	c.AllowedPorts = ports
+
+	if c.MaxLeaseSeconds < 0 || c.MaxMappings < 0 {
+		return c, fmt.Errorf("max_lease_seconds and max_mappings cannot be negative")
+	}
+	return c, nil
+}
+
+func portMappingRanges(c PortMappingConfig) []portRange {
+	ports := c.AllowedPorts
+	if len(ports) == 0 {
+		ports = []string{defaultPortMappingPorts}
+	}
+	var ranges []portRange
+	for _, value := range ports {
+		if r, err := parsePortRange(value); err == nil {
+			ranges = append(ranges, r)
+		}
+	}
+	return ranges
+}
+
+func portMappingMaxLease(c PortMappingConfig) time.Duration {
+	if c.MaxLeaseSeconds > 0 {
+		return time.Duration(c.MaxLeaseSeconds) * time.Second
+	}
+	return defaultPortMappingLease
+}
+
+func portMappingMax(c PortMappingConfig) int {
+	if c.MaxMappings > 0 {
+		return c.MaxMappings
+	}
+	return defaultMaxPortMappings
+}
+
+// portMappingSegment returns the segment a client may request mappings from.
+func portMappingSegment(cfg RouterConfig, ip net.IP) (LANSegment, bool) {
+	for _, s := range LANSegments(cfg) {
+		if s.Guest || s.Mode == SegmentModeNone || strings.HasPrefix(s.Mode, "tailscale:") {
+			continue
+		}
+		if _, network, err := net.ParseCIDR(s.CIDR()); err == nil && network.Contains(ip) {
+			return s, true
+		}
+	}
+	return LANSegment{}, false
+}
+
+func portMappingClientAllowed(cfg RouterConfig, client string) bool {
+	ip := net.ParseIP(client)
+	if ip == nil || ip.To4() == nil {
+		return false
+	}
+	s, ok := portMappingSegment(cfg, ip)
+	if !ok || s.Address == client {
+		return false
+	}
+	if len(cfg.PortMapping.AllowedClients) == 0 {
+		return true
+	}
+	for _, cidr := range cfg.PortMapping.AllowedClients {
+		if _, network, err := net.ParseCIDR(cidr); err == nil && network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func portMappingPortAllowed(ranges []portRange, port int) bool {
+	for _, r := range ranges {
+		if r.contains(port) {
+			return true
+		}
+	}
+	return false
+}
+
+// portMappingReserved reports ports that belong to the router or to a static forward.
+func portMappingReserved(cfg RouterConfig, protocol string, port int) bool {
+	switch port {
+	case 5000, guestPortalPort, upnpHTTPPort, natPMPPort:
+		return true
+	}
+	for _, f := range cfg.PortForwards {
+		if !f.Disabled && f.Source == PortForwardSourceWAN && f.ExternalPort == port && containsString(f.protocols(), protocol) {
+			return true
+		}
+	}
+	return false
+}
+
+// addPortMapping creates or renews a mapping. When the external port is taken and
+// anyPort is set, the next free allowed port is used instead (NAT-PMP semantics).
+func addPortMapping(m PortMapping, lease time.Duration, anyPort bool) (PortMapping, error) {
+	cfg := GetRouterConfig()
+	pc := cfg.PortMapping
+	ranges := portMappingRanges(pc)
+
+	pmMu.Lock()
+	defer pmMu.Unlock()
+
+	if !pc.Enabled || !pmActive {
+		return PortMapping{}, errPortMappingInactive
+	}
+	if m.Protocol != "tcp" && m.Protocol != "udp" {
+		return PortMapping{}, errPortMappingNotAllowed
+	}
+	if !portMappingClientAllowed(cfg, m.InternalIP) || !portMappingPortAllowed(ranges, m.InternalPort) {
+		return PortMapping{}, errPortMappingNotAllowed
+	}
+	if max := portMappingMaxLease(pc); lease <= 0 || lease > max {
+		lease = max
+	}
+
+	free := func(port int) bool {
+		if !portMappingPortAllowed(ranges, port) || portMappingReserved(cfg, m.Protocol, port) {
+			return false
+		}
+		existing, ok := pmMappings[portMappingKey(m.Protocol, port)]
+		return !ok || existing.InternalIP == m.InternalIP && existing.InternalPort == m.InternalPort
+	}
+
+	if !free(m.ExternalPort) {
+		if !anyPort {
+			if portMappingPortAllowed(ranges, m.ExternalPort) && !portMappingReserved(cfg, m.Protocol, m.ExternalPort) {
+				return PortMapping{}, errPortMappingConflict
+			}
+			return PortMapping{}, errPortMappingNotAllowed
+		}
+		found := 0
+		for _, r := range ranges {
+			for port := r.lo; port <= r.hi && found == 0; port++ {
+				if port >= m.ExternalPort && free(port) {
+					found = port
+				}
+			}
+		}
+		for _, r := range ranges {
+			for port := r.lo; port <= r.hi && found == 0; port++ {
+				if free(port) {
+					found = port
+				}
+			}
+		}
+		if found == 0 {
+			return PortMapping{}, errPortMappingFull
+		}
+		m.ExternalPort = found
+	}
+
+	key := portMappingKey(m.Protocol, m.ExternalPort)
+	now := time.Now()
+	if existing, ok := pmMappings[key]; ok {
+		m.CreatedAt = existing.CreatedAt
+	} else {
+		if len(pmMappings) >= portMappingMax(pc) {
+			return PortMapping{}, errPortMappingFull
+		}
+		m.CreatedAt = now
+		log.Printf("Port mapping %s/%d -> %s:%d added via %s (%s)", m.Protocol, m.ExternalPort, m.InternalIP, m.InternalPort, m.Via, m.Description)
+	}
+	m.ExpiresAt = now.Add(lease)
+	pmMappings[key] = m
+	syncPortMappingChainsLocked()
+	return m, nil
+}
+
+// deletePortMapping removes a mapping owned by client ("" skips the owner check).
+func deletePortMapping(protocol string, externalPort int, client string) error {
+	pmMu.Lock()
+	defer pmMu.Unlock()
+
+	key := portMappingKey(protocol, externalPort)
+	m, ok := pmMappings[key]
+	if !ok {
+		return errPortMappingNotFound
+	}
+	if client != "" && m.InternalIP != client {
+		return errPortMappingNotAllowed
+	}
+	delete(pmMappings, key)
+	syncPortMappingChainsLocked()
+	log.Printf("Port mapping %s/%d -> %s:%d removed", m.Protocol, m.ExternalPort, m.InternalIP, m.InternalPort)
+	return nil
+}
+
+// deleteClientPortMappings removes every mapping of client for protocol (NAT-PMP "delete all").
+func deleteClientPortMappings(protocol, client string) {
+	pmMu.Lock()
+	defer pmMu.Unlock()
+	for key, m := range pmMappings {
+		if m.Protocol == protocol && m.InternalIP == client {
+			delete(pmMappings, key)
+		}
+	}
+	syncPortMappingChainsLocked()
+}
+
+func findPortMapping(protocol string, externalPort int) (PortMapping, bool) {
+	pmMu.Lock()
+	defer pmMu.Unlock()
+	m, ok := pmMappings[portMappingKey(protocol, externalPort)]
+	return m, ok
+}
+
+func sortedPortMappingsLocked() []PortMapping {
+	list := make([]PortMapping, 0, len(pmMappings))
+	for _, m := range pmMappings {
+		list = append(list, m)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].ExternalPort != list[j].ExternalPort {
+			return list[i].ExternalPort < list[j].ExternalPort
+		}
+		return list[i].Protocol < list[j].Protocol
+	})
+	return list
+}
+
+func listPortMappings() []PortMapping {
+	pmMu.Lock()
+	defer pmMu.Unlock()
+	return sortedPortMappingsLocked()
+}
+
+func ensurePortMappingChains() {
+	exec.Command("iptables", "-N", routerPortMappingChain).Run()
+	exec.Command("iptables", "-t", "nat", "-N", routerPortMappingChain).Run()
+	if exec.Command("iptables", "-t", "nat", "-C", "PREROUTING", "-j", routerPortMappingChain).Run() != nil {
+		exec.Command("iptables", "-t", "nat", "-A", "PREROUTING", "-j", routerPortMappingChain).Run()
+	}
+}
+
+// syncPortMappingChainsLocked renders the mappings into TS-ROUTER-UPNP. Caller holds pmMu.
+func syncPortMappingChainsLocked() {
+	ensurePortMappingChains()
+	exec.Command("iptables", "-F", routerPortMappingChain).Run()
+	exec.Command("iptables", "-t", "nat", "-F", routerPortMappingChain).Run()
+	if !pmActive {
+		return
+	}
+
+	wans := ActiveWANInterfaces()
+	for _, m := range sortedPortMappingsLocked() {
+		source := []string{}
+		if m.RemoteHost != "" {
+			source = []string{"-s", m.RemoteHost}
+		}
+		to := net.JoinHostPort(m.InternalIP, strconv.Itoa(m.InternalPort))
+		for _, wan := range wans {
+			args := append([]string{"-i", wan}, source...)
+			args = append(args, "-p", m.Protocol, "--dport", strconv.Itoa(m.ExternalPort),
+				"-m", "addrtype", "--dst-type", "LOCAL", "-j", "DNAT", "--to-destination", to)
+			appendPortForwardChainRule("nat", routerPortMappingChain, args...)
+		}
+		appendPortForwardChainRule("filter", routerPortMappingChain, "-d", m.InternalIP, "-p", m.Protocol,
+			"--dport", strconv.Itoa(m.InternalPort), "-m", "conntrack", "--ctstate", "DNAT", "-j", "ACCEPT")
+	}
+}
+
+// appendPortMappingRules runs in applyDirectModeRouting (caller holds mu): it hooks
+// TS-ROUTER-UPNP into the freshly flushed TS-ROUTER-FWD and re-renders the mappings.
+func appendPortMappingRules() {
+	enabled := GetRouterConfig().PortMapping.Enabled
+	ensurePortMappingChains()
+	if enabled {
+		appendRouterForwardRule("-j", routerPortMappingChain)
+	}
+
+	pmMu.Lock()
+	pmActive = enabled
+	if !enabled {
+		pmMappings = make(map[string]PortMapping)
+	}
+	syncPortMappingChainsLocked()
+	pmMu.Unlock()
+}
+
+// clearPortMappings drops every mapping; an exit node gives LAN clients no
+// reachable public address, so mappings would only mislead them.
+func clearPortMappings() {
+	pmMu.Lock()
+	defer pmMu.Unlock()
+	if len(pmMappings) > 0 {
+		log.Printf("Removing %d port mappings: exit node active", len(pmMappings))
+	}
+	pmActive = false
+	pmMappings = make(map[string]PortMapping)
+	syncPortMappingChainsLocked()
+}
+
+// prunePortMappings removes expired mappings and those the config no longer allows.
+func prunePortMappings() {
+	cfg := GetRouterConfig()
+	ranges := portMappingRanges(cfg.PortMapping)
+	now := time.Now()
+
+	pmMu.Lock()
+	defer pmMu.Unlock()
+	changed := false
+	for key, m := range pmMappings {
+		if now.After(m.ExpiresAt) || !cfg.PortMapping.Enabled || !portMappingClientAllowed(cfg, m.InternalIP) ||
+			!portMappingPortAllowed(ranges, m.ExternalPort) || !portMappingPortAllowed(ranges, m.InternalPort) ||
+			portMappingReserved(cfg, m.Protocol, m.ExternalPort) {
+			delete(pmMappings, key)
+			changed = true
+		}
+	}
+	if !cfg.PortMapping.Enabled && pmActive {
+		pmActive = false
+		changed = true
+	}
+	if changed {
+		syncPortMappingChainsLocked()
+	}
+}
+
+// portMappingExternalIP is the address mappings are reachable on.
+func portMappingExternalIP() string {
+	for _, wan := range ActiveWANInterfaces() {
+		if ip, _ := getInterfaceIPv4CIDR(wan); ip != "" {
+			return ip
+		}
+	}
+	return ""
+}
+
+// portMappingSegments lists the segments whose router address serves NAT-PMP
+// and UPnP, or none while port mapping is disabled.
+func portMappingSegments(cfg RouterConfig) []LANSegment {
+	if !cfg.PortMapping.Enabled {
+		return nil
+	}
+	var segments []LANSegment
+	for _, s := range LANSegments(cfg) {
+		if _, ok := portMappingSegment(cfg, net.ParseIP(s.Address)); ok {
+			segments = append(segments, s)
+		}
+	}
+	return segments
+}
+
+// refreshPortMappingListeners opens the responders on the eligible segment
+// addresses and closes the rest.
+func refreshPortMappingListeners() {
+	refreshNATPMPListeners()
+	refreshUPnPServers()
+	refreshSSDPListeners()
+}
+
+// RunPortMapping keeps the responders on the eligible segments and expires mappings.
+func RunPortMapping() {
+	ticker := time.NewTicker(15 * time.Second)
+	defer ticker.Stop()
+	for {
+		refreshPortMappingListeners()
+		prunePortMappings()
+		<-ticker.C
+	}
+}
+
+func GetPortMappingStatus() PortMappingStatus {
+	cfg := GetRouterConfig()
+	pmMu.Lock()
+	active := pmActive
+	mappings := sortedPortMappingsLocked()
+	pmMu.Unlock()
+
+	status := PortMappingStatus{
+		Config:   cfg.PortMapping,
+		Active:   active && cfg.PortMapping.Enabled,
+		Mappings: mappings,
+	}
+	if status.Active {
+		status.ExternalIP = portMappingExternalIP()
+	}
+	return status
+}
+
+// PortMappingHandler reads or updates the UPnP/NAT-PMP settings and lists mappings.
+// POST /port-mapping {"enabled": true, "allowed_clients": ["192.168.50.30/32"], "allowed_ports": ["3074", "49152-65535"]}
+func PortMappingHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		var req PortMappingConfig
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "invalid JSON body", http.StatusBadRequest)
+			return
+		}
+		req, err := normalizePortMappingConfig(req)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		cfg := GetRouterConfig()
+		wasEnabled := cfg.PortMapping.Enabled
+		cfg.PortMapping = req
+		if err := SaveRouterConfig(cfg); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		if req.Enabled != wasEnabled {
+			// The TS-ROUTER-FWD jump is added by direct mode routing.
+			if err := ReapplyCurrentMode(); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
+		refreshPortMappingListeners()
+		prunePortMappings()
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(GetPortMappingStatus())
+}
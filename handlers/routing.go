@@ -11,17 +11,28 @@ import (
 // ApplyLocalPolicyRouting keeps traffic between local subnets on the main routing
 // table so SSH and HTTP management on WAN/LAN IPs keep working after tailscale up.
 func ApplyLocalPolicyRouting(cfg RouterConfig) {
-	if cfg.WANInterface != "" {
-		wanIP, wanPrefix := getInterfaceIPv4CIDR(cfg.WANInterface)
+	wans := []string{cfg.WANInterface}
+	for _, link := range cfg.WANLinks {
+		if link.Interface != cfg.WANInterface {
+			wans = append(wans, link.Interface)
+		}
+	}
+	for _, wan := range wans {
+		if wan == "" {
+			continue
+		}
+		wanIP, wanPrefix := getInterfaceIPv4CIDR(wan)
 		if wanIP != "" && wanPrefix > 0 {
 			wanNet := networkCIDR(wanIP, wanPrefix)
 			ensureIPRule(90, wanNet, wanNet)
 		}
 	}
 
-	if cfg.LANAddress != "" && cfg.LANPrefix > 0 {
-		lanNet := networkCIDR(cfg.LANAddress, cfg.LANPrefix)
-		ensureIPRule(91, lanNet, lanNet)
+	for _, segment := range LANSegments(cfg) {
+		if segment.Address != "" && segment.Prefix > 0 {
+			lanNet := segment.CIDR()
+			ensureIPRule(91, lanNet, lanNet)
+		}
 	}
 }
 
@@ -63,6 +74,42 @@ func ensureIPRule(priority int, fromCIDR, toCIDR string) {
 	}
 }
 
+// ensureFwmarkRule sends packets carrying fwmark (value/mask) to table.
+func ensureFwmarkRule(priority int, fwmark, table string) {
+	pref := fmt.Sprintf("%d:", priority)
+	out, _ := exec.Command("ip", "rule", "show").Output()
+	for _, line := range strings.Split(string(out), "\n") {
+		if strings.HasPrefix(strings.TrimSpace(line), pref) && strings.Contains(line, "fwmark "+fwmark) {
+			return
+		}
+	}
+
+	args := []string{
+		"rule", "add",
+		"fwmark", fwmark,
+		"lookup", table,
+		"priority", fmt.Sprint(priority),
+	}
+	if out, err := exec.Command("ip", args...).CombinedOutput(); err != nil {
+		msg := strings.TrimSpace(string(out))
+		if strings.Contains(msg, "File exists") {
+			return
+		}
+		log.Printf("policy routing (fwmark %s): %v: %s", fwmark, err, msg)
+	} else {
+		log.Printf("policy routing: fwmark %s uses %s table", fwmark, table)
+	}
+}
+
+// deleteIPRulePriority removes every rule at priority.
+func deleteIPRulePriority(priority int) {
+	for i := 0; i < 8; i++ {
+		if exec.Command("ip", "rule", "del", "priority", fmt.Sprint(priority)).Run() != nil {
+			return
+		}
+	}
+}
+
 const ipForwardSysctlPath = "/etc/sysctl.d/99-tailscale-router.conf"
 
 var ipForwardSettings = map[string]string{
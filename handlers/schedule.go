@@ -0,0 +1,452 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	scheduleStateFile     = configDir + "/schedule-state.json"
+	scheduleCheckInterval = 30 * time.Second
+	// scheduleCatchUp bounds how far back missed transitions are applied after a reboot.
+	scheduleCatchUp = 7 * 24 * time.Hour
+)
+
+// ScheduleRule switches the router to Mode whenever Cron matches.
+// Cron is the classic 5-field "minute hour day-of-month month day-of-week" form,
+// evaluated in Timezone (IANA name), the schedule default, or local time.
+type ScheduleRule struct {
+	Name     string `json:"name"`
+	Cron     string `json:"cron"`
+	Mode     string `json:"mode"` // direct, tailscale:<node id>, tailscale:auto[:filter]
+	Timezone string `json:"timezone,omitempty"`
+	Enabled  bool   `json:"enabled"`
+}
+
+// ScheduledChange is the next transition produced by the schedule.
+type ScheduledChange struct {
+	Rule string    `json:"rule"`
+	Mode string    `json:"mode"`
+	At   time.Time `json:"at"`
+}
+
+// ScheduleStatus is reported by /status and /schedule.
+type ScheduleStatus struct {
+	Timezone      string           `json:"timezone"`
+	Rules         []ScheduleRule   `json:"rules"`
+	Next          *ScheduledChange `json:"next,omitempty"`
+	OverrideMode  string           `json:"override_mode,omitempty"`
+	OverrideUntil *time.Time       `json:"override_until,omitempty"`
+}
+
+// scheduleState survives restarts so transitions missed while powered off are applied.
+type scheduleState struct {
+	LastCheck     time.Time  `json:"last_check"`
+	OverrideMode  string     `json:"override_mode,omitempty"`
+	OverrideUntil *time.Time `json:"override_until,omitempty"`
+}
+
+var (
+	scheduleMu    sync.Mutex
+	scheduleSaved = loadScheduleState()
+)
+
+func loadScheduleState() scheduleState {
+	var state scheduleState
+	data, err := os.ReadFile(scheduleStateFile)
+	if err != nil {
+		return state
+	}
+	if err := json.Unmarshal(data, &state); err != nil {
+		log.Printf("Ignoring unreadable %s: %v", scheduleStateFile, err)
+		return scheduleState{}
+	}
+	return state
+}
+
+// saveScheduleState writes the state file. Caller must hold scheduleMu.
+func saveScheduleState() {
+	data, _ := json.Marshal(scheduleSaved)
+	if err := os.WriteFile(scheduleStateFile, data, 0644); err != nil {
+		log.Printf("schedule state: %v", err)
+	}
+}
+
+// cronSpec is a parsed 5-field cron expression.
+type cronSpec struct {
+	minute, hour, dom, month, dow [61]bool
+	domAny, dowAny                bool
+}
+
+func parseCron(expr string) (cronSpec, error) {
+	var spec cronSpec
+	fields := strings.Fields(expr)
+	if len(fields) != 5 {
+		return spec, fmt.Errorf("cron %q: expected 5 fields (minute hour day month weekday)", expr)
+	}
+
+	parts := []struct {
+		set      *[61]bool
+		min, max int
+	}{
+		{&spec.minute, 0, 59},
+		{&spec.hour, 0, 23},
+		{&spec.dom, 1, 31},
+		{&spec.month, 1, 12},
+		{&spec.dow, 0, 7},
+	}
+	for i, part := range parts {
+		if err := parseCronField(fields[i], part.min, part.max, part.set); err != nil {
+			return spec, fmt.Errorf("cron %q: %v", expr, err)
+		}
+	}
+	// Both 0 and 7 mean Sunday.
+	if spec.dow[7] {
+		spec.dow[0] = true
+	}
+	spec.domAny = fields[2] == "*"
+	spec.dowAny = fields[4] == "*"
+	return spec, nil
+}
+
+// parseCronField handles "*", "5", "1-5", "*/15", "8-18/2" and comma lists.
+func parseCronField(field string, min, max int, set *[61]bool) error {
+	for _, item := range strings.Split(field, ",") {
+		step := 1
+		if i := strings.Index(item, "/"); i >= 0 {
+			n, err := strconv.Atoi(item[i+1:])
+			if err != nil || n <= 0 {
+				return fmt.Errorf("invalid step in %q", item)
+			}
+			step = n
+			item = item[:i]
+		}
+
+		lo, hi := min, max
+		if item != "*" {
+			bounds := strings.SplitN(item, "-", 2)
+			var err error
+			if lo, err = strconv.Atoi(bounds[0]); err != nil {
+				return fmt.Errorf("invalid value %q", item)
+			}
+			hi = lo
+			if len(bounds) == 2 {
+				if hi, err = strconv.Atoi(bounds[1]); err != nil {
+					return fmt.Errorf("invalid range %q", item)
+				}
+			} else if step > 1 {
+				hi = max
+			}
+		}
+		if lo < min || hi > max || lo > hi {
+			return fmt.Errorf("%q out of range %d-%d", item, min, max)
+		}
+		for v := lo; v <= hi; v += step {
+			set[v] = true
+		}
+	}
+	return nil
+}
+
+func (c cronSpec) dayMatches(t time.Time) bool {
+	dom := c.dom[t.Day()]
+	dow := c.dow[int(t.Weekday())]
+	// Standard cron: if both fields are restricted, either may match.
+	if !c.domAny && !c.dowAny {
+		return dom || dow
+	}
+	return dom && dow
+}
+
+// firstMinute is the earliest minute the spec matches.
+func (c cronSpec) firstMinute() int {
+	for m := 0; m < 60; m++ {
+		if c.minute[m] {
+			return m
+		}
+	}
+	return 0
+}
+
+// next returns the first matching wall-clock minute strictly after after.
+// Times skipped by a DST jump fire once, shifted past the gap by its length
+// (02:30 becomes 03:30); repeated times when clocks go back fire once.
+func (c cronSpec) next(after time.Time, loc *time.Location) (time.Time, bool) {
+	t := after.In(loc)
+	t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute()+1, 0, 0, loc)
+	limit := t.AddDate(5, 0, 0)
+
+	for t.Before(limit) {
+		switch {
+		case !c.month[int(t.Month())]:
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, loc)
+		case !c.dayMatches(t):
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, loc)
+		case !c.hour[t.Hour()], !c.minute[t.Minute()] && t.Minute() == 59:
+			wanted := t.Hour() + 1
+			t = time.Date(t.Year(), t.Month(), t.Day(), wanted, 0, 0, 0, loc)
+			if wanted < 24 && t.Hour() != wanted && c.hour[wanted] {
+				// The wanted hour does not exist today (spring forward); time.Date
+				// moves the rule's first minute in it past the gap.
+				return time.Date(t.Year(), t.Month(), t.Day(), wanted, c.firstMinute(), 0, 0, loc), true
+			}
+		case !c.minute[t.Minute()]:
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute()+1, 0, 0, loc)
+		default:
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
+
+func scheduleLocation(cfg RouterConfig, rule ScheduleRule) (*time.Location, error) {
+	name := rule.Timezone
+	if name == "" {
+		name = cfg.ScheduleTimezone
+	}
+	if name == "" {
+		return time.Local, nil
+	}
+	return time.LoadLocation(name)
+}
+
+// scheduleRuleNode returns the exit node a rule's mode names, if it names a
+// single node (not direct and not an auto spec).
+func scheduleRuleNode(mode string) (string, bool) {
+	if !strings.HasPrefix(mode, "tailscale:") {
+		return "", false
+	}
+	ref := strings.TrimPrefix(mode, "tailscale:")
+	if _, auto := parseAutoExitNodeSpec(ref); auto || ref == "" {
+		return "", false
+	}
+	return ref, true
+}
+
+// validateScheduleRule checks a rule; nodes are the tailnet's exit nodes, needed
+// only for rules that name a single node.
+func validateScheduleRule(cfg RouterConfig, rule ScheduleRule, nodes map[string]ExitNode) error {
+	if _, err := parseCron(rule.Cron); err != nil {
+		return err
+	}
+	if _, err := scheduleLocation(cfg, rule); err != nil {
+		return fmt.Errorf("rule %q: timezone: %v", rule.Name, err)
+	}
+	if rule.Mode != "direct" && !(strings.HasPrefix(rule.Mode, "tailscale:") && len(rule.Mode) > len("tailscale:")) {
+		return fmt.Errorf("rule %q: mode must be direct or tailscale:<node>", rule.Name)
+	}
+	if ref, ok := scheduleRuleNode(rule.Mode); ok {
+		if _, found := findExitNode(nodes, ref); !found {
+			return fmt.Errorf("rule %q: exit node %q not found", rule.Name, ref)
+		}
+	}
+	return nil
+}
+
+// nextScheduledChange returns the earliest enabled transition after t.
+func nextScheduledChange(cfg RouterConfig, t time.Time) *ScheduledChange {
+	var next *ScheduledChange
+	for _, rule := range cfg.ScheduleRules {
+		if !rule.Enabled {
+			continue
+		}
+		spec, err := parseCron(rule.Cron)
+		if err != nil {
+			continue
+		}
+		loc, err := scheduleLocation(cfg, rule)
+		if err != nil {
+			continue
+		}
+		at, ok := spec.next(t, loc)
+		if !ok {
+			continue
+		}
+		if next == nil || at.Before(next.At) {
+			next = &ScheduledChange{Rule: rule.Name, Mode: rule.Mode, At: at}
+		}
+	}
+	return next
+}
+
+// dueScheduledChange returns the latest transition in (since, now], if any.
+func dueScheduledChange(cfg RouterConfig, since, now time.Time) *ScheduledChange {
+	var due *ScheduledChange
+	for cursor := since; ; {
+		change := nextScheduledChange(cfg, cursor)
+		if change == nil || change.At.After(now) {
+			return due
+		}
+		due = change
+		cursor = change.At
+	}
+}
+
+// applyScheduledMode switches to a rule's mode unless it is already active. Rules
+// may name a node by hostname while CurrentMode holds node IDs, so the node is
+// resolved before comparing; otherwise every firing would flush routing again.
+func applyScheduledMode(mode string) error {
+	mu.Lock()
+	current := CurrentMode
+	mu.Unlock()
+	if mode == current {
+		return nil
+	}
+	if mode == "direct" {
+		return DisableTailscaleExitNode()
+	}
+	ref := strings.TrimPrefix(mode, "tailscale:")
+	if filter, ok := parseAutoExitNodeSpec(ref); ok {
+		if autoExitNodeMode(filter) == current {
+			return nil
+		}
+	} else {
+		nodes, err := GetExitNodes()
+		if err != nil {
+			return err
+		}
+		node, found := findExitNode(nodes, ref)
+		if !found {
+			return fmt.Errorf("exit node %q not found", ref)
+		}
+		if "tailscale:"+node.ID == current {
+			return nil
+		}
+	}
+	return SetTailscaleExitNode(ref)
+}
+
+// NoteManualModeChange records a dashboard/API mode switch. It stays in effect
+// until the next scheduled transition, which then clears the override.
+func NoteManualModeChange(mode string) {
+	next := nextScheduledChange(GetRouterConfig(), time.Now())
+	if next == nil {
+		return
+	}
+	scheduleMu.Lock()
+	defer scheduleMu.Unlock()
+	scheduleSaved.OverrideMode = mode
+	scheduleSaved.OverrideUntil = &next.At
+	saveScheduleState()
+	log.Printf("Schedule: manual mode %s overrides schedule until %s", mode, next.At.Format(time.RFC3339))
+}
+
+func runScheduleCheck(now time.Time) {
+	cfg := GetRouterConfig()
+
+	scheduleMu.Lock()
+	since := scheduleSaved.LastCheck
+	if since.IsZero() || now.Sub(since) > scheduleCatchUp {
+		since = now.Add(-scheduleCheckInterval)
+	}
+	scheduleSaved.LastCheck = now
+	due := dueScheduledChange(cfg, since, now)
+	if due != nil {
+		scheduleSaved.OverrideMode = ""
+		scheduleSaved.OverrideUntil = nil
+	}
+	saveScheduleState()
+	scheduleMu.Unlock()
+
+	if due == nil {
+		return
+	}
+	log.Printf("Schedule: rule %q switching to %s", due.Rule, due.Mode)
+	if err := applyScheduledMode(due.Mode); err != nil {
+		log.Printf("Schedule: rule %q failed: %v", due.Rule, err)
+	}
+}
+
+// RunScheduler applies scheduled mode changes. Missed transitions (e.g. while the
+// Pi was powered off) are caught up once on startup, latest rule winning.
+func RunScheduler() {
+	for {
+		runScheduleCheck(time.Now())
+		time.Sleep(scheduleCheckInterval)
+	}
+}
+
+// GetScheduleStatus reports the rules, the next transition, and any manual override.
+func GetScheduleStatus() ScheduleStatus {
+	cfg := GetRouterConfig()
+	status := ScheduleStatus{
+		Timezone: cfg.ScheduleTimezone,
+		Rules:    cfg.ScheduleRules,
+		Next:     nextScheduledChange(cfg, time.Now()),
+	}
+	if status.Timezone == "" {
+		status.Timezone = time.Local.String()
+	}
+	if status.Rules == nil {
+		status.Rules = []ScheduleRule{}
+	}
+
+	scheduleMu.Lock()
+	defer scheduleMu.Unlock()
+	if scheduleSaved.OverrideUntil != nil && time.Now().Before(*scheduleSaved.OverrideUntil) {
+		status.OverrideMode = scheduleSaved.OverrideMode
+		status.OverrideUntil = scheduleSaved.OverrideUntil
+	}
+	return status
+}
+
+// ScheduleHandler returns (GET) or replaces (POST) the schedule rules.
+// POST body: {"timezone": "Europe/Warsaw", "rules": [{"name", "cron", "mode", "timezone", "enabled"}]}
+func ScheduleHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		var req struct {
+			Timezone string         `json:"timezone"`
+			Rules    []ScheduleRule `json:"rules"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "invalid JSON body", http.StatusBadRequest)
+			return
+		}
+
+		cfg := GetRouterConfig()
+		cfg.ScheduleTimezone = strings.TrimSpace(req.Timezone)
+		cfg.ScheduleRules = req.Rules
+		var nodes map[string]ExitNode
+		for _, rule := range cfg.ScheduleRules {
+			if _, ok := scheduleRuleNode(rule.Mode); ok {
+				var err error
+				if nodes, err = GetExitNodes(); err != nil {
+					http.Error(w, "cannot check exit nodes: "+err.Error(), http.StatusServiceUnavailable)
+					return
+				}
+				break
+			}
+		}
+		for i := range cfg.ScheduleRules {
+			rule := &cfg.ScheduleRules[i]
+			rule.Name = strings.TrimSpace(rule.Name)
+			if rule.Name == "" {
+				rule.Name = fmt.Sprintf("rule-%d", i+1)
+			}
+			if err := validateScheduleRule(cfg, *rule, nodes); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+
+		if err := SaveRouterConfig(cfg); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(GetScheduleStatus())
+}
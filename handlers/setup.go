@@ -10,17 +10,20 @@ import (
 )
 
 type setupApplyRequest struct {
-	WANInterface     string `json:"wan_interface"`
-	LANInterface     string `json:"lan_interface"`
-	LANAddress       string `json:"lan_address"`
-	LANPrefix        int    `json:"lan_prefix"`
-	DHCPRangeStart   string `json:"dhcp_range_start"`
-	DHCPRangeEnd     string `json:"dhcp_range_end"`
-	DHCPLeaseHours   int    `json:"dhcp_lease_hours"`
-	TailscaleHost    string `json:"tailscale_hostname"`
-	TailscaleAuthKey string `json:"tailscale_auth_key"`
-	AdminUsername    string `json:"admin_username"`
-	AdminPassword    string `json:"admin_password"`
+	WANInterface     string           `json:"wan_interface"`
+	LANInterface     string           `json:"lan_interface"`
+	LANAddress       string           `json:"lan_address"`
+	LANPrefix        int              `json:"lan_prefix"`
+	DHCPRangeStart   string           `json:"dhcp_range_start"`
+	DHCPRangeEnd     string           `json:"dhcp_range_end"`
+	DHCPLeaseHours   int              `json:"dhcp_lease_hours"`
+	TailscaleHost    string           `json:"tailscale_hostname"`
+	TailscaleAuthKey string           `json:"tailscale_auth_key"`
+	SubnetRouter     bool             `json:"subnet_router"`
+	WifiClient       WifiClientConfig `json:"wifi_client"`
+	WifiAP           WifiAPConfig     `json:"wifi_ap"`
+	AdminUsername    string           `json:"admin_username"`
+	AdminPassword    string           `json:"admin_password"`
 }
 
 // SetupStatusHandler returns interfaces, routing, and Tailscale state for the wizard.
@@ -89,6 +92,7 @@ func parseSetupRequest(r *http.Request) (RouterConfig, string, error) {
 		DHCPRangeEnd:   strings.TrimSpace(req.DHCPRangeEnd),
 		DHCPLeaseHours: req.DHCPLeaseHours,
 		TailscaleHost:  strings.TrimSpace(req.TailscaleHost),
+		SubnetRouter:   req.SubnetRouter,
 		AdminUsername:  strings.TrimSpace(req.AdminUsername),
 		AdminPassword:  req.AdminPassword,
 	}
@@ -126,6 +130,25 @@ func parseSetupRequest(r *http.Request) (RouterConfig, string, error) {
 		cfg.TailscaleHost = getSystemHostname()
 	}
 
+	// A wireless WAN joins the chosen network before anything needs the internet.
+	if strings.TrimSpace(req.WifiClient.SSID) != "" && isWirelessInterface(cfg.WANInterface) {
+		client := normalizeWifiClientConfig(req.WifiClient)
+		client.PSK = ""
+		if err := validateWifiClientConfig(client); err != nil {
+			return RouterConfig{}, "", fmt.Errorf("Wi-Fi network: %v", err)
+		}
+		cfg.WifiClient = secureWifiClientConfig(client)
+	}
+
+	// A wireless LAN only works as an access point.
+	if cfg.LANInterface != "" && isWirelessInterface(cfg.LANInterface) {
+		cfg.WifiAP = normalizeWifiAPConfig(req.WifiAP)
+		cfg.WifiAP.Enabled = true
+		if err := validateWifiAPConfig(cfg.WifiAP); err != nil {
+			return RouterConfig{}, "", fmt.Errorf("Wi-Fi access point: %v", err)
+		}
+	}
+
 	return cfg, strings.TrimSpace(req.TailscaleAuthKey), nil
 }
 
@@ -0,0 +1,466 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Speed test paths.
+const (
+	SpeedTestPathWAN      = "wan"
+	SpeedTestPathExitNode = "exit_node"
+)
+
+const (
+	speedTestsFile          = stateDir + "/speed_tests.json"
+	speedTestHistorySize    = 50
+	defaultSpeedTestURL     = "https://speed.cloudflare.com"
+	defaultSpeedTestDown    = 25000000
+	defaultSpeedTestUp      = 10000000
+	defaultSpeedTestStreams = 4
+	speedTestPhaseTimeout   = 20 * time.Second
+	speedTestLatencySamples = 10
+)
+
+// SpeedTestConfig points the test at an HTTP endpoint speaking the speed.cloudflare.com
+// protocol: GET /__down?bytes=N and POST /__up. `tailscale-raspberry-router
+// speedtest-server` serves the same protocol for a test server on the LAN or a VPS.
+type SpeedTestConfig struct {
+	Endpoint      string `json:"endpoint,omitempty"`
+	DownloadBytes int64  `json:"download_bytes,omitempty"` // per test, split across streams
+	UploadBytes   int64  `json:"upload_bytes,omitempty"`
+	Streams       int    `json:"streams,omitempty"`
+}
+
+// SpeedTestResult is one measurement of one path.
+type SpeedTestResult struct {
+	Time         time.Time `json:"time"`
+	Path         string    `json:"path"`
+	Interface    string    `json:"interface"`
+	ExitNode     string    `json:"exit_node,omitempty"`
+	Endpoint     string    `json:"endpoint"`
+	DownloadMbps float64   `json:"download_mbps"`
+	UploadMbps   float64   `json:"upload_mbps"`
+	LatencyMs    float64   `json:"latency_ms"` // median HTTP round trip on an open connection
+	JitterMs     float64   `json:"jitter_ms"`
+	Error        string    `json:"error,omitempty"`
+}
+
+// SpeedTestStatus is returned by GET /speedtest.
+type SpeedTestStatus struct {
+	Config  SpeedTestConfig   `json:"config"`
+	Running bool              `json:"running"`
+	Results []SpeedTestResult `json:"results"` // newest first
+}
+
+// errNoExitNode is returned when the exit node path is asked for in direct mode.
+var errNoExitNode = errors.New("no exit node in use; switch to one to test its path")
+
+var (
+	speedMu      sync.Mutex
+	speedRunning bool
+	speedResults []SpeedTestResult // oldest first, loaded lazily
+	speedLoaded  bool
+)
+
+func speedTestConfig() SpeedTestConfig {
+	c := GetRouterConfig().SpeedTest
+	if c.Endpoint == "" {
+		c.Endpoint = defaultSpeedTestURL
+	}
+	if c.DownloadBytes <= 0 {
+		c.DownloadBytes = defaultSpeedTestDown
+	}
+	if c.UploadBytes <= 0 {
+		c.UploadBytes = defaultSpeedTestUp
+	}
+	if c.Streams <= 0 {
+		c.Streams = defaultSpeedTestStreams
+	}
+	return c
+}
+
+func loadSpeedResultsLocked() {
+	if speedLoaded {
+		return
+	}
+	speedLoaded = true
+	data, err := os.ReadFile(speedTestsFile)
+	if err != nil {
+		return
+	}
+	if err := json.Unmarshal(data, &speedResults); err != nil {
+		log.Printf("Ignoring unreadable %s: %v", speedTestsFile, err)
+		speedResults = nil
+	}
+}
+
+func saveSpeedResultsLocked() error {
+	if err := os.MkdirAll(stateDir, 0755); err != nil {
+		return err
+	}
+	data, err := json.Marshal(speedResults)
+	if err != nil {
+		return err
+	}
+	tmp := speedTestsFile + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, speedTestsFile)
+}
+
+func recordSpeedResult(r SpeedTestResult) {
+	speedMu.Lock()
+	defer speedMu.Unlock()
+	loadSpeedResultsLocked()
+	speedResults = append(speedResults, r)
+	if len(speedResults) > speedTestHistorySize {
+		speedResults = speedResults[len(speedResults)-speedTestHistorySize:]
+	}
+	if err := saveSpeedResultsLocked(); err != nil {
+		log.Printf("Saving %s: %v", speedTestsFile, err)
+	}
+}
+
+// latestSpeedResult is the newest successful result for path.
+func latestSpeedResult(path string) (SpeedTestResult, bool) {
+	speedMu.Lock()
+	defer speedMu.Unlock()
+	loadSpeedResultsLocked()
+	for i := len(speedResults) - 1; i >= 0; i-- {
+		if speedResults[i].Path == path && speedResults[i].Error == "" {
+			return speedResults[i], true
+		}
+	}
+	return SpeedTestResult{}, false
+}
+
+// speedTestClient sends every connection out of iface, whatever the routing
+// policy says: SO_BINDTODEVICE makes the WAN reachable while an exit node is
+// active, and pins exit-node tests to tailscale0.
+func speedTestClient(iface string, streams int) *http.Client {
+	dialer := &net.Dialer{
+		Timeout: 10 * time.Second,
+		Control: func(network, address string, c syscall.RawConn) error {
+			var sockErr error
+			err := c.Control(func(fd uintptr) {
+				sockErr = syscall.SetsockoptString(int(fd), syscall.SOL_SOCKET, syscall.SO_BINDTODEVICE, iface)
+			})
+			if err != nil {
+				return err
+			}
+			return sockErr
+		},
+	}
+	return &http.Client{Transport: &http.Transport{
+		DialContext:         dialer.DialContext,
+		TLSHandshakeTimeout: 10 * time.Second,
+		MaxIdleConnsPerHost: streams,
+		DisableCompression:  true,
+	}}
+}
+
+// zeroReader is an endless upload body.
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 0
+	}
+	return len(p), nil
+}
+
+// countingReader lets a timed-out transfer still report what it moved.
+type countingReader struct {
+	r  io.Reader
+	mu *sync.Mutex
+	n  *int64
+}
+
+func (c countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.mu.Lock()
+	*c.n += int64(n)
+	c.mu.Unlock()
+	return n, err
+}
+
+// measureLatency times small requests on a warm connection; the first request
+// pays for DNS, TCP and TLS and is not counted.
+func measureLatency(client *http.Client, base string) (median, jitter float64, err error) {
+	var samples []float64
+	for i := 0; i <= speedTestLatencySamples; i++ {
+		start := time.Now()
+		resp, err := client.Get(base + "/__down?bytes=0")
+		if err != nil {
+			return 0, 0, err
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return 0, 0, fmt.Errorf("%s: %s", base, resp.Status)
+		}
+		if i > 0 {
+			samples = append(samples, float64(time.Since(start))/float64(time.Millisecond))
+		}
+	}
+	for i := 1; i < len(samples); i++ {
+		d := samples[i] - samples[i-1]
+		if d < 0 {
+			d = -d
+		}
+		jitter += d
+	}
+	jitter /= float64(len(samples) - 1)
+	sort.Float64s(samples)
+	return samples[len(samples)/2], jitter, nil
+}
+
+// measureThroughput runs transfer on streams in parallel until they finish or the
+// phase times out, and returns Mbit/s over the wall time.
+func measureThroughput(streams int, transfer func(ctx context.Context, counter func(io.Reader) io.Reader) error) (float64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), speedTestPhaseTimeout)
+	defer cancel()
+
+	var (
+		countMu sync.Mutex
+		total   int64
+		wg      sync.WaitGroup
+		errs    = make(chan error, streams)
+	)
+	counter := func(r io.Reader) io.Reader { return countingReader{r: r, mu: &countMu, n: &total} }
+	start := time.Now()
+	for i := 0; i < streams; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := transfer(ctx, counter); err != nil && ctx.Err() == nil {
+				errs <- err
+			}
+		}()
+	}
+	wg.Wait()
+	elapsed := time.Since(start).Seconds()
+	close(errs)
+
+	countMu.Lock()
+	moved := total
+	countMu.Unlock()
+	if err := <-errs; err != nil {
+		return 0, err
+	}
+	if moved == 0 || elapsed <= 0 {
+		return 0, fmt.Errorf("no data transferred")
+	}
+	return float64(moved) * 8 / elapsed / 1e6, nil
+}
+
+func runSpeedTest(path, iface, exitNode string, cfg SpeedTestConfig) SpeedTestResult {
+	base := strings.TrimRight(cfg.Endpoint, "/")
+	r := SpeedTestResult{Time: time.Now(), Path: path, Interface: iface, ExitNode: exitNode, Endpoint: base}
+	client := speedTestClient(iface, cfg.Streams)
+	defer client.CloseIdleConnections()
+
+	var err error
+	if r.LatencyMs, r.JitterMs, err = measureLatency(client, base); err != nil {
+		r.Error = "latency: " + err.Error()
+		return r
+	}
+
+	perStream := cfg.DownloadBytes / int64(cfg.Streams)
+	r.DownloadMbps, err = measureThroughput(cfg.Streams, func(ctx context.Context, counter func(io.Reader) io.Reader) error {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, fmt.Sprintf("%s/__down?bytes=%d", base, perStream), nil)
+		if err != nil {
+			return err
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("download: %s", resp.Status)
+		}
+		_, err = io.Copy(io.Discard, counter(resp.Body))
+		return err
+	})
+	if err != nil {
+		r.Error = "download: " + err.Error()
+		return r
+	}
+
+	perStream = cfg.UploadBytes / int64(cfg.Streams)
+	r.UploadMbps, err = measureThroughput(cfg.Streams, func(ctx context.Context, counter func(io.Reader) io.Reader) error {
+		body := counter(io.LimitReader(zeroReader{}, perStream))
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, base+"/__up", body)
+		if err != nil {
+			return err
+		}
+		req.ContentLength = perStream
+		req.Header.Set("Content-Type", "application/octet-stream")
+		resp, err := client.Do(req)
+		if err != nil {
+			return err
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("upload: %s", resp.Status)
+		}
+		return nil
+	})
+	if err != nil {
+		r.Error = "upload: " + err.Error()
+	}
+	return r
+}
+
+// RunSpeedTests measures the requested paths ("wan", "exit_node" or both when
+// empty) one after the other, so they do not compete for the uplink.
+func RunSpeedTests(path string) ([]SpeedTestResult, error) {
+	speedMu.Lock()
+	if speedRunning {
+		speedMu.Unlock()
+		return nil, fmt.Errorf("a speed test is already running")
+	}
+	speedRunning = true
+	speedMu.Unlock()
+	defer func() {
+		speedMu.Lock()
+		speedRunning = false
+		speedMu.Unlock()
+	}()
+
+	mu.Lock()
+	mode := CurrentMode
+	wans := ActiveWANInterfaces()
+	exitNode := strings.TrimPrefix(mode, "tailscale:")
+	if node, ok := exitNodes[exitNode]; ok && node.Name != "" {
+		exitNode = node.Name
+	}
+	mu.Unlock()
+	cfg := speedTestConfig()
+
+	var results []SpeedTestResult
+	if path == "" || path == SpeedTestPathWAN {
+		for _, iface := range wans {
+			results = append(results, runSpeedTest(SpeedTestPathWAN, iface, "", cfg))
+		}
+	}
+	if path == "" || path == SpeedTestPathExitNode {
+		if !strings.HasPrefix(mode, "tailscale:") {
+			if path != "" {
+				return nil, errNoExitNode
+			}
+		} else {
+			results = append(results, runSpeedTest(SpeedTestPathExitNode, "tailscale0", exitNode, cfg))
+		}
+	}
+	for _, r := range results {
+		if r.Error != "" {
+			log.Printf("Speed test %s via %s: %s", r.Path, r.Interface, r.Error)
+		} else {
+			log.Printf("Speed test %s via %s: %.1f down / %.1f up Mbit/s, %.0f ms", r.Path, r.Interface, r.DownloadMbps, r.UploadMbps, r.LatencyMs)
+		}
+		recordSpeedResult(r)
+	}
+	return results, nil
+}
+
+func GetSpeedTestStatus() SpeedTestStatus {
+	status := SpeedTestStatus{Config: GetRouterConfig().SpeedTest, Results: []SpeedTestResult{}}
+	speedMu.Lock()
+	loadSpeedResultsLocked()
+	status.Running = speedRunning
+	for i := len(speedResults) - 1; i >= 0; i-- {
+		status.Results = append(status.Results, speedResults[i])
+	}
+	speedMu.Unlock()
+	return status
+}
+
+func validateSpeedTestConfig(c SpeedTestConfig) error {
+	if c.Endpoint != "" {
+		u, err := url.Parse(c.Endpoint)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("endpoint must be an http:// or https:// URL")
+		}
+	}
+	if c.DownloadBytes < 0 || c.DownloadBytes > 1e9 || c.UploadBytes < 0 || c.UploadBytes > 1e9 {
+		return fmt.Errorf("transfer sizes must be at most 1000000000 bytes")
+	}
+	if c.Streams < 0 || c.Streams > 16 {
+		return fmt.Errorf("streams must be 1-16")
+	}
+	return nil
+}
+
+// SpeedTestHandler reads or updates the speed test endpoint and lists past results.
+// POST /speedtest {"endpoint": "http://192.168.50.20:8080", "download_bytes": 50000000, "upload_bytes": 20000000, "streams": 4}
+func SpeedTestHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		var req SpeedTestConfig
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "invalid JSON body", http.StatusBadRequest)
+			return
+		}
+		req.Endpoint = strings.TrimSpace(req.Endpoint)
+		if err := validateSpeedTestConfig(req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		cfg := GetRouterConfig()
+		cfg.SpeedTest = req
+		if err := SaveRouterConfig(cfg); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(GetSpeedTestStatus())
+}
+
+// SpeedTestRunHandler measures now and returns the new results.
+// POST /speedtest/run?path=wan|exit_node (both when omitted)
+func SpeedTestRunHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	path := r.URL.Query().Get("path")
+	if path != "" && path != SpeedTestPathWAN && path != SpeedTestPathExitNode {
+		http.Error(w, "path must be wan or exit_node", http.StatusBadRequest)
+		return
+	}
+	results, err := RunSpeedTests(path)
+	if err == errNoExitNode {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"results": results})
+}
@@ -0,0 +1,61 @@
+package handlers
+
+import (
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+)
+
+const speedTestServerMaxBytes = 1000000000
+
+// speedTestChunk is written repeatedly for downloads.
+var speedTestChunk = make([]byte, 64*1024)
+
+func speedTestDownHandler(w http.ResponseWriter, r *http.Request) {
+	n, err := strconv.ParseInt(r.URL.Query().Get("bytes"), 10, 64)
+	if err != nil || n < 0 || n > speedTestServerMaxBytes {
+		http.Error(w, "bytes must be 0-1000000000", http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Length", strconv.FormatInt(n, 10))
+	w.Header().Set("Cache-Control", "no-store")
+	for n > 0 {
+		chunk := speedTestChunk
+		if n < int64(len(chunk)) {
+			chunk = chunk[:n]
+		}
+		written, err := w.Write(chunk)
+		if err != nil {
+			return
+		}
+		n -= int64(written)
+	}
+}
+
+func speedTestUpHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	io.Copy(io.Discard, io.LimitReader(r.Body, speedTestServerMaxBytes))
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+}
+
+// RunSpeedTestServer serves the speed test protocol (GET /__down?bytes=N, POST /__up)
+// so a LAN host or VPS can stand in for the public endpoint:
+//
+//	tailscale-raspberry-router speedtest-server :8080
+func RunSpeedTestServer(addr string) error {
+	log.Printf("Speed test server listening on %s", addr)
+	return http.ListenAndServe(addr, speedTestServerMux())
+}
+
+func speedTestServerMux() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/__down", speedTestDownHandler)
+	mux.HandleFunc("/__up", speedTestUpHandler)
+	return mux
+}
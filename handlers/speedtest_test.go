@@ -0,0 +1,64 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRunSpeedTestAgainstServer(t *testing.T) {
+	srv := httptest.NewServer(speedTestServerMux())
+	t.Cleanup(srv.Close)
+
+	cfg := SpeedTestConfig{Endpoint: srv.URL + "/", DownloadBytes: 4 << 20, UploadBytes: 2 << 20, Streams: 2}
+	r := runSpeedTest(SpeedTestPathWAN, "lo", "", cfg)
+	if strings.Contains(r.Error, "operation not permitted") {
+		t.Skipf("cannot bind to lo: %s", r.Error)
+	}
+	if r.Error != "" {
+		t.Fatalf("runSpeedTest: %s", r.Error)
+	}
+	if r.Endpoint != srv.URL || r.Interface != "lo" || r.Path != SpeedTestPathWAN {
+		t.Errorf("result = %+v", r)
+	}
+	if r.DownloadMbps <= 0 || r.UploadMbps <= 0 || r.LatencyMs <= 0 {
+		t.Errorf("download %.1f, upload %.1f Mbit/s, latency %.2f ms; want all above zero", r.DownloadMbps, r.UploadMbps, r.LatencyMs)
+	}
+}
+
+func TestRunSpeedTestReportsServerErrors(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/__down", speedTestDownHandler)
+	mux.HandleFunc("/__up", func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "disk full", http.StatusInternalServerError)
+	})
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+
+	r := runSpeedTest(SpeedTestPathWAN, "lo", "", SpeedTestConfig{Endpoint: srv.URL, DownloadBytes: 1 << 20, UploadBytes: 1 << 20, Streams: 1})
+	if strings.Contains(r.Error, "operation not permitted") {
+		t.Skipf("cannot bind to lo: %s", r.Error)
+	}
+	if !strings.HasPrefix(r.Error, "upload: ") || r.DownloadMbps <= 0 {
+		t.Errorf("result = %+v, want a measured download and an upload error", r)
+	}
+}
+
+func TestSpeedTestRunHandlerWithoutExitNode(t *testing.T) {
+	mu.Lock()
+	saved := CurrentMode
+	CurrentMode = "direct"
+	mu.Unlock()
+	t.Cleanup(func() {
+		mu.Lock()
+		CurrentMode = saved
+		mu.Unlock()
+	})
+
+	w := httptest.NewRecorder()
+	SpeedTestRunHandler(w, httptest.NewRequest(http.MethodPost, "/speedtest/run?path=exit_node", nil))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("status = %d, want %d: %s", w.Code, http.StatusBadRequest, w.Body)
+	}
+}
@@ -0,0 +1,387 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"regexp"
+	"strings"
+)
+
+const (
+	// splitTunnelFwmark marks LAN packets that must leave via the WAN while an
+	// exit node is active. The bit stays clear of Tailscale's 0xff0000 range.
+	splitTunnelFwmark = "0x1000/0x1000"
+	// splitTunnelRulePriority sits ahead of Tailscale's rules (5210+) and next to
+	// the local policy rules in ApplyLocalPolicyRouting.
+	splitTunnelRulePriority = 92
+	splitTunnelSetName      = "ts_router_split"
+	splitTunnelNftTable     = "tailscale_router"
+	splitTunnelNftChain     = "split_mark"
+	splitTunnelDnsmasqConf  = "/etc/dnsmasq.d/tailscale-router-split.conf"
+)
+
+var splitTunnelDomainPattern = regexp.MustCompile(`^[a-z0-9]([a-z0-9-]*[a-z0-9])?(\.[a-z0-9]([a-z0-9-]*[a-z0-9])?)*$`)
+
+// SplitTunnelStatus reports the destinations that bypass the exit node.
+type SplitTunnelStatus struct {
+	Active         bool     `json:"active"`
+	CIDRs          []string `json:"cidrs"`
+	Domains        []string `json:"domains"`
+	Backend        string   `json:"backend"`
+	DnsmasqSupport bool     `json:"dnsmasq_support"`
+	ResolvedIPs    int      `json:"resolved_ips"`
+}
+
+// splitTunnelBackend picks how resolved domain IPs are collected: an ipset
+// matched from iptables, or an nftables set when ipset is not installed.
+func splitTunnelBackend() string {
+	if commandExists("ipset") {
+		return "ipset"
+	}
+	if commandExists("nft") {
+		return "nftset"
+	}
+	return ""
+}
+
+// dnsmasqSupports checks dnsmasq's compile-time options ("ipset", "nftset").
+func dnsmasqSupports(option string) bool {
+	out, err := exec.Command("dnsmasq", "--version").Output()
+	if err != nil {
+		return false
+	}
+	for _, field := range strings.Fields(string(out)) {
+		if field == option {
+			return true
+		}
+	}
+	return false
+}
+
+// normalizeSplitTunnelCIDR accepts an IPv4 address or network and returns it in CIDR form.
+func normalizeSplitTunnelCIDR(value string) (string, error) {
+	value = strings.TrimSpace(value)
+	if !strings.Contains(value, "/") {
+		value += "/32"
+	}
+	ip, network, err := net.ParseCIDR(value)
+	if err != nil || ip.To4() == nil {
+		return "", fmt.Errorf("invalid IPv4 CIDR %q", value)
+	}
+	return network.String(), nil
+}
+
+// normalizeSplitTunnelDomain lowercases a domain and strips "*." and dots; subdomains always match.
+func normalizeSplitTunnelDomain(value string) (string, error) {
+	domain := strings.ToLower(strings.TrimSpace(value))
+	domain = strings.TrimPrefix(domain, "*.")
+	domain = strings.Trim(domain, ".")
+	if domain == "" || !splitTunnelDomainPattern.MatchString(domain) {
+		return "", fmt.Errorf("invalid domain %q", value)
+	}
+	return domain, nil
+}
+
+func splitTunnelConfigured(cfg RouterConfig) bool {
+	return len(cfg.SplitTunnelCIDRs) > 0 || len(cfg.SplitTunnelDomains) > 0
+}
+
+// ensureSplitTunnelSet creates the set dnsmasq adds resolved addresses to.
+func ensureSplitTunnelSet(backend string) error {
+	var cmds [][]string
+	switch backend {
+	case "ipset":
+		cmds = [][]string{{"ipset", "create", splitTunnelSetName, "hash:ip", "-exist"}}
+	case "nftset":
+		cmds = [][]string{
+			{"nft", "add", "table", "inet", splitTunnelNftTable},
+			{"nft", "add", "set", "inet", splitTunnelNftTable, splitTunnelSetName, "{ type ipv4_addr; }"},
+		}
+	default:
+		return nil
+	}
+	for _, args := range cmds {
+		if out, err := exec.Command(args[0], args[1:]...).CombinedOutput(); err != nil {
+			return fmt.Errorf("%s: %v: %s", strings.Join(args, " "), err, strings.TrimSpace(string(out)))
+		}
+	}
+	return nil
+}
+
+func flushSplitTunnelSet(backend string) {
+	switch backend {
+	case "ipset":
+		exec.Command("ipset", "flush", splitTunnelSetName).Run()
+	case "nftset":
+		exec.Command("nft", "flush", "set", "inet", splitTunnelNftTable, splitTunnelSetName).Run()
+	}
+}
+
+func countSplitTunnelSetEntries(backend string) int {
+	switch backend {
+	case "ipset":
+		out, err := exec.Command("ipset", "list", splitTunnelSetName).Output()
+		if err != nil {
+			return 0
+		}
+		count := 0
+		inMembers := false
+		for _, line := range strings.Split(string(out), "\n") {
+			if strings.HasPrefix(line, "Members:") {
+				inMembers = true
+				continue
+			}
+			if inMembers && strings.TrimSpace(line) != "" {
+				count++
+			}
+		}
+		return count
+	case "nftset":
+		out, err := exec.Command("nft", "list", "set", "inet", splitTunnelNftTable, splitTunnelSetName).Output()
+		if err != nil {
+			return 0
+		}
+		text := string(out)
+		start := strings.Index(text, "elements = {")
+		if start < 0 {
+			return 0
+		}
+		end := strings.Index(text[start:], "}")
+		if end < 0 {
+			return 0
+		}
+		return len(strings.Split(text[start+len("elements = {"):start+end], ","))
+	}
+	return 0
+}
+
+// writeSplitTunnelDnsmasqConf renders the ipset=/nftset= drop-in and reports whether it changed.
+func writeSplitTunnelDnsmasqConf(cfg RouterConfig, backend string) (bool, error) {
+	existing, _ := os.ReadFile(splitTunnelDnsmasqConf)
+
+	if len(cfg.SplitTunnelDomains) == 0 || backend == "" {
+		if existing == nil {
+			return false, nil
+		}
+		return true, os.Remove(splitTunnelDnsmasqConf)
+	}
+
+	domains := strings.Join(cfg.SplitTunnelDomains, "/")
+	var line string
+	if backend == "ipset" {
+		line = fmt.Sprintf("ipset=/%s/%s\n", domains, splitTunnelSetName)
+	} else {
+		line = fmt.Sprintf("nftset=/%s/4#inet#%s#%s\n", domains, splitTunnelNftTable, splitTunnelSetName)
+	}
+	conf := "# Managed by tailscale-raspberry-router (split tunnel)\n" + line
+	if string(existing) == conf {
+		return false, nil
+	}
+	return true, os.WriteFile(splitTunnelDnsmasqConf, []byte(conf), 0644)
+}
+
+// applySplitTunnelDNS prepares the address set and dnsmasq drop-in for the
+// configured domains. dnsmasq only reads ipset/nftset lines on restart.
+func applySplitTunnelDNS(cfg RouterConfig) error {
+	backend := splitTunnelBackend()
+	if len(cfg.SplitTunnelDomains) > 0 {
+		if backend == "" {
+			return fmt.Errorf("domain split tunneling needs ipset or nft installed")
+		}
+		if err := ensureSplitTunnelSet(backend); err != nil {
+			return err
+		}
+	}
+
+	changed, err := writeSplitTunnelDnsmasqConf(cfg, backend)
+	if err != nil {
+		return err
+	}
+	if !changed {
+		return nil
+	}
+
+	// Addresses of removed domains must not keep bypassing the exit node.
+	flushSplitTunnelSet(backend)
+	if out, err := exec.Command("dnsmasq", "--test").CombinedOutput(); err != nil {
+		return fmt.Errorf("dnsmasq config test failed: %v: %s", err, strings.TrimSpace(string(out)))
+	}
+	if out, err := exec.Command("systemctl", "restart", "dnsmasq").CombinedOutput(); err != nil {
+		return fmt.Errorf("systemctl restart dnsmasq: %v: %s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// appendSplitTunnelRules marks LAN traffic to split destinations and lets it out
+// through the WAN while an exit node is active. Caller holds mu; must run after
+// flushRouterIPTablesRules.
+func appendSplitTunnelRules(wanIface string) {
+	cfg := GetRouterConfig()
+	if !splitTunnelConfigured(cfg) {
+		deleteIPRulePriority(splitTunnelRulePriority)
+		return
+	}
+
+	lanInterfaces, err := GetLANInterfaces()
+	if err != nil {
+		log.Printf("Warning: split tunnel skipped: %v", err)
+		return
+	}
+
+	backend := splitTunnelBackend()
+	useSet := len(cfg.SplitTunnelDomains) > 0
+	if useSet {
+		if err := ensureSplitTunnelSet(backend); err != nil {
+			log.Printf("Warning: split tunnel domains skipped: %v", err)
+			useSet = false
+		}
+	}
+
+	ensureFwmarkRule(splitTunnelRulePriority, splitTunnelFwmark, "main")
+
+	for _, lanIface := range lanInterfaces {
+		for _, cidr := range cfg.SplitTunnelCIDRs {
+			appendRouterSplitRule("-i", lanIface, "-d", cidr, "-j", "MARK", "--set-mark", splitTunnelFwmark)
+		}
+		if useSet && backend == "ipset" {
+			appendRouterSplitRule("-i", lanIface, "-m", "set", "--match-set", splitTunnelSetName, "dst", "-j", "MARK", "--set-mark", splitTunnelFwmark)
+		}
+		if useSet && backend == "nftset" {
+			appendSplitTunnelNftRule(lanIface)
+		}
+
+		log.Printf("Setting up split tunnel from %s to %s", lanIface, wanIface)
+		appendRouterForwardRule("-i", lanIface, "-o", wanIface, "-m", "mark", "--mark", splitTunnelFwmark, "-j", "ACCEPT")
+		appendRouterForwardRule("-i", wanIface, "-o", lanIface, "-m", "state", "--state", "RELATED,ESTABLISHED", "-j", "ACCEPT")
+	}
+	appendRouterNatRule("-o", wanIface, "-m", "mark", "--mark", splitTunnelFwmark, "-j", "MASQUERADE")
+}
+
+// appendSplitTunnelNftRule marks traffic to the nftables set. iptables cannot
+// match nft sets, so this rule lives in the router's own nft table.
+func appendSplitTunnelNftRule(lanIface string) {
+	exec.Command("nft", "add", "chain", "inet", splitTunnelNftTable, splitTunnelNftChain,
+		"{ type filter hook prerouting priority mangle; }").Run()
+	out, err := exec.Command("nft", "add", "rule", "inet", splitTunnelNftTable, splitTunnelNftChain,
+		"iifname", lanIface, "ip", "daddr", "@"+splitTunnelSetName,
+		"meta", "mark", "set", "meta", "mark", "or", "0x1000").CombinedOutput()
+	if err != nil {
+		log.Printf("nft split tunnel rule failed for %s: %v: %s", lanIface, err, strings.TrimSpace(string(out)))
+	}
+}
+
+// clearSplitTunnelMarks removes packet marking so a mode switch starts clean.
+func clearSplitTunnelMarks() {
+	exec.Command("iptables", "-t", "mangle", "-F", routerSplitChain).Run()
+	if commandExists("nft") {
+		exec.Command("nft", "flush", "chain", "inet", splitTunnelNftTable, splitTunnelNftChain).Run()
+	}
+}
+
+// GetSplitTunnelStatus reports configured bypass destinations and whether they
+// are in effect (only while an exit node is active). mode is the current mode,
+// read by the caller under mu.
+func GetSplitTunnelStatus(mode string) SplitTunnelStatus {
+	cfg := GetRouterConfig()
+	backend := splitTunnelBackend()
+	status := SplitTunnelStatus{
+		Active:  splitTunnelConfigured(cfg) && strings.HasPrefix(mode, "tailscale:"),
+		CIDRs:   cfg.SplitTunnelCIDRs,
+		Domains: cfg.SplitTunnelDomains,
+		Backend: backend,
+	}
+	if status.CIDRs == nil {
+		status.CIDRs = []string{}
+	}
+	if status.Domains == nil {
+		status.Domains = []string{}
+	}
+	if backend != "" {
+		status.DnsmasqSupport = dnsmasqSupports(backend)
+		status.ResolvedIPs = countSplitTunnelSetEntries(backend)
+	}
+	return status
+}
+
+// SplitTunnelHandler reads or replaces the split tunnel destinations.
+// GET /split-tunnel, POST /split-tunnel {"cidrs": ["192.0.2.0/24"], "domains": ["bank.example"]}
+func SplitTunnelHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		var req struct {
+			CIDRs   []string `json:"cidrs"`
+			Domains []string `json:"domains"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "invalid JSON body", http.StatusBadRequest)
+			return
+		}
+
+		cfg := GetRouterConfig()
+		cfg.SplitTunnelCIDRs = nil
+		for _, value := range req.CIDRs {
+			if strings.TrimSpace(value) == "" {
+				continue
+			}
+			cidr, err := normalizeSplitTunnelCIDR(value)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if !containsString(cfg.SplitTunnelCIDRs, cidr) {
+				cfg.SplitTunnelCIDRs = append(cfg.SplitTunnelCIDRs, cidr)
+			}
+		}
+		cfg.SplitTunnelDomains = nil
+		for _, value := range req.Domains {
+			if strings.TrimSpace(value) == "" {
+				continue
+			}
+			domain, err := normalizeSplitTunnelDomain(value)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if !containsString(cfg.SplitTunnelDomains, domain) {
+				cfg.SplitTunnelDomains = append(cfg.SplitTunnelDomains, domain)
+			}
+		}
+
+		if len(cfg.SplitTunnelDomains) > 0 {
+			backend := splitTunnelBackend()
+			if backend == "" || !dnsmasqSupports(backend) {
+				http.Error(w, "dnsmasq on this system cannot fill ipset/nftset sets; use CIDRs instead", http.StatusBadRequest)
+				return
+			}
+		}
+
+		if err := SaveRouterConfig(cfg); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if err := applySplitTunnelDNS(cfg); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if strings.HasPrefix(diagnosticMode(), "tailscale:") {
+			if err := ReapplyCurrentMode(); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+		} else if !splitTunnelConfigured(cfg) {
+			deleteIPRulePriority(splitTunnelRulePriority)
+		}
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(GetSplitTunnelStatus(diagnosticMode()))
+}
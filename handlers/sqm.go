@@ -0,0 +1,324 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os/exec"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	SQMAlgorithmAuto    = "auto"
+	SQMAlgorithmCake    = "cake"
+	SQMAlgorithmFQCodel = "fq_codel"
+)
+
+var tcSentPattern = regexp.MustCompile(`Sent (\d+) bytes (\d+) pkt \(dropped (\d+), overlimits (\d+)`)
+
+// SQMRates are the shaped rates for one egress, slightly below the line rate so
+// the queue builds here instead of in the modem or the tunnel.
+type SQMRates struct {
+	UploadKbps   int `json:"upload_kbps"`
+	DownloadKbps int `json:"download_kbps"` // 0 leaves ingress unshaped
+}
+
+// SQMConfig configures smart queue management on the active egress: the WAN links
+// in direct mode, tailscale0 while an exit node is active.
+type SQMConfig struct {
+	Enabled   bool     `json:"enabled"`
+	Algorithm string   `json:"algorithm,omitempty"` // auto (CAKE if available), cake or fq_codel
+	WAN       SQMRates `json:"wan"`
+	Tunnel    SQMRates `json:"tunnel"`
+}
+
+// SQMInterfaceStatus reports what is applied on one interface.
+type SQMInterfaceStatus struct {
+	Interface    string `json:"interface"`
+	Qdisc        string `json:"qdisc"`
+	UploadKbps   int    `json:"upload_kbps"`
+	DownloadKbps int    `json:"download_kbps"`
+	IFB          string `json:"ifb,omitempty"`
+	SentBytes    uint64 `json:"sent_bytes"`
+	Dropped      uint64 `json:"dropped"`
+	IFBSentBytes uint64 `json:"ifb_sent_bytes,omitempty"`
+	IFBDropped   uint64 `json:"ifb_dropped,omitempty"`
+}
+
+// SQMStatus is returned by GET /sqm.
+type SQMStatus struct {
+	Config         SQMConfig            `json:"config"`
+	CakeAvailable  bool                 `json:"cake_available"`
+	Interfaces     []SQMInterfaceStatus `json:"interfaces"`
+	LastApplyError string               `json:"last_apply_error,omitempty"`
+}
+
+var (
+	sqmMu        sync.Mutex
+	sqmApplied   = make(map[string]SQMInterfaceStatus) // by egress interface
+	sqmLastError string
+	sqmCakeOnce  sync.Once
+	sqmCakeOK    bool
+)
+
+// cakeAvailable reports whether the kernel has sch_cake and tc understands it.
+func cakeAvailable() bool {
+	sqmCakeOnce.Do(func() {
+		exec.Command("modprobe", "sch_cake").Run()
+		// Probe on loopback: a throwaway cake root qdisc either installs or it does not.
+		if exec.Command("tc", "qdisc", "add", "dev", "lo", "root", "handle", "77:", "cake").Run() == nil {
+			sqmCakeOK = true
+			exec.Command("tc", "qdisc", "del", "dev", "lo", "root").Run()
+		}
+	})
+	return sqmCakeOK
+}
+
+func sqmAlgorithm(c SQMConfig) string {
+	switch c.Algorithm {
+	case SQMAlgorithmCake:
+		return SQMAlgorithmCake
+	case SQMAlgorithmFQCodel:
+		return SQMAlgorithmFQCodel
+	}
+	if cakeAvailable() {
+		return SQMAlgorithmCake
+	}
+	return SQMAlgorithmFQCodel
+}
+
+// sqmIFBName is the ingress mirror device for iface, within the 15-character limit.
+func sqmIFBName(iface string) string {
+	name := "ifb-" + iface
+	if len(name) > 15 {
+		name = name[:15]
+	}
+	return name
+}
+
+func runTC(args ...string) error {
+	out, err := exec.Command("tc", args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("tc %s: %v: %s", strings.Join(args, " "), err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// shapeQdisc installs the root qdisc that limits dev to kbps.
+func shapeQdisc(dev string, kbps int, algorithm string, cakeOpts ...string) error {
+	rate := fmt.Sprintf("%dkbit", kbps)
+	if algorithm == SQMAlgorithmCake {
+		return runTC(append([]string{"qdisc", "replace", "dev", dev, "root", "cake", "bandwidth", rate}, cakeOpts...)...)
+	}
+	exec.Command("tc", "qdisc", "del", "dev", dev, "root").Run()
+	if err := runTC("qdisc", "add", "dev", dev, "root", "handle", "1:", "htb", "default", "10"); err != nil {
+		return err
+	}
+	if err := runTC("class", "add", "dev", dev, "parent", "1:", "classid", "1:10", "htb", "rate", rate, "ceil", rate); err != nil {
+		return err
+	}
+	return runTC("qdisc", "add", "dev", dev, "parent", "1:10", "fq_codel")
+}
+
+// clearSQM removes shaping from iface and deletes its IFB device.
+func clearSQM(iface string) {
+	exec.Command("tc", "qdisc", "del", "dev", iface, "root").Run()
+	exec.Command("tc", "qdisc", "del", "dev", iface, "ingress").Run()
+	exec.Command("ip", "link", "del", sqmIFBName(iface)).Run()
+}
+
+func applySQMInterface(iface string, rates SQMRates, algorithm string, wan bool) (SQMInterfaceStatus, error) {
+	clearSQM(iface)
+	status := SQMInterfaceStatus{Interface: iface, Qdisc: algorithm, UploadKbps: rates.UploadKbps, DownloadKbps: rates.DownloadKbps}
+
+	if rates.UploadKbps > 0 {
+		var opts []string
+		if wan && algorithm == SQMAlgorithmCake {
+			// Behind masquerade, per-host fairness needs the pre-NAT addresses.
+			opts = append(opts, "nat")
+		}
+		if err := shapeQdisc(iface, rates.UploadKbps, algorithm, opts...); err != nil {
+			return status, err
+		}
+	}
+
+	if rates.DownloadKbps > 0 {
+		// Ingress cannot be queued directly: mirror it to an IFB device and shape that.
+		ifb := sqmIFBName(iface)
+		exec.Command("modprobe", "ifb", "numifbs=0").Run()
+		if out, err := exec.Command("ip", "link", "add", ifb, "type", "ifb").CombinedOutput(); err != nil && !strings.Contains(string(out), "File exists") {
+			return status, fmt.Errorf("create %s: %v: %s", ifb, err, strings.TrimSpace(string(out)))
+		}
+		exec.Command("ip", "link", "set", ifb, "up").Run()
+		if err := runTC("qdisc", "add", "dev", iface, "handle", "ffff:", "ingress"); err != nil {
+			return status, err
+		}
+		if err := runTC("filter", "add", "dev", iface, "parent", "ffff:", "protocol", "all", "u32", "match", "u32", "0", "0",
+			"action", "mirred", "egress", "redirect", "dev", ifb); err != nil {
+			return status, err
+		}
+		var opts []string
+		if algorithm == SQMAlgorithmCake {
+			opts = append(opts, "ingress")
+			if wan {
+				opts = append(opts, "nat", "wash")
+			}
+		}
+		if err := shapeQdisc(ifb, rates.DownloadKbps, algorithm, opts...); err != nil {
+			return status, err
+		}
+		status.IFB = ifb
+	}
+	return status, nil
+}
+
+// applyRouterSQM shapes the given egress interfaces and unshapes the previous ones.
+// It runs at the same switch points as appendRouterNatMasquerade: the WAN links in
+// applyDirectModeRouting, tailscale0 in applyExitNodeRouting. Caller holds mu.
+func applyRouterSQM(egress []string, tunnel bool) {
+	cfg := GetRouterConfig().SQM
+
+	sqmMu.Lock()
+	defer sqmMu.Unlock()
+
+	rates := cfg.WAN
+	if tunnel {
+		rates = cfg.Tunnel
+	}
+	shaped := cfg.Enabled && (rates.UploadKbps > 0 || rates.DownloadKbps > 0)
+
+	wanted := make(map[string]bool)
+	if shaped {
+		for _, iface := range egress {
+			wanted[iface] = true
+		}
+	}
+	for iface := range sqmApplied {
+		if !wanted[iface] {
+			clearSQM(iface)
+			delete(sqmApplied, iface)
+			log.Printf("SQM removed from %s", iface)
+		}
+	}
+
+	sqmLastError = ""
+	if !shaped {
+		return
+	}
+
+	algorithm := sqmAlgorithm(cfg)
+	for _, iface := range egress {
+		status, err := applySQMInterface(iface, rates, algorithm, !tunnel)
+		if err != nil {
+			log.Printf("SQM on %s: %v", iface, err)
+			sqmLastError = fmt.Sprintf("%s: %v", iface, err)
+			clearSQM(iface)
+			continue
+		}
+		sqmApplied[iface] = status
+		log.Printf("SQM %s on %s: up %d kbit/s, down %d kbit/s", algorithm, iface, rates.UploadKbps, rates.DownloadKbps)
+	}
+}
+
+// readQdiscStats returns the Sent and dropped counters of dev's root qdisc.
+func readQdiscStats(dev string) (sent, dropped uint64) {
+	out, err := exec.Command("tc", "-s", "qdisc", "show", "dev", dev).Output()
+	if err != nil {
+		return 0, 0
+	}
+	lines := strings.Split(string(out), "\n")
+	for i, line := range lines {
+		if !strings.HasPrefix(line, "qdisc ") || !strings.Contains(line, " root ") || i+1 >= len(lines) {
+			continue
+		}
+		if m := tcSentPattern.FindStringSubmatch(lines[i+1]); m != nil {
+			sent, _ = strconv.ParseUint(m[1], 10, 64)
+			dropped, _ = strconv.ParseUint(m[3], 10, 64)
+		}
+		break
+	}
+	return sent, dropped
+}
+
+func GetSQMStatus() SQMStatus {
+	cfg := GetRouterConfig().SQM
+	sqmMu.Lock()
+	status := SQMStatus{Config: cfg, LastApplyError: sqmLastError, Interfaces: []SQMInterfaceStatus{}}
+	for _, s := range sqmApplied {
+		status.Interfaces = append(status.Interfaces, s)
+	}
+	sqmMu.Unlock()
+
+	status.CakeAvailable = cakeAvailable()
+	sort.Slice(status.Interfaces, func(i, j int) bool { return status.Interfaces[i].Interface < status.Interfaces[j].Interface })
+	for i := range status.Interfaces {
+		s := &status.Interfaces[i]
+		s.SentBytes, s.Dropped = readQdiscStats(s.Interface)
+		if s.IFB != "" {
+			s.IFBSentBytes, s.IFBDropped = readQdiscStats(s.IFB)
+		}
+	}
+	return status
+}
+
+func validateSQMConfig(c SQMConfig) error {
+	switch c.Algorithm {
+	case "", SQMAlgorithmAuto, SQMAlgorithmFQCodel:
+	case SQMAlgorithmCake:
+		if !cakeAvailable() {
+			return fmt.Errorf("this kernel has no CAKE qdisc (sch_cake); use fq_codel or auto")
+		}
+	default:
+		return fmt.Errorf("algorithm must be auto, cake or fq_codel")
+	}
+	for _, rate := range []int{c.WAN.UploadKbps, c.WAN.DownloadKbps, c.Tunnel.UploadKbps, c.Tunnel.DownloadKbps} {
+		if rate < 0 || rate > 10000000 {
+			return fmt.Errorf("rates must be 0-10000000 kbit/s")
+		}
+		if rate > 0 && rate < 64 {
+			return fmt.Errorf("rates below 64 kbit/s are not supported")
+		}
+	}
+	return nil
+}
+
+// SQMHandler reads or updates traffic shaping and reapplies it to the current egress.
+// POST /sqm {"enabled": true, "algorithm": "auto", "wan": {"upload_kbps": 18000, "download_kbps": 90000}, "tunnel": {"upload_kbps": 15000, "download_kbps": 60000}}
+func SQMHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		var req SQMConfig
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "invalid JSON body", http.StatusBadRequest)
+			return
+		}
+		req.Algorithm = strings.ToLower(strings.TrimSpace(req.Algorithm))
+		if err := validateSQMConfig(req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		cfg := GetRouterConfig()
+		cfg.SQM = req
+		if err := SaveRouterConfig(cfg); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		mu.Lock()
+		applyRouterSQM(currentEgressInterfaces(), strings.HasPrefix(CurrentMode, "tailscale:"))
+		mu.Unlock()
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(GetSQMStatus())
+}
@@ -0,0 +1,290 @@
+package handlers
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+const supportBundleJournalLines = "500"
+
+// Secrets that can show up in logs and command output, not only in the config.
+var secretPatterns = []struct {
+	re   *regexp.Regexp
+	repl string
+}{
+	{regexp.MustCompile(`tskey-[A-Za-z0-9_-]+`), "tskey-***"},
+	{regexp.MustCompile(`(?i)(--auth-?key[= ])\S+`), "${1}***"},
+	{regexp.MustCompile(`(?i)(bearer\s+)[A-Za-z0-9._~+/=-]+`), "${1}***"},
+	{regexp.MustCompile(`(?i)((?:token|password|passwd|passphrase|secret|psk|auth_?key|sae_password)["']?\s*[:=]\s*["']?)[^"'\s&,]+`), "${1}***"},
+	{regexp.MustCompile(`([a-z][a-z0-9+.-]*://)[^/@\s:]+:[^/@\s]+@`), "${1}***@"},
+}
+
+// scrubSecrets masks auth keys, tokens and passwords in free text.
+func scrubSecrets(text string) string {
+	for _, p := range secretPatterns {
+		text = p.re.ReplaceAllString(text, p.repl)
+	}
+	return text
+}
+
+// isSecretKey reports whether a JSON field name holds a credential.
+func isSecretKey(key string) bool {
+	key = strings.ToLower(key)
+	for _, word := range []string{"password", "passphrase", "secret", "token", "authkey"} {
+		if strings.Contains(key, word) {
+			return true
+		}
+	}
+	return key == "psk" || strings.HasSuffix(key, "_key")
+}
+
+// redactJSONSecrets masks secret-named fields and secret-looking strings at any depth,
+// so fields added to RouterConfig later are covered without touching this code.
+func redactJSONSecrets(v interface{}) interface{} {
+	switch t := v.(type) {
+	case map[string]interface{}:
+		for k, val := range t {
+			if s, ok := val.(string); ok && s != "" && isSecretKey(k) {
+				t[k] = "***"
+				continue
+			}
+			t[k] = redactJSONSecrets(val)
+		}
+	case []interface{}:
+		for i := range t {
+			t[i] = redactJSONSecrets(t[i])
+		}
+	case string:
+		return scrubSecrets(t)
+	}
+	return v
+}
+
+// redactSecretURL keeps the host of a webhook or ntfy URL; the path and query of
+// those are often the credential itself.
+func redactSecretURL(raw string) string {
+	u, err := url.Parse(raw)
+	if err != nil || u.Host == "" {
+		return "***"
+	}
+	if u.User == nil && (u.Path == "" || u.Path == "/") && u.RawQuery == "" {
+		return raw
+	}
+	return u.Scheme + "://" + u.Host + "/***"
+}
+
+var (
+	macPattern  = regexp.MustCompile(`(?i)\b(?:[0-9a-f]{2}:){5}[0-9a-f]{2}\b`)
+	ipv4Pattern = regexp.MustCompile(`\b(?:\d{1,3}\.){3}\d{1,3}\b`)
+	ipv6Pattern = regexp.MustCompile(`(?i)[0-9a-f]{0,4}(?::[0-9a-f]{0,4}){2,7}`)
+)
+
+// bundleAnonymizer replaces MAC and IP addresses with stable placeholders, the same
+// address getting the same placeholder in every file of one bundle.
+type bundleAnonymizer struct {
+	names map[string]string
+	next  map[string]int
+}
+
+func newBundleAnonymizer() *bundleAnonymizer {
+	return &bundleAnonymizer{names: make(map[string]string), next: make(map[string]int)}
+}
+
+func (a *bundleAnonymizer) name(kind, addr string) string {
+	key := kind + "/" + strings.ToLower(addr)
+	if n, ok := a.names[key]; ok {
+		return n
+	}
+	a.next[kind]++
+	n := fmt.Sprintf("%s-%d", kind, a.next[kind])
+	a.names[key] = n
+	return n
+}
+
+// keepAddress reports addresses that identify nothing: loopback, unspecified,
+// broadcast, multicast and netmasks.
+func keepAddress(ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsUnspecified() || ip.IsMulticast() || ip.Equal(net.IPv4bcast) {
+		return true
+	}
+	if v4 := ip.To4(); v4 != nil {
+		ones, bits := net.IPMask(v4).Size()
+		return bits == 32 && ones > 0
+	}
+	return false
+}
+
+func (a *bundleAnonymizer) anonymize(text string) string {
+	text = macPattern.ReplaceAllStringFunc(text, func(mac string) string {
+		if mac == "00:00:00:00:00:00" || strings.EqualFold(mac, "ff:ff:ff:ff:ff:ff") {
+			return mac
+		}
+		return a.name("mac", mac)
+	})
+	text = ipv4Pattern.ReplaceAllStringFunc(text, func(s string) string {
+		ip := net.ParseIP(s)
+		if ip == nil || keepAddress(ip) {
+			return s
+		}
+		return a.name("ipv4", s)
+	})
+	return ipv6Pattern.ReplaceAllStringFunc(text, func(s string) string {
+		ip := net.ParseIP(s)
+		if ip == nil || ip.To4() != nil || keepAddress(ip) {
+			return s
+		}
+		return a.name("ipv6", s)
+	})
+}
+
+// supportBundleFile is one entry of the bundle; Source says where it came from.
+type supportBundleFile struct {
+	Name   string `json:"name"`
+	Source string `json:"source"`
+	Error  string `json:"error,omitempty"`
+	data   []byte
+}
+
+func bundleCommand(name, command string, args ...string) supportBundleFile {
+	f := supportBundleFile{Name: name, Source: strings.Join(append([]string{command}, args...), " ")}
+	out, err := exec.Command(command, args...).CombinedOutput()
+	if err != nil {
+		f.Error = err.Error()
+	}
+	f.data = out
+	return f
+}
+
+func bundleFile(name, path string) supportBundleFile {
+	f := supportBundleFile{Name: name, Source: path}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		f.Error = err.Error()
+	}
+	f.data = data
+	return f
+}
+
+// collectSupportBundle gathers everything a helper needs to debug the router.
+func collectSupportBundle() []supportBundleFile {
+	var files []supportBundleFile
+
+	report := RunDiagnosticChecks(nil)
+	data, _ := json.MarshalIndent(report, "", "  ")
+	files = append(files, supportBundleFile{Name: "diagnostics.json", Source: "GET /diagnostics", data: data})
+	var text strings.Builder
+	for _, c := range report.Checks {
+		for _, line := range renderDiagnosticCheck(c) {
+			text.WriteString(line + "\n")
+		}
+	}
+	files = append(files, supportBundleFile{Name: "diagnostics.txt", Source: "POST /diagnostics/run", data: []byte(text.String())})
+	files = append(files, supportBundleFile{Name: "config.json", Source: configFile + " (redacted)", data: []byte(redactedConfigJSON())})
+	files = append(files, bundleFile("mode.json", modeFile))
+
+	files = append(files, bundleFile("dnsmasq/etc/dnsmasq.conf", "/etc/dnsmasq.conf"))
+	for _, dir := range []string{"/etc/dnsmasq.d", "/run/tailscale-router"} {
+		paths, _ := filepath.Glob(filepath.Join(dir, "*.conf"))
+		for _, path := range paths {
+			files = append(files, bundleFile("dnsmasq"+path, path))
+		}
+	}
+
+	files = append(files,
+		bundleCommand("firewall/iptables-save.txt", "iptables-save", "-c"),
+		bundleCommand("firewall/ip6tables-save.txt", "ip6tables-save", "-c"),
+		bundleCommand("firewall/nft-ruleset.txt", "nft", "list", "ruleset"),
+		bundleCommand("network/ip-addr.txt", "ip", "addr", "show"),
+		bundleCommand("network/ip-link.txt", "ip", "-s", "link", "show"),
+		bundleCommand("network/ip-rule.txt", "ip", "rule", "show"),
+		bundleCommand("network/ip6-rule.txt", "ip", "-6", "rule", "show"),
+		bundleCommand("network/ip-route-all.txt", "ip", "route", "show", "table", "all"),
+		bundleCommand("network/ip6-route-all.txt", "ip", "-6", "route", "show", "table", "all"),
+		bundleCommand("network/tc-qdisc.txt", "tc", "-s", "qdisc", "show"),
+	)
+	for _, unit := range []string{"tailscale-router", "dnsmasq", "tailscaled"} {
+		files = append(files, bundleCommand("logs/"+unit+".log", "journalctl", "-u", unit, "-n", supportBundleJournalLines, "--no-pager"))
+	}
+	files = append(files, bundleCommand("tailscale/status.txt", "tailscale", "status"))
+	// bugreport prints a marker ID that Tailscale support uses to find this node's logs.
+	files = append(files, bundleCommand("tailscale/bugreport.txt", "tailscale", "bugreport"))
+	return files
+}
+
+// writeSupportBundle writes the tar.gz. Every file is scrubbed of secrets; with
+// anonymize, MAC and IP addresses are replaced as well.
+func writeSupportBundle(w *gzip.Writer, files []supportBundleFile, anonymize bool) error {
+	tw := tar.NewWriter(w)
+	now := time.Now()
+	var anon *bundleAnonymizer
+	if anonymize {
+		anon = newBundleAnonymizer()
+	}
+
+	add := func(name string, data []byte) error {
+		if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(data)), ModTime: now}); err != nil {
+			return err
+		}
+		_, err := tw.Write(data)
+		return err
+	}
+
+	for i := range files {
+		text := scrubSecrets(string(files[i].data))
+		if anon != nil {
+			text = anon.anonymize(text)
+			files[i].Source = anon.anonymize(files[i].Source)
+			files[i].Error = anon.anonymize(files[i].Error)
+		}
+		if err := add(files[i].Name, []byte(text)); err != nil {
+			return err
+		}
+	}
+
+	hostname, _ := os.Hostname()
+	manifest, _ := json.MarshalIndent(map[string]interface{}{
+		"generated":  now.UTC(),
+		"hostname":   hostname,
+		"anonymized": anonymize,
+		"files":      files,
+	}, "", "  ")
+	if err := add("manifest.json", manifest); err != nil {
+		return err
+	}
+	return tw.Close()
+}
+
+// SupportBundleHandler downloads a tar.gz for support requests.
+// GET /support-bundle?anonymize=1 also replaces MAC and IP addresses.
+func SupportBundleHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	anonymize := r.URL.Query().Get("anonymize") == "1"
+	files := collectSupportBundle()
+
+	name := fmt.Sprintf("tailscale-router-support-%s.tar.gz", time.Now().UTC().Format("20060102-150405"))
+	w.Header().Set("Content-Type", "application/gzip")
+	w.Header().Set("Content-Disposition", `attachment; filename="`+name+`"`)
+	gz := gzip.NewWriter(w)
+	if err := writeSupportBundle(gz, files, anonymize); err != nil {
+		log.Printf("Support bundle: %v", err)
+		return
+	}
+	if err := gz.Close(); err != nil {
+		log.Printf("Support bundle: %v", err)
+	}
+}
@@ -1,75 +1,153 @@
 package handlers
 
 import (
+	"encoding/json"
 	"fmt"
 	"log"
 	"os/exec"
+	"sort"
 	"strings"
 )
 
-// Struct to store exit node information
+// ExitNode describes a tailnet peer that can be used as an exit node.
+// Nodes are keyed by their stable Tailscale node ID.
 type ExitNode struct {
-	IP       string
-	Hostname string
-	Active   bool
+	ID           string   `json:"id"`
+	IP           string   `json:"ip"`
+	Hostname     string   `json:"hostname"`
+	DNSName      string   `json:"dns_name"`
+	Name         string   `json:"name"` // friendly name from config, or Hostname
+	Provider     string   `json:"provider"`
+	CountryCode  string   `json:"country_code,omitempty"`
+	Country      string   `json:"country,omitempty"`
+	CityCode     string   `json:"city_code,omitempty"`
+	City         string   `json:"city,omitempty"`
+	Priority     int      `json:"priority,omitempty"`
+	Online       bool     `json:"online"`
+	Favorite     bool     `json:"favorite"`
+	Capabilities []string `json:"capabilities,omitempty"`
+	LatencyMs    float64  `json:"latency_ms,omitempty"`
+}
+
+const (
+	exitNodeProviderMullvad = "mullvad"
+	exitNodeProviderPrivate = "private"
+)
+
+type tailscalePeerJSON struct {
+	ID             string                     `json:"ID"`
+	PublicKey      string                     `json:"PublicKey"`
+	HostName       string                     `json:"HostName"`
+	DNSName        string                     `json:"DNSName"`
+	TailscaleIPs   []string                   `json:"TailscaleIPs"`
+	Online         bool                       `json:"Online"`
+	ExitNodeOption bool                       `json:"ExitNodeOption"`
+	Capabilities   []string                   `json:"Capabilities"`
+	CapMap         map[string]json.RawMessage `json:"CapMap"`
+	Location       *struct {
+		Country     string `json:"Country"`
+		CountryCode string `json:"CountryCode"`
+		City        string `json:"City"`
+		CityCode    string `json:"CityCode"`
+		Priority    int    `json:"Priority"`
+	} `json:"Location"`
 }
 
 // Get available Tailscale exit nodes
 func GetExitNodes() (map[string]ExitNode, error) {
-	nodes := make(map[string]ExitNode)
-	privateNodes := make(map[string]ExitNode) // Stores private nodes
-	mullvadNodes := make(map[string]ExitNode) // Stores Mullvad nodes
-
-	cmd := exec.Command("tailscale", "exit-node", "list")
-	output, err := cmd.Output()
+	output, err := exec.Command("tailscale", "status", "--json").Output()
 	if err != nil {
 		return nil, err
 	}
 
-	lines := strings.Split(string(output), "\n")
-	for _, line := range lines {
-		fields := strings.Fields(line)
+	var status struct {
+		Peer map[string]tailscalePeerJSON `json:"Peer"`
+	}
+	if err := json.Unmarshal(output, &status); err != nil {
+		return nil, fmt.Errorf("parse tailscale status: %v", err)
+	}
 
-		// Ignore empty lines and headers
-		if len(fields) < 5 || strings.Contains(line, "HOSTNAME") || strings.Contains(line, "To (have") {
+	cfg := GetRouterConfig()
+	nodes := make(map[string]ExitNode)
+	for _, peer := range status.Peer {
+		if !peer.ExitNodeOption {
 			continue
 		}
-
-		ip, hostname, country, city, status := fields[0], fields[1], fields[2], fields[3], fields[4]
-		isOffline := strings.Contains(status, "offline")
-
-		// Ignore malformed entries that do not have a valid IP address
-		if !strings.Contains(ip, "100.") {
+		node := exitNodeFromPeer(peer)
+		if node.ID == "" || node.IP == "" {
 			continue
 		}
-
-		// Private nodes (self-hosted) have no country/city info
-		if country == "-" && city == "-" {
-			privateNodes[hostname] = ExitNode{
-				IP:       ip,
-				Hostname: hostname,
-				Active:   !isOffline,
-			}
-		} else {
-			// Mullvad nodes
-			displayName := fmt.Sprintf("%s (%s, %s)", hostname, country, city)
-			mullvadNodes[displayName] = ExitNode{
-				IP:       ip,
-				Hostname: displayName,
-				Active:   !isOffline,
-			}
+		if name := cfg.ExitNodeNames[node.ID]; name != "" {
+			node.Name = name
 		}
+		node.Favorite = containsString(cfg.FavoriteExitNodes, node.ID)
+		nodes[node.ID] = node
 	}
+	annotateExitNodeLatency(nodes)
+
+	return nodes, nil
+}
 
-	// Merge valid private and Mullvad nodes
-	for k, v := range privateNodes {
-		nodes[k] = v
+func exitNodeFromPeer(peer tailscalePeerJSON) ExitNode {
+	dnsName := strings.TrimSuffix(peer.DNSName, ".")
+	node := ExitNode{
+		ID:           peer.ID,
+		Hostname:     peer.HostName,
+		DNSName:      dnsName,
+		Name:         peer.HostName,
+		Provider:     exitNodeProviderPrivate,
+		Online:       peer.Online,
+		Capabilities: peer.Capabilities,
+	}
+	if node.ID == "" {
+		node.ID = peer.PublicKey
+	}
+	if node.Name == "" {
+		node.Name = dnsName
 	}
-	for k, v := range mullvadNodes {
-		nodes[k] = v
+	for _, ip := range peer.TailscaleIPs {
+		if strings.Contains(ip, ".") {
+			node.IP = ip
+			break
+		}
+	}
+	for capability := range peer.CapMap {
+		if !containsString(node.Capabilities, capability) {
+			node.Capabilities = append(node.Capabilities, capability)
+		}
 	}
+	sort.Strings(node.Capabilities)
+
+	if peer.Location != nil {
+		node.CountryCode = peer.Location.CountryCode
+		node.Country = peer.Location.Country
+		node.CityCode = peer.Location.CityCode
+		node.City = peer.Location.City
+		node.Priority = peer.Location.Priority
+	}
+	if peer.Location != nil || strings.HasSuffix(dnsName, ".mullvad.ts.net") {
+		node.Provider = exitNodeProviderMullvad
+	}
+	return node
+}
 
-	return nodes, nil
+// findExitNode resolves a stable ID, DNS name, hostname, or a legacy
+// "host (Country, City)" display name saved by older releases.
+func findExitNode(nodes map[string]ExitNode, ref string) (ExitNode, bool) {
+	if node, ok := nodes[ref]; ok {
+		return node, true
+	}
+	ref = strings.ToLower(strings.TrimSpace(ref))
+	if i := strings.Index(ref, " ("); i > 0 {
+		ref = ref[:i]
+	}
+	ref = strings.TrimSuffix(ref, ".")
+	for _, node := range nodes {
+		if strings.ToLower(node.DNSName) == ref || strings.ToLower(node.Hostname) == ref {
+			return node, true
+		}
+	}
+	return ExitNode{}, false
 }
 
 // Send an ARP ping to the exit node
@@ -151,20 +229,38 @@ func speedUpRoutingChanges() {
 
 // Enable Tailscale exit node
 func SetTailscaleExitNode(node string) error {
+	if filter, ok := parseAutoExitNodeSpec(node); ok {
+		return SetAutoExitNode(filter)
+	}
+
 	mu.Lock()
 	defer mu.Unlock()
 
+	if GetRouterConfig().AdvertiseExitNode {
+		return fmt.Errorf("this router is advertised as an exit node; disable that before using another exit node")
+	}
+
 	exitNodes, err := GetExitNodes()
 	if err != nil {
 		return err
 	}
 
-	exitNode, exists := exitNodes[node]
+	exitNode, exists := findExitNode(exitNodes, node)
 	if !exists {
-		return fmt.Errorf("exit node not found")
+		err := fmt.Errorf("exit node not found")
+		recordModeSwitch("tailscale:"+node, err)
+		return err
 	}
 
+	return applyExitNodeRouting(exitNode, "tailscale:"+exitNode.ID)
+}
+
+// applyExitNodeRouting points Tailscale at exitNode and rebuilds LAN forwarding.
+// Caller must hold mu. mode is persisted as the new CurrentMode.
+func applyExitNodeRouting(exitNode ExitNode, mode string) error {
 	flushRouterIPTablesRules()
+	appendLANSegmentRules(&exitNode)
+	clearPortMappings()
 
 	// Enable IP forwarding
 	if err := EnsureIPForwarding(); err != nil {
@@ -181,11 +277,12 @@ func SetTailscaleExitNode(node string) error {
 
 	// Allow LAN access while the router itself uses an exit node (required for
 	// forwarding LAN client traffic without breaking local subnet routing).
-	err = exec.Command("tailscale", "set",
+	_, err := tailscaleSet(
 		"--exit-node="+exitNode.IP,
 		"--exit-node-allow-lan-access",
-	).Run()
+	)
 	if err != nil {
+		recordModeSwitch(mode, err)
 		return err
 	}
 
@@ -195,6 +292,7 @@ func SetTailscaleExitNode(node string) error {
 
 	appendRouterNatMasquerade("tailscale0")
 	ensureRouterMSSClamp("tailscale0")
+	applyRouterSQM([]string{"tailscale0"}, true)
 
 	// Get LAN interfaces and set up forwarding rules
 	lanInterfaces, err := GetLANInterfaces()
@@ -210,14 +308,17 @@ func SetTailscaleExitNode(node string) error {
 			appendRouterForwardRule("-i", "tailscale0", "-o", lanIface, "-m", "state", "--state", "RELATED,ESTABLISHED", "-j", "ACCEPT")
 		}
 	}
+	appendSubnetRouterForwardRules()
+	appendSplitTunnelRules(ConfiguredWAN())
 
 	go sendArpPing(exitNode.IP)
 
 	// Speed up routing changes by flushing caches and sending ARP announcements
 	speedUpRoutingChanges()
 
-	CurrentMode = "tailscale:" + node
+	CurrentMode = mode
 	SaveMode(CurrentMode)
+	recordModeSwitch(mode, nil)
 
 	ReloadDnsmasqUpstream()
 
@@ -238,8 +339,16 @@ func DisableTailscaleExitNode() error {
 	return applyDirectModeRouting()
 }
 
+// tailscaleSet runs tailscale set and then puts TS-ROUTER-GUARD back above any
+// rules tailscaled re-inserted while applying it.
+func tailscaleSet(args ...string) ([]byte, error) {
+	out, err := exec.Command("tailscale", append([]string{"set"}, args...)...).CombinedOutput()
+	reassertRouterGuard()
+	return out, err
+}
+
 func clearTailscaleExitNode() error {
-	out, err := exec.Command("tailscale", "set", "--exit-node=").CombinedOutput()
+	out, err := tailscaleSet("--exit-node=")
 	if err == nil {
 		return nil
 	}
@@ -258,35 +367,44 @@ func applyDirectModeRouting() error {
 	exec.Command("modprobe", "nf_conntrack").Run()
 	exec.Command("modprobe", "nf_conntrack_ipv4").Run()
 
-	interfaceName, err := GetActiveInternetInterface()
-	if err != nil {
-		log.Println("Error detecting active interface, defaulting to eth0")
-		interfaceName = "eth0"
+	appendLANSegmentRules(nil)
+
+	wanInterfaces := ActiveWANInterfaces()
+	lanInterfaces, lanErr := GetLANInterfaces()
+	if lanErr != nil {
+		log.Printf("Warning: Could not detect LAN interfaces: %v", lanErr)
+		log.Println("Using permissive forwarding rules (allowing all interfaces)")
 	}
 
-	log.Println("Using interface for NAT:", interfaceName)
+	for _, interfaceName := range wanInterfaces {
+		log.Println("Using interface for NAT:", interfaceName)
 
-	appendRouterNatMasquerade(interfaceName)
+		appendRouterNatMasquerade(interfaceName)
+		ensureRouterMSSClamp(interfaceName)
+		appendExitNodeServerRules(interfaceName)
 
-	lanInterfaces, err := GetLANInterfaces()
-	if err != nil {
-		log.Printf("Warning: Could not detect LAN interfaces: %v", err)
-		log.Println("Using permissive forwarding rules (allowing all interfaces)")
-		appendRouterForwardRule("-o", interfaceName, "-m", "state", "--state", "NEW,RELATED,ESTABLISHED", "-j", "ACCEPT")
-		appendRouterForwardRule("-i", interfaceName, "-m", "state", "--state", "RELATED,ESTABLISHED", "-j", "ACCEPT")
-	} else {
+		if lanErr != nil {
+			appendRouterForwardRule("-o", interfaceName, "-m", "state", "--state", "NEW,RELATED,ESTABLISHED", "-j", "ACCEPT")
+			appendRouterForwardRule("-i", interfaceName, "-m", "state", "--state", "RELATED,ESTABLISHED", "-j", "ACCEPT")
+			continue
+		}
 		for _, lanIface := range lanInterfaces {
 			log.Printf("Setting up forwarding from %s to %s", lanIface, interfaceName)
 			appendRouterForwardRule("-i", lanIface, "-o", interfaceName, "-m", "state", "--state", "NEW,RELATED,ESTABLISHED", "-j", "ACCEPT")
 			appendRouterForwardRule("-i", interfaceName, "-o", lanIface, "-m", "state", "--state", "RELATED,ESTABLISHED", "-j", "ACCEPT")
 		}
 	}
+	applyRouterSQM(wanInterfaces, false)
+	appendSubnetRouterForwardRules()
+	appendPortMappingRules()
+	deleteIPRulePriority(splitTunnelRulePriority)
 
 	go sendArpPing("1.1.1.1")
 	speedUpRoutingChanges()
 
 	CurrentMode = "direct"
 	SaveMode(CurrentMode)
+	recordModeSwitch(CurrentMode, nil)
 
 	ReloadDnsmasqUpstream()
 	return nil
@@ -0,0 +1,283 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+const (
+	// exitNodeRoute is how Tailscale lists an advertised/approved exit node.
+	exitNodeRoute = "0.0.0.0/0"
+	// tailnetCIDR is the CGNAT range Tailscale assigns node addresses from.
+	tailnetCIDR = "100.64.0.0/10"
+)
+
+// AdvertisedRouteStatus reports the routes this router offers to the tailnet and
+// whether they have been approved in the Tailscale admin console. Advertised and
+// Approved hold only when they hold for every route.
+type AdvertisedRouteStatus struct {
+	Enabled    bool              `json:"enabled"`
+	Route      string            `json:"route"`
+	Advertised bool              `json:"advertised"`
+	Approved   bool              `json:"approved"`
+	Routes     []AdvertisedRoute `json:"routes,omitempty"`
+}
+
+// AdvertisedRoute is the advertisement and approval state of one prefix.
+type AdvertisedRoute struct {
+	Route      string `json:"route"`
+	Advertised bool   `json:"advertised"`
+	Approved   bool   `json:"approved"`
+}
+
+// lanRouteCIDR returns the LAN network advertised by the subnet router option.
+func lanRouteCIDR(cfg RouterConfig) string {
+	if cfg.LANAddress == "" || cfg.LANPrefix <= 0 {
+		return ""
+	}
+	return networkCIDR(cfg.LANAddress, cfg.LANPrefix)
+}
+
+// lanSegmentRoutes maps each LAN segment's device to its network.
+func lanSegmentRoutes(cfg RouterConfig) map[string]string {
+	routes := make(map[string]string)
+	for _, segment := range LANSegments(cfg) {
+		if segment.Address != "" && segment.Prefix > 0 {
+			routes[segment.Device()] = segment.CIDR()
+		}
+	}
+	return routes
+}
+
+// segmentRoutes lists the network of every LAN segment, primary LAN first.
+func segmentRoutes(cfg RouterConfig) []string {
+	var routes []string
+	for _, segment := range LANSegments(cfg) {
+		if segment.Address != "" && segment.Prefix > 0 {
+			routes = append(routes, segment.CIDR())
+		}
+	}
+	return routes
+}
+
+// advertisedRoutes lists the prefixes passed to tailscale --advertise-routes.
+func advertisedRoutes(cfg RouterConfig) []string {
+	if !cfg.SubnetRouter {
+		return nil
+	}
+	return segmentRoutes(cfg)
+}
+
+func advertiseRoutesFlag(cfg RouterConfig) string {
+	return "--advertise-routes=" + strings.Join(advertisedRoutes(cfg), ",")
+}
+
+func advertiseExitNodeFlag(cfg RouterConfig) string {
+	return "--advertise-exit-node=" + strconv.FormatBool(cfg.AdvertiseExitNode)
+}
+
+// applyTailscaleAdvertisedRoutes pushes the configured subnet routes to tailscaled.
+func applyTailscaleAdvertisedRoutes(cfg RouterConfig) error {
+	out, err := tailscaleSet(advertiseRoutesFlag(cfg))
+	if err != nil {
+		return fmt.Errorf("%v: %s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// appendSubnetRouterForwardRules lets tailnet peers reach LAN hosts. Must run after
+// every mode switch because flushRouterIPTablesRules clears TS-ROUTER-FWD.
+func appendSubnetRouterForwardRules() {
+	cfg := GetRouterConfig()
+	if !cfg.SubnetRouter {
+		return
+	}
+
+	for lanIface, route := range lanSegmentRoutes(cfg) {
+		log.Printf("Setting up subnet routing from tailscale0 to %s (%s)", lanIface, route)
+		appendRouterForwardRule("-i", "tailscale0", "-o", lanIface, "-d", route, "-m", "state", "--state", "NEW,RELATED,ESTABLISHED", "-j", "ACCEPT")
+		appendRouterForwardRule("-i", lanIface, "-o", "tailscale0", "-s", route, "-m", "state", "--state", "RELATED,ESTABLISHED", "-j", "ACCEPT")
+	}
+}
+
+// appendExitNodeServerRules forwards and masquerades tailnet traffic out of the
+// WAN when the router is offered as an exit node. Only valid in direct mode.
+func appendExitNodeServerRules(wanIface string) {
+	if !GetRouterConfig().AdvertiseExitNode {
+		return
+	}
+	log.Printf("Setting up exit node forwarding from tailscale0 to %s", wanIface)
+	appendRouterNatMasqueradeFrom(tailnetCIDR, wanIface)
+	appendRouterForwardRule("-i", "tailscale0", "-o", wanIface, "-m", "state", "--state", "NEW,RELATED,ESTABLISHED", "-j", "ACCEPT")
+	appendRouterForwardRule("-i", wanIface, "-o", "tailscale0", "-m", "state", "--state", "RELATED,ESTABLISHED", "-j", "ACCEPT")
+}
+
+type tailscaleSelfRoutes struct {
+	AllowedIPs    []string
+	PrimaryRoutes []string
+}
+
+func getTailscaleSelfRoutes() (tailscaleSelfRoutes, error) {
+	out, err := exec.Command("tailscale", "status", "--json").Output()
+	if err != nil {
+		return tailscaleSelfRoutes{}, err
+	}
+	var status struct {
+		Self struct {
+			AllowedIPs    []string `json:"AllowedIPs"`
+			PrimaryRoutes []string `json:"PrimaryRoutes"`
+		} `json:"Self"`
+	}
+	if err := json.Unmarshal(out, &status); err != nil {
+		return tailscaleSelfRoutes{}, err
+	}
+	return tailscaleSelfRoutes{
+		AllowedIPs:    status.Self.AllowedIPs,
+		PrimaryRoutes: status.Self.PrimaryRoutes,
+	}, nil
+}
+
+// getTailscaleAdvertisedPrefs returns the routes tailscaled currently advertises.
+func getTailscaleAdvertisedPrefs() []string {
+	out, err := exec.Command("tailscale", "debug", "prefs").Output()
+	if err != nil {
+		return nil
+	}
+	var prefs struct {
+		AdvertiseRoutes []string `json:"AdvertiseRoutes"`
+	}
+	if json.Unmarshal(out, &prefs) != nil {
+		return nil
+	}
+	return prefs.AdvertiseRoutes
+}
+
+func containsString(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
+
+func advertisedRouteStatus(enabled bool, routes ...string) AdvertisedRouteStatus {
+	status := AdvertisedRouteStatus{
+		Enabled: enabled,
+		Route:   strings.Join(routes, ", "),
+	}
+	if len(routes) == 0 {
+		return status
+	}
+
+	prefs := getTailscaleAdvertisedPrefs()
+	self, selfErr := getTailscaleSelfRoutes()
+	status.Advertised, status.Approved = true, true
+	for _, route := range routes {
+		r := AdvertisedRoute{Route: route, Advertised: containsString(prefs, route)}
+		if selfErr == nil {
+			r.Approved = containsString(self.AllowedIPs, route) ||
+				containsString(self.PrimaryRoutes, route)
+		}
+		status.Advertised = status.Advertised && r.Advertised
+		status.Approved = status.Approved && r.Approved
+		status.Routes = append(status.Routes, r)
+	}
+	return status
+}
+
+// GetSubnetRouterStatus reports the advertisement and admin approval of every
+// LAN segment's route, as advertisedRoutes offers them all.
+func GetSubnetRouterStatus() AdvertisedRouteStatus {
+	cfg := GetRouterConfig()
+	return advertisedRouteStatus(cfg.SubnetRouter, segmentRoutes(cfg)...)
+}
+
+// GetExitNodeServerStatus reports whether the router offers itself as an exit
+// node and whether that has been approved in the admin console.
+func GetExitNodeServerStatus() AdvertisedRouteStatus {
+	cfg := GetRouterConfig()
+	return advertisedRouteStatus(cfg.AdvertiseExitNode, exitNodeRoute)
+}
+
+// SubnetRouterHandler enables or disables advertising the LAN to the tailnet.
+func SubnetRouterHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	enabled, err := strconv.ParseBool(r.URL.Query().Get("enabled"))
+	if err != nil {
+		http.Error(w, "Invalid enabled parameter", http.StatusBadRequest)
+		return
+	}
+
+	cfg := GetRouterConfig()
+	if enabled && lanRouteCIDR(cfg) == "" {
+		http.Error(w, "LAN address is not configured", http.StatusBadRequest)
+		return
+	}
+	cfg.SubnetRouter = enabled
+	// Save only what tailscale accepted, so a failed set leaves the config as it was.
+	if err := applyTailscaleAdvertisedRoutes(cfg); err != nil {
+		http.Error(w, "tailscale set: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := SaveRouterConfig(cfg); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := ReapplyCurrentMode(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(GetSubnetRouterStatus())
+}
+
+// ExitNodeServerHandler enables or disables offering this router as an exit node.
+func ExitNodeServerHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	enabled, err := strconv.ParseBool(r.URL.Query().Get("enabled"))
+	if err != nil {
+		http.Error(w, "Invalid enabled parameter", http.StatusBadRequest)
+		return
+	}
+
+	// Tailscale refuses to advertise an exit node while using one.
+	if enabled && strings.HasPrefix(diagnosticMode(), "tailscale:") {
+		http.Error(w, "Switch to direct mode before offering this router as an exit node", http.StatusConflict)
+		return
+	}
+
+	cfg := GetRouterConfig()
+	cfg.AdvertiseExitNode = enabled
+	// Save only what tailscale accepted, so a failed set leaves the config as it was.
+	out, err := tailscaleSet(advertiseExitNodeFlag(cfg))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("tailscale set: %v: %s", err, strings.TrimSpace(string(out))), http.StatusInternalServerError)
+		return
+	}
+	if err := SaveRouterConfig(cfg); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := ReapplyCurrentMode(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(GetExitNodeServerStatus())
+}
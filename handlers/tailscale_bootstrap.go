@@ -9,14 +9,15 @@ import (
 
 // bootstrapTailscaleArgs returns explicit tailscale up flags for first-time / re-setup.
 // All non-default settings must be listed for newer Tailscale versions.
-func bootstrapTailscaleArgs(hostname, authKey string) []string {
+func bootstrapTailscaleArgs(cfg RouterConfig, authKey string) []string {
 	args := []string{
 		"up",
-		"--advertise-exit-node=false",
+		advertiseExitNodeFlag(cfg),
+		advertiseRoutesFlag(cfg),
 		"--accept-routes=false",
 		"--accept-dns=false",
 		"--exit-node=",
-		"--hostname=" + hostname,
+		"--hostname=" + cfg.TailscaleHost,
 	}
 	if authKey != "" {
 		args = append(args, "--auth-key="+authKey)
@@ -35,17 +36,18 @@ func clearStaleTailscaleRouterState() {
 		log.Printf("Bootstrap: clear exit node (non-fatal): %v", err)
 	}
 	// Leftover from a previous router session; ignore errors if unsupported.
-	exec.Command("tailscale", "set", "--exit-node-allow-lan-access=false").Run()
+	tailscaleSet("--exit-node-allow-lan-access=false")
 }
 
-func applyTailscaleSettingsInPlace(hostname string) error {
+func applyTailscaleSettingsInPlace(cfg RouterConfig) error {
 	clearStaleTailscaleRouterState()
-	out, err := exec.Command("tailscale", "set",
-		"--advertise-exit-node=false",
+	out, err := tailscaleSet(
+		advertiseExitNodeFlag(cfg),
+		advertiseRoutesFlag(cfg),
 		"--accept-routes=false",
 		"--accept-dns=false",
-		"--hostname="+hostname,
-	).CombinedOutput()
+		"--hostname="+cfg.TailscaleHost,
+	)
 	if err != nil {
 		return fmt.Errorf("%v: %s", err, strings.TrimSpace(string(out)))
 	}
@@ -55,14 +57,15 @@ func applyTailscaleSettingsInPlace(hostname string) error {
 
 // RunBootstrapTailscale connects or reconfigures Tailscale during web setup.
 // Handles partial installs where Tailscale already has exit-node settings.
-func RunBootstrapTailscale(hostname, authKey string) error {
+func RunBootstrapTailscale(cfg RouterConfig, authKey string) error {
 	if authKey == "" && !getTailscaleSnapshot().Connected {
 		return fmt.Errorf("tailscale auth key is required on fresh installs")
 	}
 
 	clearStaleTailscaleRouterState()
+	defer reassertRouterGuard() // tailscale up reinstalls tailscaled's FORWARD rules
 
-	args := bootstrapTailscaleArgs(hostname, authKey)
+	args := bootstrapTailscaleArgs(cfg, authKey)
 	out, err := exec.Command("tailscale", args...).CombinedOutput()
 	if err == nil {
 		return nil
@@ -81,7 +84,7 @@ func RunBootstrapTailscale(hostname, authKey string) error {
 	}
 
 	if authKey == "" && getTailscaleSnapshot().Connected {
-		if err := applyTailscaleSettingsInPlace(hostname); err == nil {
+		if err := applyTailscaleSettingsInPlace(cfg); err == nil {
 			return nil
 		}
 	}
@@ -76,6 +76,7 @@ func ensureTailscaledRunning() error {
 
 		for i := 0; i < 12; i++ {
 			if tailscaledDaemonReady() {
+				reassertRouterGuard()
 				return nil
 			}
 			time.Sleep(500 * time.Millisecond)
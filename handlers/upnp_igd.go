@@ -0,0 +1,584 @@
+package handlers
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"encoding/xml"
+	"fmt"
+	"html"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	upnpHTTPPort  = 5002
+	ssdpAddr      = "239.255.255.250:1900"
+	upnpServer    = "Linux UPnP/1.1 tailscale-raspberry-router/1.0"
+	igdDeviceType = "urn:schemas-upnp-org:device:InternetGatewayDevice:1"
+	wanIPConnType = "urn:schemas-upnp-org:service:WANIPConnection:1"
+	wanCommonType = "urn:schemas-upnp-org:service:WANCommonInterfaceConfig:1"
+)
+
+// UPnP error codes from the WANIPConnection spec.
+const (
+	upnpErrInvalidAction   = 401
+	upnpErrInvalidArgs     = 402
+	upnpErrActionFailed    = 501
+	upnpErrNotAuthorized   = 606
+	upnpErrArrayIndex      = 713
+	upnpErrNoSuchEntry     = 714
+	upnpErrConflict        = 718
+	upnpErrNoPortMapsAvail = 728
+)
+
+var (
+	ssdpMu        sync.Mutex
+	ssdpListeners = make(map[string]*net.UDPConn) // by LAN device
+	upnpServers   = make(map[string]*http.Server) // by segment address, under ssdpMu
+	upnpUUIDOnce  sync.Once
+	upnpUUIDValue string
+)
+
+// upnpUUID is stable across restarts so control points keep recognising the router.
+func upnpUUID() string {
+	upnpUUIDOnce.Do(func() {
+		seed, err := os.ReadFile("/etc/machine-id")
+		if err != nil {
+			seed = []byte(fmt.Sprint(time.Now().UnixNano()))
+		}
+		sum := sha1.Sum(append([]byte("tailscale-router-igd:"), bytes.TrimSpace(seed)...))
+		upnpUUIDValue = fmt.Sprintf("%x-%x-%x-%x-%x", sum[0:4], sum[4:6], sum[6:8], sum[8:10], sum[10:16])
+	})
+	return upnpUUIDValue
+}
+
+// upnpSegmentAddress is the router address on the client's segment, or "" if it may not use UPnP.
+func upnpSegmentAddress(client net.IP) string {
+	cfg := GetRouterConfig()
+	if !cfg.PortMapping.Enabled {
+		return ""
+	}
+	s, ok := portMappingSegment(cfg, client)
+	if !ok {
+		return ""
+	}
+	return s.Address
+}
+
+// refreshSSDPListeners keeps one multicast socket per eligible LAN segment.
+func refreshSSDPListeners() {
+	wanted := make(map[string]bool)
+	for _, s := range portMappingSegments(GetRouterConfig()) {
+		wanted[s.Device()] = true
+	}
+
+	group, _ := net.ResolveUDPAddr("udp4", ssdpAddr)
+	ssdpMu.Lock()
+	defer ssdpMu.Unlock()
+	for device, conn := range ssdpListeners {
+		if !wanted[device] {
+			conn.Close()
+			delete(ssdpListeners, device)
+		}
+	}
+	for device := range wanted {
+		if ssdpListeners[device] != nil {
+			continue
+		}
+		iface, err := net.InterfaceByName(device)
+		if err != nil {
+			continue
+		}
+		conn, err := net.ListenMulticastUDP("udp4", iface, group)
+		if err != nil {
+			log.Printf("SSDP on %s: %v", device, err)
+			continue
+		}
+		ssdpListeners[device] = conn
+		go serveSSDP(device, conn)
+	}
+}
+
+// serveSSDP answers M-SEARCH requests. Every socket sees every group packet, so each
+// one only answers senders on its own segment's subnet.
+func serveSSDP(device string, conn *net.UDPConn) {
+	log.Printf("SSDP listening on %s", device)
+	buf := make([]byte, 2048)
+	for {
+		n, addr, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			return // closed by refreshSSDPListeners
+		}
+		address := upnpSegmentAddress(addr.IP)
+		if address == "" {
+			continue
+		}
+		if seg, ok := portMappingSegment(GetRouterConfig(), addr.IP); !ok || seg.Device() != device {
+			continue
+		}
+
+		req, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(buf[:n])))
+		if err != nil || req.Method != "M-SEARCH" || strings.Trim(req.Header.Get("MAN"), `"`) != "ssdp:discover" {
+			continue
+		}
+		for _, st := range ssdpSearchTargets(req.Header.Get("ST")) {
+			sendSSDPResponse(address, addr, st)
+		}
+	}
+}
+
+func ssdpSearchTargets(st string) []string {
+	uuid := "uuid:" + upnpUUID()
+	all := []string{
+		"upnp:rootdevice",
+		uuid,
+		igdDeviceType,
+		"urn:schemas-upnp-org:device:WANDevice:1",
+		"urn:schemas-upnp-org:device:WANConnectionDevice:1",
+		wanCommonType,
+		wanIPConnType,
+	}
+	if st == "ssdp:all" {
+		return all
+	}
+	for _, target := range all {
+		if st == target {
+			return []string{st}
+		}
+	}
+	return nil
+}
+
+func sendSSDPResponse(localIP string, to *net.UDPAddr, st string) {
+	usn := "uuid:" + upnpUUID()
+	if st != usn {
+		usn += "::" + st
+	}
+	msg := "HTTP/1.1 200 OK\r\n" +
+		"CACHE-CONTROL: max-age=1800\r\n" +
+		"EXT:\r\n" +
+		fmt.Sprintf("LOCATION: http://%s:%d/rootDesc.xml\r\n", localIP, upnpHTTPPort) +
+		"SERVER: " + upnpServer + "\r\n" +
+		"ST: " + st + "\r\n" +
+		"USN: " + usn + "\r\n\r\n"
+
+	// Reply from the unicast address; the multicast socket cannot be a source.
+	conn, err := net.DialUDP("udp4", &net.UDPAddr{IP: net.ParseIP(localIP)}, to)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	conn.Write([]byte(msg))
+}
+
+// refreshUPnPServers keeps the IGD HTTP server bound to each eligible segment
+// address only, and shuts them all down when port mapping is disabled.
+func refreshUPnPServers() {
+	wanted := make(map[string]bool)
+	for _, s := range portMappingSegments(GetRouterConfig()) {
+		wanted[s.Address] = true
+	}
+
+	ssdpMu.Lock()
+	defer ssdpMu.Unlock()
+	for address, srv := range upnpServers {
+		if !wanted[address] {
+			srv.Close()
+			delete(upnpServers, address)
+		}
+	}
+	for address := range wanted {
+		if upnpServers[address] != nil {
+			continue
+		}
+		addr := net.JoinHostPort(address, strconv.Itoa(upnpHTTPPort))
+		ln, err := net.Listen("tcp4", addr)
+		if err != nil {
+			log.Printf("UPnP IGD on %s: %v", addr, err)
+			continue
+		}
+		srv := &http.Server{Handler: upnpMux()}
+		upnpServers[address] = srv
+		log.Printf("UPnP IGD listening on %s", addr)
+		go func() {
+			if err := srv.Serve(ln); err != nil && err != http.ErrServerClosed {
+				log.Printf("UPnP IGD on %s stopped: %v", addr, err)
+			}
+		}()
+	}
+}
+
+func upnpMux() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/rootDesc.xml", upnpDescriptionHandler)
+	mux.HandleFunc("/WANIPCn.xml", upnpSCPDHandler(wanIPConnSCPD))
+	mux.HandleFunc("/WANCfg.xml", upnpSCPDHandler(wanCommonSCPD))
+	mux.HandleFunc("/ctl/IPConn", upnpControlHandler)
+	mux.HandleFunc("/ctl/CmnIfCfg", upnpControlHandler)
+	return mux
+}
+
+func upnpClientAllowed(w http.ResponseWriter, r *http.Request) bool {
+	if upnpSegmentAddress(net.ParseIP(clientIP(r))) == "" {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+func upnpDescriptionHandler(w http.ResponseWriter, r *http.Request) {
+	if !upnpClientAllowed(w, r) {
+		return
+	}
+	w.Header().Set("Content-Type", `text/xml; charset="utf-8"`)
+	fmt.Fprintf(w, `<?xml version="1.0"?>
+<root xmlns="urn:schemas-upnp-org:device-1-0">
+<specVersion><major>1</major><minor>0</minor></specVersion>
+<device>
+<deviceType>%s</deviceType>
+<friendlyName>Tailscale Router</friendlyName>
+<manufacturer>tailscale-raspberry-router</manufacturer>
+<modelName>Tailscale Router</modelName>
+<UDN>uuid:%s</UDN>
+<serviceList/>
+<deviceList>
+<device>
+<deviceType>urn:schemas-upnp-org:device:WANDevice:1</deviceType>
+<friendlyName>WAN Device</friendlyName>
+<manufacturer>tailscale-raspberry-router</manufacturer>
+<modelName>WAN Device</modelName>
+<UDN>uuid:%s-wan</UDN>
+<serviceList>
+<service>
+<serviceType>%s</serviceType>
+<serviceId>urn:upnp-org:serviceId:WANCommonIFC1</serviceId>
+<SCPDURL>/WANCfg.xml</SCPDURL>
+<controlURL>/ctl/CmnIfCfg</controlURL>
+<eventSubURL>/evt/CmnIfCfg</eventSubURL>
+</service>
+</serviceList>
+<deviceList>
+<device>
+<deviceType>urn:schemas-upnp-org:device:WANConnectionDevice:1</deviceType>
+<friendlyName>WAN Connection Device</friendlyName>
+<manufacturer>tailscale-raspberry-router</manufacturer>
+<modelName>WAN Connection Device</modelName>
+<UDN>uuid:%s-conn</UDN>
+<serviceList>
+<service>
+<serviceType>%s</serviceType>
+<serviceId>urn:upnp-org:serviceId:WANIPConn1</serviceId>
+<SCPDURL>/WANIPCn.xml</SCPDURL>
+<controlURL>/ctl/IPConn</controlURL>
+<eventSubURL>/evt/IPConn</eventSubURL>
+</service>
+</serviceList>
+</device>
+</deviceList>
+</device>
+</deviceList>
+<presentationURL>http://%s:5000/</presentationURL>
+</device>
+</root>
+`, igdDeviceType, upnpUUID(), upnpUUID(), wanCommonType, upnpUUID(), wanIPConnType, upnpSegmentAddress(net.ParseIP(clientIP(r))))
+}
+
+// upnpAction describes one SCPD action: name, in arguments, out arguments.
+type upnpAction struct {
+	name string
+	in   []string
+	out  []string
+}
+
+var wanIPConnSCPD = []upnpAction{
+	{"GetConnectionTypeInfo", nil, []string{"NewConnectionType", "NewPossibleConnectionTypes"}},
+	{"GetStatusInfo", nil, []string{"NewConnectionStatus", "NewLastConnectionError", "NewUptime"}},
+	{"GetExternalIPAddress", nil, []string{"NewExternalIPAddress"}},
+	{"AddPortMapping", []string{"NewRemoteHost", "NewExternalPort", "NewProtocol", "NewInternalPort", "NewInternalClient", "NewEnabled", "NewPortMappingDescription", "NewLeaseDuration"}, nil},
+	{"DeletePortMapping", []string{"NewRemoteHost", "NewExternalPort", "NewProtocol"}, nil},
+	{"GetSpecificPortMappingEntry", []string{"NewRemoteHost", "NewExternalPort", "NewProtocol"}, []string{"NewInternalPort", "NewInternalClient", "NewEnabled", "NewPortMappingDescription", "NewLeaseDuration"}},
+	{"GetGenericPortMappingEntry", []string{"NewPortMappingIndex"}, []string{"NewRemoteHost", "NewExternalPort", "NewProtocol", "NewInternalPort", "NewInternalClient", "NewEnabled", "NewPortMappingDescription", "NewLeaseDuration"}},
+}
+
+var wanCommonSCPD = []upnpAction{
+	{"GetCommonLinkProperties", nil, []string{"NewWANAccessType", "NewLayer1UpstreamMaxBitRate", "NewLayer1DownstreamMaxBitRate", "NewPhysicalLinkStatus"}},
+}
+
+// upnpStateVariables maps each argument to its state variable and type.
+var upnpStateVariables = map[string][2]string{
+	"NewConnectionType":             {"ConnectionType", "string"},
+	"NewPossibleConnectionTypes":    {"PossibleConnectionTypes", "string"},
+	"NewConnectionStatus":           {"ConnectionStatus", "string"},
+	"NewLastConnectionError":        {"LastConnectionError", "string"},
+	"NewUptime":                     {"Uptime", "ui4"},
+	"NewExternalIPAddress":          {"ExternalIPAddress", "string"},
+	"NewRemoteHost":                 {"RemoteHost", "string"},
+	"NewExternalPort":               {"ExternalPort", "ui2"},
+	"NewProtocol":                   {"PortMappingProtocol", "string"},
+	"NewInternalPort":               {"InternalPort", "ui2"},
+	"NewInternalClient":             {"InternalClient", "string"},
+	"NewEnabled":                    {"PortMappingEnabled", "boolean"},
+	"NewPortMappingDescription":     {"PortMappingDescription", "string"},
+	"NewLeaseDuration":              {"PortMappingLeaseDuration", "ui4"},
+	"NewPortMappingIndex":           {"PortMappingNumberOfEntries", "ui2"},
+	"NewWANAccessType":              {"WANAccessType", "string"},
+	"NewLayer1UpstreamMaxBitRate":   {"Layer1UpstreamMaxBitRate", "ui4"},
+	"NewLayer1DownstreamMaxBitRate": {"Layer1DownstreamMaxBitRate", "ui4"},
+	"NewPhysicalLinkStatus":         {"PhysicalLinkStatus", "string"},
+}
+
+func upnpSCPDHandler(actions []upnpAction) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !upnpClientAllowed(w, r) {
+			return
+		}
+		var b strings.Builder
+		b.WriteString(`<?xml version="1.0"?>` + "\n" + `<scpd xmlns="urn:schemas-upnp-org:service-1-0">` + "\n")
+		b.WriteString("<specVersion><major>1</major><minor>0</minor></specVersion>\n<actionList>\n")
+		variables := make(map[string]string)
+		for _, a := range actions {
+			fmt.Fprintf(&b, "<action><name>%s</name><argumentList>\n", a.name)
+			for _, dir := range []struct {
+				name string
+				args []string
+			}{{"in", a.in}, {"out", a.out}} {
+				for _, arg := range dir.args {
+					v := upnpStateVariables[arg]
+					variables[v[0]] = v[1]
+					fmt.Fprintf(&b, "<argument><name>%s</name><direction>%s</direction><relatedStateVariable>%s</relatedStateVariable></argument>\n", arg, dir.name, v[0])
+				}
+			}
+			b.WriteString("</argumentList></action>\n")
+		}
+		b.WriteString("</actionList>\n<serviceStateTable>\n")
+		for name, kind := range variables {
+			fmt.Fprintf(&b, `<stateVariable sendEvents="no"><name>%s</name><dataType>%s</dataType></stateVariable>`+"\n", name, kind)
+		}
+		b.WriteString("</serviceStateTable>\n</scpd>\n")
+		w.Header().Set("Content-Type", `text/xml; charset="utf-8"`)
+		io.WriteString(w, b.String())
+	}
+}
+
+// parseSOAPArgs returns the action's child elements as name -> text.
+func parseSOAPArgs(body io.Reader) map[string]string {
+	args := make(map[string]string)
+	dec := xml.NewDecoder(body)
+	var current string
+	for {
+		tok, err := dec.Token()
+		if err != nil {
+			return args
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			current = t.Name.Local
+		case xml.CharData:
+			if current != "" {
+				args[current] += string(t)
+			}
+		case xml.EndElement:
+			current = ""
+		}
+	}
+}
+
+type upnpArg struct {
+	name, value string
+}
+
+func writeSOAPResponse(w http.ResponseWriter, service, action string, out []upnpArg) {
+	w.Header().Set("Content-Type", `text/xml; charset="utf-8"`)
+	w.Header().Set("EXT", "")
+	var b strings.Builder
+	for _, arg := range out {
+		fmt.Fprintf(&b, "<%s>%s</%s>", arg.name, html.EscapeString(arg.value), arg.name)
+	}
+	fmt.Fprintf(w, `<?xml version="1.0"?>
+<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/" s:encodingStyle="http://schemas.xmlsoap.org/soap/encoding/"><s:Body><u:%sResponse xmlns:u="%s">%s</u:%sResponse></s:Body></s:Envelope>
+`, action, html.EscapeString(service), b.String(), action)
+}
+
+func writeSOAPError(w http.ResponseWriter, code int, description string) {
+	w.Header().Set("Content-Type", `text/xml; charset="utf-8"`)
+	w.WriteHeader(http.StatusInternalServerError)
+	fmt.Fprintf(w, `<?xml version="1.0"?>
+<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/" s:encodingStyle="http://schemas.xmlsoap.org/soap/encoding/"><s:Body><s:Fault><faultcode>s:Client</faultcode><faultstring>UPnPError</faultstring><detail><UPnPError xmlns="urn:schemas-upnp-org:control-1-0"><errorCode>%d</errorCode><errorDescription>%s</errorDescription></UPnPError></detail></s:Fault></s:Body></s:Envelope>
+`, code, html.EscapeString(description))
+}
+
+func upnpMappingError(w http.ResponseWriter, err error) {
+	switch err {
+	case errPortMappingConflict:
+		writeSOAPError(w, upnpErrConflict, "ConflictInMappingEntry")
+	case errPortMappingFull:
+		writeSOAPError(w, upnpErrNoPortMapsAvail, "NoPortMapsAvailable")
+	case errPortMappingNotFound:
+		writeSOAPError(w, upnpErrNoSuchEntry, "NoSuchEntryInArray")
+	case errPortMappingInactive:
+		writeSOAPError(w, upnpErrActionFailed, "Action Failed")
+	default:
+		writeSOAPError(w, upnpErrNotAuthorized, "Action not authorized")
+	}
+}
+
+func upnpMappingArgs(m PortMapping, withKey bool) []upnpArg {
+	var out []upnpArg
+	if withKey {
+		out = append(out,
+			upnpArg{"NewRemoteHost", m.RemoteHost},
+			upnpArg{"NewExternalPort", strconv.Itoa(m.ExternalPort)},
+			upnpArg{"NewProtocol", strings.ToUpper(m.Protocol)},
+		)
+	}
+	lease := int(time.Until(m.ExpiresAt) / time.Second)
+	if lease < 1 {
+		lease = 1
+	}
+	return append(out,
+		upnpArg{"NewInternalPort", strconv.Itoa(m.InternalPort)},
+		upnpArg{"NewInternalClient", m.InternalIP},
+		upnpArg{"NewEnabled", "1"},
+		upnpArg{"NewPortMappingDescription", m.Description},
+		upnpArg{"NewLeaseDuration", strconv.Itoa(lease)},
+	)
+}
+
+// upnpControlHandler serves the SOAP actions of both services.
+func upnpControlHandler(w http.ResponseWriter, r *http.Request) {
+	if !upnpClientAllowed(w, r) {
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// SOAPACTION: "urn:schemas-upnp-org:service:WANIPConnection:1#AddPortMapping"
+	soapAction := strings.Trim(r.Header.Get("SOAPACTION"), `" `)
+	i := strings.LastIndex(soapAction, "#")
+	if i < 0 {
+		writeSOAPError(w, upnpErrInvalidAction, "Invalid Action")
+		return
+	}
+	service, action := soapAction[:i], soapAction[i+1:]
+	args := parseSOAPArgs(io.LimitReader(r.Body, 64*1024))
+	client := clientIP(r)
+
+	switch action {
+	case "GetCommonLinkProperties":
+		writeSOAPResponse(w, service, action, []upnpArg{
+			{"NewWANAccessType", "Ethernet"},
+			{"NewLayer1UpstreamMaxBitRate", "1000000000"},
+			{"NewLayer1DownstreamMaxBitRate", "1000000000"},
+			{"NewPhysicalLinkStatus", "Up"},
+		})
+
+	case "GetConnectionTypeInfo":
+		writeSOAPResponse(w, service, action, []upnpArg{{"NewConnectionType", "IP_Routed"}, {"NewPossibleConnectionTypes", "IP_Routed"}})
+
+	case "GetStatusInfo":
+		status := "Connected"
+		pmMu.Lock()
+		if !pmActive {
+			status = "Disconnected"
+		}
+		pmMu.Unlock()
+		writeSOAPResponse(w, service, action, []upnpArg{
+			{"NewConnectionStatus", status},
+			{"NewLastConnectionError", "ERROR_NONE"},
+			{"NewUptime", strconv.Itoa(int(time.Since(pmStarted) / time.Second))},
+		})
+
+	case "GetExternalIPAddress":
+		ip := ""
+		pmMu.Lock()
+		active := pmActive
+		pmMu.Unlock()
+		if active {
+			ip = portMappingExternalIP()
+		}
+		writeSOAPResponse(w, service, action, []upnpArg{{"NewExternalIPAddress", ip}})
+
+	case "AddPortMapping":
+		externalPort, err1 := strconv.Atoi(strings.TrimSpace(args["NewExternalPort"]))
+		internalPort, err2 := strconv.Atoi(strings.TrimSpace(args["NewInternalPort"]))
+		lease, err3 := strconv.Atoi(strings.TrimSpace(args["NewLeaseDuration"]))
+		protocol := strings.ToLower(strings.TrimSpace(args["NewProtocol"]))
+		remote := strings.TrimSpace(args["NewRemoteHost"])
+		if err1 != nil || err2 != nil || err3 != nil || externalPort < 1 || externalPort > 65535 ||
+			internalPort < 1 || internalPort > 65535 || lease < 0 || (remote != "" && net.ParseIP(remote).To4() == nil) {
+			writeSOAPError(w, upnpErrInvalidArgs, "Invalid Args")
+			return
+		}
+		// Clients may only map ports to themselves.
+		if strings.TrimSpace(args["NewInternalClient"]) != client {
+			writeSOAPError(w, upnpErrNotAuthorized, "Action not authorized")
+			return
+		}
+		if args["NewEnabled"] == "0" {
+			deletePortMapping(protocol, externalPort, client)
+			writeSOAPResponse(w, service, action, nil)
+			return
+		}
+		_, err := addPortMapping(PortMapping{
+			Protocol:     protocol,
+			ExternalPort: externalPort,
+			InternalIP:   client,
+			InternalPort: internalPort,
+			RemoteHost:   remote,
+			Description:  strings.TrimSpace(args["NewPortMappingDescription"]),
+			Via:          "upnp",
+		}, time.Duration(lease)*time.Second, false)
+		if err != nil {
+			upnpMappingError(w, err)
+			return
+		}
+		writeSOAPResponse(w, service, action, nil)
+
+	case "DeletePortMapping":
+		externalPort, err := strconv.Atoi(strings.TrimSpace(args["NewExternalPort"]))
+		if err != nil {
+			writeSOAPError(w, upnpErrInvalidArgs, "Invalid Args")
+			return
+		}
+		if err := deletePortMapping(strings.ToLower(strings.TrimSpace(args["NewProtocol"])), externalPort, client); err != nil {
+			upnpMappingError(w, err)
+			return
+		}
+		writeSOAPResponse(w, service, action, nil)
+
+	case "GetSpecificPortMappingEntry":
+		externalPort, err := strconv.Atoi(strings.TrimSpace(args["NewExternalPort"]))
+		if err != nil {
+			writeSOAPError(w, upnpErrInvalidArgs, "Invalid Args")
+			return
+		}
+		m, ok := findPortMapping(strings.ToLower(strings.TrimSpace(args["NewProtocol"])), externalPort)
+		if !ok {
+			upnpMappingError(w, errPortMappingNotFound)
+			return
+		}
+		writeSOAPResponse(w, service, action, upnpMappingArgs(m, false))
+
+	case "GetGenericPortMappingEntry":
+		index, err := strconv.Atoi(strings.TrimSpace(args["NewPortMappingIndex"]))
+		mappings := listPortMappings()
+		if err != nil || index < 0 || index >= len(mappings) {
+			writeSOAPError(w, upnpErrArrayIndex, "SpecifiedArrayIndexInvalid")
+			return
+		}
+		writeSOAPResponse(w, service, action, upnpMappingArgs(mappings[index], true))
+
+	default:
+		writeSOAPError(w, upnpErrInvalidAction, "Invalid Action")
+	}
+}
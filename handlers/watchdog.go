@@ -2,48 +2,34 @@ package handlers
 
 import (
 	"fmt"
-	"log"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"strings"
 )
 
-func enableHealthWatch() error {
-	scripts := map[string]string{
-		"router-health-check.sh":  "/usr/local/bin/router-health-check.sh",
-		"router-health-watch.sh":  "/usr/local/bin/router-health-watch.sh",
-		"router-watchdog-test.sh": "/usr/local/bin/router-watchdog-test.sh",
-	}
-	srcDir := ScriptsDir()
-
-	for name, dest := range scripts {
-		data, err := os.ReadFile(filepath.Join(srcDir, name))
-		if err != nil {
-			return err
-		}
-		if err := os.WriteFile(dest, data, 0755); err != nil {
-			return err
-		}
-	}
-
-	serviceSrc := findConfigFile("tailscale-router-health-watch.service")
-	if serviceSrc == "" {
-		log.Println("Health watch service file not found, skipping")
-		return nil
-	}
+const legacyHealthWatchUnit = "tailscale-router-health-watch.service"
 
-	data, err := os.ReadFile(serviceSrc)
+// enableHealthWatch installs the watchdog test script and retires the old shell
+// health watcher; probes and remediation now run in the daemon (see health.go).
+func enableHealthWatch() error {
+	data, err := os.ReadFile(filepath.Join(ScriptsDir(), "router-watchdog-test.sh"))
 	if err != nil {
 		return err
 	}
-	if err := os.WriteFile("/etc/systemd/system/tailscale-router-health-watch.service", data, 0644); err != nil {
+	if err := os.WriteFile("/usr/local/bin/router-watchdog-test.sh", data, 0755); err != nil {
 		return err
 	}
 
-	exec.Command("systemctl", "daemon-reload").Run()
-	exec.Command("systemctl", "enable", "tailscale-router-health-watch.service").Run()
-	return exec.Command("systemctl", "restart", "tailscale-router-health-watch.service").Run()
+	unitPath := "/etc/systemd/system/" + legacyHealthWatchUnit
+	if _, err := os.Stat(unitPath); err == nil {
+		exec.Command("systemctl", "disable", "--now", legacyHealthWatchUnit).Run()
+		os.Remove(unitPath)
+		exec.Command("systemctl", "daemon-reload").Run()
+	}
+	os.Remove("/usr/local/bin/router-health-check.sh")
+	os.Remove("/usr/local/bin/router-health-watch.sh")
+	return nil
 }
 
 // enableHardwareWatchdog configures the Pi hardware watchdog when available.
@@ -53,14 +39,14 @@ func enableHardwareWatchdog() string {
 	appendUniqueBlock("/etc/modules", "bcm2835_wdt", "bcm2835_wdt\n", func() error { return nil })
 
 	if !commandExists("watchdog") {
-		return "watchdog package not installed (optional; software health watch still active)"
+		return "watchdog package not installed (optional; daemon health checks still active)"
 	}
 
 	if _, err := os.Stat("/dev/watchdog"); err != nil {
 		return "no /dev/watchdog on this board (optional hardware watchdog skipped)"
 	}
 
-	// Install lite test script (may already exist from health watch step).
+	// Install lite test script (may already exist from the health watch step).
 	srcDir := ScriptsDir()
 	testSrc := filepath.Join(srcDir, "router-watchdog-test.sh")
 	if data, err := os.ReadFile(testSrc); err == nil {
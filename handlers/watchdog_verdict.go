@@ -0,0 +1,298 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	healthSocketDir   = "/run/tailscale-router"
+	healthSocketPath  = healthSocketDir + "/health.sock"
+	watchdogStateFile = stateDir + "/watchdog.json"
+
+	defaultWatchdogBootGrace    = 5 * time.Minute
+	defaultWatchdogFailureGrace = 3 * time.Minute
+	defaultWatchdogMaxReboots   = 3
+	watchdogQueryTimeout        = 5 * time.Second
+)
+
+// WatchdogConfig tunes when the hardware watchdog may reboot. Zero values use the defaults.
+type WatchdogConfig struct {
+	BootGraceSeconds    int `json:"boot_grace_seconds,omitempty"`
+	FailureGraceSeconds int `json:"failure_grace_seconds,omitempty"`
+	MaxRebootsPerDay    int `json:"max_reboots_per_day,omitempty"`
+}
+
+// watchdogState persists across reboots so the budget survives the reboots it counts.
+type watchdogState struct {
+	Reboots           []time.Time `json:"reboots"`
+	UnreachableSince  time.Time   `json:"daemon_unreachable_since,omitempty"`
+	LastRebootReason  string      `json:"last_reboot_reason,omitempty"`
+	LastBudgetRefusal time.Time   `json:"last_budget_refusal,omitempty"`
+}
+
+// WatchdogStatus is returned by GET /watchdog.
+type WatchdogStatus struct {
+	BootGraceSeconds    int         `json:"boot_grace_seconds"`
+	FailureGraceSeconds int         `json:"failure_grace_seconds"`
+	MaxRebootsPerDay    int         `json:"max_reboots_per_day"`
+	RebootsLastDay      []time.Time `json:"reboots_last_day"`
+	BudgetRemaining     int         `json:"budget_remaining"`
+	LastRebootReason    string      `json:"last_reboot_reason,omitempty"`
+	LastBudgetRefusal   time.Time   `json:"last_budget_refusal,omitempty"`
+}
+
+func (c WatchdogConfig) bootGrace() time.Duration {
+	if c.BootGraceSeconds > 0 {
+		return time.Duration(c.BootGraceSeconds) * time.Second
+	}
+	return defaultWatchdogBootGrace
+}
+
+func (c WatchdogConfig) failureGrace() time.Duration {
+	if c.FailureGraceSeconds > 0 {
+		return time.Duration(c.FailureGraceSeconds) * time.Second
+	}
+	return defaultWatchdogFailureGrace
+}
+
+func (c WatchdogConfig) maxReboots() int {
+	if c.MaxRebootsPerDay > 0 {
+		return c.MaxRebootsPerDay
+	}
+	return defaultWatchdogMaxReboots
+}
+
+func loadWatchdogState() watchdogState {
+	var state watchdogState
+	if data, err := os.ReadFile(watchdogStateFile); err == nil {
+		json.Unmarshal(data, &state)
+	}
+	return state
+}
+
+func saveWatchdogState(state watchdogState) error {
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(stateDir, 0755); err != nil {
+		return err
+	}
+	tmp := watchdogStateFile + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, watchdogStateFile)
+}
+
+// rebootsSince drops budget entries older than cutoff.
+func rebootsSince(reboots []time.Time, cutoff time.Time) []time.Time {
+	var recent []time.Time
+	for _, t := range reboots {
+		if t.After(cutoff) {
+			recent = append(recent, t)
+		}
+	}
+	return recent
+}
+
+func systemUptime() (time.Duration, error) {
+	data, err := os.ReadFile("/proc/uptime")
+	if err != nil {
+		return 0, err
+	}
+	fields := strings.Fields(string(data))
+	if len(fields) == 0 {
+		return 0, fmt.Errorf("unexpected /proc/uptime format")
+	}
+	seconds, err := strconv.ParseFloat(fields[0], 64)
+	if err != nil {
+		return 0, err
+	}
+	return time.Duration(seconds * float64(time.Second)), nil
+}
+
+// ServeHealthSocket exposes the health report to local root processes (the
+// watchdog-test subcommand) without going through dashboard auth.
+func ServeHealthSocket() {
+	if err := os.MkdirAll(healthSocketDir, 0755); err != nil {
+		log.Printf("Health socket: %v", err)
+		return
+	}
+	os.Remove(healthSocketPath)
+	ln, err := net.Listen("unix", healthSocketPath)
+	if err != nil {
+		log.Printf("Health socket: %v", err)
+		return
+	}
+	os.Chmod(healthSocketPath, 0600)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/health", HealthHandler)
+	if err := http.Serve(ln, mux); err != nil {
+		log.Printf("Health socket: %v", err)
+	}
+}
+
+func queryHealthSocket() (HealthReport, error) {
+	client := &http.Client{
+		Timeout: watchdogQueryTimeout,
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", healthSocketPath)
+			},
+		},
+	}
+
+	var report HealthReport
+	resp, err := client.Get("http://unix/health?history=false")
+	if err != nil {
+		return report, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return report, fmt.Errorf("health socket returned %s", resp.Status)
+	}
+	err = json.NewDecoder(resp.Body).Decode(&report)
+	return report, err
+}
+
+// watchdogFailureReason names critical probes that have failed for longer than grace.
+func watchdogFailureReason(report HealthReport, grace time.Duration, now time.Time) string {
+	var failing []string
+	for _, probe := range report.Probes {
+		if !probe.Critical || probe.Status != "failing" || probe.FailingSince.IsZero() {
+			continue
+		}
+		if now.Sub(probe.FailingSince) >= grace {
+			failing = append(failing, fmt.Sprintf("%s (%s)", probe.Name, probe.Error))
+		}
+	}
+	return strings.Join(failing, ", ")
+}
+
+// RunWatchdogTest is the watchdog daemon's test-binary. It returns the exit code:
+// 0 keeps the device running, 1 lets the watchdog reboot it.
+func RunWatchdogTest() int {
+	if !IsConfigured() {
+		return 0
+	}
+	cfg := GetRouterConfig().Watchdog
+	now := time.Now()
+
+	uptime, err := systemUptime()
+	if err != nil {
+		log.Printf("watchdog-test: %v", err)
+		return 0
+	}
+	if uptime < cfg.bootGrace() {
+		return 0
+	}
+	bootTime := now.Add(-uptime)
+
+	state := loadWatchdogState()
+	reason := ""
+	report, err := queryHealthSocket()
+	if err != nil {
+		// The daemon restarts itself; only a long outage (this boot) counts.
+		if state.UnreachableSince.IsZero() || state.UnreachableSince.Before(bootTime) {
+			state.UnreachableSince = now
+			saveWatchdogState(state)
+		}
+		if now.Sub(state.UnreachableSince) >= cfg.failureGrace() {
+			reason = fmt.Sprintf("tailscale-router unreachable since %s: %v", state.UnreachableSince.Format(time.RFC3339), err)
+		}
+	} else {
+		if !state.UnreachableSince.IsZero() {
+			state.UnreachableSince = time.Time{}
+			saveWatchdogState(state)
+		}
+		reason = watchdogFailureReason(report, cfg.failureGrace(), now)
+	}
+	if reason == "" {
+		return 0
+	}
+
+	recent := rebootsSince(state.Reboots, now.Add(-24*time.Hour))
+	if len(recent) > 0 && recent[len(recent)-1].After(bootTime) {
+		// Already counted for this boot; the watchdog is still shutting down.
+		return 1
+	}
+	if len(recent) >= cfg.maxReboots() {
+		log.Printf("watchdog-test: unhealthy (%s) but %d reboots in the last 24h; not rebooting", reason, len(recent))
+		state.Reboots = recent
+		state.LastBudgetRefusal = now
+		saveWatchdogState(state)
+		return 0
+	}
+
+	state.Reboots = append(recent, now)
+	state.LastRebootReason = reason
+	if err := saveWatchdogState(state); err != nil {
+		log.Printf("watchdog-test: could not record reboot: %v", err)
+	}
+	log.Printf("watchdog-test: unhealthy (%s); requesting reboot %d/%d", reason, len(state.Reboots), cfg.maxReboots())
+	return 1
+}
+
+func getWatchdogStatus() WatchdogStatus {
+	cfg := GetRouterConfig().Watchdog
+	state := loadWatchdogState()
+	recent := rebootsSince(state.Reboots, time.Now().Add(-24*time.Hour))
+	if recent == nil {
+		recent = []time.Time{}
+	}
+	remaining := cfg.maxReboots() - len(recent)
+	if remaining < 0 {
+		remaining = 0
+	}
+	return WatchdogStatus{
+		BootGraceSeconds:    int(cfg.bootGrace() / time.Second),
+		FailureGraceSeconds: int(cfg.failureGrace() / time.Second),
+		MaxRebootsPerDay:    cfg.maxReboots(),
+		RebootsLastDay:      recent,
+		BudgetRemaining:     remaining,
+		LastRebootReason:    state.LastRebootReason,
+		LastBudgetRefusal:   state.LastBudgetRefusal,
+	}
+}
+
+// WatchdogHandler reads or updates grace periods and the reboot budget.
+func WatchdogHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		var req WatchdogConfig
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "invalid JSON body", http.StatusBadRequest)
+			return
+		}
+		if req.BootGraceSeconds < 0 || req.FailureGraceSeconds < 0 || req.MaxRebootsPerDay < 0 {
+			http.Error(w, "watchdog settings must not be negative", http.StatusBadRequest)
+			return
+		}
+
+		cfg := GetRouterConfig()
+		cfg.Watchdog = req
+		if err := SaveRouterConfig(cfg); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(getWatchdogStatus())
+}
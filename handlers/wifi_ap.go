@@ -0,0 +1,386 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const (
+	hostapdConfFile   = "/etc/hostapd/tailscale-router.conf"
+	hostapdService    = "tailscale-router-hostapd"
+	hostapdUnitFile   = "/etc/systemd/system/" + hostapdService + ".service"
+	nmUnmanagedConf   = "/etc/NetworkManager/conf.d/tailscale-router-ap.conf"
+	defaultAPChannel  = 6
+	defaultAPSecurity = "wpa2"
+)
+
+// WifiAPConfig drives the hostapd config generated for a wireless LAN interface.
+type WifiAPConfig struct {
+	Enabled    bool   `json:"enabled"`
+	SSID       string `json:"ssid"`
+	Passphrase string `json:"passphrase,omitempty"`
+	Security   string `json:"security"` // wpa2, wpa3 or wpa2-wpa3
+	Channel    int    `json:"channel"`
+	Country    string `json:"country"` // ISO 3166-1 alpha-2, required by the regulatory domain
+	Hidden     bool   `json:"hidden,omitempty"`
+}
+
+// WifiAPStatus is returned by GET /wifi/ap.
+type WifiAPStatus struct {
+	WifiAPConfig
+	Interface     string `json:"interface"`
+	Wireless      bool   `json:"wireless"`
+	ServiceActive bool   `json:"service_active"`
+	Stations      int    `json:"stations"`
+}
+
+var wifi5GHzChannels = map[int]bool{
+	36: true, 40: true, 44: true, 48: true, 52: true, 56: true, 60: true, 64: true,
+	100: true, 104: true, 108: true, 112: true, 116: true, 120: true, 124: true, 128: true,
+	132: true, 136: true, 140: true, 144: true, 149: true, 153: true, 157: true, 161: true, 165: true,
+}
+
+func isWirelessInterface(iface string) bool {
+	if _, err := os.Stat(filepath.Join("/sys/class/net", iface, "wireless")); err == nil {
+		return true
+	}
+	return classifyInterface(iface, "") == "wireless"
+}
+
+func normalizeWifiAPConfig(ap WifiAPConfig) WifiAPConfig {
+	ap.SSID = strings.TrimSpace(ap.SSID)
+	ap.Security = strings.ToLower(strings.TrimSpace(ap.Security))
+	if ap.Security == "" {
+		ap.Security = defaultAPSecurity
+	}
+	ap.Country = strings.ToUpper(strings.TrimSpace(ap.Country))
+	if ap.Channel == 0 {
+		ap.Channel = defaultAPChannel
+	}
+	return ap
+}
+
+// validateWifiAPConfig applies the same limits hostapd enforces when it parses its config.
+func validateWifiAPConfig(ap WifiAPConfig) error {
+	if ap.SSID == "" || len(ap.SSID) > 32 {
+		return fmt.Errorf("SSID must be 1-32 bytes")
+	}
+	if strings.ContainsAny(ap.SSID, "\r\n") {
+		return fmt.Errorf("SSID must not contain line breaks")
+	}
+	switch ap.Security {
+	case "wpa2", "wpa3", "wpa2-wpa3":
+	default:
+		return fmt.Errorf("security must be wpa2, wpa3 or wpa2-wpa3")
+	}
+	if len(ap.Passphrase) < 8 || len(ap.Passphrase) > 63 {
+		return fmt.Errorf("passphrase must be 8-63 characters")
+	}
+	for _, c := range ap.Passphrase {
+		if c < 32 || c > 126 {
+			return fmt.Errorf("passphrase must be printable ASCII")
+		}
+	}
+	if len(ap.Country) != 2 || ap.Country[0] < 'A' || ap.Country[0] > 'Z' || ap.Country[1] < 'A' || ap.Country[1] > 'Z' {
+		return fmt.Errorf("country must be a two-letter code such as DE or US")
+	}
+	if !(ap.Channel >= 1 && ap.Channel <= 13) && !wifi5GHzChannels[ap.Channel] {
+		return fmt.Errorf("channel %d is not a valid 2.4 GHz (1-13) or 5 GHz channel", ap.Channel)
+	}
+	return nil
+}
+
+// renderHostapdConf builds the hostapd config for iface. isolate stops wireless
+// clients from talking to each other, which the iptables rules alone cannot do.
+func renderHostapdConf(iface string, ap WifiAPConfig, isolate bool) string {
+	var b strings.Builder
+	b.WriteString("# Managed by tailscale-raspberry-router\n")
+	fmt.Fprintf(&b, "interface=%s\n", iface)
+	b.WriteString("driver=nl80211\nctrl_interface=/run/hostapd\nctrl_interface_group=0\n")
+	fmt.Fprintf(&b, "ssid=%s\nutf8_ssid=1\n", ap.SSID)
+	fmt.Fprintf(&b, "country_code=%s\nieee80211d=1\n", ap.Country)
+
+	if ap.Channel > 14 {
+		fmt.Fprintf(&b, "hw_mode=a\nchannel=%d\nieee80211n=1\nieee80211ac=1\n", ap.Channel)
+	} else {
+		fmt.Fprintf(&b, "hw_mode=g\nchannel=%d\nieee80211n=1\n", ap.Channel)
+	}
+	b.WriteString("wmm_enabled=1\n")
+	if ap.Hidden {
+		b.WriteString("ignore_broadcast_ssid=1\n")
+	} else {
+		b.WriteString("ignore_broadcast_ssid=0\n")
+	}
+	if isolate {
+		b.WriteString("ap_isolate=1\n")
+	}
+
+	b.WriteString("auth_algs=1\nwpa=2\nrsn_pairwise=CCMP\n")
+	switch ap.Security {
+	case "wpa3":
+		fmt.Fprintf(&b, "wpa_key_mgmt=SAE\nsae_password=%s\nieee80211w=2\n", ap.Passphrase)
+	case "wpa2-wpa3":
+		fmt.Fprintf(&b, "wpa_key_mgmt=WPA-PSK SAE\nwpa_passphrase=%s\nsae_password=%s\nieee80211w=1\nsae_require_mfp=1\n", ap.Passphrase, ap.Passphrase)
+	default:
+		fmt.Fprintf(&b, "wpa_key_mgmt=WPA-PSK\nwpa_passphrase=%s\n", ap.Passphrase)
+	}
+	return b.String()
+}
+
+// checkHostapdConf re-reads a rendered config the way hostapd does (key=value lines,
+// required keys present). hostapd has no test-only flag like dnsmasq --test.
+func checkHostapdConf(conf string) error {
+	values := make(map[string]string)
+	for i, line := range strings.Split(conf, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		eq := strings.Index(line, "=")
+		if eq <= 0 {
+			return fmt.Errorf("hostapd config line %d: invalid line %q", i+1, line)
+		}
+		key := line[:eq]
+		if _, dup := values[key]; dup {
+			return fmt.Errorf("hostapd config line %d: duplicate %s", i+1, key)
+		}
+		values[key] = line[eq+1:]
+	}
+
+	for _, key := range []string{"interface", "ssid", "hw_mode", "channel", "country_code", "wpa", "wpa_key_mgmt"} {
+		if values[key] == "" {
+			return fmt.Errorf("hostapd config: missing %s", key)
+		}
+	}
+	if _, err := strconv.Atoi(values["channel"]); err != nil {
+		return fmt.Errorf("hostapd config: invalid channel %q", values["channel"])
+	}
+	if values["wpa_passphrase"] == "" && values["sae_password"] == "" {
+		return fmt.Errorf("hostapd config: no passphrase")
+	}
+	if strings.Contains(values["wpa_key_mgmt"], "SAE") && values["ieee80211w"] == "" {
+		return fmt.Errorf("hostapd config: SAE requires ieee80211w")
+	}
+	return nil
+}
+
+func ensureHostapdInstalled() error {
+	if commandExists("hostapd") {
+		return nil
+	}
+	if !commandExists("apt-get") {
+		return fmt.Errorf("hostapd is not installed and apt-get is unavailable. Run: apt-get install -y hostapd")
+	}
+
+	log.Println("Bootstrap: installing hostapd package")
+	if out, err := exec.Command("apt-get", "install", "-y", "hostapd").CombinedOutput(); err != nil {
+		return fmt.Errorf("apt-get install hostapd: %v: %s", err, strings.TrimSpace(string(out)))
+	}
+	// The distro unit would fight ours for the interface.
+	exec.Command("systemctl", "disable", "--now", "hostapd").Run()
+	return nil
+}
+
+func renderHostapdUnit(cfg RouterConfig) string {
+	hostapd, err := exec.LookPath("hostapd")
+	if err != nil {
+		hostapd = "/usr/sbin/hostapd"
+	}
+	ip, err := exec.LookPath("ip")
+	if err != nil {
+		ip = "/usr/sbin/ip"
+	}
+	return fmt.Sprintf(`# Managed by tailscale-raspberry-router
+[Unit]
+Description=Tailscale Router Wi-Fi access point (hostapd)
+After=network.target
+Before=dnsmasq.service
+
+[Service]
+Type=simple
+ExecStartPre=-/usr/sbin/rfkill unblock wlan
+ExecStartPre=%s link set %s up
+ExecStartPre=-%s addr replace %s/%d dev %s
+ExecStart=%s %s
+Restart=on-failure
+RestartSec=5
+
+[Install]
+WantedBy=multi-user.target
+`, ip, cfg.LANInterface, ip, cfg.LANAddress, cfg.LANPrefix, cfg.LANInterface, hostapd, hostapdConfFile)
+}
+
+// releaseFromNetworkManager stops NetworkManager from running wpa_supplicant on the AP interface.
+func releaseFromNetworkManager(iface string) error {
+	if !usesNetworkManager() {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(nmUnmanagedConf), 0755); err != nil {
+		return err
+	}
+	conf := fmt.Sprintf("# Managed by tailscale-raspberry-router\n[keyfile]\nunmanaged-devices=interface-name:%s\n", iface)
+	if err := os.WriteFile(nmUnmanagedConf, []byte(conf), 0644); err != nil {
+		return err
+	}
+	exec.Command("nmcli", "general", "reload").Run()
+	exec.Command("nmcli", "device", "set", iface, "managed", "no").Run()
+	return nil
+}
+
+// restoreToNetworkManager undoes releaseFromNetworkManager.
+func restoreToNetworkManager(iface string) error {
+	if err := os.Remove(nmUnmanagedConf); err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	if !usesNetworkManager() {
+		return nil
+	}
+	exec.Command("nmcli", "general", "reload").Run()
+	if iface != "" {
+		exec.Command("nmcli", "device", "set", iface, "managed", "yes").Run()
+	}
+	return nil
+}
+
+// configureWifiAP writes hostapd's config and unit, then (re)starts the managed service.
+func configureWifiAP(cfg RouterConfig) error {
+	ap := cfg.WifiAP
+	if !ap.Enabled {
+		return disableWifiAP(cfg.LANInterface)
+	}
+	if err := validateWifiAPConfig(ap); err != nil {
+		return err
+	}
+	if err := ensureHostapdInstalled(); err != nil {
+		return err
+	}
+
+	segments := LANSegments(cfg)
+	conf := renderHostapdConf(cfg.LANInterface, ap, len(segments) > 0 && segments[0].Guest)
+	if err := checkHostapdConf(conf); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(hostapdConfFile), 0755); err != nil {
+		return err
+	}
+	if err := os.WriteFile(hostapdConfFile, []byte(conf), 0600); err != nil {
+		return err
+	}
+	if err := os.WriteFile(hostapdUnitFile, []byte(renderHostapdUnit(cfg)), 0644); err != nil {
+		return err
+	}
+	if err := releaseFromNetworkManager(cfg.LANInterface); err != nil {
+		return err
+	}
+	exec.Command("iw", "reg", "set", ap.Country).Run()
+
+	exec.Command("systemctl", "daemon-reload").Run()
+	exec.Command("systemctl", "enable", hostapdService).Run()
+	if out, err := exec.Command("systemctl", "restart", hostapdService).CombinedOutput(); err != nil {
+		return fmt.Errorf("systemctl restart %s: %v: %s%s", hostapdService, err, strings.TrimSpace(string(out)), hostapdJournalTail())
+	}
+	return nil
+}
+
+// disableWifiAP stops hostapd and hands the interface back to NetworkManager.
+func disableWifiAP(iface string) error {
+	if _, err := os.Stat(hostapdUnitFile); err != nil {
+		return nil
+	}
+	exec.Command("systemctl", "disable", "--now", hostapdService).Run()
+	return restoreToNetworkManager(iface)
+}
+
+func hostapdJournalTail() string {
+	out, err := exec.Command("journalctl", "-u", hostapdService, "-n", "15", "--no-pager").CombinedOutput()
+	if err != nil {
+		return ""
+	}
+	return "\n--- journalctl -u " + hostapdService + " ---\n" + strings.TrimSpace(string(out))
+}
+
+func countAPStations(iface string) int {
+	out, err := exec.Command("iw", "dev", iface, "station", "dump").Output()
+	if err != nil {
+		return 0
+	}
+	return strings.Count(string(out), "Station ")
+}
+
+func GetWifiAPStatus() WifiAPStatus {
+	cfg := GetRouterConfig()
+	status := WifiAPStatus{
+		WifiAPConfig: cfg.WifiAP,
+		Interface:    cfg.LANInterface,
+		Wireless:     cfg.LANInterface != "" && isWirelessInterface(cfg.LANInterface),
+	}
+	if status.Passphrase != "" {
+		status.Passphrase = "***"
+	}
+	if cfg.WifiAP.Enabled {
+		status.ServiceActive = exec.Command("systemctl", "is-active", "--quiet", hostapdService).Run() == nil
+		status.Stations = countAPStations(cfg.LANInterface)
+	}
+	return status
+}
+
+// WifiAPHandler reads or updates the access point. A passphrase sent as "***" keeps the stored one.
+func WifiAPHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		var req WifiAPConfig
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "invalid JSON body", http.StatusBadRequest)
+			return
+		}
+
+		cfg := GetRouterConfig()
+		if req.Enabled && !isWirelessInterface(cfg.LANInterface) {
+			http.Error(w, fmt.Sprintf("LAN interface %s is not a wireless interface", cfg.LANInterface), http.StatusBadRequest)
+			return
+		}
+		// A wireless LAN only works as an access point: hostapd owns the LAN address,
+		// so turning it off would leave the LAN unreachable.
+		if !req.Enabled && cfg.LANInterface != "" && isWirelessInterface(cfg.LANInterface) {
+			http.Error(w, fmt.Sprintf("LAN interface %s is wireless; the access point cannot be disabled", cfg.LANInterface), http.StatusBadRequest)
+			return
+		}
+		if req.Passphrase == "***" {
+			req.Passphrase = cfg.WifiAP.Passphrase
+		}
+		req = normalizeWifiAPConfig(req)
+		if req.Enabled {
+			if err := validateWifiAPConfig(req); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+
+		cfg.WifiAP = req
+		if err := configureWifiAP(cfg); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if err := SaveRouterConfig(cfg); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(GetWifiAPStatus())
+}
@@ -0,0 +1,708 @@
+package handlers
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// EventWifiJoin is recorded when the wireless WAN is pointed at a network.
+const EventWifiJoin = "wifi_join"
+
+const (
+	wifiClientConnName    = "tailscale-router-wan-wifi"
+	wpaSupplicantConfDir  = "/etc/wpa_supplicant"
+	wifiAssociateTimeout  = 30 * time.Second
+	wifiDHCPTimeout       = 30 * time.Second
+	defaultClientSecurity = "wpa2"
+)
+
+// WifiClientConfig is the network a wireless WAN joins. For WPA2 networks only the
+// derived PSK is stored; the passphrase itself is kept only where SAE needs it (WPA3-only).
+type WifiClientConfig struct {
+	SSID       string `json:"ssid"`
+	Security   string `json:"security"` // open, wpa2, wpa3 or wpa2-wpa3
+	Passphrase string `json:"passphrase,omitempty"`
+	PSK        string `json:"psk,omitempty"` // 64 hex digits, PBKDF2(passphrase, SSID)
+	Hidden     bool   `json:"hidden,omitempty"`
+	Country    string `json:"country,omitempty"`
+}
+
+// WifiNetwork is one scan result.
+type WifiNetwork struct {
+	SSID     string `json:"ssid"`
+	BSSID    string `json:"bssid"`
+	Signal   int    `json:"signal"` // percent, 0-100
+	Security string `json:"security"`
+	Channel  int    `json:"channel"`
+	InUse    bool   `json:"in_use"`
+}
+
+// WifiClientStatus is returned by GET /wifi/client.
+type WifiClientStatus struct {
+	WifiClientConfig
+	Interface string   `json:"interface"`
+	Wireless  bool     `json:"wireless"`
+	Backend   string   `json:"backend"` // networkmanager or wpa_supplicant
+	Connected bool     `json:"connected"`
+	Current   string   `json:"current_ssid,omitempty"`
+	Signal    int      `json:"signal"`
+	IPv4      []string `json:"ipv4"`
+}
+
+func wifiBackend() string {
+	if usesNetworkManager() {
+		return "networkmanager"
+	}
+	return "wpa_supplicant"
+}
+
+func normalizeWifiClientConfig(c WifiClientConfig) WifiClientConfig {
+	c.Security = strings.ToLower(strings.TrimSpace(c.Security))
+	if c.Security == "" {
+		c.Security = defaultClientSecurity
+	}
+	c.Country = strings.ToUpper(strings.TrimSpace(c.Country))
+	return c
+}
+
+func validateWifiClientConfig(c WifiClientConfig) error {
+	if c.SSID == "" || len(c.SSID) > 32 {
+		return fmt.Errorf("SSID must be 1-32 bytes")
+	}
+	if c.Country != "" && (len(c.Country) != 2 || c.Country[0] < 'A' || c.Country[0] > 'Z' || c.Country[1] < 'A' || c.Country[1] > 'Z') {
+		return fmt.Errorf("country must be a two-letter code such as DE or US")
+	}
+	switch c.Security {
+	case "open":
+		return nil
+	case "wpa2", "wpa2-wpa3":
+		if isHexPSK(c.PSK) {
+			return nil
+		}
+	case "wpa3":
+		// SAE derives keys per session and cannot use a precomputed PSK.
+	default:
+		return fmt.Errorf("security must be open, wpa2, wpa3 or wpa2-wpa3")
+	}
+	if len(c.Passphrase) < 8 || len(c.Passphrase) > 63 {
+		return fmt.Errorf("passphrase must be 8-63 characters")
+	}
+	for _, ch := range c.Passphrase {
+		if ch < 32 || ch > 126 {
+			return fmt.Errorf("passphrase must be printable ASCII")
+		}
+	}
+	return nil
+}
+
+func isHexPSK(psk string) bool {
+	if len(psk) != 64 {
+		return false
+	}
+	_, err := hex.DecodeString(psk)
+	return err == nil
+}
+
+// secureWifiClientConfig replaces a WPA2 passphrase with its PSK so config.json never
+// holds the plain text. Call after validation.
+func secureWifiClientConfig(c WifiClientConfig) WifiClientConfig {
+	switch c.Security {
+	case "open":
+		c.Passphrase, c.PSK = "", ""
+	case "wpa3":
+		c.PSK = ""
+	default:
+		if c.Passphrase != "" {
+			c.PSK = wpaPSK(c.Passphrase, c.SSID)
+		}
+		c.Passphrase = ""
+	}
+	return c
+}
+
+// wpaPSK is what wpa_passphrase prints: PBKDF2-HMAC-SHA1, 4096 rounds, 32 bytes.
+func wpaPSK(passphrase, ssid string) string {
+	return hex.EncodeToString(pbkdf2SHA1([]byte(passphrase), []byte(ssid), 4096, 32))
+}
+
+func pbkdf2SHA1(password, salt []byte, iterations, keyLen int) []byte {
+	prf := hmac.New(sha1.New, password)
+	var key []byte
+	for block := uint32(1); len(key) < keyLen; block++ {
+		prf.Reset()
+		prf.Write(salt)
+		var counter [4]byte
+		binary.BigEndian.PutUint32(counter[:], block)
+		prf.Write(counter[:])
+		u := prf.Sum(nil)
+		t := append([]byte(nil), u...)
+		for i := 1; i < iterations; i++ {
+			prf.Reset()
+			prf.Write(u)
+			u = prf.Sum(u[:0])
+			for j := range t {
+				t[j] ^= u[j]
+			}
+		}
+		key = append(key, t...)
+	}
+	return key[:keyLen]
+}
+
+// dBmToPercent uses the same scale as NetworkManager: -100 dBm is 0%, -50 dBm is 100%.
+func dBmToPercent(dbm float64) int {
+	percent := int(2 * (dbm + 100))
+	if percent < 0 {
+		return 0
+	}
+	if percent > 100 {
+		return 100
+	}
+	return percent
+}
+
+// wifiLinkInfo reports the associated SSID and signal of a wireless interface.
+func wifiLinkInfo(iface string) (ssid string, signal int, connected bool) {
+	out, err := exec.Command("iw", "dev", iface, "link").Output()
+	if err != nil || !strings.HasPrefix(strings.TrimSpace(string(out)), "Connected to") {
+		return "", 0, false
+	}
+	for _, line := range strings.Split(string(out), "\n") {
+		line = strings.TrimSpace(line)
+		switch {
+		case strings.HasPrefix(line, "SSID:"):
+			ssid = strings.TrimSpace(strings.TrimPrefix(line, "SSID:"))
+		case strings.HasPrefix(line, "signal:"):
+			fields := strings.Fields(strings.TrimPrefix(line, "signal:"))
+			if len(fields) > 0 {
+				if dbm, err := strconv.ParseFloat(fields[0], 64); err == nil {
+					signal = dBmToPercent(dbm)
+				}
+			}
+		}
+	}
+	return ssid, signal, true
+}
+
+// ScanWifiNetworks lists visible networks on iface, strongest first, one entry per SSID.
+func ScanWifiNetworks(iface string) ([]WifiNetwork, error) {
+	if !isWirelessInterface(iface) {
+		return nil, fmt.Errorf("%s is not a wireless interface", iface)
+	}
+	exec.Command("ip", "link", "set", iface, "up").Run()
+
+	var networks []WifiNetwork
+	var err error
+	if usesNetworkManager() {
+		networks, err = scanWifiNetworkManager(iface)
+	} else {
+		networks, err = scanWifiIW(iface)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	best := make(map[string]WifiNetwork)
+	for _, n := range networks {
+		if n.SSID == "" {
+			continue
+		}
+		prev, seen := best[n.SSID]
+		if !seen || n.InUse || (!prev.InUse && n.Signal > prev.Signal) {
+			best[n.SSID] = n
+		}
+	}
+	result := make([]WifiNetwork, 0, len(best))
+	for _, n := range best {
+		result = append(result, n)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Signal != result[j].Signal {
+			return result[i].Signal > result[j].Signal
+		}
+		return result[i].SSID < result[j].SSID
+	})
+	return result, nil
+}
+
+func scanWifiNetworkManager(iface string) ([]WifiNetwork, error) {
+	out, err := exec.Command("nmcli", "-t", "-f", "IN-USE,SSID,BSSID,SIGNAL,SECURITY,CHAN",
+		"dev", "wifi", "list", "ifname", iface, "--rescan", "yes").CombinedOutput()
+	if err != nil {
+		return nil, fmt.Errorf("nmcli dev wifi list: %v: %s", err, strings.TrimSpace(string(out)))
+	}
+
+	var networks []WifiNetwork
+	for _, line := range strings.Split(string(out), "\n") {
+		fields := splitNmcliTerse(line)
+		if len(fields) < 6 {
+			continue
+		}
+		signal, _ := strconv.Atoi(fields[3])
+		channel, _ := strconv.Atoi(fields[5])
+		networks = append(networks, WifiNetwork{
+			SSID:     fields[1],
+			BSSID:    fields[2],
+			Signal:   signal,
+			Security: wifiSecurityFromFlags(fields[4]),
+			Channel:  channel,
+			InUse:    strings.TrimSpace(fields[0]) == "*",
+		})
+	}
+	return networks, nil
+}
+
+// splitNmcliTerse splits nmcli -t output, where literal colons are escaped as "\:".
+func splitNmcliTerse(line string) []string {
+	var fields []string
+	var cur strings.Builder
+	for i := 0; i < len(line); i++ {
+		switch {
+		case line[i] == '\\' && i+1 < len(line):
+			i++
+			cur.WriteByte(line[i])
+		case line[i] == ':':
+			fields = append(fields, cur.String())
+			cur.Reset()
+		default:
+			cur.WriteByte(line[i])
+		}
+	}
+	if line != "" {
+		fields = append(fields, cur.String())
+	}
+	return fields
+}
+
+// wifiSecurityFromFlags maps nmcli SECURITY or iw authentication suites to our names.
+func wifiSecurityFromFlags(flags string) string {
+	upper := strings.ToUpper(flags)
+	hasSAE := strings.Contains(upper, "WPA3") || strings.Contains(upper, "SAE")
+	hasPSK := strings.Contains(upper, "WPA2") || strings.Contains(upper, "WPA1") || strings.Contains(upper, "PSK")
+	switch {
+	case hasSAE && hasPSK:
+		return "wpa2-wpa3"
+	case hasSAE:
+		return "wpa3"
+	case hasPSK:
+		return "wpa2"
+	case strings.Contains(upper, "WEP"):
+		return "wep"
+	case strings.Contains(upper, "802.1X"):
+		return "enterprise"
+	default:
+		return "open"
+	}
+}
+
+func scanWifiIW(iface string) ([]WifiNetwork, error) {
+	out, err := exec.Command("iw", "dev", iface, "scan").CombinedOutput()
+	if err != nil {
+		return nil, fmt.Errorf("iw dev %s scan: %v: %s", iface, err, strings.TrimSpace(string(out)))
+	}
+	return parseIWScan(string(out)), nil
+}
+
+func parseIWScan(out string) []WifiNetwork {
+	var networks []WifiNetwork
+	var cur *WifiNetwork
+	var auth []string
+	privacy := false
+
+	flush := func() {
+		if cur == nil {
+			return
+		}
+		if len(auth) > 0 {
+			cur.Security = wifiSecurityFromFlags(strings.Join(auth, " "))
+		} else if privacy {
+			cur.Security = "wep"
+		} else {
+			cur.Security = "open"
+		}
+		networks = append(networks, *cur)
+	}
+
+	for _, raw := range strings.Split(out, "\n") {
+		line := strings.TrimSpace(raw)
+		switch {
+		case strings.HasPrefix(raw, "BSS "):
+			flush()
+			bssid := strings.TrimPrefix(raw, "BSS ")
+			if i := strings.IndexAny(bssid, "( "); i > 0 {
+				bssid = bssid[:i]
+			}
+			cur = &WifiNetwork{BSSID: bssid, InUse: strings.Contains(raw, "associated")}
+			auth = nil
+			privacy = false
+		case cur == nil:
+		case strings.HasPrefix(line, "SSID:"):
+			cur.SSID = strings.TrimSpace(strings.TrimPrefix(line, "SSID:"))
+		case strings.HasPrefix(line, "signal:"):
+			fields := strings.Fields(strings.TrimPrefix(line, "signal:"))
+			if len(fields) > 0 {
+				if dbm, err := strconv.ParseFloat(fields[0], 64); err == nil {
+					cur.Signal = dBmToPercent(dbm)
+				}
+			}
+		case strings.HasPrefix(line, "DS Parameter set: channel"):
+			cur.Channel, _ = strconv.Atoi(strings.TrimSpace(strings.TrimPrefix(line, "DS Parameter set: channel")))
+		case strings.HasPrefix(line, "* primary channel:") && cur.Channel == 0:
+			cur.Channel, _ = strconv.Atoi(strings.TrimSpace(strings.TrimPrefix(line, "* primary channel:")))
+		case strings.HasPrefix(line, "* Authentication suites:"):
+			auth = append(auth, strings.TrimPrefix(line, "* Authentication suites:"))
+		case strings.HasPrefix(line, "capability:") && strings.Contains(line, "Privacy"):
+			privacy = true
+		}
+	}
+	flush()
+	return networks
+}
+
+// ConnectWifiClient joins iface to the configured network and waits for an address.
+// Both backends keep retrying on their own after a drop; the wifi_wan probe covers the rest.
+func ConnectWifiClient(iface string, c WifiClientConfig) error {
+	if !isWirelessInterface(iface) {
+		return fmt.Errorf("%s is not a wireless interface", iface)
+	}
+	if err := validateWifiClientConfig(c); err != nil {
+		return err
+	}
+	exec.Command("rfkill", "unblock", "wlan").Run()
+	exec.Command("ip", "link", "set", iface, "up").Run()
+	if c.Country != "" {
+		exec.Command("iw", "reg", "set", c.Country).Run()
+	}
+
+	var err error
+	if usesNetworkManager() {
+		err = connectWifiNetworkManager(iface, c)
+	} else {
+		err = connectWifiSupplicant(iface, c)
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := waitForWifiAssociation(iface, c.SSID); err != nil {
+		return err
+	}
+	deadline := time.Now().Add(wifiDHCPTimeout)
+	for time.Now().Before(deadline) {
+		if ip, _ := getInterfaceIPv4CIDR(iface); ip != "" {
+			log.Printf("Wi-Fi: %s joined %q with %s", iface, c.SSID, ip)
+			return nil
+		}
+		time.Sleep(time.Second)
+	}
+	return fmt.Errorf("%s joined %q but got no DHCP address within %s", iface, c.SSID, wifiDHCPTimeout)
+}
+
+func waitForWifiAssociation(iface, ssid string) error {
+	deadline := time.Now().Add(wifiAssociateTimeout)
+	for time.Now().Before(deadline) {
+		if current, _, ok := wifiLinkInfo(iface); ok && current == ssid {
+			return nil
+		}
+		time.Sleep(time.Second)
+	}
+	return fmt.Errorf("%s did not associate with %q within %s (check the passphrase and signal)", iface, ssid, wifiAssociateTimeout)
+}
+
+// connectWifiNetworkManager creates an autoconnecting profile. NetworkManager keeps
+// the secret in its own root-only keyfile under /etc/NetworkManager/system-connections.
+func connectWifiNetworkManager(iface string, c WifiClientConfig) error {
+	_ = exec.Command("nmcli", "con", "delete", wifiClientConnName).Run()
+
+	args := []string{"con", "add", "type", "wifi",
+		"ifname", iface,
+		"con-name", wifiClientConnName,
+		"ssid", c.SSID,
+		"ipv4.method", "auto",
+		"connection.autoconnect", "yes",
+		"connection.autoconnect-retries", "0",
+		"802-11-wireless.hidden", strconv.FormatBool(c.Hidden),
+	}
+	switch c.Security {
+	case "open":
+	case "wpa3":
+		args = append(args, "wifi-sec.key-mgmt", "sae", "wifi-sec.psk", c.Passphrase)
+	default:
+		psk := c.PSK
+		if psk == "" {
+			psk = wpaPSK(c.Passphrase, c.SSID)
+		}
+		args = append(args, "wifi-sec.key-mgmt", "wpa-psk", "wifi-sec.psk", psk)
+	}
+
+	if out, err := exec.Command("nmcli", args...).CombinedOutput(); err != nil {
+		return fmt.Errorf("nmcli con add: %v: %s", err, strings.TrimSpace(string(out)))
+	}
+	if out, err := exec.Command("nmcli", "--wait", "45", "con", "up", wifiClientConnName).CombinedOutput(); err != nil {
+		return fmt.Errorf("nmcli con up: %v: %s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+func wpaSupplicantConfPath(iface string) string {
+	return filepath.Join(wpaSupplicantConfDir, "wpa_supplicant-"+iface+".conf")
+}
+
+// renderWpaSupplicantConf writes the SSID and SAE password as hex so no quoting or
+// escaping is needed; wpa_supplicant takes a quoted string literally up to its last
+// quote and has no backslash escapes.
+func renderWpaSupplicantConf(c WifiClientConfig) string {
+	var b strings.Builder
+	b.WriteString("# Managed by tailscale-raspberry-router\n")
+	b.WriteString("ctrl_interface=DIR=/run/wpa_supplicant GROUP=netdev\nupdate_config=0\n")
+	if c.Country != "" {
+		fmt.Fprintf(&b, "country=%s\n", c.Country)
+	}
+	b.WriteString("\nnetwork={\n")
+	fmt.Fprintf(&b, "\tssid=%s\n", hex.EncodeToString([]byte(c.SSID)))
+	if c.Hidden {
+		b.WriteString("\tscan_ssid=1\n")
+	}
+	switch c.Security {
+	case "open":
+		b.WriteString("\tkey_mgmt=NONE\n")
+	case "wpa3":
+		fmt.Fprintf(&b, "\tkey_mgmt=SAE\n\tsae_password=%s\n\tieee80211w=2\n", hex.EncodeToString([]byte(c.Passphrase)))
+	default:
+		psk := c.PSK
+		if psk == "" {
+			psk = wpaPSK(c.Passphrase, c.SSID)
+		}
+		fmt.Fprintf(&b, "\tkey_mgmt=WPA-PSK\n\tpsk=%s\n", psk)
+	}
+	b.WriteString("}\n")
+	return b.String()
+}
+
+// connectWifiSupplicant runs wpa_supplicant@<iface>; dhcpcd's hook sees it already
+// running and only handles DHCP.
+func connectWifiSupplicant(iface string, c WifiClientConfig) error {
+	if !commandExists("wpa_supplicant") {
+		return fmt.Errorf("wpa_supplicant is not installed. Run: apt-get install -y wpasupplicant")
+	}
+	if err := os.MkdirAll(wpaSupplicantConfDir, 0755); err != nil {
+		return err
+	}
+	if err := os.WriteFile(wpaSupplicantConfPath(iface), []byte(renderWpaSupplicantConf(c)), 0600); err != nil {
+		return err
+	}
+	// WriteFile keeps the mode of an existing file.
+	if err := os.Chmod(wpaSupplicantConfPath(iface), 0600); err != nil {
+		return err
+	}
+
+	unit := "wpa_supplicant@" + iface
+	exec.Command("systemctl", "enable", unit).Run()
+	if out, err := exec.Command("systemctl", "restart", unit).CombinedOutput(); err != nil {
+		return fmt.Errorf("systemctl restart %s: %v: %s", unit, err, strings.TrimSpace(string(out)))
+	}
+
+	switch {
+	case exec.Command("systemctl", "is-active", "--quiet", "dhcpcd").Run() == nil:
+		exec.Command("dhcpcd", "-n", iface).Run()
+	case commandExists("dhclient"):
+		exec.Command("dhclient", "-nw", iface).Run()
+	}
+	return nil
+}
+
+// reconnectWifiClient nudges the backend when the link stays down.
+func reconnectWifiClient() error {
+	cfg := GetRouterConfig()
+	iface := cfg.WANInterface
+	if usesNetworkManager() {
+		if out, err := exec.Command("nmcli", "--wait", "45", "con", "up", wifiClientConnName).CombinedOutput(); err != nil {
+			return fmt.Errorf("%v: %s", err, strings.TrimSpace(string(out)))
+		}
+		return nil
+	}
+	if exec.Command("wpa_cli", "-i", iface, "reassociate").Run() == nil {
+		if waitForWifiAssociation(iface, cfg.WifiClient.SSID) == nil {
+			return nil
+		}
+	}
+	return restartHealthService("wpa_supplicant@" + iface)
+}
+
+func wifiClientConfigured() bool {
+	if !IsConfigured() {
+		return false
+	}
+	cfg := GetRouterConfig()
+	return cfg.WifiClient.SSID != "" && isWirelessInterface(cfg.WANInterface)
+}
+
+func wifiClientHealthProbe() HealthProbe {
+	return HealthProbe{
+		Name:        "wifi_wan",
+		Description: "Wireless WAN is associated with its network",
+		Interval:    20 * time.Second,
+		Critical:    true,
+		Applies:     wifiClientConfigured,
+		Check: func() (string, error) {
+			cfg := GetRouterConfig()
+			ssid, signal, ok := wifiLinkInfo(cfg.WANInterface)
+			if !ok {
+				return "", fmt.Errorf("%s is not associated", cfg.WANInterface)
+			}
+			if ssid != cfg.WifiClient.SSID {
+				return "", fmt.Errorf("%s is on %q instead of %q", cfg.WANInterface, ssid, cfg.WifiClient.SSID)
+			}
+			return fmt.Sprintf("%s on %q, signal %d%%", cfg.WANInterface, ssid, signal), nil
+		},
+		Remediate: reconnectWifiClient,
+	}
+}
+
+func redactWifiClientConfig(c WifiClientConfig) WifiClientConfig {
+	if c.Passphrase != "" {
+		c.Passphrase = "***"
+	}
+	if c.PSK != "" {
+		c.PSK = "***"
+	}
+	return c
+}
+
+func GetWifiClientStatus() WifiClientStatus {
+	cfg := GetRouterConfig()
+	status := WifiClientStatus{
+		WifiClientConfig: redactWifiClientConfig(cfg.WifiClient),
+		Interface:        cfg.WANInterface,
+		Wireless:         cfg.WANInterface != "" && isWirelessInterface(cfg.WANInterface),
+		Backend:          wifiBackend(),
+	}
+	if status.Wireless {
+		status.Current, status.Signal, status.Connected = wifiLinkInfo(cfg.WANInterface)
+		status.IPv4 = getIPv4ByInterface()[cfg.WANInterface]
+	}
+	return status
+}
+
+// WifiClientHandler reads or changes the network the wireless WAN joins.
+// A passphrase sent as "***" or left empty keeps the stored credential, but only for
+// the same SSID: the stored PSK is derived with the SSID as salt.
+func WifiClientHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		var req WifiClientConfig
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "invalid JSON body", http.StatusBadRequest)
+			return
+		}
+
+		cfg := GetRouterConfig()
+		if !isWirelessInterface(cfg.WANInterface) {
+			http.Error(w, fmt.Sprintf("WAN interface %s is not a wireless interface", cfg.WANInterface), http.StatusBadRequest)
+			return
+		}
+		req = normalizeWifiClientConfig(req)
+		req.PSK = ""
+		if req.SSID == cfg.WifiClient.SSID && (req.Passphrase == "***" || req.Passphrase == "") {
+			req.Passphrase = cfg.WifiClient.Passphrase
+			req.PSK = cfg.WifiClient.PSK
+		} else if req.Passphrase == "***" {
+			http.Error(w, fmt.Sprintf("a passphrase is required to join %q; the stored one belongs to %q", req.SSID, cfg.WifiClient.SSID), http.StatusBadRequest)
+			return
+		}
+		if err := validateWifiClientConfig(req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		req = secureWifiClientConfig(req)
+
+		ev := Event{Type: EventWifiJoin, Actor: requestActor(r), Before: cfg.WifiClient.SSID, After: req.SSID}
+		err := ConnectWifiClient(cfg.WANInterface, req)
+		RecordEvent(eventResult(ev, err))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+
+		// Joining can take minutes; save onto the config as it is now, not as it was.
+		cfg = GetRouterConfig()
+		cfg.WifiClient = req
+		if err := SaveRouterConfig(cfg); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(GetWifiClientStatus())
+}
+
+// WifiScanHandler lists networks visible on a wireless interface.
+// GET /wifi/scan?interface=wlan0 (defaults to the configured WAN).
+func WifiScanHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	iface := strings.TrimSpace(r.URL.Query().Get("interface"))
+	if iface == "" {
+		iface = GetRouterConfig().WANInterface
+	}
+	if !isScannableInterface(iface) {
+		http.Error(w, "Invalid interface: not a wireless interface", http.StatusBadRequest)
+		return
+	}
+
+	networks, err := ScanWifiNetworks(iface)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"interface": iface,
+		"networks":  networks,
+	})
+}
+
+// isScannableInterface accepts only existing wireless interfaces, before anything
+// runs "ip link set <iface> up" on them.
+func isScannableInterface(iface string) bool {
+	if iface == "" {
+		return false
+	}
+	if _, err := net.InterfaceByName(iface); err != nil {
+		return false
+	}
+	return isWirelessInterface(iface)
+}
+
+// SetupWifiScanHandler exposes scanning to the unauthenticated wizard until setup
+// completes. WifiScanHandler's isScannableInterface check applies here as well.
+func SetupWifiScanHandler(w http.ResponseWriter, r *http.Request) {
+	if IsConfigured() {
+		http.Error(w, "Router is already configured", http.StatusConflict)
+		return
+	}
+	WifiScanHandler(w, r)
+}
@@ -16,11 +16,26 @@ func checkRootPrivileges() {
 }
 
 func main() {
+	// A speed test endpoint for another machine; needs no root and no router state.
+	if len(os.Args) > 1 && os.Args[1] == "speedtest-server" {
+		addr := ":8080"
+		if len(os.Args) > 2 {
+			addr = os.Args[2]
+		}
+		log.Fatal(handlers.RunSpeedTestServer(addr))
+	}
+
 	checkRootPrivileges()
 
+	// Run by the hardware watchdog as its test-binary (via router-watchdog-test.sh).
+	if len(os.Args) > 1 && os.Args[1] == "watchdog-test" {
+		os.Exit(handlers.RunWatchdogTest())
+	}
+
 	http.HandleFunc("/setup", handlers.SetupPageHandler)
 	http.HandleFunc("/setup/status", handlers.SetupStatusHandler)
 	http.HandleFunc("/setup/apply", handlers.SetupApplyHandler)
+	http.HandleFunc("/setup/wifi/scan", handlers.SetupWifiScanHandler)
 
 	http.HandleFunc("/login", handlers.LoginHandler)
 	http.HandleFunc("/logout", handlers.LogoutHandler)
@@ -34,7 +49,6 @@ func main() {
 	http.HandleFunc("/styles.css", serveStatic("styles.css"))
 	http.HandleFunc("/script.js", serveStatic("script.js"))
 	http.HandleFunc("/setup.js", serveStatic("setup.js"))
-	http.HandleFunc("/friendly-names.json", serveStatic("friendly-names.json"))
 
 	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		if !handlers.IsConfigured() {
@@ -50,10 +64,44 @@ func main() {
 		})(w, r)
 	})
 
+	// Session or bearer token; Prometheus cannot log in.
+	http.HandleFunc("/metrics", handlers.MetricsHandler)
 	http.HandleFunc("/status", handlers.RequireAuth(handlers.StatusHandler))
 	http.HandleFunc("/set-mode", handlers.RequireAuth(handlers.SetModeHandler))
+	http.HandleFunc("/subnet-router", handlers.RequireAuth(handlers.SubnetRouterHandler))
+	http.HandleFunc("/exit-node-server", handlers.RequireAuth(handlers.ExitNodeServerHandler))
+	http.HandleFunc("/exit-nodes", handlers.RequireAuth(handlers.ExitNodesHandler))
+	http.HandleFunc("/exit-nodes/latency", handlers.RequireAuth(handlers.ExitNodeLatencyHandler))
+	http.HandleFunc("/exit-nodes/name", handlers.RequireAuth(handlers.ExitNodeNameHandler))
+	http.HandleFunc("/exit-nodes/favorite", handlers.RequireAuth(handlers.ExitNodeFavoriteHandler))
+	http.HandleFunc("/schedule", handlers.RequireAuth(handlers.ScheduleHandler))
+	http.HandleFunc("/wan", handlers.RequireAuth(handlers.WANHandler))
+	http.HandleFunc("/lan/segments", handlers.RequireAuth(handlers.LANSegmentsHandler))
+	http.HandleFunc("/guest", handlers.RequireAuth(handlers.GuestHandler))
+	http.HandleFunc("/guest/revoke", handlers.RequireAuth(handlers.GuestRevokeHandler))
+	http.HandleFunc("/wifi/ap", handlers.RequireAuth(handlers.WifiAPHandler))
+	http.HandleFunc("/wifi/client", handlers.RequireAuth(handlers.WifiClientHandler))
+	http.HandleFunc("/wifi/scan", handlers.RequireAuth(handlers.WifiScanHandler))
+	http.HandleFunc("/port-forwards", handlers.RequireAuth(handlers.PortForwardsHandler))
+	http.HandleFunc("/port-mapping", handlers.RequireAuth(handlers.PortMappingHandler))
+	http.HandleFunc("/firewall", handlers.RequireAuth(handlers.FirewallHandler))
+	http.HandleFunc("/sqm", handlers.RequireAuth(handlers.SQMHandler))
+	http.HandleFunc("/mtu", handlers.RequireAuth(handlers.MTUHandler))
+	http.HandleFunc("/mtu/probe", handlers.RequireAuth(handlers.MTUProbeHandler))
+	http.HandleFunc("/speedtest", handlers.RequireAuth(handlers.SpeedTestHandler))
+	http.HandleFunc("/speedtest/run", handlers.RequireAuth(handlers.SpeedTestRunHandler))
+	http.HandleFunc("/split-tunnel", handlers.RequireAuth(handlers.SplitTunnelHandler))
+	http.HandleFunc("/clients/traffic", handlers.RequireAuth(handlers.ClientTrafficHandler))
+	http.HandleFunc("/events", handlers.RequireAuth(handlers.EventsHandler))
+	http.HandleFunc("/notifications", handlers.RequireAuth(handlers.NotificationsHandler))
+	http.HandleFunc("/notifications/test", handlers.RequireAuth(handlers.NotificationTestHandler))
+	http.HandleFunc("/health", handlers.RequireAuth(handlers.HealthHandler))
+	http.HandleFunc("/health/run", handlers.RequireAuth(handlers.HealthRunHandler))
+	http.HandleFunc("/watchdog", handlers.RequireAuth(handlers.WatchdogHandler))
+	http.HandleFunc("/diagnostics", handlers.RequireAuth(handlers.DiagnosticsHandler))
 	http.HandleFunc("/diagnostics/run", handlers.RequireAuth(handlers.DiagnosticsRunHandler))
 	http.HandleFunc("/diagnostics/repair", handlers.RequireAuth(handlers.DiagnosticsRepairHandler))
+	http.HandleFunc("/support-bundle", handlers.RequireAuth(handlers.SupportBundleHandler))
 
 	go func() {
 		log.Println("Starting server on :5000")
@@ -73,8 +121,29 @@ func main() {
 		log.Printf("Warning: IP forwarding: %v", err)
 	}
 
+	// Probes that need a configured router skip themselves until setup completes.
+	go handlers.RunHealthChecks()
+	go handlers.ServeHealthSocket()
+
 	if handlers.IsConfigured() {
-		go handlers.RestorePreviousMode()
+		go func() {
+			// VLAN links must exist before forwarding rules name them.
+			handlers.EnsureLANSegments()
+			handlers.EnsurePortForwards()
+			handlers.EnsureFirewallPolicy()
+			handlers.RestorePreviousMode()
+			// Start after restore so caught-up scheduled changes win over the saved mode.
+			handlers.RunScheduler()
+		}()
+		go handlers.RunForwardGuard()
+		go handlers.RunAutoExitNodeLoop()
+		go handlers.RunWANFailover()
+		go handlers.RunTrafficAccounting()
+		go handlers.RunNotificationMonitor()
+		go handlers.RunGuestPortal()
+		go handlers.RunPortMapping()
+		go handlers.RunFirewallSchedule()
+		go handlers.RunMTUProbes()
 	} else {
 		log.Println("Skipping mode restore until first-time setup completes")
 	}
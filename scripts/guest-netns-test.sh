@@ -0,0 +1,159 @@
+#!/bin/sh
+# Exercise the guest network from a throwaway network namespace on the router itself.
+#
+#   sudo ./scripts/guest-netns-test.sh setup     # veth pair + namespace, prints the segment to add
+#   sudo ./scripts/guest-netns-test.sh check     # run the guest checks from inside the namespace
+#   sudo ./scripts/guest-netns-test.sh check-exit # the same with an exit node in use
+#   sudo ./scripts/guest-netns-test.sh teardown  # remove the namespace and veth pair
+#
+# After setup, add the printed segment to POST /lan/segments (keep your existing
+# segments in the list), then run check. Select an exit node on the dashboard and
+# run check-exit to repeat the checks through tailscale0. Every check gives the
+# namespace a fresh MAC, so it starts out unaccepted. Exit 0 = all checks passed.
+set -eu
+
+NS="tsr-guest"
+HOST_IF="tsr-guest0"
+NS_IF="tsr-guest1"
+SUBNET_PREFIX="${GUEST_TEST_SUBNET:-10.99.0}"
+ROUTER_IP="$SUBNET_PREFIX.1"
+CLIENT_IP="$SUBNET_PREFIX.50"
+PORTAL_PORT=5001
+FAIL=0
+
+pass() { echo "OK   $1"; }
+fail() { echo "FAIL $1"; FAIL=1; }
+
+in_ns() { ip netns exec "$NS" "$@"; }
+
+setup() {
+	if ip netns list | grep -qw "$NS"; then
+		echo "namespace $NS already exists; run teardown first" >&2
+		exit 1
+	fi
+	ip netns add "$NS"
+	ip link add "$HOST_IF" type veth peer name "$NS_IF"
+	ip link set "$NS_IF" netns "$NS"
+	ip link set "$HOST_IF" up
+	in_ns ip link set lo up
+	in_ns ip addr add "$CLIENT_IP/24" dev "$NS_IF"
+	in_ns ip link set "$NS_IF" up
+	in_ns ip route add default via "$ROUTER_IP"
+	mkdir -p "/etc/netns/$NS"
+	echo "nameserver $ROUTER_IP" > "/etc/netns/$NS/resolv.conf"
+
+	cat <<EOF
+Namespace $NS is ready ($CLIENT_IP behind $HOST_IF). Add this segment to POST /lan/segments:
+
+  {"name": "guesttest", "interface": "$HOST_IF", "address": "$ROUTER_IP", "prefix": 24,
+   "dhcp_range_start": "$SUBNET_PREFIX.100", "dhcp_range_end": "$SUBNET_PREFIX.150",
+   "guest": true, "download_kbps": 2000, "upload_kbps": 1000}
+EOF
+}
+
+# exit_node_active is true while tailscale routes this node's traffic through an exit node.
+exit_node_active() {
+	tailscale status --json 2>/dev/null | grep -q '"ExitNodeStatus"'
+}
+
+check() {
+	mode="${1:-direct}"
+	if ! ip netns list | grep -qw "$NS"; then
+		echo "namespace $NS does not exist; run setup first" >&2
+		exit 1
+	fi
+	if [ "$mode" = "exit" ] && ! exit_node_active; then
+		echo "no exit node in use; select one on the dashboard first" >&2
+		exit 1
+	fi
+	if [ "$mode" = "direct" ] && exit_node_active; then
+		echo "an exit node is in use; run check-exit instead" >&2
+		exit 1
+	fi
+	lan_ip="$(ip -4 -o addr show scope global | awk -v ns="$HOST_IF" '$2 != ns {split($4, a, "/"); print a[1]; exit}')"
+
+	# A fresh locally administered MAC, so the namespace has not accepted the terms yet.
+	mac="$(od -An -N5 -tx1 /dev/urandom | tr -s ' ' ':' | sed 's/^:/02:/')"
+	in_ns ip link set "$NS_IF" address "$mac"
+	ip neigh flush dev "$HOST_IF" >/dev/null 2>&1 || true
+
+	echo "=== guest network checks ($mode) from $NS ($CLIENT_IP, $mac) ==="
+	in_ns ip neigh flush all >/dev/null 2>&1 || true
+
+	first="$(iptables -S FORWARD | grep -m 1 '^-A FORWARD')"
+	if [ "$first" = "-A FORWARD -j TS-ROUTER-GUARD" ]; then
+		pass "TS-ROUTER-GUARD is the first FORWARD rule"
+	else
+		fail "first FORWARD rule is '$first', not the TS-ROUTER-GUARD jump"
+	fi
+
+	if in_ns curl -s -m 3 -o /dev/null "http://$ROUTER_IP:5000/"; then
+		fail "management port 5000 reachable on $ROUTER_IP"
+	else
+		pass "management port 5000 blocked on $ROUTER_IP"
+	fi
+	if [ -n "$lan_ip" ] && in_ns curl -s -m 3 -o /dev/null "http://$lan_ip:5000/"; then
+		fail "management port 5000 reachable on $lan_ip"
+	else
+		pass "management port 5000 blocked on the other router addresses"
+	fi
+
+	if in_ns curl -s -m 5 "http://example.com/" | grep -q 'name="accept"'; then
+		pass "web request redirected to the portal before accepting"
+	else
+		fail "web request was not redirected to the portal"
+	fi
+	if in_ns ping -c 1 -W 2 1.1.1.1 >/dev/null 2>&1; then
+		fail "internet reachable before accepting"
+	else
+		pass "internet blocked before accepting"
+	fi
+
+	if in_ns curl -s -m 5 -d accept=1 "http://$ROUTER_IP:$PORTAL_PORT/accept" | grep -q "You are connected"; then
+		pass "terms accepted"
+	else
+		fail "accepting the terms failed"
+	fi
+
+	if in_ns ping -c 1 -W 2 1.1.1.1 >/dev/null 2>&1; then
+		pass "internet reachable after accepting"
+	else
+		fail "internet still blocked after accepting"
+	fi
+	if in_ns ping -c 1 -W 2 100.100.100.100 >/dev/null 2>&1; then
+		fail "tailnet address 100.100.100.100 reachable"
+	else
+		pass "tailnet addresses blocked"
+	fi
+	if in_ns curl -s -m 3 -o /dev/null "http://$ROUTER_IP:5000/"; then
+		fail "management port 5000 reachable after accepting"
+	else
+		pass "management port 5000 still blocked after accepting"
+	fi
+
+	echo
+	if [ "$FAIL" -eq 0 ]; then
+		echo "All guest checks passed."
+	else
+		echo "Some guest checks failed."
+	fi
+	exit "$FAIL"
+}
+
+teardown() {
+	ip netns del "$NS" 2>/dev/null || true
+	ip link del "$HOST_IF" 2>/dev/null || true
+	rm -rf "/etc/netns/$NS"
+	echo "Removed $NS. Drop the guesttest segment from POST /lan/segments as well."
+}
+
+case "${1:-}" in
+setup) setup ;;
+check) check direct ;;
+check-exit) check exit ;;
+teardown) teardown ;;
+*)
+	echo "usage: $0 setup|check|check-exit|teardown" >&2
+	exit 2
+	;;
+esac
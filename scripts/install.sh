@@ -42,7 +42,7 @@ install_app_files() {
 
 install_helper_scripts() {
 	log "Installing helper scripts"
-	for script in update-dns.sh tailscale-dns-watch.sh router-health-check.sh router-health-watch.sh router-watchdog-test.sh bootstrap-verify.sh; do
+	for script in update-dns.sh tailscale-dns-watch.sh router-watchdog-test.sh bootstrap-verify.sh; do
 		install -m 755 "$REPO_DIR/scripts/$script" "/usr/local/bin/$script"
 	done
 }
@@ -50,16 +50,15 @@ install_helper_scripts() {
 install_systemd() {
 	log "Installing systemd services"
 	cp "$REPO_DIR/configs/tailscale-router.service" /etc/systemd/system/tailscale-router.service
-	if [ -f "$REPO_DIR/configs/tailscale-router-health-watch.service" ]; then
-		cp "$REPO_DIR/configs/tailscale-router-health-watch.service" /etc/systemd/system/
+	# Health checks run inside the daemon now; retire the old shell watcher.
+	if [ -f /etc/systemd/system/tailscale-router-health-watch.service ]; then
+		systemctl disable --now tailscale-router-health-watch.service 2>/dev/null || true
+		rm -f /etc/systemd/system/tailscale-router-health-watch.service
 	fi
+	rm -f /usr/local/bin/router-health-check.sh /usr/local/bin/router-health-watch.sh
 	systemctl daemon-reload
 	systemctl enable tailscale-router.service
 	systemctl restart tailscale-router.service
-	if systemctl list-unit-files tailscale-router-health-watch.service >/dev/null 2>&1; then
-		systemctl enable tailscale-router-health-watch.service
-		systemctl restart tailscale-router-health-watch.service
-	fi
 }
 
 print_access_help() {
@@ -1,28 +1,12 @@
 #!/bin/sh
-# Read-only health ping for the hardware watchdog daemon.
-# Must not restart services or change sysctl (watchdog runs this unprivileged).
-set -eu
+# Test-binary for the hardware watchdog daemon. The verdict comes from the
+# tailscale-router health checks (grace periods and reboot budget included);
+# this wrapper exists because watchdog.conf cannot pass arguments.
+BIN="/opt/tailscale-raspberry-router/tailscale-raspberry-router"
 
-CONFIG="/etc/tailscale-router/config.json"
-
-configured() {
-	[ -f "$CONFIG" ] && grep -q '"configured"[[:space:]]*:[[:space:]]*true' "$CONFIG"
-}
-
-running() {
-	if systemctl is-active --quiet "$1" 2>/dev/null; then
-		return 0
-	fi
-	pgrep -x "$1" >/dev/null 2>&1
-}
-
-if configured; then
-	running tailscale-router || exit 1
-	running tailscaled || exit 1
-	running dnsmasq || exit 1
-	ip route show default 2>/dev/null | grep -q . || exit 1
-else
-	running tailscale-router || exit 1
+if [ -x "$BIN" ]; then
+	exec "$BIN" watchdog-test
 fi
 
-exit 0
+# No daemon binary: only require the service itself.
+systemctl is-active --quiet tailscale-router
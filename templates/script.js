@@ -1,39 +1,10 @@
 const itemsPerPage = 10;
 let currentPage = 1;
 let exitNodes = [];
-let friendlyNames = {}; // Store friendly names
+let exitNodesById = {}; // From /status, keyed by stable node ID
 
-// Utility function to fetch friendly names
-function getFriendlyName(node) {
-  if (!node) return "Unknown"; // Fallback if null or undefined
-  let cleanNode = node
-    .trim()
-    .toLowerCase()
-    .replace(/\s*\(.*?\)\s*$/, "");
-  return friendlyNames[cleanNode] || node;
-}
-
-// Fetch friendly names JSON
-async function loadFriendlyNames() {
-  try {
-    const response = await fetch("/friendly-names.json");
-    if (!response.ok) throw new Error("Failed to load friendly names");
-
-    const data = await response.json();
-
-    // Normalize and clean up keys
-    friendlyNames = Object.fromEntries(
-      Object.entries(data).map(([key, value]) => [
-        key
-          .trim()
-          .toLowerCase()
-          .replace(/\s*\(.*?\)\s*$/, ""),
-        value,
-      ])
-    );
-  } catch (error) {
-    console.error("Error loading friendly names:", error);
-  }
+function nodeLabel(id) {
+  return exitNodesById[id]?.name || id || "";
 }
 
 // Fetch status and update UI
@@ -43,82 +14,149 @@ async function fetchStatus() {
     if (!response.ok) throw new Error("Failed to fetch status");
 
     const data = await response.json();
+    exitNodesById = data.exitNodes || {};
 
-    // Extract raw hostname (remove "tailscale:" prefix if exists)
-    let currentModeRaw = data.mode
-      .replace(/^tailscale:/, "")
-      .trim()
-      .toLowerCase();
-
-    // Remove any location info inside parentheses
-    currentModeRaw = currentModeRaw.replace(/\s*\(.*?\)\s*$/, "");
-
-    // ✅ Properly match with friendly name
-    const currentModeFriendly = friendlyNames[currentModeRaw] || currentModeRaw;
-
-    // ✅ Fix: Display the friendly name correctly in "Current Mode"
-    document.getElementById(
-      "currentMode"
-    ).innerHTML = `<span class="active-node">${currentModeFriendly}</span>`;
-
-    exitNodes = [];
-    let friendlyPrivateNodes = [];
-    let friendlyMullvadNodes = [];
-    let genericNodes = [];
-
-    // Categorize nodes, but **exclude offline nodes**
-    Object.entries(data.exitNodes || {}).forEach(([node, details]) => {
-      if (!details?.Active) return; // Skip offline nodes 🚀
-
-      const button = document.createElement("button");
-      let cleanNode = node
-        .trim()
-        .toLowerCase()
-        .replace(/\s*\(.*?\)\s*$/, "");
-      const displayName = friendlyNames[cleanNode] || node;
-
-      button.textContent = `${displayName}`;
-      button.className = node.includes(".mullvad.")
-        ? "exit-node"
-        : "private-node";
-
-      // ✅ Fix: Highlight the currently active node
-      if (cleanNode === currentModeRaw) {
-        button.classList.add("active-node");
-        button.disabled = true;
-      } else {
-        button.onclick = () => switchMode("tailscale", node);
-      }
+    // Mode is "direct", "tailscale:<node id>" or "tailscale:auto[:filter]"
+    const currentModeRaw = data.mode.replace(/^tailscale:/, "").trim();
+    let activeId = currentModeRaw;
+    let currentModeLabel = data.mode === "direct" ? "direct" : nodeLabel(currentModeRaw);
 
-      // **Prioritize friendly names first**
-      if (friendlyNames[cleanNode]) {
-        if (!node.includes(".mullvad.")) {
-          friendlyPrivateNodes.push(button); // Private (Green)
-        } else {
-          friendlyMullvadNodes.push(button); // Mullvad (Blue)
-        }
-      } else {
-        genericNodes.push(button); // Generic
-      }
-    });
+    // Auto mode: show the filter and the node it picked
+    if (currentModeRaw.startsWith("auto")) {
+      const filter = currentModeRaw.replace(/^auto:?/, "");
+      activeId = data.autoExitNode || "";
+      currentModeLabel = `Best node${filter ? " (" + filter + ")" : ""}: ${
+        nodeLabel(activeId) || "selecting..."
+      }`;
+    }
 
-    // Arrange exit nodes (Private & Friendly on top)
-    exitNodes = [
-      ...friendlyPrivateNodes,
-      "separator",
-      ...friendlyMullvadNodes,
-      "separator",
-      ...genericNodes,
-    ];
+    const modeEl = document.getElementById("currentMode");
+    modeEl.innerHTML = "";
+    const modeSpan = document.createElement("span");
+    modeSpan.className = "active-node";
+    modeSpan.textContent = currentModeLabel;
+    modeEl.appendChild(modeSpan);
 
-    // Render the first page
-    currentPage = 1;
-    renderPage();
+    await loadExitNodeList(activeId);
+
+    renderSubnetRouter(data.subnetRouter);
+    renderExitNodeServer(data.exitNodeServer, data.mode);
+    renderSchedule(data.schedule);
+    renderSplitTunnel(data.splitTunnel);
+    renderWAN(data.wan);
+    loadClientTraffic();
   } catch (error) {
     console.error("Error fetching status:", error);
   }
 }
 
+function scheduleModeLabel(mode) {
+  if (mode === "direct") return "direct";
+  const node = mode.replace(/^tailscale:/, "");
+  return node.startsWith("auto") ? "best node" + node.replace(/^auto:?/, " ").trimEnd() : nodeLabel(node) || node;
+}
+
+// Next scheduled change and any manual override holding it off
+function renderSchedule(schedule) {
+  const el = document.getElementById("scheduleStatus");
+  if (!schedule || !schedule.next) {
+    el.hidden = true;
+    return;
+  }
+  const at = new Date(schedule.next.at).toLocaleString();
+  let text = `Next scheduled change: ${scheduleModeLabel(schedule.next.mode)} at ${at}`;
+  if (schedule.next.rule) text += ` (${schedule.next.rule})`;
+  if (schedule.override_until) {
+    text += ` · manual override until ${new Date(schedule.override_until).toLocaleString()}`;
+  }
+  el.textContent = text;
+  el.hidden = false;
+}
+
+// Load online exit nodes, ordered by the server: favorites, private, then Mullvad
+async function loadExitNodeList(activeId) {
+  const search = document.getElementById("nodeSearch").value.trim();
+  const response = await fetch(`/exit-nodes?online=1&q=${encodeURIComponent(search)}`);
+  if (!response.ok) throw new Error("Failed to fetch exit nodes");
+
+  const nodes = await response.json();
+
+  exitNodes = [];
+  let section = "";
+  nodes.forEach((node) => {
+    const nodeSection = node.favorite ? "favorite" : node.provider;
+    if (section && nodeSection !== section) {
+      exitNodes.push("separator");
+    }
+    section = nodeSection;
+    exitNodes.push(renderExitNodeRow(node, activeId));
+  });
+
+  // Render the first page
+  currentPage = 1;
+  renderPage();
+}
+
+function renderExitNodeRow(node, activeId) {
+  const row = document.createElement("div");
+  row.className = "exit-node-row";
+
+  const button = document.createElement("button");
+  const location = node.city ? ` (${node.city}, ${node.country_code})` : "";
+  const latency = node.latency_ms ? ` · ${Math.round(node.latency_ms)} ms` : "";
+  button.textContent = `${node.name}${location}${latency}`;
+  button.className = node.provider === "mullvad" ? "exit-node" : "private-node";
+
+  // Highlight the currently active node
+  if (node.id === activeId) {
+    button.classList.add("active-node");
+    button.disabled = true;
+  } else {
+    button.onclick = () => switchMode("tailscale", node.id, node.name);
+  }
+
+  const star = document.createElement("button");
+  star.className = "node-action";
+  star.textContent = node.favorite ? "★" : "☆";
+  star.title = node.favorite ? "Remove from favorites" : "Add to favorites";
+  star.onclick = () => setFavorite(node.id, !node.favorite);
+
+  const rename = document.createElement("button");
+  rename.className = "node-action";
+  rename.textContent = "✎";
+  rename.title = "Rename";
+  rename.onclick = () => renameNode(node);
+
+  row.append(button, star, rename);
+  return row;
+}
+
+async function setFavorite(id, favorite) {
+  const response = await fetch(
+    `/exit-nodes/favorite?id=${encodeURIComponent(id)}&favorite=${favorite}`,
+    { method: "POST" }
+  );
+  if (!response.ok) {
+    showNotification("Could not update favorites");
+  }
+  fetchStatus();
+}
+
+async function renameNode(node) {
+  const name = prompt(`Friendly name for ${node.dns_name || node.hostname} (empty to reset)`, node.name);
+  if (name === null) {
+    return;
+  }
+  const response = await fetch(
+    `/exit-nodes/name?id=${encodeURIComponent(node.id)}&name=${encodeURIComponent(name.trim())}`,
+    { method: "POST" }
+  );
+  if (!response.ok) {
+    showNotification("Could not rename exit node");
+  }
+  fetchStatus();
+}
+
 // Render paginated exit nodes
 function renderPage() {
   const nodeList = document.getElementById("exitNodesList");
@@ -181,14 +219,14 @@ function showNotification(message) {
 }
 
 // Switch mode and notify
-async function switchMode(mode, node = "") {
+async function switchMode(mode, node = "", label = "") {
   let url = `/set-mode?mode=${mode}`;
   if (mode === "tailscale") {
-    url += `&node=${node}`;
+    url += `&node=${encodeURIComponent(node)}`;
   }
   try {
     await fetch(url, { method: "POST" });
-    const displayName = getFriendlyName(node);
+    const displayName = label || nodeLabel(node);
     showNotification(
       `Switched to ${mode} ${displayName ? "(" + displayName + ")" : ""}`
     );
@@ -199,11 +237,972 @@ async function switchMode(mode, node = "") {
   }
 }
 
-// Load friendly names first, then fetch status
+// Ping every online exit node and refresh the list with latencies
+async function measureLatency() {
+  const btn = document.getElementById("measureLatencyBtn");
+  btn.disabled = true;
+  btn.textContent = "Measuring...";
+  try {
+    const response = await fetch("/exit-nodes/latency", { method: "POST" });
+    if (!response.ok) {
+      throw new Error((await response.text()) || "Latency probe failed");
+    }
+    await fetchStatus();
+  } catch (error) {
+    showNotification(error.message);
+  } finally {
+    btn.disabled = false;
+    btn.textContent = "Measure Latency";
+  }
+}
+
+function useBestNode() {
+  const filter = document.getElementById("autoFilter").value.trim();
+  switchMode("tailscale", filter ? `auto:${filter}` : "auto");
+}
+
+let subnetRouterEnabled = false;
+
+// Describe an advertised route and its admin-console approval state
+function describeAdvertisedRoute(status, label) {
+  if (!status?.enabled) {
+    return "Disabled";
+  }
+  if (!status.advertised) {
+    return `${label} enabled, not yet advertised`;
+  }
+  if (!status.approved) {
+    const pending = (status.routes || []).filter((r) => !r.approved).map((r) => r.route);
+    if (pending.length && pending.length < status.routes.length) {
+      return `${label} advertised, ${pending.join(", ")} awaiting approval in the Tailscale admin console`;
+    }
+    return `${label} advertised, awaiting approval in the Tailscale admin console`;
+  }
+  return `${label} advertised and approved`;
+}
+
+function renderSubnetRouter(status) {
+  subnetRouterEnabled = !!status?.enabled;
+  document.getElementById("subnetRouterStatus").textContent =
+    describeAdvertisedRoute(status, status?.route || "LAN");
+  document.getElementById("subnetRouterBtn").textContent = subnetRouterEnabled
+    ? "Stop Advertising LAN"
+    : "Advertise LAN";
+}
+
+async function toggleSubnetRouter() {
+  const btn = document.getElementById("subnetRouterBtn");
+  btn.disabled = true;
+  try {
+    const response = await fetch(`/subnet-router?enabled=${!subnetRouterEnabled}`, {
+      method: "POST",
+    });
+    if (!response.ok) {
+      throw new Error((await response.text()) || "Subnet router update failed");
+    }
+    renderSubnetRouter(await response.json());
+    showNotification(subnetRouterEnabled ? "LAN advertised to tailnet" : "LAN no longer advertised");
+  } catch (error) {
+    showNotification(error.message);
+  } finally {
+    btn.disabled = false;
+  }
+}
+
+let exitNodeServerEnabled = false;
+
+function renderExitNodeServer(status, mode) {
+  exitNodeServerEnabled = !!status?.enabled;
+  document.getElementById("exitNodeServerStatus").textContent =
+    describeAdvertisedRoute(status, "Exit node");
+  const btn = document.getElementById("exitNodeServerBtn");
+  btn.textContent = exitNodeServerEnabled ? "Stop Offering Exit Node" : "Offer as Exit Node";
+  // Tailscale cannot advertise an exit node while using one
+  btn.disabled = !exitNodeServerEnabled && mode !== "direct";
+}
+
+async function toggleExitNodeServer() {
+  const btn = document.getElementById("exitNodeServerBtn");
+  btn.disabled = true;
+  try {
+    const response = await fetch(`/exit-node-server?enabled=${!exitNodeServerEnabled}`, {
+      method: "POST",
+    });
+    if (!response.ok) {
+      throw new Error((await response.text()) || "Exit node update failed");
+    }
+    showNotification(exitNodeServerEnabled ? "No longer offered as exit node" : "Offered as exit node");
+  } catch (error) {
+    showNotification(error.message);
+  } finally {
+    fetchStatus();
+  }
+}
+
+function formatBytes(bytes) {
+  const units = ["B", "KB", "MB", "GB", "TB"];
+  let i = 0;
+  while (bytes >= 1024 && i < units.length - 1) {
+    bytes /= 1024;
+    i++;
+  }
+  return `${bytes.toFixed(i ? 1 : 0)} ${units[i]}`;
+}
+
+// Busiest clients first (server-sorted by current rate)
+async function loadClientTraffic() {
+  const el = document.getElementById("clientTraffic");
+  try {
+    const response = await fetch("/clients/traffic");
+    if (!response.ok) throw new Error("Failed to load client traffic");
+    const clients = await response.json();
+    if (!clients.length) {
+      el.textContent = "No LAN clients seen yet";
+      return;
+    }
+
+    const table = document.createElement("table");
+    table.className = "traffic-table";
+    table.innerHTML =
+      "<tr><th>Client</th><th>WAN ↓/↑ per s</th><th>Exit node ↓/↑ per s</th><th>Today</th><th>Month</th></tr>";
+    for (const c of clients.slice(0, 10)) {
+      const sum = (t) => t.wan_down + t.wan_up + t.tailscale_down + t.tailscale_up;
+      const row = document.createElement("tr");
+      [
+        c.hostname ? `${c.hostname} (${c.ip})` : c.ip,
+        `${formatBytes(c.rate.wan_down)} / ${formatBytes(c.rate.wan_up)}`,
+        `${formatBytes(c.rate.tailscale_down)} / ${formatBytes(c.rate.tailscale_up)}`,
+        formatBytes(sum(c.today)),
+        formatBytes(sum(c.month)),
+      ].forEach((text) => {
+        const cell = document.createElement("td");
+        cell.textContent = text;
+        row.appendChild(cell);
+      });
+      table.appendChild(row);
+    }
+    el.innerHTML = "";
+    el.appendChild(table);
+  } catch (error) {
+    el.textContent = error.message;
+  }
+}
+
+// One line per uplink: state, gateway and whether it carries traffic
+function renderWAN(wan) {
+  if (!wan) return;
+  document.getElementById("wanMode").textContent =
+    wan.links.length > 1 ? (wan.mode === "balance" ? "Weighted balancing" : "Failover") : "Single WAN";
+
+  const list = document.getElementById("wanLinks");
+  list.innerHTML = "";
+  wan.links.forEach((link) => {
+    const item = document.createElement("li");
+    let text = `${link.interface}: ${link.healthy ? "healthy" : "down"}`;
+    if (link.gateway) text += ` via ${link.gateway}`;
+    if (wan.mode === "balance" && wan.links.length > 1) text += ` · weight ${link.weight || 1}`;
+    if (link.active) text += " · active";
+    if (link.error) text += ` (${link.error})`;
+    item.textContent = text;
+    list.appendChild(item);
+  });
+}
+
+function renderLANSegments(segments) {
+  const list = document.getElementById("lanSegments");
+  list.innerHTML = "";
+  (segments || []).forEach((segment) => {
+    const item = document.createElement("li");
+    let text = `${segment.name}: ${segment.device} ${segment.cidr} · ${segment.link_up ? "up" : "down"} · internet ${segment.internet}`;
+    if (segment.guest) {
+      text += " · guest";
+      if (segment.download_kbps) text += ` · ↓ ${segment.download_kbps} kbit/s`;
+      if (segment.upload_kbps) text += ` · ↑ ${segment.upload_kbps} kbit/s`;
+    } else if (segment.isolation === "isolated") {
+      text += segment.allow_segments?.length ? ` · isolated (may reach ${segment.allow_segments.join(", ")})` : " · isolated";
+    }
+    item.textContent = text;
+    list.appendChild(item);
+  });
+}
+
+async function loadLANSegments() {
+  try {
+    const response = await fetch("/lan/segments");
+    if (response.ok) renderLANSegments(await response.json());
+  } catch (error) {
+    console.error("Error loading LAN segments:", error);
+  }
+}
+
+function renderGuest(status) {
+  document.getElementById("guestBox").hidden = !status.segments.length;
+  if (!status.segments.length) return;
+
+  document.getElementById("guestTitle").value = status.portal.title;
+  document.getElementById("guestTerms").value = status.portal.terms;
+  document.getElementById("guestSessionHours").value = status.portal.session_hours;
+
+  const list = document.getElementById("guestSessions");
+  list.innerHTML = "";
+  if (!status.sessions.length) {
+    const item = document.createElement("li");
+    item.textContent = "No guests have accepted the terms";
+    list.appendChild(item);
+  }
+  status.sessions.forEach((session) => {
+    const item = document.createElement("li");
+    item.textContent = `${session.mac} (${session.ip}) on ${session.segment} · until ${new Date(session.expires_at).toLocaleString()} `;
+    const revoke = document.createElement("button");
+    revoke.type = "button";
+    revoke.className = "direct";
+    revoke.textContent = "Revoke";
+    revoke.addEventListener("click", () => revokeGuest(session.mac));
+    item.appendChild(revoke);
+    list.appendChild(item);
+  });
+}
+
+async function loadGuest() {
+  try {
+    const response = await fetch("/guest");
+    if (response.ok) renderGuest(await response.json());
+  } catch (error) {
+    console.error("Error loading guest access:", error);
+  }
+}
+
+async function saveGuest() {
+  try {
+    const response = await fetch("/guest", {
+      method: "POST",
+      headers: { "Content-Type": "application/json" },
+      body: JSON.stringify({
+        title: document.getElementById("guestTitle").value.trim(),
+        terms: document.getElementById("guestTerms").value.trim(),
+        session_hours: parseInt(document.getElementById("guestSessionHours").value, 10) || 0,
+      }),
+    });
+    if (!response.ok) {
+      throw new Error((await response.text()) || "Saving the portal failed");
+    }
+    renderGuest(await response.json());
+    showNotification("Guest portal saved");
+  } catch (error) {
+    showNotification(error.message);
+  }
+}
+
+async function revokeGuest(mac) {
+  try {
+    const response = await fetch(`/guest/revoke?mac=${encodeURIComponent(mac)}`, { method: "POST" });
+    if (!response.ok) {
+      throw new Error((await response.text()) || "Revoking the session failed");
+    }
+    renderGuest(await response.json());
+  } catch (error) {
+    showNotification(error.message);
+  }
+}
+
+function renderWifiNetworkOptions(select, networks, current) {
+  select.innerHTML = "";
+  const placeholder = document.createElement("option");
+  placeholder.value = "";
+  placeholder.textContent = networks.length ? "Choose a network" : "No networks found";
+  select.appendChild(placeholder);
+  networks.forEach((net) => {
+    const option = document.createElement("option");
+    option.value = net.ssid;
+    option.dataset.security = net.security;
+    option.textContent = `${net.ssid} · ${net.signal}% · ${net.security}${net.in_use ? " · connected" : ""}`;
+    option.selected = net.ssid === current;
+    select.appendChild(option);
+  });
+}
+
+function renderWifiClient(status) {
+  document.getElementById("wifiClientBox").hidden = !status.wireless;
+  if (!status.wireless) return;
+
+  document.getElementById("wifiClientSSID").value = status.ssid || "";
+  document.getElementById("wifiClientSecurity").value = status.security || "wpa2";
+  document.getElementById("wifiClientHidden").checked = !!status.hidden;
+  document.getElementById("wifiClientPassphrase").value = "";
+
+  let text = `${status.interface} is not connected`;
+  if (status.connected) {
+    const ips = status.ipv4?.length ? status.ipv4.join(", ") : "waiting for DHCP";
+    text = `${status.interface} on ${status.current_ssid} · signal ${status.signal}% · ${ips}`;
+  }
+  document.getElementById("wifiClientStatus").textContent = text;
+}
+
+async function loadWifiClient() {
+  try {
+    const response = await fetch("/wifi/client");
+    if (response.ok) renderWifiClient(await response.json());
+  } catch (error) {
+    console.error("Error loading Wi-Fi uplink:", error);
+  }
+}
+
+async function scanWifiClient() {
+  const btn = document.getElementById("wifiClientScanBtn");
+  btn.disabled = true;
+  btn.textContent = "Scanning...";
+  try {
+    const response = await fetch("/wifi/scan");
+    if (!response.ok) {
+      throw new Error((await response.text()) || "Scan failed");
+    }
+    const result = await response.json();
+    renderWifiNetworkOptions(
+      document.getElementById("wifiClientNetworks"),
+      result.networks || [],
+      document.getElementById("wifiClientSSID").value
+    );
+  } catch (error) {
+    showNotification(error.message);
+  } finally {
+    btn.disabled = false;
+    btn.textContent = "Scan";
+  }
+}
+
+async function joinWifiClient() {
+  const btn = document.getElementById("wifiClientJoinBtn");
+  btn.disabled = true;
+  btn.textContent = "Joining...";
+  try {
+    const response = await fetch("/wifi/client", {
+      method: "POST",
+      headers: { "Content-Type": "application/json" },
+      body: JSON.stringify({
+        ssid: document.getElementById("wifiClientSSID").value.trim(),
+        security: document.getElementById("wifiClientSecurity").value,
+        // Blank keeps the stored credential for the same network
+        passphrase: document.getElementById("wifiClientPassphrase").value,
+        hidden: document.getElementById("wifiClientHidden").checked,
+      }),
+    });
+    if (!response.ok) {
+      throw new Error((await response.text()) || "Joining the network failed");
+    }
+    renderWifiClient(await response.json());
+    showNotification("Wi-Fi network joined");
+  } catch (error) {
+    showNotification(error.message);
+  } finally {
+    btn.disabled = false;
+    btn.textContent = "Join Network";
+  }
+}
+
+function renderWifiAP(status) {
+  document.getElementById("wifiAPBox").hidden = !status.wireless;
+  if (!status.wireless) return;
+
+  document.getElementById("wifiAPSSID").value = status.ssid || "";
+  document.getElementById("wifiAPSecurity").value = status.security || "wpa2";
+  document.getElementById("wifiAPChannel").value = status.channel || 6;
+  document.getElementById("wifiAPCountry").value = status.country || "";
+  document.getElementById("wifiAPPassphrase").value = "";
+
+  let text = "Disabled";
+  if (status.enabled) {
+    text = status.service_active ? `Broadcasting on ${status.interface} · ${status.stations} client(s)` : "hostapd is not running";
+  }
+  document.getElementById("wifiAPStatus").textContent = text;
+}
+
+async function loadWifiAP() {
+  try {
+    const response = await fetch("/wifi/ap");
+    if (response.ok) renderWifiAP(await response.json());
+  } catch (error) {
+    console.error("Error loading Wi-Fi access point:", error);
+  }
+}
+
+async function saveWifiAP() {
+  const btn = document.getElementById("wifiAPSaveBtn");
+  btn.disabled = true;
+  try {
+    const response = await fetch("/wifi/ap", {
+      method: "POST",
+      headers: { "Content-Type": "application/json" },
+      body: JSON.stringify({
+        enabled: true,
+        ssid: document.getElementById("wifiAPSSID").value.trim(),
+        // Blank keeps the stored passphrase
+        passphrase: document.getElementById("wifiAPPassphrase").value || "***",
+        security: document.getElementById("wifiAPSecurity").value,
+        channel: parseInt(document.getElementById("wifiAPChannel").value, 10) || 6,
+        country: document.getElementById("wifiAPCountry").value.trim().toUpperCase(),
+      }),
+    });
+    if (!response.ok) {
+      throw new Error((await response.text()) || "Access point update failed");
+    }
+    renderWifiAP(await response.json());
+    showNotification("Access point saved");
+  } catch (error) {
+    showNotification(error.message);
+  } finally {
+    btn.disabled = false;
+  }
+}
+
+let splitTunnelLoaded = false;
+
+function renderSplitTunnel(status) {
+  if (!status) return;
+  // Keep unsaved edits; fill the lists only on first load or after saving
+  if (!splitTunnelLoaded) {
+    document.getElementById("splitTunnelDomains").value = status.domains.join("\n");
+    document.getElementById("splitTunnelCIDRs").value = status.cidrs.join("\n");
+    splitTunnelLoaded = true;
+  }
+
+  let text = "No bypass destinations";
+  if (status.domains.length || status.cidrs.length) {
+    text = status.active ? "Bypassing exit node" : "Configured (applies while an exit node is active)";
+    if (status.domains.length) {
+      text += ` · ${status.resolved_ips} resolved IPs via ${status.backend || "none"}`;
+      if (!status.dnsmasq_support) text += " (dnsmasq lacks support)";
+    }
+  }
+  document.getElementById("splitTunnelStatus").textContent = text;
+}
+
+function splitLines(id) {
+  return document
+    .getElementById(id)
+    .value.split(/[\s,]+/)
+    .map((line) => line.trim())
+    .filter(Boolean);
+}
+
+async function saveSplitTunnel() {
+  const btn = document.getElementById("splitTunnelSaveBtn");
+  btn.disabled = true;
+  try {
+    const response = await fetch("/split-tunnel", {
+      method: "POST",
+      headers: { "Content-Type": "application/json" },
+      body: JSON.stringify({
+        domains: splitLines("splitTunnelDomains"),
+        cidrs: splitLines("splitTunnelCIDRs"),
+      }),
+    });
+    if (!response.ok) {
+      throw new Error((await response.text()) || "Split tunnel update failed");
+    }
+    splitTunnelLoaded = false;
+    renderSplitTunnel(await response.json());
+    showNotification("Split tunnel saved");
+  } catch (error) {
+    showNotification(error.message);
+  } finally {
+    btn.disabled = false;
+  }
+}
+
+let firewallRules = [];
+
+function describeFirewallRule(rule) {
+  let text = `${rule.name}: ${rule.action} ${rule.protocol !== "any" ? rule.protocol + " " : ""}`;
+  text += `${rule.source || "any"} → ${rule.destination || "any"}`;
+  if (rule.ports) text += `:${rule.ports}`;
+  if (rule.schedule) text += ` · ${rule.schedule.start}-${rule.schedule.end}${rule.schedule.days?.length ? " " + rule.schedule.days.join(",") : ""}`;
+  text += rule.active ? ` · ${rule.packets} hits` : " · inactive";
+  return text;
+}
+
+function renderFirewall(rules) {
+  firewallRules = rules || [];
+  const list = document.getElementById("firewallRules");
+  list.innerHTML = "";
+  if (!firewallRules.length) {
+    const item = document.createElement("li");
+    item.textContent = "No rules; the mode's defaults apply";
+    list.appendChild(item);
+  }
+  firewallRules.forEach((rule, index) => {
+    const item = document.createElement("li");
+    item.textContent = describeFirewallRule(rule) + " ";
+    const move = (delta) => {
+      const next = firewallRules.slice();
+      next.splice(index + delta, 0, next.splice(index, 1)[0]);
+      saveFirewall(next);
+    };
+    const buttons = [
+      ["↑", index > 0, () => move(-1)],
+      ["↓", index < firewallRules.length - 1, () => move(1)],
+      ["Remove", true, () => saveFirewall(firewallRules.filter((_, i) => i !== index))],
+    ];
+    buttons.forEach(([label, enabled, action]) => {
+      const btn = document.createElement("button");
+      btn.type = "button";
+      btn.className = "direct";
+      btn.textContent = label;
+      btn.disabled = !enabled;
+      btn.addEventListener("click", action);
+      item.appendChild(btn);
+    });
+    list.appendChild(item);
+  });
+}
+
+async function loadFirewall() {
+  try {
+    const response = await fetch("/firewall");
+    if (response.ok) renderFirewall((await response.json()).rules);
+  } catch (error) {
+    console.error("Error loading firewall rules:", error);
+  }
+}
+
+async function saveFirewall(rules) {
+  // Send only the rule fields, not the live counters
+  const body = rules.map(({ active, packets, bytes, ...rule }) => rule);
+  const response = await fetch("/firewall", {
+    method: "POST",
+    headers: { "Content-Type": "application/json" },
+    body: JSON.stringify({ rules: body }),
+  });
+  if (!response.ok) {
+    showNotification((await response.text()) || "Saving firewall rules failed");
+    return false;
+  }
+  renderFirewall((await response.json()).rules);
+  return true;
+}
+
+async function addFirewallRule() {
+  const btn = document.getElementById("firewallAddBtn");
+  btn.disabled = true;
+  try {
+    const rule = {
+      name: document.getElementById("firewallName").value.trim(),
+      action: document.getElementById("firewallAction").value,
+      source: document.getElementById("firewallSource").value.trim(),
+      destination: document.getElementById("firewallDestination").value.trim(),
+      protocol: document.getElementById("firewallProtocol").value,
+      ports: document.getElementById("firewallPorts").value.trim(),
+    };
+    const start = document.getElementById("firewallStart").value;
+    const end = document.getElementById("firewallEnd").value;
+    if (start || end) rule.schedule = { start, end };
+    if (await saveFirewall([...firewallRules, rule])) {
+      ["firewallName", "firewallSource", "firewallDestination", "firewallPorts", "firewallStart", "firewallEnd"].forEach(
+        (id) => (document.getElementById(id).value = "")
+      );
+      showNotification("Firewall rule added");
+    }
+  } catch (error) {
+    showNotification(error.message);
+  } finally {
+    btn.disabled = false;
+  }
+}
+
+let portForwards = [];
+
+function renderPortForwards(forwards) {
+  portForwards = forwards || [];
+  const list = document.getElementById("portForwards");
+  list.innerHTML = "";
+  if (!portForwards.length) {
+    const item = document.createElement("li");
+    item.textContent = "No port forwards";
+    list.appendChild(item);
+  }
+  portForwards.forEach((forward, index) => {
+    const item = document.createElement("li");
+    let text = `${forward.name ? forward.name + ": " : ""}${forward.source} ${forward.protocol}/${forward.external_port} → ${forward.target_ip}:${forward.target_port}`;
+    if (forward.source_cidrs?.length) text += ` · from ${forward.source_cidrs.join(", ")}`;
+    item.textContent = text + " ";
+    const remove = document.createElement("button");
+    remove.type = "button";
+    remove.className = "direct";
+    remove.textContent = "Remove";
+    remove.addEventListener("click", () => savePortForwards(portForwards.filter((_, i) => i !== index)));
+    item.appendChild(remove);
+    list.appendChild(item);
+  });
+}
+
+async function loadPortForwards() {
+  try {
+    const response = await fetch("/port-forwards");
+    if (response.ok) renderPortForwards((await response.json()).forwards);
+  } catch (error) {
+    console.error("Error loading port forwards:", error);
+  }
+}
+
+async function savePortForwards(forwards) {
+  const response = await fetch("/port-forwards", {
+    method: "POST",
+    headers: { "Content-Type": "application/json" },
+    body: JSON.stringify({ forwards }),
+  });
+  if (!response.ok) {
+    showNotification((await response.text()) || "Saving port forwards failed");
+    return false;
+  }
+  renderPortForwards((await response.json()).forwards);
+  return true;
+}
+
+async function addPortForward() {
+  const btn = document.getElementById("portForwardAddBtn");
+  btn.disabled = true;
+  try {
+    const forward = {
+      name: document.getElementById("portForwardName").value.trim(),
+      source: document.getElementById("portForwardSource").value,
+      protocol: document.getElementById("portForwardProtocol").value,
+      external_port: parseInt(document.getElementById("portForwardExternalPort").value, 10) || 0,
+      target_ip: document.getElementById("portForwardTargetIP").value.trim(),
+      target_port: parseInt(document.getElementById("portForwardTargetPort").value, 10) || 0,
+      source_cidrs: splitLines("portForwardCIDRs"),
+    };
+    if (await savePortForwards([...portForwards, forward])) {
+      ["portForwardName", "portForwardExternalPort", "portForwardTargetIP", "portForwardTargetPort", "portForwardCIDRs"].forEach(
+        (id) => (document.getElementById(id).value = "")
+      );
+      showNotification("Port forward added");
+    }
+  } catch (error) {
+    showNotification(error.message);
+  } finally {
+    btn.disabled = false;
+  }
+}
+
+let portMappingLoaded = false;
+
+function renderPortMapping(status) {
+  // Keep unsaved edits; fill the form only on first load or after saving
+  if (!portMappingLoaded) {
+    document.getElementById("portMappingEnabled").checked = status.config.enabled;
+    document.getElementById("portMappingClients").value = (status.config.allowed_clients || []).join("\n");
+    document.getElementById("portMappingPorts").value = (status.config.allowed_ports || []).join("\n");
+    portMappingLoaded = true;
+  }
+
+  let text = "Disabled";
+  if (status.config.enabled) {
+    text = status.active ? `Active on ${status.external_ip || "WAN"}` : "Enabled (inactive while an exit node is in use)";
+  }
+  document.getElementById("portMappingStatus").textContent = text;
+
+  const list = document.getElementById("portMappings");
+  list.innerHTML = "";
+  status.mappings.forEach((m) => {
+    const item = document.createElement("li");
+    item.textContent = `${m.protocol}/${m.external_port} → ${m.internal_ip}:${m.internal_port} · ${m.via}${m.description ? " · " + m.description : ""} · until ${new Date(m.expires_at).toLocaleTimeString()}`;
+    list.appendChild(item);
+  });
+}
+
+async function loadPortMapping() {
+  try {
+    const response = await fetch("/port-mapping");
+    if (response.ok) renderPortMapping(await response.json());
+  } catch (error) {
+    console.error("Error loading port mappings:", error);
+  }
+}
+
+async function savePortMapping() {
+  const btn = document.getElementById("portMappingSaveBtn");
+  btn.disabled = true;
+  try {
+    const response = await fetch("/port-mapping", {
+      method: "POST",
+      headers: { "Content-Type": "application/json" },
+      body: JSON.stringify({
+        enabled: document.getElementById("portMappingEnabled").checked,
+        allowed_clients: splitLines("portMappingClients"),
+        allowed_ports: splitLines("portMappingPorts"),
+      }),
+    });
+    if (!response.ok) {
+      throw new Error((await response.text()) || "Saving UPnP settings failed");
+    }
+    portMappingLoaded = false;
+    renderPortMapping(await response.json());
+    showNotification("UPnP settings saved");
+  } catch (error) {
+    showNotification(error.message);
+  } finally {
+    btn.disabled = false;
+  }
+}
+
+let sqmLoaded = false;
+
+function renderSQM(status) {
+  // Keep unsaved edits; fill the form only on first load or after saving
+  if (!sqmLoaded) {
+    document.getElementById("sqmEnabled").checked = status.config.enabled;
+    document.getElementById("sqmAlgorithm").value = status.config.algorithm || "auto";
+    document.getElementById("sqmWANUpload").value = status.config.wan.upload_kbps || "";
+    document.getElementById("sqmWANDownload").value = status.config.wan.download_kbps || "";
+    document.getElementById("sqmTunnelUpload").value = status.config.tunnel.upload_kbps || "";
+    document.getElementById("sqmTunnelDownload").value = status.config.tunnel.download_kbps || "";
+    sqmLoaded = true;
+  }
+
+  let text = status.config.enabled ? (status.interfaces.length ? "Shaping" : "Enabled (no rates for the current egress)") : "Disabled";
+  if (!status.cake_available) text += " · CAKE not available, using fq_codel";
+  if (status.last_apply_error) text += ` · Error: ${status.last_apply_error}`;
+  document.getElementById("sqmStatus").textContent = text;
+
+  const list = document.getElementById("sqmInterfaces");
+  list.innerHTML = "";
+  status.interfaces.forEach((s) => {
+    const item = document.createElement("li");
+    let line = `${s.interface} · ${s.qdisc} · ↑ ${s.upload_kbps || "—"} / ↓ ${s.download_kbps || "—"} kbit/s · sent ${formatBytes(s.sent_bytes)}, ${s.dropped} dropped`;
+    if (s.ifb) line += ` · ${s.ifb}: ${formatBytes(s.ifb_sent_bytes)}, ${s.ifb_dropped} dropped`;
+    item.textContent = line;
+    list.appendChild(item);
+  });
+}
+
+async function loadSQM() {
+  try {
+    const response = await fetch("/sqm");
+    if (response.ok) renderSQM(await response.json());
+  } catch (error) {
+    console.error("Error loading SQM:", error);
+  }
+}
+
+function sqmRate(id) {
+  return parseInt(document.getElementById(id).value, 10) || 0;
+}
+
+async function saveSQM() {
+  const btn = document.getElementById("sqmSaveBtn");
+  btn.disabled = true;
+  try {
+    const response = await fetch("/sqm", {
+      method: "POST",
+      headers: { "Content-Type": "application/json" },
+      body: JSON.stringify({
+        enabled: document.getElementById("sqmEnabled").checked,
+        algorithm: document.getElementById("sqmAlgorithm").value,
+        wan: { upload_kbps: sqmRate("sqmWANUpload"), download_kbps: sqmRate("sqmWANDownload") },
+        tunnel: { upload_kbps: sqmRate("sqmTunnelUpload"), download_kbps: sqmRate("sqmTunnelDownload") },
+      }),
+    });
+    if (!response.ok) {
+      throw new Error((await response.text()) || "Saving SQM failed");
+    }
+    sqmLoaded = false;
+    renderSQM(await response.json());
+    showNotification("SQM settings saved");
+  } catch (error) {
+    showNotification(error.message);
+  } finally {
+    btn.disabled = false;
+  }
+}
+
+let mtuClamp = {};
+
+function renderMTU(status) {
+  mtuClamp = status.mss_clamp || {};
+  const list = document.getElementById("mtuEgress");
+  list.innerHTML = "";
+  status.egress.forEach((e) => {
+    const item = document.createElement("li");
+    let line = `${e.interface} · MTU ${e.interface_mtu} · clamp ${e.mode}${e.mss ? " (MSS " + e.mss + ")" : ""}`;
+    if (e.probe) {
+      line += e.probe.error
+        ? ` · last probe failed: ${e.probe.error}`
+        : ` · path MTU ${e.probe.path_mtu} to ${e.probe.target}, ${new Date(e.probe.time).toLocaleString()}`;
+    }
+    item.textContent = line;
+    list.appendChild(item);
+  });
+}
+
+async function loadMTU() {
+  try {
+    const response = await fetch("/mtu");
+    if (response.ok) renderMTU(await response.json());
+  } catch (error) {
+    console.error("Error loading MTU status:", error);
+  }
+}
+
+async function saveMTUClamp() {
+  const btn = document.getElementById("mtuSaveBtn");
+  const iface = document.getElementById("mtuInterface").value.trim();
+  if (!iface) {
+    showNotification("Enter an interface name");
+    return;
+  }
+  const mode = document.getElementById("mtuMode").value;
+  const clamp = { ...mtuClamp };
+  clamp[iface] = mode === "fixed" ? { mode, mss: parseInt(document.getElementById("mtuMSS").value, 10) || 0 } : { mode };
+  btn.disabled = true;
+  try {
+    const response = await fetch("/mtu", {
+      method: "POST",
+      headers: { "Content-Type": "application/json" },
+      body: JSON.stringify({ mss_clamp: clamp }),
+    });
+    if (!response.ok) {
+      throw new Error((await response.text()) || "Saving MSS clamp failed");
+    }
+    renderMTU(await response.json());
+    showNotification(`MSS clamp for ${iface} saved`);
+  } catch (error) {
+    showNotification(error.message);
+  } finally {
+    btn.disabled = false;
+  }
+}
+
+async function probeMTU() {
+  const btn = document.getElementById("mtuProbeBtn");
+  btn.disabled = true;
+  btn.textContent = "Probing...";
+  try {
+    const response = await fetch("/mtu/probe", { method: "POST" });
+    if (!response.ok) {
+      throw new Error((await response.text()) || "MTU probe failed");
+    }
+    renderMTU(await response.json());
+  } catch (error) {
+    showNotification(error.message);
+  } finally {
+    btn.disabled = false;
+    btn.textContent = "Probe Path MTU";
+  }
+}
+
+let speedTestLoaded = false;
+
+function renderSpeedTest(status) {
+  if (!speedTestLoaded) {
+    document.getElementById("speedTestEndpoint").value = status.config.endpoint || "";
+    speedTestLoaded = true;
+  }
+  const list = document.getElementById("speedTestResults");
+  list.innerHTML = "";
+  if (!status.results.length) {
+    list.innerHTML = "<li>No results yet</li>";
+    return;
+  }
+  status.results.slice(0, 10).forEach((r) => {
+    const item = document.createElement("li");
+    const via = r.exit_node ? `${r.exit_node} (${r.interface})` : r.interface;
+    const when = new Date(r.time).toLocaleString();
+    item.textContent = r.error
+      ? `${when} · ${r.path} · ${via} · failed: ${r.error}`
+      : `${when} · ${r.path} · ${via} · ↓ ${r.download_mbps.toFixed(1)} / ↑ ${r.upload_mbps.toFixed(1)} Mbit/s · ${r.latency_ms.toFixed(0)} ms (±${r.jitter_ms.toFixed(0)})`;
+    list.appendChild(item);
+  });
+}
+
+async function loadSpeedTest() {
+  try {
+    const response = await fetch("/speedtest");
+    if (response.ok) renderSpeedTest(await response.json());
+  } catch (error) {
+    console.error("Error loading speed tests:", error);
+  }
+}
+
+async function saveSpeedTest() {
+  const btn = document.getElementById("speedTestSaveBtn");
+  btn.disabled = true;
+  try {
+    const response = await fetch("/speedtest", {
+      method: "POST",
+      headers: { "Content-Type": "application/json" },
+      body: JSON.stringify({ endpoint: document.getElementById("speedTestEndpoint").value.trim() }),
+    });
+    if (!response.ok) {
+      throw new Error((await response.text()) || "Saving speed test endpoint failed");
+    }
+    speedTestLoaded = false;
+    renderSpeedTest(await response.json());
+    showNotification("Speed test endpoint saved");
+  } catch (error) {
+    showNotification(error.message);
+  } finally {
+    btn.disabled = false;
+  }
+}
+
+async function runSpeedTest(path) {
+  const buttons = ["speedTestWANBtn", "speedTestExitBtn"].map((id) => document.getElementById(id));
+  buttons.forEach((b) => (b.disabled = true));
+  showNotification("Speed test running, this takes up to a minute");
+  try {
+    const response = await fetch(`/speedtest/run?path=${path}`, { method: "POST" });
+    if (!response.ok) {
+      throw new Error((await response.text()) || "Speed test failed");
+    }
+    await loadSpeedTest();
+  } catch (error) {
+    showNotification(error.message);
+  } finally {
+    buttons.forEach((b) => (b.disabled = false));
+  }
+}
+
 window.onload = async () => {
-  await loadFriendlyNames();
   fetchStatus();
+  document.getElementById("nodeSearch").addEventListener("input", () => {
+    clearTimeout(window.nodeSearchTimer);
+    window.nodeSearchTimer = setTimeout(fetchStatus, 300);
+  });
   bindDiagnosticsUI();
+  document.getElementById("subnetRouterBtn").addEventListener("click", toggleSubnetRouter);
+  document.getElementById("measureLatencyBtn").addEventListener("click", measureLatency);
+  document.getElementById("useBestNodeBtn").addEventListener("click", useBestNode);
+  document.getElementById("exitNodeServerBtn").addEventListener("click", toggleExitNodeServer);
+  document.getElementById("splitTunnelSaveBtn").addEventListener("click", saveSplitTunnel);
+  document.getElementById("wifiAPSaveBtn").addEventListener("click", saveWifiAP);
+  document.getElementById("wifiClientScanBtn").addEventListener("click", scanWifiClient);
+  document.getElementById("wifiClientJoinBtn").addEventListener("click", joinWifiClient);
+  document.getElementById("guestSaveBtn").addEventListener("click", saveGuest);
+  document.getElementById("firewallAddBtn").addEventListener("click", addFirewallRule);
+  document.getElementById("portForwardAddBtn").addEventListener("click", addPortForward);
+  document.getElementById("portMappingSaveBtn").addEventListener("click", savePortMapping);
+  document.getElementById("sqmSaveBtn").addEventListener("click", saveSQM);
+  document.getElementById("mtuSaveBtn").addEventListener("click", saveMTUClamp);
+  document.getElementById("mtuProbeBtn").addEventListener("click", probeMTU);
+  document.getElementById("speedTestSaveBtn").addEventListener("click", saveSpeedTest);
+  document.getElementById("speedTestWANBtn").addEventListener("click", () => runSpeedTest("wan"));
+  document.getElementById("speedTestExitBtn").addEventListener("click", () => runSpeedTest("exit_node"));
+  document.getElementById("wifiClientNetworks").addEventListener("change", (event) => {
+    const option = event.target.selectedOptions[0];
+    if (!option?.value) return;
+    document.getElementById("wifiClientSSID").value = option.value;
+    document.getElementById("wifiClientSecurity").value = option.dataset.security;
+    document.getElementById("wifiClientHidden").checked = false;
+  });
+  loadWifiAP();
+  loadWifiClient();
+  loadLANSegments();
+  loadGuest();
+  loadFirewall();
+  loadPortForwards();
+  loadPortMapping();
+  loadSQM();
+  loadMTU();
+  loadSpeedTest();
 };
 
 function bindDiagnosticsUI() {
@@ -213,6 +1212,11 @@ function bindDiagnosticsUI() {
   document.getElementById("repairRoutingBtn").addEventListener("click", () => {
     runDiagnosticStream("/diagnostics/repair?stream=1", "repairRoutingBtn", "Repair Routing & DNS");
   });
+  document.getElementById("supportBundleBtn").addEventListener("click", () => {
+    const anonymize = document.getElementById("supportBundleAnonymize").checked;
+    window.location.href = "/support-bundle" + (anonymize ? "?anonymize=1" : "");
+    showNotification("Collecting support bundle, the download starts shortly");
+  });
   document.getElementById("copyDiagBtn").addEventListener("click", async () => {
     const text = document.getElementById("diagLog").textContent;
     try {
@@ -18,7 +18,8 @@ function renderInterfaceOption(select, iface, selectedName) {
   option.value = iface.name;
   const ips = iface.ipv4?.length ? iface.ipv4.join(", ") : "DHCP / none yet";
   const route = iface.is_default_route ? ", default route" : "";
-  option.textContent = `${iface.name} (${iface.kind}, ${iface.state}${route}): ${ips}`;
+  const signal = iface.ssid ? `, ${iface.ssid} ${iface.signal}%` : "";
+  option.textContent = `${iface.name} (${iface.kind}, ${iface.state}${route}${signal}): ${ips}`;
   if (iface.name === selectedName) {
     option.selected = true;
   }
@@ -46,7 +47,8 @@ function renderNetworkSummary(snapshot) {
     snapshot.interfaces.forEach((iface) => {
       const ips = iface.ipv4?.length ? iface.ipv4.join(", ") : "none";
       const marker = iface.is_default_route ? " [WAN candidate]" : "";
-      lines.push(`• ${iface.name}${marker}: ${iface.mac || "no mac"}, ${ips}`);
+      const wifi = iface.ssid ? `, Wi-Fi ${iface.ssid} (${iface.signal}%)` : "";
+      lines.push(`• ${iface.name}${marker}: ${iface.mac || "no mac"}, ${ips}${wifi}`);
     });
   }
 
@@ -123,6 +125,17 @@ function populateInterfaceSelects(snapshot) {
     renderInterfaceOption(lanSelect, iface, defaultLAN);
   });
 
+  const wirelessNames = snapshot.interfaces.filter((i) => i.kind === "wireless").map((i) => i.name);
+  const updateWifiAPFields = () => {
+    document.getElementById("wifiAPFields").hidden = !wirelessNames.includes(lanSelect.value);
+  };
+  const updateWifiClientFields = () => {
+    document.getElementById("wifiClientFields").hidden = !wirelessNames.includes(wanSelect.value);
+  };
+  lanSelect.onchange = updateWifiAPFields;
+  updateWifiAPFields();
+  updateWifiClientFields();
+
   if (snapshot.config?.lan_address) {
     document.getElementById("lanAddress").value = snapshot.config.lan_address;
   }
@@ -140,17 +153,63 @@ function populateInterfaceSelects(snapshot) {
   } else if (snapshot.hostname) {
     document.getElementById("tailscaleHost").value = snapshot.hostname;
   }
+  document.getElementById("subnetRouter").checked = !!snapshot.config?.subnet_router;
 
   applySuggestedLAN(snapshot);
 
   wanSelect.onchange = async () => {
+    updateWifiClientFields();
     const wan = wanSelect.value;
     const refreshed = await fetch(`/setup/status?wan=${encodeURIComponent(wan)}`).then((r) => r.json());
     applySuggestedLAN(refreshed, true);
   };
 }
 
+async function scanWifiNetworks() {
+  const btn = document.getElementById("clientScanBtn");
+  const wan = document.getElementById("wanInterface").value;
+  btn.disabled = true;
+  btn.textContent = "Scanning...";
+  try {
+    const response = await fetch(`/setup/wifi/scan?interface=${encodeURIComponent(wan)}`);
+    if (!response.ok) {
+      throw new Error((await response.text()) || "Scan failed");
+    }
+    const result = await response.json();
+    const select = document.getElementById("clientNetworks");
+    select.innerHTML = "";
+    const placeholder = document.createElement("option");
+    placeholder.value = "";
+    placeholder.textContent = result.networks?.length ? "Choose a network" : "No networks found";
+    select.appendChild(placeholder);
+    (result.networks || []).forEach((net) => {
+      const option = document.createElement("option");
+      option.value = net.ssid;
+      option.dataset.security = net.security;
+      option.textContent = `${net.ssid} · ${net.signal}% · ${net.security}${net.in_use ? " · connected" : ""}`;
+      select.appendChild(option);
+    });
+  } catch (error) {
+    showNotification(error.message, true);
+  } finally {
+    btn.disabled = false;
+    btn.textContent = "Scan";
+  }
+}
+
+function bindWifiClientFields() {
+  document.getElementById("clientScanBtn").addEventListener("click", scanWifiNetworks);
+  document.getElementById("clientNetworks").addEventListener("change", (event) => {
+    const option = event.target.selectedOptions[0];
+    if (!option?.value) return;
+    document.getElementById("clientSSID").value = option.value;
+    document.getElementById("clientSecurity").value = option.dataset.security;
+    document.getElementById("clientHidden").checked = false;
+  });
+}
+
 async function initSetup() {
+  bindWifiClientFields();
   try {
     const snapshot = await loadSetupStatus();
     if (snapshot.configured) {
@@ -322,10 +381,46 @@ document.getElementById("setupForm").addEventListener("submit", async (event) =>
     dhcp_lease_hours: 12,
     tailscale_hostname: document.getElementById("tailscaleHost").value.trim(),
     tailscale_auth_key: document.getElementById("tailscaleAuthKey").value.trim(),
+    subnet_router: document.getElementById("subnetRouter").checked,
     admin_username: document.getElementById("adminUser").value.trim(),
     admin_password: document.getElementById("adminPass").value,
   };
 
+  const clientSSID = document.getElementById("clientSSID").value.trim();
+  if (!document.getElementById("wifiClientFields").hidden && clientSSID) {
+    payload.wifi_client = {
+      ssid: clientSSID,
+      security: document.getElementById("clientSecurity").value,
+      passphrase: document.getElementById("clientPassphrase").value,
+      hidden: document.getElementById("clientHidden").checked,
+    };
+    if (payload.wifi_client.security !== "open" && payload.wifi_client.passphrase.length < 8) {
+      showNotification("Wi-Fi network needs an 8+ character passphrase", true);
+      btn.disabled = false;
+      btn.textContent = "Install & Configure";
+      form.style.opacity = "1";
+      return;
+    }
+  }
+
+  if (!document.getElementById("wifiAPFields").hidden) {
+    payload.wifi_ap = {
+      enabled: true,
+      ssid: document.getElementById("apSSID").value.trim(),
+      passphrase: document.getElementById("apPassphrase").value,
+      security: document.getElementById("apSecurity").value,
+      channel: parseInt(document.getElementById("apChannel").value, 10) || 6,
+      country: document.getElementById("apCountry").value.trim().toUpperCase(),
+    };
+    if (!payload.wifi_ap.ssid || payload.wifi_ap.passphrase.length < 8 || payload.wifi_ap.country.length !== 2) {
+      showNotification("Wi-Fi access point needs an SSID, an 8+ character passphrase and a country code", true);
+      btn.disabled = false;
+      btn.textContent = "Install & Configure";
+      form.style.opacity = "1";
+      return;
+    }
+  }
+
   if (payload.wan_interface === payload.lan_interface) {
     showNotification("WAN and LAN must be different interfaces", true);
     btn.disabled = false;